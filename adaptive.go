@@ -0,0 +1,125 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveTimeoutK     = 4
+	adaptiveTimeoutAlpha = 0.125
+)
+
+// AdaptiveTimeout estimates the timeout of the requests to a device from the
+// latency of its previous requests, e.g. on links of variable latency. The
+// timeout is the mean plus K standard deviations of the exponentially
+// weighted latencies, bounded by Min and Max. A request timing out counts as
+// a latency of its timeout, so that the estimate grows on a slowing link.
+type AdaptiveTimeout struct {
+	// K is the number of standard deviations above the mean, 4 if not set
+	K float64
+	// Bounds of the timeout, Max is used until a latency is observed. There
+	// is no upper bound if Max is not set, the Timeout of the handler being
+	// used until a latency is observed then.
+	Min, Max time.Duration
+	// Alpha is the weight of each new latency, from 0 to 1, 0.125 if not set
+	Alpha float64
+
+	mu       sync.Mutex
+	observed bool
+	// Estimates in nanoseconds
+	mean     float64
+	variance float64
+}
+
+// NewAdaptiveTimeout allocates an AdaptiveTimeout bounded by min and max.
+func NewAdaptiveTimeout(min, max time.Duration) *AdaptiveTimeout {
+	return &AdaptiveTimeout{Min: min, Max: max}
+}
+
+// Observe adds the latency of a request to the estimate.
+func (a *AdaptiveTimeout) Observe(latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l := float64(latency)
+	if !a.observed {
+		a.observed = true
+		a.mean, a.variance = l, l*l/4
+		return
+	}
+	alpha := a.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = adaptiveTimeoutAlpha
+	}
+	diff := l - a.mean
+	a.mean += alpha * diff
+	a.variance = (1 - alpha) * (a.variance + alpha*diff*diff)
+}
+
+// Estimate returns the weighted mean and standard deviation of the observed
+// latencies, zero if none.
+func (a *AdaptiveTimeout) Estimate() (mean, stddev time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Duration(a.mean), time.Duration(math.Sqrt(a.variance))
+}
+
+// Timeout returns the current timeout of the requests, 0 until a latency
+// is observed if Max is not set.
+func (a *AdaptiveTimeout) Timeout() time.Duration {
+	return a.current(0)
+}
+
+// current returns the current timeout, initial until a latency is observed
+// if Max is not set.
+func (a *AdaptiveTimeout) current(initial time.Duration) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.observed {
+		if a.Max > 0 {
+			return a.Max
+		}
+		return initial
+	}
+	k := a.K
+	if k <= 0 {
+		k = adaptiveTimeoutK
+	}
+	timeout := time.Duration(a.mean + k*math.Sqrt(a.variance))
+	if timeout < a.Min {
+		timeout = a.Min
+	}
+	if a.Max > 0 && timeout > a.Max {
+		timeout = a.Max
+	}
+	return timeout
+}
+
+// timeout returns the current timeout, or the given one if a is nil or has
+// neither observed a latency nor Max.
+func (a *AdaptiveTimeout) timeout(timeout time.Duration) time.Duration {
+	if a == nil {
+		return timeout
+	}
+	return a.current(timeout)
+}
+
+// observe adds the latency of a request started at start if it succeeded or
+// timed out, without a context error.
+func (a *AdaptiveTimeout) observe(start time.Time, err error) {
+	if a == nil {
+		return
+	}
+	var netError net.Error
+	if err == nil || (err != context.DeadlineExceeded && errors.As(err, &netError) && netError.Timeout()) {
+		a.Observe(time.Since(start))
+	}
+}
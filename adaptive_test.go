@@ -0,0 +1,123 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	a := NewAdaptiveTimeout(10*time.Millisecond, time.Second)
+	if timeout := a.Timeout(); timeout != time.Second {
+		t.Fatalf("timeout: expected %v before any latency, actual %v", time.Second, timeout)
+	}
+	a.Observe(100 * time.Millisecond)
+	// Deviation of half the first latency
+	if mean, stddev := a.Estimate(); mean != 100*time.Millisecond || stddev != 50*time.Millisecond {
+		t.Fatalf("estimate: unexpected %v, %v", mean, stddev)
+	}
+	if timeout := a.Timeout(); timeout != 300*time.Millisecond {
+		t.Fatalf("timeout: expected %v, actual %v", 300*time.Millisecond, timeout)
+	}
+	for i := 0; i < 100; i++ {
+		a.Observe(100 * time.Millisecond)
+	}
+	mean, stddev := a.Estimate()
+	if mean != 100*time.Millisecond || stddev > time.Millisecond {
+		t.Fatalf("estimate: unexpected %v, %v", mean, stddev)
+	}
+	if timeout := a.Timeout(); timeout < 100*time.Millisecond || timeout > 104*time.Millisecond {
+		t.Fatalf("timeout: unexpected %v", timeout)
+	}
+	// Bounds
+	a.K = 1000
+	a.Observe(200 * time.Millisecond)
+	if timeout := a.Timeout(); timeout != time.Second {
+		t.Fatalf("timeout: expected %v, actual %v", time.Second, timeout)
+	}
+	a = NewAdaptiveTimeout(10*time.Millisecond, time.Second)
+	a.Observe(time.Millisecond)
+	if timeout := a.Timeout(); timeout != 10*time.Millisecond {
+		t.Fatalf("timeout: expected %v, actual %v", 10*time.Millisecond, timeout)
+	}
+
+	// Timeouts count, not context or other errors
+	a = NewAdaptiveTimeout(0, 0)
+	start := time.Now().Add(-50 * time.Millisecond)
+	a.observe(start, context.DeadlineExceeded)
+	a.observe(start, net.ErrClosed)
+	if mean, _ := a.Estimate(); mean != 0 {
+		t.Fatalf("estimate: unexpected %v", mean)
+	}
+	a.observe(start, os.ErrDeadlineExceeded)
+	if mean, _ := a.Estimate(); mean < 50*time.Millisecond {
+		t.Fatalf("estimate: unexpected %v", mean)
+	}
+}
+
+func TestDTUTransporterAdaptiveTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			server.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	handler.AdaptiveTimeout = NewAdaptiveTimeout(20*time.Millisecond, time.Second)
+	defer handler.Close()
+	mb := NewClient(handler)
+	for i := 0; i < 5; i++ {
+		if _, err := mb.ReadHoldingRegisters(0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mean, _ := handler.AdaptiveTimeout.Estimate(); mean < 5*time.Millisecond || mean > 500*time.Millisecond {
+		t.Fatalf("estimate: unexpected %v", mean)
+	}
+	if timeout := handler.AdaptiveTimeout.Timeout(); timeout >= time.Second {
+		t.Fatalf("timeout: expected less than %v, actual %v", time.Second, timeout)
+	}
+}
+
+func TestAdaptiveTimeoutWithoutMax(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// Never answered
+	go io.Copy(io.Discard, server)
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	handler.Timeout = 20 * time.Millisecond
+	handler.AdaptiveTimeout = NewAdaptiveTimeout(10*time.Millisecond, 0)
+	defer handler.Close()
+	if timeout := handler.AdaptiveTimeout.timeout(handler.Timeout); timeout != handler.Timeout {
+		t.Fatalf("timeout: expected %v, actual %v", handler.Timeout, timeout)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewClient(handler).ReadHoldingRegisters(0, 1)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the timeout of the handler before any latency observed")
+	}
+}
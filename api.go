@@ -4,6 +4,10 @@
 
 package modbus
 
+import "context"
+
+// Client is the interface of the Modbus functions. The results returned are
+// owned by the caller, they are not modified by later requests.
 type Client interface {
 	// Bit access
 
@@ -14,7 +18,8 @@ type Client interface {
 	// discrete inputs in a remote device and returns input status.
 	ReadDiscreteInputs(address, quantity uint16) (results []byte, err error)
 	// WriteSingleCoil write a single output to either ON or OFF in a
-	// remote device and returns output value.
+	// remote device and returns output value. The value must be CoilOn or
+	// CoilOff, see TypedClient.WriteSingleCoilBool to write a bool.
 	WriteSingleCoil(address, value uint16) (results []byte, err error)
 	// WriteMultipleCoils forces each coil in a sequence of coils to either
 	// ON or OFF in a remote device and returns quantity of outputs.
@@ -46,4 +51,107 @@ type Client interface {
 	//ReadFIFOQueue reads the contents of a First-In-First-Out (FIFO) queue
 	// of register in a remote device and returns FIFO value register.
 	ReadFIFOQueue(address uint16) (results []byte, err error)
+
+	// File record access
+
+	// ReadFileRecord reads the RecordLength registers at RecordNumber of
+	// FileNumber for each of records in one request and returns the records
+	// with their Data.
+	ReadFileRecord(records []FileRecord) (results []FileRecord, err error)
+	// WriteFileRecord writes the Data registers at RecordNumber of
+	// FileNumber for each of records in one request.
+	WriteFileRecord(records []FileRecord) (err error)
+
+	// Diagnostics
+
+	// ReadExceptionStatus reads the contents of eight Exception Status
+	// outputs in a remote device and returns the status byte.
+	ReadExceptionStatus() (status byte, err error)
+	// Diagnostics sends the diagnostics sub-function with its data field
+	// and returns the data field of the response. The data of
+	// DiagnosticsReturnQueryData must be echoed back unchanged.
+	Diagnostics(subFunction, data uint16) (results []byte, err error)
+	// GetCommEventCounter reads the status word (0xFFFF while a previous
+	// command is being processed) and the count of successful messages.
+	GetCommEventCounter() (status, eventCount uint16, err error)
+	// GetCommEventLog reads the status word, the event and message counts
+	// and the event bytes, most recent first.
+	GetCommEventLog() (log *CommEventLog, err error)
+	// ReportServerID reads the device specific server id, which may be
+	// empty, and the run indicator status (0x00 = off, 0xFF = on).
+	ReportServerID() (id []byte, status byte, err error)
+	// ReadDeviceIdentification reads the identification objects of a
+	// device starting at objectID. The stream access codes (basic, regular
+	// and extended) send further requests until all objects are read,
+	// ReadDeviceIDCodeSpecific only reads the given object.
+	ReadDeviceIdentification(readDeviceIDCode, objectID byte) (objects map[byte][]byte, err error)
+
+	// Raw
+
+	// SendPDU sends a request of any function code, e.g. a vendor specific
+	// one, and returns the response once its frame is verified. The response
+	// must have data, exception responses are returned as *ModbusError.
+	SendPDU(request *ProtocolDataUnit) (response *ProtocolDataUnit, err error)
+	// SendNoResponse sends a request of a function the device does not
+	// respond to and returns once it is written, instead of timing out
+	// waiting for a response. The transporter must implement
+	// NoResponseTransporter.
+	SendNoResponse(request *ProtocolDataUnit) (err error)
+	// WriteSingleCoilPDU, WriteSingleRegisterPDU, WriteMultipleCoilsPDU,
+	// WriteMultipleRegistersPDU and MaskWriteRegisterPDU are like the write
+	// functions but return the decoded response, also with the error if the
+	// device responds with an exception or does not echo the request.
+	WriteSingleCoilPDU(address, value uint16) (response *ProtocolDataUnit, err error)
+	WriteSingleRegisterPDU(address, value uint16) (response *ProtocolDataUnit, err error)
+	WriteMultipleCoilsPDU(address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error)
+	WriteMultipleRegistersPDU(address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error)
+	MaskWriteRegisterPDU(address, andMask, orMask uint16) (response *ProtocolDataUnit, err error)
+
+	// Connection
+
+	// Ping sends a cheap request and returns nil if the device responds
+	// correctly. The request is sent by the Ping function of the handler,
+	// PingDiagnostics if not set.
+	Ping() (err error)
+}
+
+// ClientContext extends Client with methods taking a context. Cancelling the
+// context or reaching its deadline aborts the request in flight and the method
+// returns ctx.Err(). Transporters that do not implement ContextTransporter
+// only check the context before a request is sent.
+type ClientContext interface {
+	Client
+
+	ReadCoilsContext(ctx context.Context, address, quantity uint16) (results []byte, err error)
+	ReadDiscreteInputsContext(ctx context.Context, address, quantity uint16) (results []byte, err error)
+	WriteSingleCoilContext(ctx context.Context, address, value uint16) (results []byte, err error)
+	WriteMultipleCoilsContext(ctx context.Context, address, quantity uint16, value []byte) (results []byte, err error)
+
+	ReadInputRegistersContext(ctx context.Context, address, quantity uint16) (results []byte, err error)
+	ReadHoldingRegistersContext(ctx context.Context, address, quantity uint16) (results []byte, err error)
+	WriteSingleRegisterContext(ctx context.Context, address, value uint16) (results []byte, err error)
+	WriteMultipleRegistersContext(ctx context.Context, address, quantity uint16, value []byte) (results []byte, err error)
+	ReadWriteMultipleRegistersContext(ctx context.Context, readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []byte, err error)
+	MaskWriteRegisterContext(ctx context.Context, address, andMask, orMask uint16) (results []byte, err error)
+	ReadFIFOQueueContext(ctx context.Context, address uint16) (results []byte, err error)
+
+	ReadFileRecordContext(ctx context.Context, records []FileRecord) (results []FileRecord, err error)
+	WriteFileRecordContext(ctx context.Context, records []FileRecord) (err error)
+
+	ReadExceptionStatusContext(ctx context.Context) (status byte, err error)
+	DiagnosticsContext(ctx context.Context, subFunction, data uint16) (results []byte, err error)
+	GetCommEventCounterContext(ctx context.Context) (status, eventCount uint16, err error)
+	GetCommEventLogContext(ctx context.Context) (log *CommEventLog, err error)
+	ReportServerIDContext(ctx context.Context) (id []byte, status byte, err error)
+	ReadDeviceIdentificationContext(ctx context.Context, readDeviceIDCode, objectID byte) (objects map[byte][]byte, err error)
+
+	SendPDUContext(ctx context.Context, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error)
+	SendNoResponseContext(ctx context.Context, request *ProtocolDataUnit) (err error)
+	WriteSingleCoilPDUContext(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, err error)
+	WriteSingleRegisterPDUContext(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, err error)
+	WriteMultipleCoilsPDUContext(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error)
+	WriteMultipleRegistersPDUContext(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error)
+	MaskWriteRegisterPDUContext(ctx context.Context, address, andMask, orMask uint16) (response *ProtocolDataUnit, err error)
+
+	PingContext(ctx context.Context) (err error)
 }
@@ -6,6 +6,7 @@ package modbus
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"time"
@@ -46,6 +47,10 @@ type asciiPackager struct {
 	SlaveId byte
 }
 
+func (mb *asciiPackager) defaultSlaveId() byte {
+	return mb.SlaveId
+}
+
 // Encode encodes PDU in a ASCII frame:
 //  Start           : 1 char
 //  Address         : 2 chars
@@ -54,12 +59,17 @@ type asciiPackager struct {
 //  LRC             : 2 chars
 //  End             : 2 chars
 func (mb *asciiPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
+	return mb.EncodeSlave(mb.SlaveId, pdu)
+}
+
+// EncodeSlave encodes PDU in a ASCII frame addressed to the given slave.
+func (mb *asciiPackager) EncodeSlave(slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error) {
 	var buf bytes.Buffer
 
 	if _, err = buf.WriteString(asciiStart); err != nil {
 		return
 	}
-	if err = writeHex(&buf, []byte{mb.SlaveId, pdu.FunctionCode}); err != nil {
+	if err = writeHex(&buf, []byte{slaveId, pdu.FunctionCode}); err != nil {
 		return
 	}
 	if err = writeHex(&buf, pdu.Data); err != nil {
@@ -68,7 +78,7 @@ func (mb *asciiPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	// Exclude the beginning colon and terminating CRLF pair characters
 	var lrc lrc
 	lrc.reset()
-	lrc.pushByte(mb.SlaveId).pushByte(pdu.FunctionCode).pushBytes(pdu.Data)
+	lrc.pushByte(slaveId).pushByte(pdu.FunctionCode).pushBytes(pdu.Data)
 	if err = writeHex(&buf, []byte{lrc.value()}); err != nil {
 		return
 	}
@@ -79,77 +89,81 @@ func (mb *asciiPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	return
 }
 
-// Verify verifies response length, frame boundary and slave id.
+// Verify verifies response length, frame boundary, slave id and function code.
 func (mb *asciiPackager) Verify(aduRequest []byte, aduResponse []byte) (err error) {
-	length := len(aduResponse)
-	// Minimum size (including address, function and LRC)
-	if length < asciiMinSize+6 {
-		err = fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", length, 9)
+	frame, err := decodeASCIIFrame(aduResponse)
+	if err != nil {
 		return
 	}
-	// Length excluding colon must be an even number
-	if length%2 != 1 {
-		err = fmt.Errorf("modbus: response length '%v' is not an even number", length-1)
+	// Slave id
+	requestVal, err := readHex(aduRequest[1:])
+	if err != nil {
 		return
 	}
-	// First char must be a colon
-	str := string(aduResponse[0:len(asciiStart)])
-	if str != asciiStart {
-		err = fmt.Errorf("modbus: response frame '%v'... is not started with '%v'", str, asciiStart)
+	if frame[0] != requestVal {
+		err = fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", frame[0], requestVal)
 		return
 	}
-	// 2 last chars must be \r\n
-	str = string(aduResponse[len(aduResponse)-len(asciiEnd):])
-	if str != asciiEnd {
-		err = fmt.Errorf("modbus: response frame ...'%v' is not ended with '%v'", str, asciiEnd)
+	// Function code
+	if requestVal, err = readHex(aduRequest[3:]); err != nil {
 		return
 	}
-	// Slave id
-	responseVal, err := readHex(aduResponse[1:])
+	err = verifyFunctionCode(requestVal, frame[1])
+	return
+}
+
+// Decode extracts PDU from ASCII frame and verify LRC.
+func (mb *asciiPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
+	frame, err := decodeASCIIFrame(adu)
 	if err != nil {
 		return
 	}
-	requestVal, err := readHex(aduRequest[1:])
-	if err != nil {
+	// Calculate checksum of address, function and data
+	length := len(frame) - 1
+	var lrc lrc
+	lrc.reset()
+	lrc.pushBytes(frame[:length])
+	if frame[length] != lrc.value() {
+		err = fmt.Errorf("modbus: response lrc '%v' does not match expected '%v'", frame[length], lrc.value())
 		return
 	}
-	if responseVal != requestVal {
-		err = fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", responseVal, requestVal)
-		return
+	pdu = &ProtocolDataUnit{
+		FunctionCode: frame[1],
+		Data:         frame[2:length],
 	}
 	return
 }
 
-// Decode extracts PDU from ASCII frame and verify LRC.
-func (mb *asciiPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
-	pdu = &ProtocolDataUnit{}
-	// Slave address
-	address, err := readHex(adu[1:])
-	if err != nil {
+// decodeASCIIFrame checks the boundaries of an ASCII frame and decodes the
+// hexadecimal characters in between: address, function, data and LRC.
+func decodeASCIIFrame(adu []byte) (frame []byte, err error) {
+	length := len(adu)
+	// Minimum size (including address, function and LRC)
+	if length < asciiMinSize+6 {
+		err = fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", length, asciiMinSize+6)
 		return
 	}
-	// Function code
-	if pdu.FunctionCode, err = readHex(adu[3:]); err != nil {
+	// First char must be a colon
+	str := string(adu[0:len(asciiStart)])
+	if str != asciiStart {
+		err = fmt.Errorf("modbus: response frame '%v'... is not started with '%v'", str, asciiStart)
 		return
 	}
-	// Data
-	dataEnd := len(adu) - 4
-	data := adu[5:dataEnd]
-	pdu.Data = make([]byte, hex.DecodedLen(len(data)))
-	if _, err = hex.Decode(pdu.Data, data); err != nil {
+	// 2 last chars must be \r\n
+	str = string(adu[length-len(asciiEnd):])
+	if str != asciiEnd {
+		err = fmt.Errorf("modbus: response frame ...%q is not ended with %q", str, asciiEnd)
 		return
 	}
-	// LRC
-	lrcVal, err := readHex(adu[dataEnd:])
-	if err != nil {
+	chars := adu[len(asciiStart) : length-len(asciiEnd)]
+	if len(chars)%2 != 0 {
+		err = fmt.Errorf("modbus: response frame has an odd number '%v' of hexadecimal characters", len(chars))
 		return
 	}
-	// Calculate checksum
-	var lrc lrc
-	lrc.reset()
-	lrc.pushByte(address).pushByte(pdu.FunctionCode).pushBytes(pdu.Data)
-	if lrcVal != lrc.value() {
-		err = fmt.Errorf("modbus: response lrc '%v' does not match expected '%v'", lrcVal, lrc.value())
+	frame = make([]byte, len(chars)/2)
+	if _, err = hex.Decode(frame, chars); err != nil {
+		err = fmt.Errorf("modbus: response frame is not hexadecimal: %v", err)
+		frame = nil
 		return
 	}
 	return
@@ -160,10 +174,49 @@ type asciiSerialTransporter struct {
 	serialPort
 }
 
+// SendBroadcast writes the request, there is no response.
+func (mb *asciiSerialTransporter) SendBroadcast(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "broadcasting")
+}
+
+// SendNoResponse writes the request of a function without response.
+func (mb *asciiSerialTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "sending")
+}
+
+// write writes the request without reading a response, tracing it as action.
+func (mb *asciiSerialTransporter) write(ctx context.Context, aduRequest []byte, action string) (err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.serialPort.mu.Lock()
+	defer mb.serialPort.mu.Unlock()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = waitInterRequestDelay(ctx, mb.serialPort.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.serialPort.requestEnd = time.Now() }()
+	if err = mb.serialPort.connect(); err != nil {
+		return
+	}
+	mb.serialPort.lastActivity = time.Now()
+	mb.serialPort.startCloseTimer()
+
+	mb.serialPort.tracef("modbus: "+action+" %q\n", aduRequest)
+	err = writeFull(mb.port, aduRequest)
+	return
+}
+
 func (mb *asciiSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
 	mb.serialPort.mu.Lock()
 	defer mb.serialPort.mu.Unlock()
 
+	if err = waitInterRequestDelay(context.Background(), mb.serialPort.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.serialPort.requestEnd = time.Now() }()
 	// Make sure port is connected
 	if err = mb.serialPort.connect(); err != nil {
 		return
@@ -173,13 +226,14 @@ func (mb *asciiSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, e
 	mb.serialPort.startCloseTimer()
 
 	// Send the request
-	mb.serialPort.logf("modbus: sending %q\n", aduRequest)
-	if _, err = mb.port.Write(aduRequest); err != nil {
+	mb.serialPort.tracef("modbus: sending %q\n", aduRequest)
+	if err = writeFull(mb.port, aduRequest); err != nil {
 		return
 	}
 	// Get the response
 	var n int
-	var data [asciiMaxSize]byte
+	data := getReadBuffer(asciiMaxSize)
+	defer putReadBuffer(data)
 	length := 0
 	for {
 		if n, err = mb.port.Read(data[length:]); err != nil {
@@ -196,8 +250,8 @@ func (mb *asciiSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, e
 			}
 		}
 	}
-	aduResponse = data[:length]
-	mb.serialPort.logf("modbus: received %q\n", aduResponse)
+	aduResponse = append([]byte(nil), data[:length]...)
+	mb.serialPort.tracef("modbus: received %q\n", aduResponse)
 	return
 }
 
@@ -6,6 +6,7 @@ package modbus
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -25,6 +26,14 @@ func TestASCIIEncoding(t *testing.T) {
 	if !bytes.Equal(expected, adu) {
 		t.Fatalf("adu actual: %v, expected %v", adu, expected)
 	}
+	encoder.SlaveId = 1
+	adu, err = encoder.EncodeSlave(17, &pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, adu) {
+		t.Fatalf("adu actual: %v, expected %v", adu, expected)
+	}
 }
 
 func TestASCIIDecoding(t *testing.T) {
@@ -46,6 +55,33 @@ func TestASCIIDecoding(t *testing.T) {
 	}
 }
 
+func TestASCIIDecodingErrors(t *testing.T) {
+	packager := asciiPackager{}
+	request := []byte(":F7031389000A60\r\n")
+	tests := []struct {
+		adu string
+		err string
+	}{
+		{":F7031389000A6\r\n", "odd number"},
+		{":F7031389000A60", "not ended"},
+		{":F7031389000A60\n\r", "not ended"},
+		{"F7031389000A600\r\n", "not started"},
+		{":F7031389000A61\r\n", "lrc"},
+		{":F70313G9000A60\r\n", "not hexadecimal"},
+		{":F7\r\n", "minimum"},
+		{":01031389000A56\r\n", "slave id"},
+	}
+	for _, test := range tests {
+		err := packager.Verify(request, []byte(test.adu))
+		if err == nil {
+			_, err = packager.Decode([]byte(test.adu))
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected error containing %q, actual %v", test.adu, test.err, err)
+		}
+	}
+}
+
 func BenchmarkASCIIEncoder(b *testing.B) {
 	encoder := asciiPackager{
 		SlaveId: 10,
@@ -0,0 +1,104 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned by AsyncClient.Submit when its queue is full.
+var ErrQueueFull = errors.New("modbus: request queue is full")
+
+// AsyncResult is the response to a request submitted to an AsyncClient.
+type AsyncResult struct {
+	Response *ProtocolDataUnit
+	Err      error
+}
+
+// AsyncClient sends the requests submitted by the application goroutines
+// from a pool of workers, so that they do not wait for the responses. With a
+// Pipelined TCP handler, each worker may have a request in flight.
+type AsyncClient struct {
+	Client ClientContext
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan asyncRequest
+	wg     sync.WaitGroup
+}
+
+type asyncRequest struct {
+	ctx     context.Context
+	request *ProtocolDataUnit
+	result  chan AsyncResult
+}
+
+// NewAsyncClient creates an AsyncClient sending the requests through client
+// with the given number of workers, at least one. Up to queueSize requests
+// wait for a worker.
+func NewAsyncClient(client ClientContext, workers, queueSize int) *AsyncClient {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	c := &AsyncClient{
+		Client: client,
+		queue:  make(chan asyncRequest, queueSize),
+	}
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+	return c
+}
+
+// Submit queues the request without blocking and returns the channel of its
+// result. It returns ErrQueueFull if the queue is full and ErrClosed once
+// the client is closed. The request is sent with ctx, e.g. carrying its
+// slave id set by WithSlaveId, and fails with ctx.Err() if ctx is done
+// before a worker takes it.
+func (c *AsyncClient) Submit(ctx context.Context, request *ProtocolDataUnit) (<-chan AsyncResult, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	result := make(chan AsyncResult, 1)
+	select {
+	case c.queue <- asyncRequest{ctx: ctx, request: request, result: result}:
+		return result, nil
+	default:
+		return nil, ErrQueueFull
+	}
+}
+
+// Close stops accepting requests and returns once the queued requests are
+// done.
+func (c *AsyncClient) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+// work sends the queued requests until the queue is closed.
+func (c *AsyncClient) work() {
+	defer c.wg.Done()
+	for r := range c.queue {
+		var result AsyncResult
+		if result.Err = r.ctx.Err(); result.Err == nil {
+			result.Response, result.Err = c.Client.SendPDUContext(r.ctx, r.request)
+		}
+		r.result <- result
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestAsyncClient(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 42)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server.RegisterFunctionHandler(FuncCodeReadInputRegisters, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		started <- struct{}{}
+		<-release
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{2, 0, 7}}, nil
+	})
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewAsyncClient(NewClient(handler), 1, 2)
+
+	ctx := context.Background()
+	blocked, err := client.Submit(ctx, &ProtocolDataUnit{FunctionCode: FuncCodeReadInputRegisters, Data: []byte{0, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	read := &ProtocolDataUnit{FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{0, 0, 0, 1}}
+	queued, err := client.Submit(ctx, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	canceled, err := client.Submit(canceledCtx, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Submit(ctx, read); err != ErrQueueFull {
+		t.Fatalf("expected %v, actual %v", ErrQueueFull, err)
+	}
+	close(release)
+
+	if result := <-blocked; result.Err != nil || !bytes.Equal(result.Response.Data, []byte{2, 0, 7}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result := <-queued; result.Err != nil || !bytes.Equal(result.Response.Data, []byte{2, 0, 42}) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result := <-canceled; result.Err != context.Canceled {
+		t.Fatalf("expected %v, actual %v", context.Canceled, result.Err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Submit(ctx, read); err != ErrClosed {
+		t.Fatalf("expected %v, actual %v", ErrClosed, err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
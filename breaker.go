@@ -0,0 +1,181 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// Consecutive failures opening the circuit of a slave
+	circuitMaxFailures = 3
+	// Time the circuit of a slave stays open before a probe
+	circuitCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without sending the request to a slave whose
+// circuit is open, see CircuitBreaker.
+var ErrCircuitOpen = errors.New("modbus: circuit open")
+
+// CircuitState is the state of the circuit of a slave.
+type CircuitState int
+
+const (
+	// CircuitClosed passes the requests to the slave
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails the requests to the slave with ErrCircuitOpen
+	CircuitOpen
+	// CircuitHalfOpen passes one request to the slave, the probe, and fails
+	// the others with ErrCircuitOpen until the probe is done
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker fails the requests to a slave fast, without waiting for the
+// timeout, once it has failed MaxFailures times in a row, e.g. so that the
+// slaves offline do not slow down polling the others. It is set in the
+// CircuitBreaker field of a handler. The circuit of the slave opens for
+// Cooldown, then a probe request is sent: the circuit closes if it succeeds
+// and opens again otherwise.
+//
+// Exception responses, the slave being alive, are not failures. Requests
+// aborted by their context and requests without response are not counted.
+type CircuitBreaker struct {
+	// Consecutive failures opening the circuit of a slave, 3 if not set
+	MaxFailures int
+	// Time the circuit stays open before a probe, 30 seconds if not set
+	Cooldown time.Duration
+	// OnStateChange, if set, is called with each transition of the circuit
+	// of a slave, not holding the lock of the breaker
+	OnStateChange func(slaveId byte, from, to CircuitState)
+
+	mu       sync.Mutex
+	circuits map[byte]*circuit
+}
+
+// circuit is the state of the circuit of a slave.
+type circuit struct {
+	state    CircuitState
+	failures int
+	// End of the cooldown of an open circuit
+	until time.Time
+}
+
+// NewCircuitBreaker creates a CircuitBreaker opening the circuit of a slave
+// for cooldown after maxFailures consecutive failures.
+func NewCircuitBreaker(maxFailures int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{MaxFailures: maxFailures, Cooldown: cooldown}
+}
+
+// State returns the state of the circuit of the slave. An open circuit is
+// reported as open until a request probes the slave after the cooldown.
+func (b *CircuitBreaker) State(slaveId byte) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.circuits[slaveId]; ok {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// Reset closes the circuit of the slave.
+func (b *CircuitBreaker) Reset(slaveId byte) {
+	b.mu.Lock()
+	c, ok := b.circuits[slaveId]
+	from := CircuitClosed
+	if ok {
+		from = c.state
+		delete(b.circuits, slaveId)
+	}
+	b.mu.Unlock()
+	b.changed(slaveId, from, CircuitClosed)
+}
+
+// allow returns ErrCircuitOpen if the request to the slave must not be sent.
+// It lets the probe of an open circuit through once the cooldown is over.
+func (b *CircuitBreaker) allow(slaveId byte) error {
+	b.mu.Lock()
+	c, ok := b.circuits[slaveId]
+	if !ok || c.state == CircuitClosed {
+		b.mu.Unlock()
+		return nil
+	}
+	if c.state == CircuitHalfOpen || time.Now().Before(c.until) {
+		b.mu.Unlock()
+		return ErrCircuitOpen
+	}
+	c.state = CircuitHalfOpen
+	b.mu.Unlock()
+	b.changed(slaveId, CircuitOpen, CircuitHalfOpen)
+	return nil
+}
+
+// done updates the circuit of the slave with the error of a request allowed.
+func (b *CircuitBreaker) done(slaveId byte, err error, aborted bool) {
+	b.mu.Lock()
+	if b.circuits == nil {
+		b.circuits = make(map[byte]*circuit)
+	}
+	c, ok := b.circuits[slaveId]
+	if !ok {
+		c = &circuit{}
+		b.circuits[slaveId] = c
+	}
+	from := c.state
+	var mbError *ModbusError
+	switch {
+	case aborted:
+		// Another request probes again
+		if c.state == CircuitHalfOpen {
+			c.state = CircuitOpen
+		}
+	case err == nil || errors.As(err, &mbError):
+		c.state = CircuitClosed
+		c.failures = 0
+	default:
+		c.failures++
+		if c.state == CircuitHalfOpen || c.failures >= b.maxFailures() {
+			c.state = CircuitOpen
+			c.until = time.Now().Add(b.cooldown())
+		}
+	}
+	to := c.state
+	b.mu.Unlock()
+	b.changed(slaveId, from, to)
+}
+
+func (b *CircuitBreaker) changed(slaveId byte, from, to CircuitState) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(slaveId, from, to)
+	}
+}
+
+func (b *CircuitBreaker) maxFailures() int {
+	if b.MaxFailures > 0 {
+		return b.MaxFailures
+	}
+	return circuitMaxFailures
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return b.Cooldown
+	}
+	return circuitCooldown
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.Timeout = 20 * time.Millisecond
+	var mu sync.Mutex
+	var transitions []string
+	handler.CircuitBreaker = NewCircuitBreaker(2, 50*time.Millisecond)
+	handler.CircuitBreaker.OnStateChange = func(slaveId byte, from, to CircuitState) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, fmt.Sprintf("%v: %v -> %v", slaveId, from, to))
+	}
+	client := NewClient(handler)
+	alive := WithSlaveId(context.Background(), 1)
+	offline := WithSlaveId(context.Background(), 2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.ReadHoldingRegistersContext(offline, 0, 1); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+		}
+	}
+	if state := handler.CircuitBreaker.State(2); state != CircuitOpen {
+		t.Fatalf("state: expected %v, actual %v", CircuitOpen, state)
+	}
+	start := time.Now()
+	if _, err := client.ReadHoldingRegistersContext(offline, 0, 1); err != ErrCircuitOpen {
+		t.Fatalf("expected %v, actual %v", ErrCircuitOpen, err)
+	}
+	if d := time.Since(start); d >= handler.Timeout {
+		t.Fatalf("expected a fast failure, failed after %v", d)
+	}
+	// Other slaves and exceptions are not affected
+	for i := 0; i < 3; i++ {
+		if _, err := client.ReadHoldingRegistersContext(alive, 0xFFFF, 2); err == nil {
+			t.Fatal("expected exception")
+		}
+	}
+	if _, err := client.ReadHoldingRegistersContext(alive, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed probe, then successful one
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.ReadHoldingRegistersContext(offline, 0, 1); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+	}
+	if _, err := client.ReadHoldingRegistersContext(offline, 0, 1); err != ErrCircuitOpen {
+		t.Fatalf("expected %v, actual %v", ErrCircuitOpen, err)
+	}
+	server.AddSlave(2)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.ReadHoldingRegistersContext(offline, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if state := handler.CircuitBreaker.State(2); state != CircuitClosed {
+		t.Fatalf("state: expected %v, actual %v", CircuitClosed, state)
+	}
+	expected := []string{
+		"2: closed -> open",
+		"2: open -> half-open",
+		"2: half-open -> open",
+		"2: open -> half-open",
+		"2: half-open -> closed",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(expected, transitions) {
+		t.Fatalf("transitions: expected %q, actual %q", expected, transitions)
+	}
+}
+
+func TestCircuitBreakerAbortedProbe(t *testing.T) {
+	breaker := &CircuitBreaker{MaxFailures: 1, Cooldown: time.Millisecond}
+	breaker.done(1, ErrTimeout, false)
+	time.Sleep(2 * time.Millisecond)
+	if err := breaker.allow(1); err != nil {
+		t.Fatal(err)
+	}
+	// Only one probe at a time
+	if err := breaker.allow(1); err != ErrCircuitOpen {
+		t.Fatalf("expected %v, actual %v", ErrCircuitOpen, err)
+	}
+	breaker.done(1, context.Canceled, true)
+	if err := breaker.allow(1); err != nil {
+		t.Fatalf("expected another probe, actual %v", err)
+	}
+	breaker.Reset(1)
+	if state := breaker.State(1); state != CircuitClosed {
+		t.Fatalf("state: expected %v, actual %v", CircuitClosed, state)
+	}
+}
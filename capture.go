@@ -0,0 +1,307 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureHeader is the first line of a capture of version 1.
+const captureHeader = "modbus-capture 1"
+
+// Exchange is a request and its response captured by a Recorder.
+type Exchange struct {
+	// Start of the request since the start of the capture
+	Offset time.Duration
+	// Time until the response or the error
+	Latency  time.Duration
+	Request  []byte
+	Response []byte
+	// Err is the error of the request, matching ErrTimeout for the timeouts
+	Err error
+}
+
+// Recorder passes the requests to Transporter and writes each exchange to a
+// capture, which a ReplayTransporter reads back, e.g. to reproduce the
+// behavior of a device in tests:
+//  recorder := modbus.NewRecorder(handler, file)
+//  client := modbus.NewClient2(handler, recorder)
+//
+// A capture is a text file. Its first line is "modbus-capture 1", version 1
+// of the format. Each following line is an exchange, with fields separated
+// by a space: the offset and the latency in microseconds, the request and
+// the response in hexadecimal, "-" if none, and if the request failed,
+// "timeout" or "error" followed by the quoted error message.
+//
+// The optional features of Transporter, such as its Metrics or broadcasts,
+// are not available through the recorder.
+type Recorder struct {
+	Transporter Transporter
+
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	err   error
+}
+
+// NewRecorder creates a Recorder writing the capture to w.
+func NewRecorder(transporter Transporter, w io.Writer) *Recorder {
+	r := &Recorder{Transporter: transporter, w: w, start: time.Now()}
+	_, r.err = fmt.Fprintln(w, captureHeader)
+	return r
+}
+
+// Send passes the request to Transporter and records the exchange.
+func (r *Recorder) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return r.SendContext(context.Background(), aduRequest)
+}
+
+// SendContext is like Send but uses the SendContext of Transporter if it
+// implements ContextTransporter.
+func (r *Recorder) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	start := time.Now()
+	if transporter, ok := r.Transporter.(ContextTransporter); ok {
+		aduResponse, err = transporter.SendContext(ctx, aduRequest)
+	} else if err = ctx.Err(); err == nil {
+		aduResponse, err = r.Transporter.Send(aduRequest)
+	}
+	r.record(Exchange{
+		Offset:   start.Sub(r.start),
+		Latency:  time.Since(start),
+		Request:  aduRequest,
+		Response: aduResponse,
+		Err:      err,
+	})
+	return
+}
+
+// SendNoResponse passes the request to Transporter, which must implement
+// NoResponseTransporter, and records it without response.
+func (r *Recorder) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	transporter, ok := r.Transporter.(NoResponseTransporter)
+	if !ok {
+		err = fmt.Errorf("modbus: transporter does not support requests without response")
+		return
+	}
+	start := time.Now()
+	err = transporter.SendNoResponse(ctx, aduRequest)
+	r.record(Exchange{
+		Offset:  start.Sub(r.start),
+		Latency: time.Since(start),
+		Request: aduRequest,
+		Err:     err,
+	})
+	return
+}
+
+// Err returns the first error writing the capture. The exchanges are not
+// written after an error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(exchange Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		_, r.err = io.WriteString(r.w, formatExchange(exchange))
+	}
+}
+
+// formatExchange returns the line of the exchange in a capture.
+func formatExchange(exchange Exchange) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d %s ", exchange.Offset.Microseconds(), exchange.Latency.Microseconds(), formatFrame(exchange.Request))
+	b.WriteString(formatFrame(exchange.Response))
+	if exchange.Err != nil {
+		kind := "error"
+		if CategorizeError(exchange.Err) == ErrorCategoryTimeout {
+			kind = "timeout"
+		}
+		fmt.Fprintf(&b, " %s %s", kind, strconv.Quote(exchange.Err.Error()))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func formatFrame(frame []byte) string {
+	if frame == nil {
+		return "-"
+	}
+	return hex.EncodeToString(frame)
+}
+
+// ReadCapture reads the exchanges of a capture written by a Recorder.
+func ReadCapture(r io.Reader) (exchanges []Exchange, err error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err = scanner.Err(); err == nil {
+			err = fmt.Errorf("modbus: capture is empty")
+		}
+		return
+	}
+	if header := scanner.Text(); header != captureHeader {
+		err = fmt.Errorf("modbus: capture header '%v' is not supported", header)
+		return
+	}
+	for line := 2; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		exchange, err := parseExchange(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("modbus: capture line '%v': %v", line, err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	err = scanner.Err()
+	return
+}
+
+// parseExchange parses a line of a capture.
+func parseExchange(line string) (exchange Exchange, err error) {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) != 4 && len(fields) != 6 {
+		err = fmt.Errorf("expected 4 or 6 fields, actual %v", len(fields))
+		return
+	}
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	latency, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	exchange.Offset = time.Duration(offset) * time.Microsecond
+	exchange.Latency = time.Duration(latency) * time.Microsecond
+	if exchange.Request, err = parseFrame(fields[2]); err != nil {
+		return
+	}
+	if exchange.Request == nil {
+		err = fmt.Errorf("missing request")
+		return
+	}
+	if exchange.Response, err = parseFrame(fields[3]); err != nil {
+		return
+	}
+	if len(fields) == 6 {
+		message, err := strconv.Unquote(fields[5])
+		if err != nil {
+			return exchange, err
+		}
+		switch fields[4] {
+		case "timeout":
+			exchange.Err = &timeoutError{errors.New(message)}
+		case "error":
+			exchange.Err = errors.New(message)
+		default:
+			return exchange, fmt.Errorf("unknown error kind '%v'", fields[4])
+		}
+	}
+	return
+}
+
+func parseFrame(field string) ([]byte, error) {
+	if field == "-" {
+		return nil, nil
+	}
+	frame, err := hex.DecodeString(field)
+	if err == nil && frame == nil {
+		frame = []byte{}
+	}
+	return frame, err
+}
+
+// ReplayTransporter replays the exchanges of a capture in order, e.g. with a
+// client created with the packager of the handler the capture was recorded
+// with:
+//  replay, err := modbus.NewReplayTransporter(file)
+//  client := modbus.NewClient2(modbus.NewTCPClientHandler(""), replay)
+// Each request must match that of the next exchange, which returns its
+// response and error.
+type ReplayTransporter struct {
+	Exchanges []Exchange
+	// Timing, if set, delays each response by the latency of its exchange
+	Timing bool
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewReplayTransporter creates a ReplayTransporter of the capture read from r.
+func NewReplayTransporter(r io.Reader) (*ReplayTransporter, error) {
+	exchanges, err := ReadCapture(r)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayTransporter{Exchanges: exchanges}, nil
+}
+
+// Send returns the response and the error of the next exchange.
+func (mb *ReplayTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return mb.SendContext(context.Background(), aduRequest)
+}
+
+// SendContext is like Send but returns ctx.Err() if ctx is done while
+// delaying the response.
+func (mb *ReplayTransporter) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	exchange, err := mb.replay(aduRequest)
+	if err != nil {
+		return
+	}
+	if mb.Timing {
+		if err = sleepContext(ctx, exchange.Latency); err != nil {
+			return
+		}
+	}
+	if exchange.Response != nil {
+		aduResponse = append([]byte(nil), exchange.Response...)
+	}
+	err = exchange.Err
+	return
+}
+
+// SendNoResponse is like SendContext for a request without response.
+func (mb *ReplayTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	_, err = mb.SendContext(ctx, aduRequest)
+	return
+}
+
+// Remaining returns the number of exchanges not replayed yet.
+func (mb *ReplayTransporter) Remaining() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.Exchanges) - mb.next
+}
+
+// replay returns the next exchange, which must be that of the request.
+func (mb *ReplayTransporter) replay(aduRequest []byte) (exchange Exchange, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.next >= len(mb.Exchanges) {
+		err = fmt.Errorf("modbus: no exchange left to replay request '% x'", aduRequest)
+		return
+	}
+	exchange = mb.Exchanges[mb.next]
+	if !bytes.Equal(exchange.Request, aduRequest) {
+		err = fmt.Errorf("modbus: request '% x' does not match recorded request '% x' of exchange '%v'", aduRequest, exchange.Request, mb.next)
+		return
+	}
+	mb.next++
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 42)
+	handler := newServerClient(t, server)
+	handler.Timeout = 50 * time.Millisecond
+	var capture bytes.Buffer
+	recorder := NewRecorder(handler, &capture)
+	client := NewClient2(handler, recorder)
+
+	// Response, exception and timeout of a slave not answering
+	ctx := WithSlaveId(context.Background(), 1)
+	if _, err := client.ReadHoldingRegistersContext(ctx, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadHoldingRegistersContext(ctx, 0xFFFF, 2); err == nil {
+		t.Fatal("expected exception")
+	}
+	if _, err := client.ReadHoldingRegistersContext(WithSlaveId(ctx, 2), 0, 1); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(capture.String()), "\n")
+	if len(lines) != 4 || lines[0] != "modbus-capture 1" {
+		t.Fatalf("unexpected capture: %q", capture.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 4 || fields[2] != "010300000001840a" || fields[3] != "010302002a399b" {
+		t.Fatalf("unexpected exchange: %q", lines[1])
+	}
+	if !strings.Contains(lines[3], " - timeout \"") {
+		t.Fatalf("unexpected exchange: %q", lines[3])
+	}
+
+	replay, err := NewReplayTransporter(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.Timing = true
+	client = NewClient2(NewDTUClientHandler(nil), replay)
+	results, err := client.ReadHoldingRegistersContext(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 42}; !bytes.Equal(expected, results) {
+		t.Fatalf("results: expected % x, actual % x", expected, results)
+	}
+	var mbError *ModbusError
+	if _, err = client.ReadHoldingRegistersContext(ctx, 0xFFFF, 2); !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Fatalf("expected exception, actual %v", err)
+	}
+	// Not matching the next exchange
+	if _, err = client.ReadHoldingRegistersContext(ctx, 1, 1); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected mismatch, actual %v", err)
+	}
+	start := time.Now()
+	if _, err = client.ReadHoldingRegistersContext(WithSlaveId(ctx, 2), 0, 1); !errors.Is(err, ErrTimeout) || !IsRetryable(err) {
+		t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("expected recorded latency, replayed after %v", d)
+	}
+	if n := replay.Remaining(); n != 0 {
+		t.Fatalf("remaining: expected 0, actual %v", n)
+	}
+	if _, err = client.ReadHoldingRegistersContext(ctx, 0, 1); err == nil {
+		t.Fatal("expected error without exchange left")
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	exchanges, err := ReadCapture(strings.NewReader("modbus-capture 1\n1500 250 0102 - error \"modbus: a \\\"b\\\"\"\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("exchanges: expected 1, actual %v", len(exchanges))
+	}
+	exchange := exchanges[0]
+	if exchange.Offset != 1500*time.Microsecond || exchange.Latency != 250*time.Microsecond {
+		t.Fatalf("unexpected timing: %v %v", exchange.Offset, exchange.Latency)
+	}
+	if !bytes.Equal(exchange.Request, []byte{1, 2}) || exchange.Response != nil {
+		t.Fatalf("unexpected frames: % x, % x", exchange.Request, exchange.Response)
+	}
+	if exchange.Err == nil || exchange.Err.Error() != `modbus: a "b"` || errors.Is(exchange.Err, ErrTimeout) {
+		t.Fatalf("unexpected error: %v", exchange.Err)
+	}
+
+	for _, capture := range []string{
+		"",
+		"modbus-capture 2\n",
+		"modbus-capture 1\n0 0 01\n",
+		"modbus-capture 1\n0 0 0x 01\n",
+		"modbus-capture 1\n0 0 01 01 failure \"x\"\n",
+	} {
+		if _, err = ReadCapture(strings.NewReader(capture)); err == nil {
+			t.Errorf("expected error for %q", capture)
+		}
+	}
+}
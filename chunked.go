@@ -0,0 +1,104 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"fmt"
+)
+
+const (
+	// Maximum number of coils or discrete inputs in one read
+	maxReadBits = 2000
+)
+
+// ChunkedClient wraps a Client with reads of ranges larger than allowed in
+// one request. They are split in requests of up to RegisterChunkSize
+// registers or BitChunkSize bits whose results are concatenated.
+type ChunkedClient struct {
+	Client
+	// Maximum number of registers per request, 125 if not set
+	RegisterChunkSize int
+	// Maximum number of coils or discrete inputs per request, 2000 if not
+	// set. It is rounded down to a multiple of 8 so that the bytes of the
+	// requests can be concatenated.
+	BitChunkSize int
+}
+
+// NewChunkedClient creates a ChunkedClient using the given client.
+func NewChunkedClient(client Client) *ChunkedClient {
+	return &ChunkedClient{Client: client}
+}
+
+// ReadHoldingRegistersLarge reads quantity holding registers starting at
+// address. On error the registers read so far are returned with the error.
+func (mb *ChunkedClient) ReadHoldingRegistersLarge(address, quantity uint16) (results []byte, err error) {
+	return mb.readChunks(FuncCodeReadHoldingRegisters, address, quantity, mb.registerChunkSize(), 2, mb.Client.ReadHoldingRegisters)
+}
+
+// ReadInputRegistersLarge reads quantity input registers starting at address.
+// On error the registers read so far are returned with the error.
+func (mb *ChunkedClient) ReadInputRegistersLarge(address, quantity uint16) (results []byte, err error) {
+	return mb.readChunks(FuncCodeReadInputRegisters, address, quantity, mb.registerChunkSize(), 2, mb.Client.ReadInputRegisters)
+}
+
+// ReadCoilsLarge reads quantity coils starting at address, packed as by
+// ReadCoils. On error the coils read so far are returned with the error.
+func (mb *ChunkedClient) ReadCoilsLarge(address, quantity uint16) (results []byte, err error) {
+	return mb.readChunks(FuncCodeReadCoils, address, quantity, mb.bitChunkSize(), 0, mb.Client.ReadCoils)
+}
+
+// ReadDiscreteInputsLarge reads quantity discrete inputs starting at address,
+// packed as by ReadDiscreteInputs. On error the inputs read so far are
+// returned with the error.
+func (mb *ChunkedClient) ReadDiscreteInputsLarge(address, quantity uint16) (results []byte, err error) {
+	return mb.readChunks(FuncCodeReadDiscreteInputs, address, quantity, mb.bitChunkSize(), 0, mb.Client.ReadDiscreteInputs)
+}
+
+func (mb *ChunkedClient) registerChunkSize() int {
+	if mb.RegisterChunkSize > 0 && mb.RegisterChunkSize < maxReadRegisters {
+		return mb.RegisterChunkSize
+	}
+	return maxReadRegisters
+}
+
+func (mb *ChunkedClient) bitChunkSize() int {
+	if mb.BitChunkSize >= 8 && mb.BitChunkSize < maxReadBits {
+		return mb.BitChunkSize / 8 * 8
+	}
+	return maxReadBits
+}
+
+// readChunks reads quantity items starting at address in requests of up to
+// size items of function functionCode, each of width bytes or packed bits if
+// width is 0.
+func (mb *ChunkedClient) readChunks(functionCode byte, address, quantity uint16, size, width int,
+	read func(address, quantity uint16) ([]byte, error)) (results []byte, err error) {
+	// Up to the last address
+	if max := 0x10000 - int(address); quantity < 1 || int(quantity) > max {
+		err = &QuantityError{FunctionCode: functionCode, Field: "quantity", Quantity: int(quantity), Min: 1, Max: max}
+		return
+	}
+	for start := 0; start < int(quantity); start += size {
+		n := int(quantity) - start
+		if n > size {
+			n = size
+		}
+		var data []byte
+		data, err = read(address+uint16(start), uint16(n))
+		if err != nil {
+			return
+		}
+		expected := n * width
+		if width == 0 {
+			expected = (n + 7) / 8
+		}
+		if len(data) != expected {
+			err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), expected)
+			return
+		}
+		results = append(results, data...)
+	}
+	return
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChunkedClientRegisters(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	expected := make([]byte, 2*300)
+	for i := 0; i < 300; i++ {
+		store.SetHoldingRegister(uint16(1000+i), uint16(i))
+		store.SetInputRegister(uint16(1000+i), uint16(i))
+		binary.BigEndian.PutUint16(expected[2*i:], uint16(i))
+	}
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	var requests int
+	handler.Metrics = MetricsFunc(func(slaveId, functionCode byte, _ time.Duration, err error) {
+		requests++
+	})
+	client := NewChunkedClient(NewClient(handler))
+
+	results, err := client.ReadHoldingRegistersLarge(1000, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, results) || requests != 3 {
+		t.Fatalf("unexpected %v requests: % x", requests, results)
+	}
+	requests = 0
+	client.RegisterChunkSize = 100
+	if results, err = client.ReadInputRegistersLarge(1000, 300); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, results) || requests != 3 {
+		t.Fatalf("unexpected %v requests: % x", requests, results)
+	}
+	if _, err = client.ReadHoldingRegistersLarge(0xFF00, 0x200); err == nil {
+		t.Fatal("expected error for address out of range")
+	}
+}
+
+func TestChunkedClientBits(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	values := make([]bool, 2500)
+	for i := range values {
+		values[i] = i%3 == 0
+		store.SetCoil(uint16(i), values[i])
+		store.SetDiscreteInput(uint16(i), values[i])
+	}
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewChunkedClient(NewClient(handler))
+
+	results, err := client.ReadCoilsLarge(0, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(PackCoils(values), results) {
+		t.Fatalf("unexpected coils % x", results)
+	}
+	// Rounded down to 1000 bits
+	client.BitChunkSize = 1001
+	if results, err = client.ReadDiscreteInputsLarge(0, 2500); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(PackCoils(values), results) {
+		t.Fatalf("unexpected discrete inputs % x", results)
+	}
+}
+
+func TestChunkedClientPartial(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	server.RegisterFunctionHandler(FuncCodeReadHoldingRegisters, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		address := binary.BigEndian.Uint16(request.Data)
+		quantity := binary.BigEndian.Uint16(request.Data[2:])
+		if address >= 125 {
+			return nil, &ModbusError{ExceptionCode: ExceptionCodeIllegalDataAddress}
+		}
+		return &ProtocolDataUnit{
+			FunctionCode: request.FunctionCode,
+			Data:         append([]byte{byte(2 * quantity)}, make([]byte, 2*quantity)...),
+		}, nil
+	})
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewChunkedClient(NewClient(handler))
+
+	results, err := client.ReadHoldingRegistersLarge(0, 200)
+	if err == nil {
+		t.Fatal("expected error of the second request")
+	}
+	if len(results) != 2*125 {
+		t.Fatalf("unexpected partial data size %v", len(results))
+	}
+	if _, err = client.ReadHoldingRegistersLarge(0, 0); !errors.Is(err, ErrInvalidQuantity) {
+		t.Fatalf("expected %v, actual %v", ErrInvalidQuantity, err)
+	}
+	if _, err = client.ReadCoilsLarge(0xFFF0, 17); !errors.Is(err, ErrInvalidQuantity) {
+		t.Fatalf("expected %v, actual %v", ErrInvalidQuantity, err)
+	}
+}
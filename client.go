@@ -5,8 +5,12 @@
 package modbus
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"time"
 )
 
 // ClientHandler is the interface that groups the Packager and Transporter methods.
@@ -15,18 +19,30 @@ type ClientHandler interface {
 	Transporter
 }
 
+type slaveIdKey struct{}
+
+// noResponseKey marks the context of a request without response.
+type noResponseKey struct{}
+
+// WithSlaveId returns a context addressing requests made with it to the slave,
+// instead of the SlaveId of the handler. This allows polling several slaves
+// through one handler from multiple goroutines.
+func WithSlaveId(ctx context.Context, slaveId byte) context.Context {
+	return context.WithValue(ctx, slaveIdKey{}, slaveId)
+}
+
 type client struct {
 	packager    Packager
 	transporter Transporter
 }
 
 // NewClient creates a new modbus client with given backend handler.
-func NewClient(handler ClientHandler) Client {
+func NewClient(handler ClientHandler) ClientContext {
 	return &client{packager: handler, transporter: handler}
 }
 
 // NewClient2 creates a new modbus client with given backend packager and transporter.
-func NewClient2(packager Packager, transporter Transporter) Client {
+func NewClient2(packager Packager, transporter Transporter) ClientContext {
 	return &client{packager: packager, transporter: transporter}
 }
 
@@ -39,15 +55,19 @@ func NewClient2(packager Packager, transporter Transporter) Client {
 //  Byte count            : 1 byte
 //  Coil status           : N* bytes (=N or N+1)
 func (mb *client) ReadCoils(address, quantity uint16) (results []byte, err error) {
+	return mb.ReadCoilsContext(context.Background(), address, quantity)
+}
+
+func (mb *client) ReadCoilsContext(ctx context.Context, address, quantity uint16) (results []byte, err error) {
 	if quantity < 1 || quantity > 2000 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 2000)
+		err = &QuantityError{FunctionCode: FuncCodeReadCoils, Field: "quantity", Quantity: int(quantity), Min: 1, Max: 2000}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadCoils,
 		Data:         dataBlock(address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -57,6 +77,11 @@ func (mb *client) ReadCoils(address, quantity uint16) (results []byte, err error
 		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
 		return
 	}
+	// Devices may report a stale byte count
+	if expected := (int(quantity) + 7) / 8; count != expected {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match expected '%v'", count, expected)
+		return
+	}
 	results = response.Data[1:]
 	return
 }
@@ -70,15 +95,19 @@ func (mb *client) ReadCoils(address, quantity uint16) (results []byte, err error
 //  Byte count            : 1 byte
 //  Input status          : N* bytes (=N or N+1)
 func (mb *client) ReadDiscreteInputs(address, quantity uint16) (results []byte, err error) {
+	return mb.ReadDiscreteInputsContext(context.Background(), address, quantity)
+}
+
+func (mb *client) ReadDiscreteInputsContext(ctx context.Context, address, quantity uint16) (results []byte, err error) {
 	if quantity < 1 || quantity > 2000 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 2000)
+		err = &QuantityError{FunctionCode: FuncCodeReadDiscreteInputs, Field: "quantity", Quantity: int(quantity), Min: 1, Max: 2000}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadDiscreteInputs,
 		Data:         dataBlock(address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -88,6 +117,11 @@ func (mb *client) ReadDiscreteInputs(address, quantity uint16) (results []byte,
 		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
 		return
 	}
+	// Devices may report a stale byte count
+	if expected := (int(quantity) + 7) / 8; count != expected {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match expected '%v'", count, expected)
+		return
+	}
 	results = response.Data[1:]
 	return
 }
@@ -101,15 +135,19 @@ func (mb *client) ReadDiscreteInputs(address, quantity uint16) (results []byte,
 //  Byte count            : 1 byte
 //  Register value        : Nx2 bytes
 func (mb *client) ReadHoldingRegisters(address, quantity uint16) (results []byte, err error) {
+	return mb.ReadHoldingRegistersContext(context.Background(), address, quantity)
+}
+
+func (mb *client) ReadHoldingRegistersContext(ctx context.Context, address, quantity uint16) (results []byte, err error) {
 	if quantity < 1 || quantity > 125 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 125)
+		err = &QuantityError{FunctionCode: FuncCodeReadHoldingRegisters, Field: "quantity", Quantity: int(quantity), Min: 1, Max: 125}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadHoldingRegisters,
 		Data:         dataBlock(address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -119,6 +157,11 @@ func (mb *client) ReadHoldingRegisters(address, quantity uint16) (results []byte
 		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
 		return
 	}
+	// Devices may report a stale byte count
+	if expected := int(quantity) * 2; count != expected {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match expected '%v'", count, expected)
+		return
+	}
 	results = response.Data[1:]
 	return
 }
@@ -132,15 +175,19 @@ func (mb *client) ReadHoldingRegisters(address, quantity uint16) (results []byte
 //  Byte count            : 1 byte
 //  Input registers       : N bytes
 func (mb *client) ReadInputRegisters(address, quantity uint16) (results []byte, err error) {
+	return mb.ReadInputRegistersContext(context.Background(), address, quantity)
+}
+
+func (mb *client) ReadInputRegistersContext(ctx context.Context, address, quantity uint16) (results []byte, err error) {
 	if quantity < 1 || quantity > 125 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 125)
+		err = &QuantityError{FunctionCode: FuncCodeReadInputRegisters, Field: "quantity", Quantity: int(quantity), Min: 1, Max: 125}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadInputRegisters,
 		Data:         dataBlock(address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -150,6 +197,11 @@ func (mb *client) ReadInputRegisters(address, quantity uint16) (results []byte,
 		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
 		return
 	}
+	// Devices may report a stale byte count
+	if expected := int(quantity) * 2; count != expected {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match expected '%v'", count, expected)
+		return
+	}
 	results = response.Data[1:]
 	return
 }
@@ -163,8 +215,29 @@ func (mb *client) ReadInputRegisters(address, quantity uint16) (results []byte,
 //  Output address        : 2 bytes
 //  Output value          : 2 bytes
 func (mb *client) WriteSingleCoil(address, value uint16) (results []byte, err error) {
+	return mb.WriteSingleCoilContext(context.Background(), address, value)
+}
+
+func (mb *client) WriteSingleCoilContext(ctx context.Context, address, value uint16) (results []byte, err error) {
+	_, results, err = mb.writeSingleCoil(ctx, address, value)
+	return
+}
+
+// WriteSingleCoilPDU is like WriteSingleCoil but returns the decoded response.
+func (mb *client) WriteSingleCoilPDU(address, value uint16) (response *ProtocolDataUnit, err error) {
+	return mb.WriteSingleCoilPDUContext(context.Background(), address, value)
+}
+
+func (mb *client) WriteSingleCoilPDUContext(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, err error) {
+	response, _, err = mb.writeSingleCoil(ctx, address, value)
+	return
+}
+
+// writeSingleCoil sends the request and checks the response echoes it. The
+// response is returned with the error of an exception or a mismatch.
+func (mb *client) writeSingleCoil(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, results []byte, err error) {
 	// The requested ON/OFF state can only be 0xFF00 and 0x0000
-	if value != 0xFF00 && value != 0x0000 {
+	if value != CoilOn && value != CoilOff {
 		err = fmt.Errorf("modbus: state '%v' must be either 0xFF00 (ON) or 0x0000 (OFF)", value)
 		return
 	}
@@ -172,7 +245,7 @@ func (mb *client) WriteSingleCoil(address, value uint16) (results []byte, err er
 		FunctionCode: FuncCodeWriteSingleCoil,
 		Data:         dataBlock(address, value),
 	}
-	response, err := mb.send(&request)
+	response, err = mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -183,13 +256,13 @@ func (mb *client) WriteSingleCoil(address, value uint16) (results []byte, err er
 	}
 	respValue := binary.BigEndian.Uint16(response.Data)
 	if address != respValue {
-		err = fmt.Errorf("modbus: response address '%v' does not match request '%v'", respValue, address)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "address", Request: address, Response: respValue}
 		return
 	}
 	results = response.Data[2:]
 	respValue = binary.BigEndian.Uint16(results)
 	if value != respValue {
-		err = fmt.Errorf("modbus: response value '%v' does not match request '%v'", respValue, value)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "value", Request: value, Response: respValue}
 		return
 	}
 	return
@@ -204,11 +277,32 @@ func (mb *client) WriteSingleCoil(address, value uint16) (results []byte, err er
 //  Register address      : 2 bytes
 //  Register value        : 2 bytes
 func (mb *client) WriteSingleRegister(address, value uint16) (results []byte, err error) {
+	return mb.WriteSingleRegisterContext(context.Background(), address, value)
+}
+
+func (mb *client) WriteSingleRegisterContext(ctx context.Context, address, value uint16) (results []byte, err error) {
+	_, results, err = mb.writeSingleRegister(ctx, address, value)
+	return
+}
+
+// WriteSingleRegisterPDU is like WriteSingleRegister but returns the decoded response.
+func (mb *client) WriteSingleRegisterPDU(address, value uint16) (response *ProtocolDataUnit, err error) {
+	return mb.WriteSingleRegisterPDUContext(context.Background(), address, value)
+}
+
+func (mb *client) WriteSingleRegisterPDUContext(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, err error) {
+	response, _, err = mb.writeSingleRegister(ctx, address, value)
+	return
+}
+
+// writeSingleRegister sends the request and checks the response echoes it. The
+// response is returned with the error of an exception or a mismatch.
+func (mb *client) writeSingleRegister(ctx context.Context, address, value uint16) (response *ProtocolDataUnit, results []byte, err error) {
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeWriteSingleRegister,
 		Data:         dataBlock(address, value),
 	}
-	response, err := mb.send(&request)
+	response, err = mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -219,13 +313,13 @@ func (mb *client) WriteSingleRegister(address, value uint16) (results []byte, er
 	}
 	respValue := binary.BigEndian.Uint16(response.Data)
 	if address != respValue {
-		err = fmt.Errorf("modbus: response address '%v' does not match request '%v'", respValue, address)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "address", Request: address, Response: respValue}
 		return
 	}
 	results = response.Data[2:]
 	respValue = binary.BigEndian.Uint16(results)
 	if value != respValue {
-		err = fmt.Errorf("modbus: response value '%v' does not match request '%v'", respValue, value)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "value", Request: value, Response: respValue}
 		return
 	}
 	return
@@ -242,15 +336,36 @@ func (mb *client) WriteSingleRegister(address, value uint16) (results []byte, er
 //  Starting address      : 2 bytes
 //  Quantity of outputs   : 2 bytes
 func (mb *client) WriteMultipleCoils(address, quantity uint16, value []byte) (results []byte, err error) {
-	if quantity < 1 || quantity > 1968 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 1968)
+	return mb.WriteMultipleCoilsContext(context.Background(), address, quantity, value)
+}
+
+func (mb *client) WriteMultipleCoilsContext(ctx context.Context, address, quantity uint16, value []byte) (results []byte, err error) {
+	_, results, err = mb.writeMultipleCoils(ctx, address, quantity, value)
+	return
+}
+
+// WriteMultipleCoilsPDU is like WriteMultipleCoils but returns the decoded response.
+func (mb *client) WriteMultipleCoilsPDU(address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error) {
+	return mb.WriteMultipleCoilsPDUContext(context.Background(), address, quantity, value)
+}
+
+func (mb *client) WriteMultipleCoilsPDUContext(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error) {
+	response, _, err = mb.writeMultipleCoils(ctx, address, quantity, value)
+	return
+}
+
+// writeMultipleCoils sends the request and checks the response echoes it. The
+// response is returned with the error of an exception or a mismatch.
+func (mb *client) writeMultipleCoils(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, results []byte, err error) {
+	if quantity < 1 || quantity > maxWriteCoils {
+		err = &QuantityError{FunctionCode: FuncCodeWriteMultipleCoils, Field: "quantity", Quantity: int(quantity), Min: 1, Max: maxWriteCoils}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeWriteMultipleCoils,
 		Data:         dataBlockSuffix(value, address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err = mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -261,13 +376,13 @@ func (mb *client) WriteMultipleCoils(address, quantity uint16, value []byte) (re
 	}
 	respValue := binary.BigEndian.Uint16(response.Data)
 	if address != respValue {
-		err = fmt.Errorf("modbus: response address '%v' does not match request '%v'", respValue, address)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "address", Request: address, Response: respValue}
 		return
 	}
 	results = response.Data[2:]
 	respValue = binary.BigEndian.Uint16(results)
 	if quantity != respValue {
-		err = fmt.Errorf("modbus: response quantity '%v' does not match request '%v'", respValue, quantity)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "quantity", Request: quantity, Response: respValue}
 		return
 	}
 	return
@@ -284,15 +399,36 @@ func (mb *client) WriteMultipleCoils(address, quantity uint16, value []byte) (re
 //  Starting address      : 2 bytes
 //  Quantity of registers : 2 bytes
 func (mb *client) WriteMultipleRegisters(address, quantity uint16, value []byte) (results []byte, err error) {
+	return mb.WriteMultipleRegistersContext(context.Background(), address, quantity, value)
+}
+
+func (mb *client) WriteMultipleRegistersContext(ctx context.Context, address, quantity uint16, value []byte) (results []byte, err error) {
+	_, results, err = mb.writeMultipleRegisters(ctx, address, quantity, value)
+	return
+}
+
+// WriteMultipleRegistersPDU is like WriteMultipleRegisters but returns the decoded response.
+func (mb *client) WriteMultipleRegistersPDU(address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error) {
+	return mb.WriteMultipleRegistersPDUContext(context.Background(), address, quantity, value)
+}
+
+func (mb *client) WriteMultipleRegistersPDUContext(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, err error) {
+	response, _, err = mb.writeMultipleRegisters(ctx, address, quantity, value)
+	return
+}
+
+// writeMultipleRegisters sends the request and checks the response echoes it. The
+// response is returned with the error of an exception or a mismatch.
+func (mb *client) writeMultipleRegisters(ctx context.Context, address, quantity uint16, value []byte) (response *ProtocolDataUnit, results []byte, err error) {
 	if quantity < 1 || quantity > 123 {
-		err = fmt.Errorf("modbus: quantity '%v' must be between '%v' and '%v',", quantity, 1, 123)
+		err = &QuantityError{FunctionCode: FuncCodeWriteMultipleRegisters, Field: "quantity", Quantity: int(quantity), Min: 1, Max: 123}
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeWriteMultipleRegisters,
 		Data:         dataBlockSuffix(value, address, quantity),
 	}
-	response, err := mb.send(&request)
+	response, err = mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -303,13 +439,13 @@ func (mb *client) WriteMultipleRegisters(address, quantity uint16, value []byte)
 	}
 	respValue := binary.BigEndian.Uint16(response.Data)
 	if address != respValue {
-		err = fmt.Errorf("modbus: response address '%v' does not match request '%v'", respValue, address)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "address", Request: address, Response: respValue}
 		return
 	}
 	results = response.Data[2:]
 	respValue = binary.BigEndian.Uint16(results)
 	if quantity != respValue {
-		err = fmt.Errorf("modbus: response quantity '%v' does not match request '%v'", respValue, quantity)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "quantity", Request: quantity, Response: respValue}
 		return
 	}
 	return
@@ -326,11 +462,32 @@ func (mb *client) WriteMultipleRegisters(address, quantity uint16, value []byte)
 //  AND-mask              : 2 bytes
 //  OR-mask               : 2 bytes
 func (mb *client) MaskWriteRegister(address, andMask, orMask uint16) (results []byte, err error) {
+	return mb.MaskWriteRegisterContext(context.Background(), address, andMask, orMask)
+}
+
+func (mb *client) MaskWriteRegisterContext(ctx context.Context, address, andMask, orMask uint16) (results []byte, err error) {
+	_, results, err = mb.maskWriteRegister(ctx, address, andMask, orMask)
+	return
+}
+
+// MaskWriteRegisterPDU is like MaskWriteRegister but returns the decoded response.
+func (mb *client) MaskWriteRegisterPDU(address, andMask, orMask uint16) (response *ProtocolDataUnit, err error) {
+	return mb.MaskWriteRegisterPDUContext(context.Background(), address, andMask, orMask)
+}
+
+func (mb *client) MaskWriteRegisterPDUContext(ctx context.Context, address, andMask, orMask uint16) (response *ProtocolDataUnit, err error) {
+	response, _, err = mb.maskWriteRegister(ctx, address, andMask, orMask)
+	return
+}
+
+// maskWriteRegister sends the request and checks the response echoes it. The
+// response is returned with the error of an exception or a mismatch.
+func (mb *client) maskWriteRegister(ctx context.Context, address, andMask, orMask uint16) (response *ProtocolDataUnit, results []byte, err error) {
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeMaskWriteRegister,
 		Data:         dataBlock(address, andMask, orMask),
 	}
-	response, err := mb.send(&request)
+	response, err = mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -341,17 +498,17 @@ func (mb *client) MaskWriteRegister(address, andMask, orMask uint16) (results []
 	}
 	respValue := binary.BigEndian.Uint16(response.Data)
 	if address != respValue {
-		err = fmt.Errorf("modbus: response address '%v' does not match request '%v'", respValue, address)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "address", Request: address, Response: respValue}
 		return
 	}
 	respValue = binary.BigEndian.Uint16(response.Data[2:])
 	if andMask != respValue {
-		err = fmt.Errorf("modbus: response AND-mask '%v' does not match request '%v'", respValue, andMask)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "AND-mask", Request: andMask, Response: respValue}
 		return
 	}
 	respValue = binary.BigEndian.Uint16(response.Data[4:])
 	if orMask != respValue {
-		err = fmt.Errorf("modbus: response OR-mask '%v' does not match request '%v'", respValue, orMask)
+		err = &EchoError{FunctionCode: request.FunctionCode, Field: "OR-mask", Request: orMask, Response: respValue}
 		return
 	}
 	results = response.Data[2:]
@@ -371,27 +528,43 @@ func (mb *client) MaskWriteRegister(address, andMask, orMask uint16) (results []
 //  Byte count            : 1 byte
 //  Read registers value  : Nx2 bytes
 func (mb *client) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []byte, err error) {
+	return mb.ReadWriteMultipleRegistersContext(context.Background(), readAddress, readQuantity, writeAddress, writeQuantity, value)
+}
+
+func (mb *client) ReadWriteMultipleRegistersContext(ctx context.Context, readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) (results []byte, err error) {
 	if readQuantity < 1 || readQuantity > 125 {
-		err = fmt.Errorf("modbus: quantity to read '%v' must be between '%v' and '%v',", readQuantity, 1, 125)
+		err = &QuantityError{FunctionCode: FuncCodeReadWriteMultipleRegisters, Field: "quantity to read", Quantity: int(readQuantity), Min: 1, Max: 125}
 		return
 	}
 	if writeQuantity < 1 || writeQuantity > 121 {
-		err = fmt.Errorf("modbus: quantity to write '%v' must be between '%v' and '%v',", writeQuantity, 1, 121)
+		err = &QuantityError{FunctionCode: FuncCodeReadWriteMultipleRegisters, Field: "quantity to write", Quantity: int(writeQuantity), Min: 1, Max: 121}
+		return
+	}
+	if len(value) != 2*int(writeQuantity) {
+		err = fmt.Errorf("modbus: value size '%v' does not match quantity to write '%v'", len(value), writeQuantity)
 		return
 	}
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadWriteMultipleRegisters,
 		Data:         dataBlockSuffix(value, readAddress, readQuantity, writeAddress, writeQuantity),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
+	if len(response.Data) < 1 {
+		err = fmt.Errorf("modbus: response data is empty")
+		return
+	}
 	count := int(response.Data[0])
 	if count != (len(response.Data) - 1) {
 		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-1, count)
 		return
 	}
+	if count != 2*int(readQuantity) {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match quantity to read '%v'", count, readQuantity)
+		return
+	}
 	results = response.Data[1:]
 	return
 }
@@ -402,15 +575,18 @@ func (mb *client) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAdd
 // Response:
 //  Function code         : 1 byte (0x18)
 //  Byte count            : 2 bytes
-//  FIFO count            : 2 bytes
 //  FIFO count            : 2 bytes (<=31)
 //  FIFO value register   : Nx2 bytes
 func (mb *client) ReadFIFOQueue(address uint16) (results []byte, err error) {
+	return mb.ReadFIFOQueueContext(context.Background(), address)
+}
+
+func (mb *client) ReadFIFOQueueContext(ctx context.Context, address uint16) (results []byte, err error) {
 	request := ProtocolDataUnit{
 		FunctionCode: FuncCodeReadFIFOQueue,
 		Data:         dataBlock(address),
 	}
-	response, err := mb.send(&request)
+	response, err := mb.send(ctx, &request)
 	if err != nil {
 		return
 	}
@@ -418,39 +594,569 @@ func (mb *client) ReadFIFOQueue(address uint16) (results []byte, err error) {
 		err = fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(response.Data), 4)
 		return
 	}
+	// Byte count includes FIFO count
 	count := int(binary.BigEndian.Uint16(response.Data))
-	if count != (len(response.Data) - 1) {
-		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-1, count)
+	if count != (len(response.Data) - 2) {
+		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-2, count)
 		return
 	}
-	count = int(binary.BigEndian.Uint16(response.Data[2:]))
-	if count > 31 {
-		err = fmt.Errorf("modbus: fifo count '%v' is greater than expected '%v'", count, 31)
+	fifoCount := int(binary.BigEndian.Uint16(response.Data[2:]))
+	if fifoCount > 31 {
+		err = fmt.Errorf("modbus: fifo count '%v' is greater than expected '%v'", fifoCount, 31)
+		return
+	}
+	if count != 2+2*fifoCount {
+		err = fmt.Errorf("modbus: response byte count '%v' does not match fifo count '%v'", count, fifoCount)
 		return
 	}
 	results = response.Data[4:]
 	return
 }
 
+// FileRecord is a group of registers of a file, a sub-request of
+// ReadFileRecord and WriteFileRecord.
+type FileRecord struct {
+	// FileNumber is from 1 to 0xFFFF
+	FileNumber uint16
+	// RecordNumber is from 0 to 9999
+	RecordNumber uint16
+	// RecordLength is the number of registers read, ignored by
+	// WriteFileRecord which writes len(Data)/2 registers
+	RecordLength uint16
+	// Data holds the registers read or written, 2 bytes each
+	Data []byte
+}
+
+const (
+	// Reference type of the file record sub-requests
+	fileRecordReferenceType = 6
+	fileRecordMaxNumber     = 9999
+	// Maximum byte count of a file record request or response
+	fileRecordMaxReadSize  = 0xF5
+	fileRecordMaxWriteSize = 0xFB
+)
+
+// checkFileRecord returns an error if the file or record number of record
+// is out of range.
+func checkFileRecord(record *FileRecord) error {
+	if record.FileNumber == 0 {
+		return fmt.Errorf("modbus: file number '%v' must not be zero", record.FileNumber)
+	}
+	if record.RecordNumber > fileRecordMaxNumber {
+		return fmt.Errorf("modbus: record number '%v' must be between '%v' and '%v'", record.RecordNumber, 0, fileRecordMaxNumber)
+	}
+	return nil
+}
+
+// Request:
+//  Function code         : 1 byte (0x14)
+//  Byte count            : 1 byte
+//  Sub-requests          : N* (reference type 1 byte (0x06), file number
+//                          2 bytes, record number 2 bytes, record length 2 bytes)
+// Response:
+//  Function code         : 1 byte (0x14)
+//  Byte count            : 1 byte
+//  Sub-responses         : N* (length 1 byte, reference type 1 byte (0x06),
+//                          record data Mx2 bytes)
+func (mb *client) ReadFileRecord(records []FileRecord) (results []FileRecord, err error) {
+	return mb.ReadFileRecordContext(context.Background(), records)
+}
+
+func (mb *client) ReadFileRecordContext(ctx context.Context, records []FileRecord) (results []FileRecord, err error) {
+	if len(records) == 0 {
+		err = fmt.Errorf("modbus: file records must not be empty")
+		return
+	}
+	data := []byte{0}
+	responseSize := 0
+	for i := range records {
+		record := &records[i]
+		if err = checkFileRecord(record); err != nil {
+			return
+		}
+		if record.RecordLength == 0 {
+			err = fmt.Errorf("modbus: record length '%v' must not be zero", record.RecordLength)
+			return
+		}
+		responseSize += 2 + 2*int(record.RecordLength)
+		data = append(data, fileRecordReferenceType)
+		data = append(data, dataBlock(record.FileNumber, record.RecordNumber, record.RecordLength)...)
+	}
+	if len(data)-1 > fileRecordMaxReadSize {
+		err = fmt.Errorf("modbus: request byte count '%v' must not be greater than '%v'", len(data)-1, fileRecordMaxReadSize)
+		return
+	}
+	if responseSize > fileRecordMaxReadSize {
+		err = fmt.Errorf("modbus: response byte count '%v' must not be greater than '%v'", responseSize, fileRecordMaxReadSize)
+		return
+	}
+	data[0] = byte(len(data) - 1)
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeReadFileRecord,
+		Data:         data,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	if len(response.Data) < 1 {
+		err = fmt.Errorf("modbus: response data is empty")
+		return
+	}
+	count := int(response.Data[0])
+	if count != len(response.Data)-1 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", len(response.Data)-1, count)
+		return
+	}
+	results = make([]FileRecord, len(records))
+	offset := 1
+	for i, record := range records {
+		if offset+2 > len(response.Data) {
+			err = fmt.Errorf("modbus: response sub-responses '%v' do not match requested '%v'", i, len(records))
+			return nil, err
+		}
+		length := int(response.Data[offset])
+		if length != 1+2*int(record.RecordLength) {
+			err = fmt.Errorf("modbus: response sub-response length '%v' does not match record length '%v'", length, record.RecordLength)
+			return nil, err
+		}
+		if offset+1+length > len(response.Data) {
+			err = fmt.Errorf("modbus: response sub-response length '%v' exceeds data size '%v'", length, len(response.Data)-offset-1)
+			return nil, err
+		}
+		if response.Data[offset+1] != fileRecordReferenceType {
+			err = fmt.Errorf("modbus: response reference type '%v' does not match expected '%v'", response.Data[offset+1], fileRecordReferenceType)
+			return nil, err
+		}
+		results[i] = record
+		results[i].Data = response.Data[offset+2 : offset+1+length]
+		offset += 1 + length
+	}
+	if offset != len(response.Data) {
+		err = fmt.Errorf("modbus: response data size '%v' does not match sub-responses size '%v'", len(response.Data), offset)
+		return nil, err
+	}
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x15)
+//  Byte count            : 1 byte
+//  Sub-requests          : N* (reference type 1 byte (0x06), file number
+//                          2 bytes, record number 2 bytes, record length
+//                          2 bytes, record data Mx2 bytes)
+// Response:
+//  Function code         : 1 byte (0x15)
+//  Byte count            : 1 byte
+//  Sub-requests          : echoed
+func (mb *client) WriteFileRecord(records []FileRecord) (err error) {
+	return mb.WriteFileRecordContext(context.Background(), records)
+}
+
+func (mb *client) WriteFileRecordContext(ctx context.Context, records []FileRecord) (err error) {
+	if len(records) == 0 {
+		return fmt.Errorf("modbus: file records must not be empty")
+	}
+	data := []byte{0}
+	for i := range records {
+		record := &records[i]
+		if err = checkFileRecord(record); err != nil {
+			return
+		}
+		if len(record.Data) == 0 || len(record.Data)%2 != 0 {
+			return fmt.Errorf("modbus: record data size '%v' must be a positive multiple of 2", len(record.Data))
+		}
+		if len(data)-1+7+len(record.Data) > fileRecordMaxWriteSize {
+			return fmt.Errorf("modbus: request byte count must not be greater than '%v'", fileRecordMaxWriteSize)
+		}
+		data = append(data, fileRecordReferenceType)
+		data = append(data, dataBlock(record.FileNumber, record.RecordNumber, uint16(len(record.Data)/2))...)
+		data = append(data, record.Data...)
+	}
+	data[0] = byte(len(data) - 1)
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeWriteFileRecord,
+		Data:         data,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(response.Data, request.Data) {
+		err = fmt.Errorf("modbus: response data '%x' does not match request '%x'", response.Data, request.Data)
+	}
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x07)
+// Response:
+//  Function code         : 1 byte (0x07)
+//  Output data           : 1 byte
+func (mb *client) ReadExceptionStatus() (status byte, err error) {
+	return mb.ReadExceptionStatusContext(context.Background())
+}
+
+func (mb *client) ReadExceptionStatusContext(ctx context.Context) (status byte, err error) {
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeReadExceptionStatus,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	// Fixed response length
+	if len(response.Data) != 1 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(response.Data), 1)
+		return
+	}
+	status = response.Data[0]
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x08)
+//  Sub-function          : 2 bytes
+//  Data                  : 2 bytes
+// Response:
+//  Function code         : 1 byte (0x08)
+//  Sub-function          : 2 bytes
+//  Data                  : 2 bytes
+func (mb *client) Diagnostics(subFunction, data uint16) (results []byte, err error) {
+	return mb.DiagnosticsContext(context.Background(), subFunction, data)
+}
+
+func (mb *client) DiagnosticsContext(ctx context.Context, subFunction, data uint16) (results []byte, err error) {
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeDiagnostics,
+		Data:         dataBlock(subFunction, data),
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	// Fixed response length
+	if len(response.Data) != 4 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(response.Data), 4)
+		return
+	}
+	respValue := binary.BigEndian.Uint16(response.Data)
+	if subFunction != respValue {
+		err = fmt.Errorf("modbus: response sub-function '%v' does not match request '%v'", respValue, subFunction)
+		return
+	}
+	results = response.Data[2:]
+	// Loopback must return the query data unchanged
+	if subFunction == DiagnosticsReturnQueryData {
+		respValue = binary.BigEndian.Uint16(results)
+		if data != respValue {
+			err = fmt.Errorf("modbus: response data '%v' does not match request '%v'", respValue, data)
+			return
+		}
+	}
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x0B)
+// Response:
+//  Function code         : 1 byte (0x0B)
+//  Status                : 2 bytes
+//  Event count           : 2 bytes
+func (mb *client) GetCommEventCounter() (status, eventCount uint16, err error) {
+	return mb.GetCommEventCounterContext(context.Background())
+}
+
+func (mb *client) GetCommEventCounterContext(ctx context.Context) (status, eventCount uint16, err error) {
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeGetCommEventCounter,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	// Fixed response length
+	if len(response.Data) != 4 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(response.Data), 4)
+		return
+	}
+	status = binary.BigEndian.Uint16(response.Data)
+	eventCount = binary.BigEndian.Uint16(response.Data[2:])
+	return
+}
+
+// CommEventLog is the response of GetCommEventLog.
+type CommEventLog struct {
+	// Status is 0xFFFF while a previous command is being processed
+	Status       uint16
+	EventCount   uint16
+	MessageCount uint16
+	// Events holds up to 64 event bytes, most recent first
+	Events []byte
+}
+
+// Request:
+//  Function code         : 1 byte (0x0C)
+// Response:
+//  Function code         : 1 byte (0x0C)
+//  Byte count            : 1 byte
+//  Status                : 2 bytes
+//  Event count           : 2 bytes
+//  Message count         : 2 bytes
+//  Events                : N bytes (<=64)
+func (mb *client) GetCommEventLog() (log *CommEventLog, err error) {
+	return mb.GetCommEventLogContext(context.Background())
+}
+
+func (mb *client) GetCommEventLogContext(ctx context.Context) (log *CommEventLog, err error) {
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeGetCommEventLog,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	if len(response.Data) < 7 {
+		err = fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(response.Data), 7)
+		return
+	}
+	count := int(response.Data[0])
+	length := len(response.Data) - 1
+	if count != length {
+		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
+		return
+	}
+	log = &CommEventLog{
+		Status:       binary.BigEndian.Uint16(response.Data[1:]),
+		EventCount:   binary.BigEndian.Uint16(response.Data[3:]),
+		MessageCount: binary.BigEndian.Uint16(response.Data[5:]),
+		Events:       response.Data[7:],
+	}
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x11)
+// Response:
+//  Function code         : 1 byte (0x11)
+//  Byte count            : 1 byte
+//  Server ID             : N bytes
+//  Run indicator status  : 1 byte
+func (mb *client) ReportServerID() (id []byte, status byte, err error) {
+	return mb.ReportServerIDContext(context.Background())
+}
+
+func (mb *client) ReportServerIDContext(ctx context.Context) (id []byte, status byte, err error) {
+	request := ProtocolDataUnit{
+		FunctionCode: FuncCodeReportServerID,
+	}
+	response, err := mb.send(ctx, &request)
+	if err != nil {
+		return
+	}
+	count := int(response.Data[0])
+	length := len(response.Data) - 1
+	if count != length {
+		err = fmt.Errorf("modbus: response data size '%v' does not match count '%v'", length, count)
+		return
+	}
+	if count < 1 {
+		err = fmt.Errorf("modbus: response data size '%v' is missing the run indicator status", count)
+		return
+	}
+	id = response.Data[1:count]
+	status = response.Data[count]
+	return
+}
+
+// Request:
+//  Function code         : 1 byte (0x2B)
+//  MEI type              : 1 byte (0x0E)
+//  Read device id code   : 1 byte
+//  Object id             : 1 byte
+// Response:
+//  Function code         : 1 byte (0x2B)
+//  MEI type              : 1 byte (0x0E)
+//  Read device id code   : 1 byte
+//  Conformity level      : 1 byte
+//  More follows          : 1 byte (0x00 or 0xFF)
+//  Next object id        : 1 byte
+//  Number of objects     : 1 byte
+//  Objects               : N* (id 1 byte, length 1 byte, value)
+func (mb *client) ReadDeviceIdentification(readDeviceIDCode, objectID byte) (objects map[byte][]byte, err error) {
+	return mb.ReadDeviceIdentificationContext(context.Background(), readDeviceIDCode, objectID)
+}
+
+func (mb *client) ReadDeviceIdentificationContext(ctx context.Context, readDeviceIDCode, objectID byte) (objects map[byte][]byte, err error) {
+	if readDeviceIDCode < ReadDeviceIDCodeBasic || readDeviceIDCode > ReadDeviceIDCodeSpecific {
+		err = fmt.Errorf("modbus: read device id code '%v' must be between '%v' and '%v'", readDeviceIDCode, ReadDeviceIDCodeBasic, ReadDeviceIDCodeSpecific)
+		return
+	}
+	objects = make(map[byte][]byte)
+	for {
+		request := ProtocolDataUnit{
+			FunctionCode: FuncCodeEncapsulatedInterfaceTransport,
+			Data:         []byte{MEITypeReadDeviceIdentification, readDeviceIDCode, objectID},
+		}
+		var response *ProtocolDataUnit
+		response, err = mb.send(ctx, &request)
+		if err != nil {
+			return nil, err
+		}
+		var moreFollows bool
+		var nextObjectID byte
+		if moreFollows, nextObjectID, err = parseDeviceIdentification(response.Data, readDeviceIDCode, objects); err != nil {
+			return nil, err
+		}
+		if !moreFollows || readDeviceIDCode == ReadDeviceIDCodeSpecific {
+			return
+		}
+		// Object ids are sent in increasing order
+		if nextObjectID <= objectID {
+			err = fmt.Errorf("modbus: response next object id '%v' does not follow request '%v'", nextObjectID, objectID)
+			return nil, err
+		}
+		objectID = nextObjectID
+	}
+}
+
+// parseDeviceIdentification adds the objects of a read device identification
+// response to objects.
+func parseDeviceIdentification(data []byte, readDeviceIDCode byte, objects map[byte][]byte) (moreFollows bool, nextObjectID byte, err error) {
+	if len(data) < 6 {
+		err = fmt.Errorf("modbus: response data size '%v' is less than expected '%v'", len(data), 6)
+		return
+	}
+	if data[0] != MEITypeReadDeviceIdentification {
+		err = fmt.Errorf("modbus: response MEI type '%v' does not match expected '%v'", data[0], MEITypeReadDeviceIdentification)
+		return
+	}
+	if data[1] != readDeviceIDCode {
+		err = fmt.Errorf("modbus: response read device id code '%v' does not match request '%v'", data[1], readDeviceIDCode)
+		return
+	}
+	moreFollows = data[3] == 0xFF
+	nextObjectID = data[4]
+	count := int(data[5])
+	data = data[6:]
+	for i := 0; i < count; i++ {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			err = fmt.Errorf("modbus: response object '%v' of '%v' is truncated", i+1, count)
+			return
+		}
+		length := int(data[1])
+		objects[data[0]] = data[2 : 2+length]
+		data = data[2+length:]
+	}
+	if len(data) != 0 {
+		err = fmt.Errorf("modbus: response data has '%v' unexpected trailing bytes", len(data))
+		return
+	}
+	return
+}
+
+// SendPDU sends a request of any function code and returns the response.
+func (mb *client) SendPDU(request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	return mb.SendPDUContext(context.Background(), request)
+}
+
+func (mb *client) SendPDUContext(ctx context.Context, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	return mb.send(ctx, request)
+}
+
+// SendNoResponse sends a request of a function without response.
+func (mb *client) SendNoResponse(request *ProtocolDataUnit) (err error) {
+	return mb.SendNoResponseContext(context.Background(), request)
+}
+
+func (mb *client) SendNoResponseContext(ctx context.Context, request *ProtocolDataUnit) (err error) {
+	_, err = mb.send(context.WithValue(ctx, noResponseKey{}, true), request)
+	return
+}
+
 // Helpers
 
 // send sends request and checks possible exception in the response.
-func (mb *client) send(request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
-	aduRequest, err := mb.packager.Encode(request)
-	if err != nil {
+func (mb *client) send(ctx context.Context, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	var metrics Metrics
+	if transporter, ok := mb.transporter.(metricsTransporter); ok {
+		metrics = transporter.metrics()
+	}
+	if metrics == nil {
+		return mb.guard(ctx, request)
+	}
+	start := time.Now()
+	response, err = mb.guard(ctx, request)
+	metrics.ObserveRequest(mb.slaveId(ctx), request.FunctionCode, time.Since(start), err)
+	return
+}
+
+// guard passes the request through the circuit breaker of the transporter,
+// if any.
+func (mb *client) guard(ctx context.Context, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	var breaker *CircuitBreaker
+	if transporter, ok := mb.transporter.(breakerTransporter); ok {
+		breaker = transporter.circuitBreaker()
+	}
+	if noResponse, _ := ctx.Value(noResponseKey{}).(bool); breaker == nil || noResponse {
+		return mb.do(ctx, request)
+	}
+	slaveId := mb.slaveId(ctx)
+	if err = breaker.allow(slaveId); err != nil {
+		return
+	}
+	response, err = mb.do(ctx, request)
+	breaker.done(slaveId, err, err != nil && ctx.Err() != nil)
+	return
+}
+
+// do encodes the request, sends it and decodes the response.
+func (mb *client) do(ctx context.Context, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	if noResponse, _ := ctx.Value(noResponseKey{}).(bool); noResponse {
+		err = mb.sendNoResponse(ctx, request)
 		return
 	}
-	aduResponse, err := mb.transporter.Send(aduRequest)
+	if transporter, ok := mb.transporter.(BroadcastTransporter); ok && mb.slaveId(ctx) == 0 {
+		return mb.broadcast(ctx, transporter, request)
+	}
+	aduRequest, err := mb.encode(ctx, request)
 	if err != nil {
 		return
 	}
+	if transporter, ok := mb.transporter.(tracerTransporter); ok {
+		if tracef := transporter.requestTracer(); tracef != nil {
+			start := time.Now()
+			defer func() {
+				mb.traceRequest(tracef, mb.slaveId(ctx), aduRequest, request, response, err, time.Since(start))
+			}()
+		}
+	}
+	var aduResponse []byte
+	if onResponse := mb.inspect(aduRequest); onResponse != nil {
+		defer func() { onResponse(aduResponse, err) }()
+	}
+	if aduResponse, err = mb.transport(ctx, aduRequest); err != nil {
+		return
+	}
+	if err = mb.validate(aduRequest, aduResponse); err != nil {
+		err = &frameError{err}
+		return
+	}
 	if err = mb.packager.Verify(aduRequest, aduResponse); err != nil {
+		err = &frameError{err}
 		return
 	}
 	response, err = mb.packager.Decode(aduResponse)
 	if err != nil {
+		// Packagers may report exception responses themselves
+		var mbError *ModbusError
+		if !errors.As(err, &mbError) {
+			err = &frameError{err}
+		}
 		return
 	}
+	// The frame may be a buffer reused by the transporter
+	response.Data = append([]byte(nil), response.Data...)
 	// Check correct function code returned (exception)
 	if response.FunctionCode != request.FunctionCode {
 		err = responseError(response)
@@ -464,6 +1170,117 @@ func (mb *client) send(request *ProtocolDataUnit) (response *ProtocolDataUnit, e
 	return
 }
 
+// broadcast sends a write request to all slaves. As no slave replies, the
+// response is made up of the request fields echoed by the write functions.
+func (mb *client) broadcast(ctx context.Context, transporter BroadcastTransporter, request *ProtocolDataUnit) (response *ProtocolDataUnit, err error) {
+	switch request.FunctionCode {
+	case FuncCodeWriteSingleCoil,
+		FuncCodeWriteMultipleCoils,
+		FuncCodeWriteSingleRegister,
+		FuncCodeWriteMultipleRegisters:
+	default:
+		err = fmt.Errorf("modbus: function code '%v' can not be broadcast", request.FunctionCode)
+		return
+	}
+	aduRequest, err := mb.encode(ctx, request)
+	if err != nil {
+		return
+	}
+	if onResponse := mb.inspect(aduRequest); onResponse != nil {
+		defer func() { onResponse(nil, err) }()
+	}
+	if err = transporter.SendBroadcast(ctx, aduRequest); err != nil {
+		return
+	}
+	// Address and value or quantity
+	response = &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data[:4]}
+	return
+}
+
+// sendNoResponse writes a request without waiting for a response.
+func (mb *client) sendNoResponse(ctx context.Context, request *ProtocolDataUnit) (err error) {
+	transporter, ok := mb.transporter.(NoResponseTransporter)
+	if !ok {
+		err = fmt.Errorf("modbus: transporter does not support requests without response")
+		return
+	}
+	aduRequest, err := mb.encode(ctx, request)
+	if err != nil {
+		return
+	}
+	if onResponse := mb.inspect(aduRequest); onResponse != nil {
+		defer func() { onResponse(nil, err) }()
+	}
+	err = transporter.SendNoResponse(ctx, aduRequest)
+	return
+}
+
+// inspect passes the request to the OnRequest hook of the transporter and
+// returns its OnResponse hook. They are called without holding the lock of
+// the transporter.
+func (mb *client) inspect(aduRequest []byte) (onResponse func(adu []byte, err error)) {
+	transporter, ok := mb.transporter.(hookTransporter)
+	if !ok {
+		return
+	}
+	onRequest, onResponse := transporter.hooks()
+	if onRequest != nil {
+		onRequest(aduRequest)
+	}
+	return
+}
+
+// validate passes the response to the ResponseValidator of the transporter,
+// if set.
+func (mb *client) validate(aduRequest, aduResponse []byte) error {
+	transporter, ok := mb.transporter.(validatorTransporter)
+	if !ok {
+		return nil
+	}
+	if validator := transporter.responseValidator(); validator != nil {
+		return validator(aduRequest, aduResponse)
+	}
+	return nil
+}
+
+// slaveId returns the slave addressed by requests made with ctx.
+func (mb *client) slaveId(ctx context.Context) byte {
+	if slaveId, ok := ctx.Value(slaveIdKey{}).(byte); ok {
+		return slaveId
+	}
+	if packager, ok := mb.packager.(defaultSlavePackager); ok {
+		return packager.defaultSlaveId()
+	}
+	return 0
+}
+
+// encode encodes the request for the slave set by WithSlaveId or the default
+// slave of the packager.
+func (mb *client) encode(ctx context.Context, request *ProtocolDataUnit) (aduRequest []byte, err error) {
+	slaveId, ok := ctx.Value(slaveIdKey{}).(byte)
+	if !ok {
+		return mb.packager.Encode(request)
+	}
+	packager, ok := mb.packager.(SlavePackager)
+	if !ok {
+		err = fmt.Errorf("modbus: packager does not support per-request slave id")
+		return
+	}
+	return packager.EncodeSlave(slaveId, request)
+}
+
+// transport passes the request to the transporter, using its context-aware
+// method when available.
+func (mb *client) transport(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	if transporter, ok := mb.transporter.(ContextTransporter); ok {
+		return transporter.SendContext(ctx, aduRequest)
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return mb.transporter.Send(aduRequest)
+}
+
 // dataBlock creates a sequence of uint16 data.
 func dataBlock(value ...uint16) []byte {
 	data := make([]byte, 2*len(value))
@@ -485,6 +1302,15 @@ func dataBlockSuffix(suffix []byte, value ...uint16) []byte {
 	return data
 }
 
+// verifyFunctionCode checks the function code of a response, without the
+// exception bit, is the one of the request.
+func verifyFunctionCode(request, response byte) error {
+	if response&0x7F != request {
+		return fmt.Errorf("modbus: response function code '%v' does not match request '%v'", response, request)
+	}
+	return nil
+}
+
 func responseError(response *ProtocolDataUnit) error {
 	mbError := &ModbusError{FunctionCode: response.FunctionCode}
 	if response.Data != nil && len(response.Data) > 0 {
@@ -492,3 +1318,17 @@ func responseError(response *ProtocolDataUnit) error {
 	}
 	return mbError
 }
+
+// frameError wraps errors of a malformed response frame, e.g. a crc or a
+// length mismatch, so they can be told apart from request errors.
+type frameError struct {
+	err error
+}
+
+func (e *frameError) Error() string {
+	return e.err.Error()
+}
+
+func (e *frameError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,463 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pduTransporter answers the requests framed by a tcpPackager with the
+// response returned by its function.
+type pduTransporter func(request *ProtocolDataUnit) *ProtocolDataUnit
+
+func (f pduTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	request := &ProtocolDataUnit{
+		FunctionCode: aduRequest[tcpHeaderSize],
+		Data:         aduRequest[tcpHeaderSize+1:],
+	}
+	response := f(request)
+	aduResponse = make([]byte, tcpHeaderSize+1+len(response.Data))
+	copy(aduResponse, aduRequest[:tcpHeaderSize])
+	binary.BigEndian.PutUint16(aduResponse[4:], uint16(2+len(response.Data)))
+	aduResponse[tcpHeaderSize] = response.FunctionCode
+	copy(aduResponse[tcpHeaderSize+1:], response.Data)
+	return
+}
+
+// newPDUClient returns a client whose requests are answered by f.
+func newPDUClient(f func(request *ProtocolDataUnit) *ProtocolDataUnit) Client {
+	return NewClient2(&tcpPackager{}, pduTransporter(f))
+}
+
+func TestReadWriteMultipleRegistersByteCount(t *testing.T) {
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		// One register less than requested
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{2, 0, 1}}
+	})
+	if _, err := client.ReadWriteMultipleRegisters(0, 2, 0, 1, []byte{0, 1}); err == nil {
+		t.Fatal("expected error for response byte count")
+	}
+	client = newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode}
+	})
+	if _, err := client.ReadWriteMultipleRegisters(0, 2, 0, 1, []byte{0, 1}); err == nil {
+		t.Fatal("expected error for empty response")
+	}
+}
+
+func TestWriteSingleRegisterEcho(t *testing.T) {
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		// Setpoint clamped to 100
+		value := binary.BigEndian.Uint16(request.Data[2:])
+		if value > 100 {
+			value = 100
+		}
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: dataBlock(binary.BigEndian.Uint16(request.Data), value)}
+	})
+	if _, err := client.WriteSingleRegister(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.WriteSingleRegister(1, 150)
+	var echoError *EchoError
+	if !errors.As(err, &echoError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := EchoError{FunctionCode: FuncCodeWriteSingleRegister, Field: "value", Request: 150, Response: 100}
+	if *echoError != expected {
+		t.Fatalf("echo error: expected %+v, actual %+v", expected, *echoError)
+	}
+}
+
+func TestWriteSingleRegisterPDU(t *testing.T) {
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		if binary.BigEndian.Uint16(request.Data) > 10 {
+			return &ProtocolDataUnit{FunctionCode: request.FunctionCode | 0x80, Data: []byte{ExceptionCodeIllegalDataAddress}}
+		}
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data}
+	})
+	response, err := client.WriteSingleRegisterPDU(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 1, 0, 3}; response.FunctionCode != FuncCodeWriteSingleRegister || !bytes.Equal(expected, response.Data) {
+		t.Fatalf("response: expected %v % x, actual %v % x", FuncCodeWriteSingleRegister, expected, response.FunctionCode, response.Data)
+	}
+	// The exception response comes with the error
+	response, err = client.WriteSingleRegisterPDU(20, 3)
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response == nil || response.FunctionCode != FuncCodeWriteSingleRegister|0x80 {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+}
+
+func TestMaskWriteRegisterEcho(t *testing.T) {
+	var echo []byte
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: echo}
+	})
+	tests := []struct {
+		echo []byte
+		ok   bool
+	}{
+		{[]byte{0, 4, 0, 0xF2, 0, 0x25}, true},
+		{[]byte{0, 5, 0, 0xF2, 0, 0x25}, false},
+		{[]byte{0, 4, 0, 0xF3, 0, 0x25}, false},
+		{[]byte{0, 4, 0, 0xF2, 0, 0x24}, false},
+		{[]byte{0, 4, 0, 0xF2, 0}, false},
+	}
+	for _, test := range tests {
+		echo = test.echo
+		_, err := client.MaskWriteRegister(4, 0x00F2, 0x0025)
+		if (err == nil) != test.ok {
+			t.Errorf("% x: unexpected error %v", test.echo, err)
+		}
+	}
+}
+
+func TestReadFIFOQueue(t *testing.T) {
+	var data []byte
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}
+	})
+	data = []byte{0, 6, 0, 2, 0x01, 0xB8, 0x12, 0x84}
+	values, err := NewTypedClient(client).ReadFIFOQueueUint16(0x04DE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != 0x01B8 || values[1] != 0x1284 {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	fifo := make([]byte, 4+2*32)
+	binary.BigEndian.PutUint16(fifo, 2+2*32)
+	binary.BigEndian.PutUint16(fifo[2:], 32)
+	for _, data = range [][]byte{
+		{0, 6, 0},
+		{0, 7, 0, 2, 0x01, 0xB8, 0x12, 0x84},
+		{0, 6, 0, 1, 0x01, 0xB8, 0x12, 0x84},
+		fifo,
+	} {
+		if _, err = client.ReadFIFOQueue(0x04DE); err == nil {
+			t.Errorf("% x: expected error", data)
+		}
+	}
+}
+
+func TestReadByteCount(t *testing.T) {
+	var data []byte
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}
+	})
+	tests := []struct {
+		read func(address, quantity uint16) ([]byte, error)
+		data []byte
+		ok   bool
+	}{
+		{client.ReadCoils, []byte{2, 0xCD, 0x01}, true},
+		{client.ReadCoils, []byte{1, 0xCD}, false},
+		{client.ReadDiscreteInputs, []byte{2, 0xAC, 0x02}, true},
+		{client.ReadDiscreteInputs, []byte{3, 0xAC, 0x02, 0x00}, false},
+		{client.ReadHoldingRegisters, append([]byte{20}, make([]byte, 20)...), true},
+		{client.ReadHoldingRegisters, append([]byte{18}, make([]byte, 18)...), false},
+		{client.ReadInputRegisters, append([]byte{20}, make([]byte, 20)...), true},
+		{client.ReadInputRegisters, append([]byte{22}, make([]byte, 22)...), false},
+	}
+	for i, test := range tests {
+		data = test.data
+		_, err := test.read(0, 10)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: % x: unexpected error %v", i, test.data, err)
+		}
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	var requests, responses [][]byte
+	var errs []error
+	handler.OnRequest = func(adu []byte) {
+		requests = append(requests, adu)
+	}
+	handler.OnResponse = func(adu []byte, err error) {
+		// The handler is not locked
+		handler.State()
+		responses = append(responses, adu)
+		errs = append(errs, err)
+	}
+	client := NewClient(handler)
+
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFIFOQueue(0); err == nil {
+		t.Fatal("expected exception")
+	}
+	ctx, cancel := context.WithTimeout(WithSlaveId(context.Background(), 9), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.ReadInputRegistersContext(ctx, 0, 1); err == nil {
+		t.Fatal("expected timeout")
+	}
+	if len(requests) != 3 || len(responses) != 3 {
+		t.Fatalf("unexpected hook calls: %v requests, %v responses", len(requests), len(responses))
+	}
+	expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	if !bytes.Equal(expected, requests[0]) {
+		t.Fatalf("request: expected % x, actual % x", expected, requests[0])
+	}
+	expected = []byte{0x01, 0x03, 0x02, 0x00, 0x00, 0xB8, 0x44}
+	if !bytes.Equal(expected, responses[0]) || errs[0] != nil {
+		t.Fatalf("response: expected % x, actual % x, %v", expected, responses[0], errs[0])
+	}
+	var mbError *ModbusError
+	if responses[1] == nil || !errors.As(errs[1], &mbError) {
+		t.Fatalf("exception response: % x, %v", responses[1], errs[1])
+	}
+	if responses[2] != nil || errs[2] != context.DeadlineExceeded {
+		t.Fatalf("timeout response: % x, %v", responses[2], errs[2])
+	}
+}
+
+func TestSendPDU(t *testing.T) {
+	client := newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		if request.FunctionCode != 0x41 {
+			return &ProtocolDataUnit{FunctionCode: request.FunctionCode | 0x80, Data: []byte{ExceptionCodeIllegalFunction}}
+		}
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{0xAA}, request.Data...)}
+	})
+	response, err := client.SendPDU(&ProtocolDataUnit{FunctionCode: 0x41, Data: []byte{0x01, 0x02}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xAA, 0x01, 0x02}; response.FunctionCode != 0x41 || !bytes.Equal(expected, response.Data) {
+		t.Fatalf("response: expected %v % x, actual %v % x", 0x41, expected, response.FunctionCode, response.Data)
+	}
+	_, err = client.SendPDU(&ProtocolDataUnit{FunctionCode: 0x64})
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalFunction {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSendNoResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 16)
+		n, err := server.Read(b)
+		if err != nil {
+			return
+		}
+		// No response
+		received <- b[:n]
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	handler.Timeout = time.Second
+	defer handler.Close()
+	var hooked bool
+	handler.OnResponse = func(adu []byte, err error) { hooked = adu == nil && err == nil }
+
+	start := time.Now()
+	if err := NewClient(handler).SendNoResponse(&ProtocolDataUnit{FunctionCode: 0x41, Data: []byte{0x01}}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= handler.Timeout {
+		t.Fatalf("waited %v for a response", d)
+	}
+	if expected := []byte{0x01, 0x41, 0x01}; !bytes.Equal(expected, (<-received)[:3]) {
+		t.Fatalf("request: expected % x", expected)
+	}
+	if !hooked {
+		t.Fatal("OnResponse must be called without response")
+	}
+
+	err := newPDUClient(nil).SendNoResponse(&ProtocolDataUnit{FunctionCode: 0x41})
+	if err == nil {
+		t.Fatal("expected error for transporter without SendNoResponse")
+	}
+}
+
+// reusingTransporter answers reads of one register with its counter, in
+// the same buffer for each response.
+type reusingTransporter struct {
+	buf     [tcpHeaderSize + 4]byte
+	counter uint16
+}
+
+func (mb *reusingTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	mb.counter++
+	copy(mb.buf[:], aduRequest[:tcpHeaderSize+1])
+	binary.BigEndian.PutUint16(mb.buf[4:], 5)
+	mb.buf[tcpHeaderSize+1] = 2
+	binary.BigEndian.PutUint16(mb.buf[tcpHeaderSize+2:], mb.counter)
+	return mb.buf[:], nil
+}
+
+func TestClientResultsOwned(t *testing.T) {
+	client := NewClient2(&tcpPackager{}, &reusingTransporter{})
+	first, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{0, 1}, first) || !bytes.Equal([]byte{0, 2}, second) {
+		t.Fatalf("results: % x, % x", first, second)
+	}
+}
+
+func TestReadFileRecord(t *testing.T) {
+	var request []byte
+	response := []byte{0x0C, 0x05, 0x06, 0x0D, 0xFE, 0x00, 0x20, 0x05, 0x06, 0x33, 0xCD, 0x00, 0x40}
+	client := newPDUClient(func(r *ProtocolDataUnit) *ProtocolDataUnit {
+		request = r.Data
+		return &ProtocolDataUnit{FunctionCode: r.FunctionCode, Data: response}
+	})
+	records, err := client.ReadFileRecord([]FileRecord{
+		{FileNumber: 4, RecordNumber: 1, RecordLength: 2},
+		{FileNumber: 3, RecordNumber: 9, RecordLength: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x0E, 0x06, 0x00, 0x04, 0x00, 0x01, 0x00, 0x02, 0x06, 0x00, 0x03, 0x00, 0x09, 0x00, 0x02}
+	if !bytes.Equal(expected, request) {
+		t.Fatalf("request: expected % x, actual % x", expected, request)
+	}
+	if len(records) != 2 || records[0].FileNumber != 4 || records[1].RecordNumber != 9 {
+		t.Fatalf("records: unexpected %+v", records)
+	}
+	if !bytes.Equal(records[0].Data, []byte{0x0D, 0xFE, 0x00, 0x20}) || !bytes.Equal(records[1].Data, []byte{0x33, 0xCD, 0x00, 0x40}) {
+		t.Fatalf("record data: unexpected % x, % x", records[0].Data, records[1].Data)
+	}
+
+	// Wrong reference type, record length and byte count
+	for _, data := range [][]byte{
+		{0x0C, 0x05, 0x07, 0x0D, 0xFE, 0x00, 0x20, 0x05, 0x06, 0x33, 0xCD, 0x00, 0x40},
+		{0x0C, 0x03, 0x06, 0x0D, 0xFE, 0x05, 0x06, 0x33, 0xCD, 0x00, 0x40, 0x00, 0x00},
+		{0x0D, 0x05, 0x06, 0x0D, 0xFE, 0x00, 0x20, 0x05, 0x06, 0x33, 0xCD, 0x00, 0x40},
+		{0x06, 0x05, 0x06, 0x0D, 0xFE, 0x00, 0x20},
+	} {
+		response = data
+		if _, err = client.ReadFileRecord([]FileRecord{
+			{FileNumber: 4, RecordNumber: 1, RecordLength: 2},
+			{FileNumber: 3, RecordNumber: 9, RecordLength: 2},
+		}); err == nil {
+			t.Errorf("% x: expected error", data)
+		}
+	}
+	// Invalid requests
+	for _, records := range [][]FileRecord{
+		nil,
+		{{FileNumber: 0, RecordLength: 1}},
+		{{FileNumber: 1, RecordNumber: 10000, RecordLength: 1}},
+		{{FileNumber: 1, RecordLength: 0}},
+		{{FileNumber: 1, RecordLength: 200}},
+	} {
+		if _, err = client.ReadFileRecord(records); err == nil {
+			t.Errorf("%+v: expected error", records)
+		}
+	}
+}
+
+func TestWriteFileRecord(t *testing.T) {
+	var request []byte
+	echo := true
+	client := newPDUClient(func(r *ProtocolDataUnit) *ProtocolDataUnit {
+		request = r.Data
+		data := append([]byte(nil), r.Data...)
+		if !echo {
+			data[len(data)-1]++
+		}
+		return &ProtocolDataUnit{FunctionCode: r.FunctionCode, Data: data}
+	})
+	err := client.WriteFileRecord([]FileRecord{
+		{FileNumber: 4, RecordNumber: 7, Data: []byte{0x06, 0xAF, 0x04, 0xBE, 0x10, 0x0D}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x0D, 0x06, 0x00, 0x04, 0x00, 0x07, 0x00, 0x03, 0x06, 0xAF, 0x04, 0xBE, 0x10, 0x0D}
+	if !bytes.Equal(expected, request) {
+		t.Fatalf("request: expected % x, actual % x", expected, request)
+	}
+	echo = false
+	if err = client.WriteFileRecord([]FileRecord{{FileNumber: 4, Data: []byte{0, 1}}}); err == nil {
+		t.Fatal("expected error for response not echoing the request")
+	}
+	if err = client.WriteFileRecord([]FileRecord{{FileNumber: 4, Data: []byte{0}}}); err == nil {
+		t.Fatal("expected error for odd record data size")
+	}
+}
+
+func TestQuantityBounds(t *testing.T) {
+	dryRun := &DryRunTransporter{}
+	handler := NewRTUClientHandler("/dev/null")
+	client := NewClient2(handler, dryRun)
+	typed := NewTypedClient(client)
+	tests := []struct {
+		name     string
+		min, max int
+		fn       func(quantity int) error
+	}{
+		{"ReadCoils", 1, 2000, func(n int) error { _, err := client.ReadCoils(0, uint16(n)); return err }},
+		{"ReadDiscreteInputs", 1, 2000, func(n int) error { _, err := client.ReadDiscreteInputs(0, uint16(n)); return err }},
+		{"ReadHoldingRegisters", 1, 125, func(n int) error { _, err := client.ReadHoldingRegisters(0, uint16(n)); return err }},
+		{"ReadInputRegisters", 1, 125, func(n int) error { _, err := client.ReadInputRegisters(0, uint16(n)); return err }},
+		{"WriteMultipleCoils", 1, 1968, func(n int) error {
+			_, err := client.WriteMultipleCoils(0, uint16(n), make([]byte, (n+7)/8))
+			return err
+		}},
+		{"WriteMultipleRegisters", 1, 123, func(n int) error {
+			_, err := client.WriteMultipleRegisters(0, uint16(n), make([]byte, 2*n))
+			return err
+		}},
+		{"ReadWriteMultipleRegisters read", 1, 125, func(n int) error {
+			_, err := client.ReadWriteMultipleRegisters(0, uint16(n), 0, 1, make([]byte, 2))
+			return err
+		}},
+		{"ReadWriteMultipleRegisters write", 1, 121, func(n int) error {
+			_, err := client.ReadWriteMultipleRegisters(0, 1, 0, uint16(n), make([]byte, 2*n))
+			return err
+		}},
+		{"WriteMultipleCoilsBool", 1, 1968, func(n int) error { return typed.WriteMultipleCoilsBool(0, make([]bool, n)) }},
+		{"WriteMultipleRegistersFromUint16", 1, 123, func(n int) error {
+			return typed.WriteMultipleRegistersFromUint16(0, make([]uint16, n))
+		}},
+	}
+	for _, test := range tests {
+		for _, n := range []int{test.min - 1, test.max + 1} {
+			dryRun.Reset()
+			err := test.fn(n)
+			var quantityError *QuantityError
+			if !errors.Is(err, ErrInvalidQuantity) || !errors.As(err, &quantityError) || quantityError.Quantity != n {
+				t.Errorf("%v(%v): expected %v, actual %v", test.name, n, ErrInvalidQuantity, err)
+			}
+			if len(dryRun.Frames()) != 0 {
+				t.Errorf("%v(%v): request sent", test.name, n)
+			}
+		}
+		for _, n := range []int{test.min, test.max} {
+			if err := test.fn(n); !errors.Is(err, ErrDryRun) {
+				t.Errorf("%v(%v): expected %v, actual %v", test.name, n, ErrDryRun, err)
+			}
+		}
+	}
+}
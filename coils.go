@@ -0,0 +1,259 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"fmt"
+)
+
+// Coil values of WriteSingleCoil
+const (
+	CoilOn  uint16 = 0xFF00
+	CoilOff uint16 = 0x0000
+)
+
+const (
+	// Maximum number of coils in one write, packed in 246 bytes
+	maxWriteCoils = 1968
+)
+
+// PackCoils packs the coil states in bytes, the first coil in the least
+// significant bit of the first byte. Unused bits of the last byte are zero.
+func PackCoils(values []bool) []byte {
+	data := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			data[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return data
+}
+
+// UnpackCoils returns the states of the first quantity coils packed in data,
+// at most 8 per byte of data.
+func UnpackCoils(data []byte, quantity int) []bool {
+	if quantity > len(data)*8 {
+		quantity = len(data) * 8
+	}
+	values := make([]bool, quantity)
+	for i := range values {
+		values[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+	return values
+}
+
+// Bitset holds coil states packed as by PackCoils, e.g. the results of
+// ReadCoils, without a bool per coil. Its length is the number of coils, not
+// rounded up to bytes.
+type Bitset struct {
+	data   []byte
+	length int
+}
+
+// NewBitset returns a Bitset of the first length coils packed in data, at
+// most 8 per byte of data. It shares data.
+func NewBitset(data []byte, length int) Bitset {
+	if length > len(data)*8 {
+		length = len(data) * 8
+	}
+	if length < 0 {
+		length = 0
+	}
+	return Bitset{data: data, length: length}
+}
+
+// MakeBitset returns a Bitset of length coils, all off.
+func MakeBitset(length int) Bitset {
+	return Bitset{data: make([]byte, (length+7)/8), length: length}
+}
+
+// Len returns the number of coils.
+func (b Bitset) Len() int {
+	return b.length
+}
+
+// Get returns the state of coil i. It panics if i is out of range.
+func (b Bitset) Get(i int) bool {
+	b.check(i)
+	return b.data[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Set sets the state of coil i. It panics if i is out of range.
+func (b Bitset) Set(i int, value bool) {
+	b.check(i)
+	if value {
+		b.data[i/8] |= 1 << uint(i%8)
+	} else {
+		b.data[i/8] &^= 1 << uint(i%8)
+	}
+}
+
+// Bytes returns the packed coils, e.g. for WriteMultipleCoils.
+func (b Bitset) Bytes() []byte {
+	return b.data[:(b.length+7)/8]
+}
+
+// Bools returns the coil states as bool.
+func (b Bitset) Bools() []bool {
+	return UnpackCoils(b.data, b.length)
+}
+
+func (b Bitset) check(i int) {
+	if i < 0 || i >= b.length {
+		panic(fmt.Sprintf("modbus: bit index %v out of range [0:%v]", i, b.length))
+	}
+}
+
+// ReadCoilsBool reads quantity coils starting at address.
+func (mb *TypedClient) ReadCoilsBool(address, quantity uint16) (values []bool, err error) {
+	data, err := mb.ReadCoils(address, quantity)
+	if err != nil {
+		return
+	}
+	return unpackResponseCoils(data, quantity)
+}
+
+// ReadDiscreteInputsBool reads quantity discrete inputs starting at address.
+func (mb *TypedClient) ReadDiscreteInputsBool(address, quantity uint16) (values []bool, err error) {
+	data, err := mb.ReadDiscreteInputs(address, quantity)
+	if err != nil {
+		return
+	}
+	return unpackResponseCoils(data, quantity)
+}
+
+// ReadCoilsBitset reads quantity coils starting at address.
+func (mb *TypedClient) ReadCoilsBitset(address, quantity uint16) (values Bitset, err error) {
+	data, err := mb.ReadCoils(address, quantity)
+	if err != nil {
+		return
+	}
+	if err = checkResponseCoils(data, quantity); err != nil {
+		return
+	}
+	values = NewBitset(data, int(quantity))
+	return
+}
+
+// ReadDiscreteInputsBitset reads quantity discrete inputs starting at address.
+func (mb *TypedClient) ReadDiscreteInputsBitset(address, quantity uint16) (values Bitset, err error) {
+	data, err := mb.ReadDiscreteInputs(address, quantity)
+	if err != nil {
+		return
+	}
+	if err = checkResponseCoils(data, quantity); err != nil {
+		return
+	}
+	values = NewBitset(data, int(quantity))
+	return
+}
+
+// WriteSingleCoilBool turns the coil at address on or off.
+func (mb *TypedClient) WriteSingleCoilBool(address uint16, value bool) (err error) {
+	state := CoilOff
+	if value {
+		state = CoilOn
+	}
+	_, err = mb.WriteSingleCoil(address, state)
+	return
+}
+
+// WriteMultipleCoilsBool writes the coil states starting at address, the
+// quantity being the number of values.
+func (mb *TypedClient) WriteMultipleCoilsBool(address uint16, values []bool) (err error) {
+	if len(values) < 1 {
+		err = &QuantityError{FunctionCode: FuncCodeWriteMultipleCoils, Field: "quantity", Quantity: len(values), Min: 1, Max: maxWriteCoils}
+		return
+	}
+	if len(values) > maxWriteCoils {
+		err = fmt.Errorf("%w, packed in '%v' bytes over the limit of '%v' bytes",
+			&QuantityError{FunctionCode: FuncCodeWriteMultipleCoils, Field: "quantity", Quantity: len(values), Min: 1, Max: maxWriteCoils},
+			(len(values)+7)/8, maxWriteCoils/8)
+		return
+	}
+	_, err = mb.WriteMultipleCoils(address, uint16(len(values)), PackCoils(values))
+	return
+}
+
+// WriteCoilsMask writes the low count bits of mask, up to 16, to the coils
+// starting at address, bit 0 to the coil at address.
+func (mb *TypedClient) WriteCoilsMask(address uint16, count int, mask uint16) (err error) {
+	if count < 1 || count > 16 {
+		err = &QuantityError{FunctionCode: FuncCodeWriteMultipleCoils, Field: "count", Quantity: count, Min: 1, Max: 16}
+		return
+	}
+	mask &= uint16(1<<uint(count) - 1)
+	data := []byte{byte(mask), byte(mask >> 8)}
+	_, err = mb.WriteMultipleCoils(address, uint16(count), data[:(count+7)/8])
+	return
+}
+
+// WriteCoilsMaskVerified is like WriteCoilsMask but reads the coils back
+// once written. An *EchoError is returned if they do not match mask, e.g.
+// coils forced by the device.
+func (mb *TypedClient) WriteCoilsMaskVerified(address uint16, count int, mask uint16) (err error) {
+	if err = mb.WriteCoilsMask(address, count, mask); err != nil {
+		return
+	}
+	results, err := mb.ReadCoils(address, uint16(count))
+	if err != nil {
+		return
+	}
+	if err = checkResponseCoils(results, uint16(count)); err != nil {
+		return
+	}
+	actual := uint16(results[0])
+	if len(results) > 1 {
+		actual |= uint16(results[1]) << 8
+	}
+	// Bits beyond count are padding
+	bits := uint16(1<<uint(count) - 1)
+	if mask, actual = mask&bits, actual&bits; actual != mask {
+		err = &EchoError{FunctionCode: FuncCodeReadCoils, Field: "coils", Request: mask, Response: actual}
+	}
+	return
+}
+
+// WriteMultipleCoilsBoolVerified is like WriteMultipleCoilsBool but reads
+// the coils back once written. A *CoilMismatchError listing the coils not
+// holding their value is returned if they do not match, e.g. writes dropped
+// by the device.
+func (mb *TypedClient) WriteMultipleCoilsBoolVerified(address uint16, values []bool) (err error) {
+	if err = mb.WriteMultipleCoilsBool(address, values); err != nil {
+		return
+	}
+	// Padding bits of the last byte read are not compared
+	actual, err := mb.ReadCoilsBool(address, uint16(len(values)))
+	if err != nil {
+		return
+	}
+	var indices []int
+	for i, value := range values {
+		if actual[i] != value {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) > 0 {
+		err = &CoilMismatchError{Address: address, Indices: indices}
+	}
+	return
+}
+
+// unpackResponseCoils ensures the response holds all requested bits.
+func unpackResponseCoils(data []byte, quantity uint16) (values []bool, err error) {
+	if err = checkResponseCoils(data, quantity); err != nil {
+		return
+	}
+	values = UnpackCoils(data, int(quantity))
+	return
+}
+
+// checkResponseCoils checks the size of a response of quantity bits.
+func checkResponseCoils(data []byte, quantity uint16) error {
+	if expected := (int(quantity) + 7) / 8; len(data) != expected {
+		return fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), expected)
+	}
+	return nil
+}
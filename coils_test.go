@@ -0,0 +1,249 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var coilsTests = []struct {
+	values []bool
+	data   []byte
+}{
+	{[]bool{}, []byte{}},
+	{[]bool{true}, []byte{0x01}},
+	{[]bool{false, false, true, false, false, false, false, false}, []byte{0x04}},
+	// 10 coils, see WriteMultipleCoils(5, 10, []byte{4, 3})
+	{[]bool{false, false, true, false, false, false, false, false, true, true}, []byte{0x04, 0x03}},
+	// Coils 20-38 of the specification example
+	{[]bool{true, false, true, true, false, false, true, true, true, true, false, true, false, true, true, false, true, false, true}, []byte{0xCD, 0x6B, 0x05}},
+}
+
+func TestPackCoils(t *testing.T) {
+	for _, input := range coilsTests {
+		data := PackCoils(input.values)
+		if !bytes.Equal(input.data, data) {
+			t.Errorf("%v: expected % x, actual % x", input.values, input.data, data)
+		}
+		values := UnpackCoils(input.data, len(input.values))
+		if fmt.Sprint(input.values) != fmt.Sprint(values) {
+			t.Errorf("% x: expected %v, actual %v", input.data, input.values, values)
+		}
+	}
+	if values := UnpackCoils([]byte{0xFF}, 10); len(values) != 8 {
+		t.Fatalf("unpacked coils must be limited to data: %v", values)
+	}
+}
+
+func TestTypedClientCoils(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	store.SetDiscreteInput(3, true)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewTypedClient(NewClient(handler))
+
+	values := []bool{true, false, true, true, false, false, true, true, true, false, true}
+	if err := client.WriteMultipleCoilsBool(20, values); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if store.Coil(uint16(20+i)) != v {
+			t.Fatalf("coil %v: expected %v", 20+i, v)
+		}
+	}
+	if err := client.WriteSingleCoilBool(21, true); err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.ReadCoilsBool(20, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values[1] = true
+	if fmt.Sprint(values) != fmt.Sprint(results) {
+		t.Fatalf("coils: expected %v, actual %v", values, results)
+	}
+	inputs, err := client.ReadDiscreteInputsBool(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint([]bool{false, false, false, true}) != fmt.Sprint(inputs) {
+		t.Fatalf("discrete inputs: unexpected %v", inputs)
+	}
+	if err = client.WriteMultipleCoilsBool(0, nil); err == nil {
+		t.Fatal("expected error for empty coils")
+	}
+	if err = client.WriteMultipleCoilsBool(0, make([]bool, maxWriteCoils)); err != nil {
+		t.Fatal(err)
+	}
+	err = client.WriteMultipleCoilsBool(0, make([]bool, maxWriteCoils+1))
+	if err == nil || !strings.Contains(err.Error(), "'247' bytes") {
+		t.Fatalf("expected error for byte count, actual %v", err)
+	}
+}
+
+func TestBitset(t *testing.T) {
+	for _, input := range coilsTests {
+		b := NewBitset(input.data, len(input.values))
+		if b.Len() != len(input.values) {
+			t.Fatalf("% x: expected length %v, actual %v", input.data, len(input.values), b.Len())
+		}
+		for i, v := range input.values {
+			if b.Get(i) != v {
+				t.Fatalf("% x: bit %v expected %v", input.data, i, v)
+			}
+		}
+		if fmt.Sprint(input.values) != fmt.Sprint(b.Bools()) {
+			t.Fatalf("% x: expected %v, actual %v", input.data, input.values, b.Bools())
+		}
+	}
+	b := MakeBitset(10)
+	b.Set(2, true)
+	b.Set(8, true)
+	b.Set(9, true)
+	b.Set(9, false)
+	if expected := []byte{0x04, 0x01}; !bytes.Equal(expected, b.Bytes()) {
+		t.Fatalf("bytes: expected % x, actual % x", expected, b.Bytes())
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for bit out of length")
+		}
+	}()
+	// Within the last byte but not the requested quantity
+	b.Get(10)
+}
+
+func TestTypedClientBitset(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	store.SetCoil(12, true)
+	store.SetDiscreteInput(1000, true)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewTypedClient(NewClient(handler))
+
+	coils, err := client.ReadCoilsBitset(10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coils.Len() != 3 || coils.Get(1) || !coils.Get(2) {
+		t.Fatalf("coils: unexpected %v", coils.Bools())
+	}
+	inputs, err := client.ReadDiscreteInputsBitset(0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inputs.Len() != 2000 || !inputs.Get(1000) || inputs.Get(999) {
+		t.Fatalf("discrete inputs: unexpected length %v", inputs.Len())
+	}
+}
+
+func TestTypedClientWriteCoilsMask(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewTypedClient(NewClient(handler))
+
+	// Bits beyond count are not written
+	if err := client.WriteCoilsMask(10, 12, 0xFA35); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 13; i++ {
+		if expected := i < 12 && 0xFA35&(1<<uint(i)) != 0; store.Coil(uint16(10+i)) != expected {
+			t.Fatalf("coil %v: expected %v", 10+i, expected)
+		}
+	}
+	if err := client.WriteCoilsMaskVerified(0, 9, 0x0101); err != nil {
+		t.Fatal(err)
+	}
+	for _, count := range []int{0, 17} {
+		if err := client.WriteCoilsMask(0, count, 0); err == nil {
+			t.Errorf("count %v: expected error", count)
+		}
+	}
+
+	// Coil 1 forced on by the device
+	server.RegisterFunctionHandler(FuncCodeReadCoils, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{1, 0x03}}, nil
+	})
+	err := client.WriteCoilsMaskVerified(0, 4, 0x0001)
+	var echoError *EchoError
+	if !errors.As(err, &echoError) || echoError.Request != 0x0001 || echoError.Response != 0x0003 {
+		t.Fatalf("expected echo error, actual %v", err)
+	}
+}
+
+func TestTypedClientWriteMultipleCoilsBoolVerified(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewTypedClient(NewClient(handler))
+
+	values := make([]bool, maxWriteCoils)
+	for i := range values {
+		values[i] = i%3 == 0
+	}
+	if err := client.WriteMultipleCoilsBoolVerified(5, values); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Coil(5) || store.Coil(6) || !store.Coil(5+1965) || store.Coil(5+1967) {
+		t.Fatal("coils: unexpected values written")
+	}
+
+	// The relay board acknowledges the write but drops it, coils 5 to 10
+	// keeping on, off, off, on, off, off
+	server.RegisterFunctionHandler(FuncCodeWriteMultipleCoils, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data[:4]}, nil
+	})
+	err := client.WriteMultipleCoilsBoolVerified(5, []bool{false, false, false, true, false, true})
+	var mismatch *CoilMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Address != 5 || !reflect.DeepEqual(mismatch.Indices, []int{0, 5}) {
+		t.Fatalf("expected mismatch of coils 0 and 5, actual %v", err)
+	}
+
+	// Padding bits of the read set by the device
+	server.RegisterFunctionHandler(FuncCodeReadCoils, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{2, 0xFF, 0xFF}}, nil
+	})
+	if err = client.WriteMultipleCoilsBoolVerified(0, []bool{true, true, true, true, true, true, true, true, true, true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteSingleCoilValue(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	if _, err := client.WriteSingleCoil(3, 0x0001); err == nil {
+		t.Fatal("expected error for coil value")
+	}
+	if store.Coil(3) {
+		t.Fatal("coil 3: expected off")
+	}
+	if _, err := client.WriteSingleCoil(3, CoilOn); err != nil || !store.Coil(3) {
+		t.Fatalf("coil 3: expected on, error %v", err)
+	}
+
+	// Device echoing a value other than ON or OFF
+	server.RegisterFunctionHandler(FuncCodeWriteSingleCoil, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{0, 3, 0x00, 0x01}}, nil
+	})
+	_, err := client.WriteSingleCoil(3, CoilOff)
+	var echoError *EchoError
+	if !errors.As(err, &echoError) || echoError.Field != "value" || echoError.Response != 0x0001 {
+		t.Fatalf("expected echo error, actual %v", err)
+	}
+}
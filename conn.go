@@ -0,0 +1,288 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// readBufferSize is the size of the pooled buffers responses are read into,
+// that of the largest frame by default.
+const readBufferSize = asciiMaxSize
+
+type readBuffer [readBufferSize]byte
+
+var readBufferPool = sync.Pool{
+	New: func() interface{} { return new(readBuffer) },
+}
+
+// getReadBuffer returns a buffer of size bytes to read a response into,
+// taken from a pool if it fits. It must be released by putReadBuffer and
+// the response copied out of it.
+func getReadBuffer(size int) []byte {
+	if size > readBufferSize {
+		return make([]byte, size)
+	}
+	return readBufferPool.Get().(*readBuffer)[:size]
+}
+
+// putReadBuffer releases a buffer returned by getReadBuffer.
+func putReadBuffer(buf []byte) {
+	if cap(buf) == readBufferSize {
+		readBufferPool.Put((*readBuffer)(buf[:readBufferSize]))
+	}
+}
+
+// aLongTimeAgo is a deadline in the past used to unblock pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+const (
+	// drainTimeout is how long drain waits for pending data. A deadline in
+	// the past would fail the read before consuming any buffered data.
+	drainTimeout = time.Millisecond
+	// drainMaxSize bounds the data discarded by drain
+	drainMaxSize = 4096
+)
+
+// ConnState is the state of the connection of a transporter.
+type ConnState int
+
+const (
+	// StateClosed is not connected
+	StateClosed ConnState = iota
+	// StateConnected is connected with a request in progress or sent
+	// within the last Timeout
+	StateConnected
+	// StateIdle is connected without any request within the last Timeout
+	StateIdle
+)
+
+// String returns the state name.
+func (s ConnState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateConnected:
+		return "connected"
+	case StateIdle:
+		return "idle"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// connState returns the state of a connection whose last request started at
+// lastActivity.
+func connState(connected bool, lastActivity time.Time, timeout time.Duration) ConnState {
+	if !connected {
+		return StateClosed
+	}
+	if timeout > 0 && time.Since(lastActivity) > timeout {
+		return StateIdle
+	}
+	return StateConnected
+}
+
+// requestDeadline returns the earlier of the context deadline and now+timeout.
+// A zero time means no deadline.
+func requestDeadline(ctx context.Context, now time.Time, timeout time.Duration) (deadline time.Time) {
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return
+}
+
+// setFunctionTimeout sets or, if timeout is 0, removes the timeout override
+// of the function code in timeouts, which is allocated if nil.
+func setFunctionTimeout(timeouts map[byte]time.Duration, functionCode byte, timeout time.Duration) map[byte]time.Duration {
+	if timeout <= 0 {
+		delete(timeouts, functionCode)
+		return timeouts
+	}
+	if timeouts == nil {
+		timeouts = make(map[byte]time.Duration)
+	}
+	timeouts[functionCode] = timeout
+	return timeouts
+}
+
+// functionTimeout returns the timeout override of the function code, or def
+// if there is none.
+func functionTimeout(timeouts map[byte]time.Duration, functionCode byte, def time.Duration) time.Duration {
+	if timeout, ok := timeouts[functionCode]; ok {
+		return timeout
+	}
+	return def
+}
+
+// waitInterRequestDelay waits until delay has passed since the end of the
+// previous request, or ctx is done.
+func waitInterRequestDelay(ctx context.Context, requestEnd time.Time, delay time.Duration) error {
+	if delay <= 0 || requestEnd.IsZero() {
+		return nil
+	}
+	return sleepContext(ctx, delay-time.Since(requestEnd))
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wrapTimeout wraps err in a timeoutError if it is a timeout of a network
+// connection or a serial port. Errors of a context are returned as is.
+func wrapTimeout(err error) error {
+	if err == nil || err == context.DeadlineExceeded || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	var netError net.Error
+	if (errors.As(err, &netError) && netError.Timeout()) || errors.Is(err, serial.ErrTimeout) {
+		return &timeoutError{err}
+	}
+	return err
+}
+
+// contextErr returns the error of ctx, which is context.DeadlineExceeded once
+// its deadline has passed even if ctx has not been marked done yet.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// watchContext interrupts blocking I/O on conn once ctx is done. The returned
+// function stops watching and reports whether the I/O has been interrupted.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// sendWithCancel sends a request with send, aborted once done is closed. It
+// then closes the connection with closeConn, the stream being left in an
+// unknown state, and returns ErrCancelled.
+func sendWithCancel(done <-chan struct{}, send func(ctx context.Context) ([]byte, error), closeConn func()) (aduResponse []byte, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	aduResponse, err = send(ctx)
+	if err != nil {
+		select {
+		case <-done:
+			closeConn()
+			return nil, ErrCancelled
+		default:
+		}
+	}
+	return
+}
+
+// maxADULength returns the configured maximum frame length, or def if not
+// configured. It must not be less than min.
+func maxADULength(configured, def, min int) (int, error) {
+	if configured == 0 {
+		return def, nil
+	}
+	if configured < min {
+		return 0, fmt.Errorf("modbus: max ADU length '%v' must be at least '%v'", configured, min)
+	}
+	return configured, nil
+}
+
+// writeFull writes all of b to w, retrying short writes as some connection
+// wrappers return a short count without error.
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// drain discards the data already available in conn without waiting for
+// more, and returns the number of bytes discarded. The read deadline of conn
+// is left in the past.
+func drain(conn net.Conn) (n int, err error) {
+	var b [256]byte
+	for n < drainMaxSize {
+		if err = conn.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+			return
+		}
+		var n1 int
+		n1, err = conn.Read(b[:])
+		n += n1
+		if err != nil {
+			if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				err = nil
+			}
+			return
+		}
+	}
+	return
+}
+
+// isConnectionClosed reports whether err indicates the peer or the local end
+// has closed the connection, as opposed to a timeout or a framing error.
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"time"
+)
+
+// Config configures a Device.
+type Config struct {
+	// Address of the device, host:port
+	Address string
+	SlaveId byte
+	// Connect & Read timeout, 10 seconds if not set
+	Timeout time.Duration
+	// Layout of multi-register values, BigEndian by default
+	WordOrder WordOrder
+	// Transmission logger
+	Logger Logger
+}
+
+// Device bundles the handler and client of a Modbus TCP device with the
+// typed helpers of TypedClient. Handler remains accessible for the settings
+// not in Config.
+type Device struct {
+	*TypedClient
+	Handler *TCPClientHandler
+}
+
+// NewDevice creates a Device as configured. It connects on the first request
+// or on Connect.
+func NewDevice(config Config) *Device {
+	handler := NewTCPClientHandler(config.Address)
+	handler.SlaveId = config.SlaveId
+	if config.Timeout > 0 {
+		handler.Timeout = config.Timeout
+	}
+	handler.Logger = config.Logger
+	typed := NewTypedClient(NewClient(handler))
+	typed.Order = config.WordOrder
+	return &Device{TypedClient: typed, Handler: handler}
+}
+
+// Connect establishes the connection to the device.
+func (d *Device) Connect() error {
+	return d.Handler.Connect()
+}
+
+// Close closes the connection to the device. Requests fail with ErrClosed
+// until Connect.
+func (d *Device) Close() error {
+	return d.Handler.Close()
+}
+
+// RegisterMap creates a RegisterMap of the given points read and written
+// through the device.
+func (d *Device) RegisterMap(points ...Point) (*RegisterMap, error) {
+	return NewRegisterMap(d.Client, points...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTCP serves the requests of a Modbus TCP connection by server.
+func serveTCP(conn net.Conn, server *Server) {
+	defer conn.Close()
+	header := make([]byte, tcpHeaderSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		response := server.HandleRequest(header[6], &ProtocolDataUnit{FunctionCode: pdu[0], Data: pdu[1:]})
+		adu := append(append([]byte(nil), header...), response.FunctionCode)
+		adu = append(adu, response.Data...)
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(adu)-tcpHeaderSize+1))
+		if _, err := conn.Write(adu); err != nil {
+			return
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	server := NewServer()
+	store := server.AddSlave(5)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		serveTCP(conn, server)
+	}()
+
+	device := NewDevice(Config{
+		Address:   ln.Addr().String(),
+		SlaveId:   5,
+		Timeout:   time.Second,
+		WordOrder: LittleEndianSwap,
+	})
+	if device.Handler.Timeout != time.Second {
+		t.Fatalf("timeout: expected %v, actual %v", time.Second, device.Handler.Timeout)
+	}
+	if err = device.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+
+	if err = device.WriteFloat32(10, 1.5); err != nil {
+		t.Fatal(err)
+	}
+	// 0x3FC00000 with swapped words
+	if hi, lo := store.HoldingRegister(10), store.HoldingRegister(11); hi != 0x0000 || lo != 0x3FC0 {
+		t.Fatalf("registers: expected 0000 3fc0, actual %04x %04x", hi, lo)
+	}
+	rm, err := device.RegisterMap(Point{Name: "Status", Address: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := rm.ReadUint16("Status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0x3FC0 {
+		t.Fatalf("status: expected %04x, actual %04x", 0x3FC0, status)
+	}
+}
+
+func TestDeviceDefaults(t *testing.T) {
+	device := NewDevice(Config{Address: "localhost:502"})
+	if device.Handler.Timeout != tcpTimeout {
+		t.Fatalf("timeout: expected %v, actual %v", tcpTimeout, device.Handler.Timeout)
+	}
+	if device.Order != BigEndian {
+		t.Fatalf("word order: expected %v, actual %v", BigEndian, device.Order)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDryRun is returned by the requests sent through a DryRunTransporter.
+var ErrDryRun = errors.New("modbus: dry run, request not sent")
+
+// EncodeRequest returns the frame of the request to the slave as encoded by
+// the packager, e.g. a handler, without sending it. The packager must
+// implement SlavePackager unless slaveId is its default slave. A TCP
+// handler uses a transaction id like for a sent request.
+func EncodeRequest(packager Packager, slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error) {
+	if p, ok := packager.(SlavePackager); ok {
+		return p.EncodeSlave(slaveId, pdu)
+	}
+	if p, ok := packager.(defaultSlavePackager); !ok || p.defaultSlaveId() != slaveId {
+		err = fmt.Errorf("modbus: packager does not support per-request slave id")
+		return
+	}
+	return packager.Encode(pdu)
+}
+
+// DryRunTransporter records the frames of the requests instead of sending
+// them, e.g. for golden-file tests of the frames of the client functions:
+//  dryRun := &modbus.DryRunTransporter{}
+//  client := modbus.NewClient2(modbus.NewRTUClientHandler("/dev/ttyUSB0"), dryRun)
+//  client.ReadHoldingRegisters(0, 2) // fails with ErrDryRun
+//  frames := dryRun.Frames()
+type DryRunTransporter struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+// Send records the request and returns ErrDryRun.
+func (mb *DryRunTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	mb.record(aduRequest)
+	err = ErrDryRun
+	return
+}
+
+// SendNoResponse records the request and returns nil as if it was written.
+func (mb *DryRunTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	mb.record(aduRequest)
+	return
+}
+
+// Frames returns the recorded frames in the order of the requests.
+func (mb *DryRunTransporter) Frames() [][]byte {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return append([][]byte(nil), mb.frames...)
+}
+
+// Reset discards the recorded frames.
+func (mb *DryRunTransporter) Reset() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.frames = nil
+}
+
+func (mb *DryRunTransporter) record(aduRequest []byte) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.frames = append(mb.frames, append([]byte(nil), aduRequest...))
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncodeRequest(t *testing.T) {
+	pdu := &ProtocolDataUnit{FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{0, 0, 0, 1}}
+	adu, err := EncodeRequest(NewRTUClientHandler("/dev/null"), 1, pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}; !bytes.Equal(expected, adu) {
+		t.Fatalf("adu: expected % x, actual % x", expected, adu)
+	}
+	handler := NewTCPClientHandler("localhost:502")
+	handler.SetTransactionId(7)
+	adu, err = EncodeRequest(handler, 5, pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 7, 0, 0, 0, 6, 5, 3, 0, 0, 0, 1}; !bytes.Equal(expected, adu) {
+		t.Fatalf("adu: expected % x, actual % x", expected, adu)
+	}
+}
+
+func TestDryRunTransporter(t *testing.T) {
+	dryRun := &DryRunTransporter{}
+	handler := NewRTUClientHandler("/dev/null")
+	handler.SlaveId = 1
+	client := NewClient2(handler, dryRun)
+	if _, err := client.ReadHoldingRegisters(0, 1); !errors.Is(err, ErrDryRun) {
+		t.Fatalf("expected ErrDryRun, actual %v", err)
+	}
+	if err := client.SendNoResponse(&ProtocolDataUnit{FunctionCode: 0x42, Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	frames := dryRun.Frames()
+	if len(frames) != 2 {
+		t.Fatalf("frames: expected 2, actual %v", len(frames))
+	}
+	if expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}; !bytes.Equal(expected, frames[0]) {
+		t.Fatalf("frame: expected % x, actual % x", expected, frames[0])
+	}
+	if frames[1][0] != 1 || frames[1][1] != 0x42 {
+		t.Fatalf("frame: unexpected % x", frames[1])
+	}
+	dryRun.Reset()
+	if frames = dryRun.Frames(); len(frames) != 0 {
+		t.Fatalf("frames: expected none, actual %v", len(frames))
+	}
+}
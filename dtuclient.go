@@ -5,6 +5,9 @@
 package modbus
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -17,6 +20,10 @@ const (
 	dtuMaxSize = 256
 
 	dtuExceptionSize = 5
+
+	dtuIdleTimeout = 60 * time.Second
+
+	dtuMaxReconnectBackoff = time.Minute
 )
 
 // DTUClientHandler implements Packager and Transporter interface.
@@ -30,9 +37,34 @@ func NewDTUClientHandler(conn net.Conn) *DTUClientHandler {
 	handler := &DTUClientHandler{}
 	handler.conn = conn
 	handler.Timeout = tcpTimeout
+	handler.keepAliveClient = NewClient(handler)
 	return handler
 }
 
+// NewDTUClientHandlerContext allocates a DTUClientHandler connected to address
+// with dialer, a dialer with the default timeout if nil. The connection is
+// aborted if ctx is done first. Reconnect dials address with dialer too, or
+// without dialer with the connect timeout of the handler.
+func NewDTUClientHandlerContext(ctx context.Context, address string, dialer *net.Dialer) (*DTUClientHandler, error) {
+	initial := dialer
+	if initial == nil {
+		initial = &net.Dialer{Timeout: tcpTimeout}
+	}
+	conn, err := initial.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	handler := NewDTUClientHandler(conn)
+	handler.Reconnect = func() (net.Conn, error) {
+		if dialer != nil {
+			return dialer.Dial("tcp", address)
+		}
+		// Called holding the mutex
+		return net.DialTimeout("tcp", address, handler.connectTimeout())
+	}
+	return handler, nil
+}
+
 // DTUClient creates RTU client with default handler and given connect string.
 func DTUClient(conn net.Conn) Client {
 	handler := NewDTUClientHandler(conn)
@@ -41,7 +73,26 @@ func DTUClient(conn net.Conn) Client {
 
 // dtuPackager implements Packager interface.
 type dtuPackager struct {
+	// Default slave of the requests. Unlike SetSlaveId, setting it is not
+	// safe while requests are made from other goroutines.
 	SlaveId byte
+
+	// Guards SlaveId set by SetSlaveId
+	config sync.RWMutex
+}
+
+// SetSlaveId sets SlaveId, the slave of the requests encoded from then on.
+// It is safe while requests are made from other goroutines.
+func (mb *dtuPackager) SetSlaveId(slaveId byte) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.SlaveId = slaveId
+}
+
+func (mb *dtuPackager) defaultSlaveId() byte {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.SlaveId
 }
 
 // Encode encodes PDU in a RTU frame:
@@ -50,6 +101,11 @@ type dtuPackager struct {
 //  Data            : 0 up to 252 bytes
 //  CRC             : 2 byte
 func (mb *dtuPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
+	return mb.EncodeSlave(mb.defaultSlaveId(), pdu)
+}
+
+// EncodeSlave encodes PDU in a RTU frame addressed to the given slave.
+func (mb *dtuPackager) EncodeSlave(slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error) {
 	length := len(pdu.Data) + 4
 	if length > dtuMaxSize {
 		err = fmt.Errorf("modbus: length of data '%v' must not be bigger than '%v'", length, dtuMaxSize)
@@ -57,7 +113,7 @@ func (mb *dtuPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	}
 	adu = make([]byte, length)
 
-	adu[0] = mb.SlaveId
+	adu[0] = slaveId
 	adu[1] = pdu.FunctionCode
 	copy(adu[2:], pdu.Data)
 
@@ -71,7 +127,7 @@ func (mb *dtuPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	return
 }
 
-// Verify verifies response length and slave id.
+// Verify verifies response length, slave id and function code.
 func (mb *dtuPackager) Verify(aduRequest []byte, aduResponse []byte) (err error) {
 	length := len(aduResponse)
 	// Minimum size (including address, function and CRC)
@@ -84,12 +140,17 @@ func (mb *dtuPackager) Verify(aduRequest []byte, aduResponse []byte) (err error)
 		err = fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", aduResponse[0], aduRequest[0])
 		return
 	}
+	err = verifyFunctionCode(aduRequest[1], aduResponse[1])
 	return
 }
 
 // Decode extracts PDU from RTU frame and verify CRC.
 func (mb *dtuPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
 	length := len(adu)
+	if length < dtuMinSize {
+		err = fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", length, dtuMinSize)
+		return
+	}
 	// Calculate checksum
 	var crc crc
 	crc.reset().pushBytes(adu[0 : length-2])
@@ -102,68 +163,609 @@ func (mb *dtuPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
 	pdu = &ProtocolDataUnit{}
 	pdu.FunctionCode = adu[1]
 	pdu.Data = adu[2 : length-2]
+	// Exception response has the error bit set and the exception code only
+	if pdu.FunctionCode&0x80 != 0 {
+		if len(pdu.Data) != 1 {
+			err = fmt.Errorf("modbus: exception response data size '%v' does not match expected '%v'", len(pdu.Data), 1)
+			return
+		}
+		err = responseError(pdu)
+	}
 	return
 }
 
-type logger interface {
-	Printf(format string, v ...interface{})
-}
-
 // dtuTransporter implements Transporter interface.
 type dtuTransporter struct {
-	// Connect & Read timeout
+	// Request timeout, and timeout of the connections dialed by
+	// NewDTUClientHandlerContext if ConnectTimeout is not set
 	Timeout time.Duration
+	// AdaptiveTimeout, if set, replaces Timeout as the timeout of the
+	// requests, estimated from the latency of the previous ones. Timeout
+	// still applies until a latency is observed if its Max is not set, and
+	// the timeouts set by SetTimeout still apply.
+	AdaptiveTimeout *AdaptiveTimeout
+	// ConnectTimeout, if set, is the timeout of the connections dialed by
+	// the Reconnect of NewDTUClientHandlerContext without dialer, in place
+	// of Timeout
+	ConnectTimeout time.Duration
+	// Idle timeout to close the connection, 0 disables it
+	IdleTimeout time.Duration
 	// Transmission logger
-	Logger logger
+	Logger Logger
+	// TraceFrames enables logging of the sent and received frames
+	TraceFrames bool
+	// TraceRequests enables logging of each request decoded, with its
+	// function, fields and response values, e.g. during integration
+	TraceRequests bool
+	// Metrics, if set, observes each request
+	Metrics Metrics
+	// OnRequest, if set, is called with each request frame before it is sent
+	OnRequest func(adu []byte)
+	// OnResponse, if set, is called with the response frame of each request,
+	// nil if none, and the error of the request
+	OnResponse func(adu []byte, err error)
+	// ResponseValidator, if set, is called with each request and its response
+	// frame once read, before the client verifies and decodes the frame with
+	// the Verify and Decode of the packager. It may correct the frame in
+	// place or reject it, the error is returned as a framing error.
+	ResponseValidator func(aduRequest, aduResponse []byte) error
+	// CircuitBreaker, if set, fails the requests to the slaves failing
+	// repeatedly fast, see CircuitBreaker
+	CircuitBreaker *CircuitBreaker
+	// Ping, if set, sends the request of Client.Ping
+	Ping PingFunc
+	// InterRequestDelay, if set, is the minimum time from the end of a
+	// request to the start of the next one, e.g. for slow devices
+	InterRequestDelay time.Duration
 
 	BaudRate int
 
+	// Reconnect, if set, is called to establish a new connection when the
+	// current one is closed or broken. The failed request is then retried.
+	Reconnect func() (net.Conn, error)
+	// Maximum number of reconnect attempts per request, 1 if not set
+	MaxReconnects int
+	// ReconnectBackoff, if set, is the time to wait after a reconnect not
+	// followed by a successful request before the next one, doubled for
+	// each further reconnect up to MaxReconnectBackoff, e.g. for flapping
+	// devices. Requests fail without reconnecting meanwhile and a DTUPool
+	// rejects the connections of its device.
+	ReconnectBackoff time.Duration
+	// Maximum of the reconnect backoff, 1 minute if not set
+	MaxReconnectBackoff time.Duration
+	// OnReconnect, if set, is called holding the lock of the handler with
+	// the number of reconnects since the last successful request and the
+	// error of each reconnect, e.g. to alert on devices never stabilizing.
+	OnReconnect func(reconnects int, err error)
+
+	// RegistrationHandler, if set, receives the registration packet which
+	// the device sends right after connecting. It is read before the first
+	// request on each connection.
+	RegistrationHandler func(packet []byte)
+	// HeartbeatMarker, if set, is the heartbeat packet periodically sent by
+	// the device. Heartbeats are skipped while waiting for a response.
+	HeartbeatMarker []byte
+	// FlushBeforeSend discards stale data of previous requests received on
+	// the connection before sending a new request.
+	FlushBeforeSend bool
+	// BlockingRead makes requests and Receive wait for the frame from the
+	// device without deadline, until their context is done, e.g. for devices
+	// pushing data at any time. Unlike a Timeout of 0, which removes the
+	// deadline of writes too, writes still fail after Timeout.
+	BlockingRead bool
+	// MaxADULength is the maximum length of a response frame, 256 if not set
+	MaxADULength int
+	// KeepAliveInterval, if set, is the period of inactivity after which
+	// KeepAlive is called to keep the connection open, e.g. through carrier
+	// NAT. It starts with the first request or Connect.
+	KeepAliveInterval time.Duration
+	// KeepAlive sends the keep-alive probe, serialized with the other
+	// requests. Client.Ping if not set.
+	KeepAlive func(client Client) error
+
 	// TCP connection
 	mu           sync.Mutex
 	conn         net.Conn
 	closeTimer   *time.Timer
 	lastActivity time.Time
+	// End of the previous request
+	requestEnd time.Time
+	// Keep-alive probes are sent through this client of the handler
+	keepAliveClient Client
+	keepAliveTimer  *time.Timer
+	// Connection the registration packet has been read from
+	registered net.Conn
+	// Timeout overrides per function code
+	timeouts map[byte]time.Duration
+	// Reconnects since the last successful request, and time of the next
+	// one if ReconnectBackoff is set
+	reconnects    int
+	nextReconnect time.Time
+	// Set by Close until Connect
+	closed bool
+	// Guards Timeout and Logger set by SetRequestTimeout and SetLogger
+	config sync.RWMutex
 }
 
 func (mb *dtuTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return mb.SendContext(context.Background(), aduRequest)
+}
+
+// SendWithCancel is like Send but aborts the request once done is closed,
+// e.g. on shutdown, returning ErrCancelled. The connection is closed then as
+// a broken connection, see Reconnect.
+func (mb *dtuTransporter) SendWithCancel(aduRequest []byte, done <-chan struct{}) (aduResponse []byte, err error) {
+	return sendWithCancel(done, func(ctx context.Context) ([]byte, error) {
+		return mb.SendContext(ctx, aduRequest)
+	}, func() {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+		mb.close()
+	})
+}
+
+// SendContext is like Send but gives up waiting for the response when ctx is
+// done. Any partial response is flushed so it does not corrupt the next one.
+func (mb *dtuTransporter) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
+	size, err := maxADULength(mb.MaxADULength, dtuMaxSize, dtuExceptionSize)
+	if err != nil {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.requestEnd = time.Now() }()
+	for attempt := 0; ; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = mb.connect(); err != nil {
+			return
+		}
+		aduResponse, err = mb.sendContext(ctx, aduRequest, size)
+		if err == nil {
+			mb.reconnects, mb.nextReconnect = 0, time.Time{}
+			return
+		}
+		if !isConnectionClosed(err) {
+			return
+		}
+		// Drop the broken connection
+		mb.close()
+		if mb.Reconnect == nil || attempt >= mb.maxReconnects() {
+			return
+		}
+		mb.logf("modbus: reconnecting after error: %v", err)
+	}
+}
+
+// SendBroadcast writes the request, there is no response.
+func (mb *dtuTransporter) SendBroadcast(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "broadcasting")
+}
+
+// SendNoResponse writes the request of a function without response.
+func (mb *dtuTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "sending")
+}
+
+// write writes the request without reading a response, tracing it as action.
+func (mb *dtuTransporter) write(ctx context.Context, aduRequest []byte, action string) (err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.requestEnd = time.Now() }()
+	if err = mb.connect(); err != nil {
+		return
+	}
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	mb.startKeepAliveTimer()
+
+	timeout := functionTimeout(mb.timeouts, aduRequest[1], mb.timeout())
+	if err = mb.conn.SetDeadline(requestDeadline(ctx, mb.lastActivity, timeout)); err != nil {
+		return
+	}
+	stop := watchContext(ctx, mb.conn)
+	if err = mb.register(); err == nil {
+		mb.tracef("modbus: "+action+" % x\n", aduRequest)
+		err = writeFull(mb.conn, aduRequest)
+	}
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		err = contextErr(ctx)
+	} else if err != nil && isConnectionClosed(err) {
+		mb.close()
+	}
+	return
+}
+
+// sendContext sends the request on the current connection. Caller must hold the mutex.
+func (mb *dtuTransporter) sendContext(ctx context.Context, aduRequest []byte, size int) (aduResponse []byte, err error) {
+	// Start the timer to close when idle
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	mb.startKeepAliveTimer()
+
+	// Set write and read timeout, whichever of ctx and Timeout expires first
+	timeout := functionTimeout(mb.timeouts, aduRequest[1], mb.AdaptiveTimeout.timeout(mb.timeout()))
+	deadline := requestDeadline(ctx, mb.lastActivity, timeout)
+	if err = mb.conn.SetDeadline(deadline); err != nil {
+		return
+	}
+	if mb.BlockingRead {
+		deadline = requestDeadline(ctx, mb.lastActivity, 0)
+		if err = mb.conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+	}
+	stop := watchContext(ctx, mb.conn)
+	if err = mb.register(); err == nil && mb.FlushBeforeSend {
+		err = mb.discardStale(ctx, deadline)
+	}
+	start := time.Now()
+	if err == nil {
+		aduResponse, err = mb.send(aduRequest, size)
+	}
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		aduResponse, err = nil, contextErr(ctx)
+		_ = mb.flush()
+	}
+	mb.AdaptiveTimeout.observe(start, err)
+	return
+}
+
+// Receive reads a frame sent by the device without request, waiting up to
+// Timeout or, if BlockingRead is set, until ctx is done. Heartbeats are
+// skipped. Unless its function tells its length, the frame is assumed to be
+// received in one piece.
+func (mb *dtuTransporter) Receive(ctx context.Context) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
+	size, err := maxADULength(mb.MaxADULength, dtuMaxSize, dtuExceptionSize)
+	if err != nil {
+		return
+	}
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = mb.connect(); err != nil {
+		return
+	}
+	timeout := mb.timeout()
+	if mb.BlockingRead {
+		timeout = 0
+	}
+	if err = mb.conn.SetReadDeadline(requestDeadline(ctx, time.Now(), timeout)); err != nil {
+		return
+	}
+	stop := watchContext(ctx, mb.conn)
+	data := getReadBuffer(size)
+	defer putReadBuffer(data)
+	var n int
+	if err = mb.register(); err == nil {
+		if n, err = mb.readAtLeast(data, dtuMinSize); err == nil {
+			n, err = mb.readFrame(data, n)
+		}
+	}
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		err = contextErr(ctx)
+		_ = mb.flush()
+		return
+	}
+	if err != nil {
+		if isConnectionClosed(err) {
+			mb.close()
+		}
+		return
+	}
 	// Start the timer to close when idle
 	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	mb.startKeepAliveTimer()
+	aduResponse = append([]byte(nil), data[:n]...)
+	mb.tracef("modbus: received % x\n", aduResponse)
+	return
+}
+
+// SetRequestTimeout sets Timeout, the timeout of the requests sent from then
+// on. Unlike setting Timeout and Logger, SetRequestTimeout and SetLogger are
+// safe while requests are in flight, each request uses the values set when
+// it starts.
+func (mb *dtuTransporter) SetRequestTimeout(timeout time.Duration) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.Timeout = timeout
+}
+
+// SetLogger sets Logger, the transmission logger.
+func (mb *dtuTransporter) SetLogger(logger Logger) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.Logger = logger
+}
+
+func (mb *dtuTransporter) timeout() time.Duration {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.Timeout
+}
+
+func (mb *dtuTransporter) logger() Logger {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.Logger
+}
+
+// SetTimeout sets the timeout of the requests of the function code, in place
+// of Timeout. A timeout of 0 removes the override.
+func (mb *dtuTransporter) SetTimeout(functionCode byte, timeout time.Duration) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.timeouts = setFunctionTimeout(mb.timeouts, functionCode, timeout)
+}
+
+// Connect establishes a new connection using Reconnect if the handler is not
+// connected, and starts the keep-alive timer. It reopens a handler closed by
+// Close.
+func (mb *dtuTransporter) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.closed = false
+	if err := mb.connect(); err != nil {
+		return wrapTimeout(err)
+	}
+	mb.startKeepAliveTimer()
+	return nil
+}
+
+// connect reconnects if there is no connection. Caller must hold the mutex.
+func (mb *dtuTransporter) connect() error {
+	if mb.closed {
+		return ErrClosed
+	}
+	if mb.conn == nil {
+		if mb.Reconnect == nil {
+			return fmt.Errorf("modbus: connection is closed")
+		}
+		if wait := mb.reconnectWait(); wait > 0 {
+			return fmt.Errorf("modbus: connection is closed, reconnecting in %v", wait)
+		}
+		conn, err := mb.Reconnect()
+		mb.reconnected(err)
+		if err != nil {
+			return err
+		}
+		mb.setConn(conn)
+	}
+	return nil
+}
+
+// setConn replaces the connection and starts its idle timer. Caller must
+// hold the mutex.
+func (mb *dtuTransporter) setConn(conn net.Conn) {
+	mb.conn = conn
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	mb.startKeepAliveTimer()
+}
+
+func (mb *dtuTransporter) startCloseTimer() {
+	if mb.IdleTimeout <= 0 {
+		return
+	}
+	if mb.closeTimer == nil {
+		mb.closeTimer = time.AfterFunc(mb.IdleTimeout, mb.closeIdle)
+	} else {
+		mb.closeTimer.Reset(mb.IdleTimeout)
+	}
+}
+
+// closeIdle closes the connection if last activity is passed behind IdleTimeout.
+func (mb *dtuTransporter) closeIdle() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.IdleTimeout <= 0 || mb.conn == nil {
+		return
+	}
+	idle := time.Now().Sub(mb.lastActivity)
+	if idle >= mb.IdleTimeout {
+		mb.logf("modbus: closing connection due to idle timeout: %v", idle)
+		mb.close()
+	} else {
+		// Activity in the meantime, e.g. a new connection
+		mb.closeTimer.Reset(mb.IdleTimeout - idle)
+	}
+}
+
+func (mb *dtuTransporter) startKeepAliveTimer() {
+	if mb.KeepAliveInterval <= 0 || mb.keepAliveClient == nil {
+		return
+	}
+	if mb.keepAliveTimer == nil {
+		mb.keepAliveTimer = time.AfterFunc(mb.KeepAliveInterval, mb.keepAlive)
+	} else {
+		mb.keepAliveTimer.Reset(mb.KeepAliveInterval)
+	}
+}
 
-	var timeout time.Time
-	if mb.Timeout > 0 {
-		timeout = mb.lastActivity.Add(mb.Timeout)
+// keepAlive sends the keep-alive probe if there has been no activity for
+// KeepAliveInterval.
+func (mb *dtuTransporter) keepAlive() {
+	mb.mu.Lock()
+	if mb.KeepAliveInterval <= 0 || mb.conn == nil {
+		mb.mu.Unlock()
+		return
 	}
-	if err = mb.conn.SetDeadline(timeout); err != nil {
+	if idle := time.Now().Sub(mb.lastActivity); idle < mb.KeepAliveInterval {
+		// Activity in the meantime
+		mb.keepAliveTimer.Reset(mb.KeepAliveInterval - idle)
+		mb.mu.Unlock()
 		return
 	}
+	probe := mb.KeepAlive
+	mb.mu.Unlock()
+
+	if probe == nil {
+		probe = Client.Ping
+	}
+	// The request restarts the timer. An exception response still tells
+	// the connection is alive.
+	err := probe(mb.keepAliveClient)
+	var mbError *ModbusError
+	if err != nil && !errors.As(err, &mbError) {
+		mb.logf("modbus: keep-alive error: %v", err)
+	}
+}
 
+// Close closes current connection and stops the idle and keep-alive timers
+// once the request in progress, if any, is done. Further requests fail with
+// ErrClosed instead of reconnecting, until Connect. Closing a closed handler
+// does nothing.
+func (mb *dtuTransporter) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.closed = true
+	if mb.closeTimer != nil {
+		mb.closeTimer.Stop()
+	}
+	if mb.keepAliveTimer != nil {
+		mb.keepAliveTimer.Stop()
+	}
+	return mb.close()
+}
+
+// LastActivity returns the start time of the last request, or the time the
+// connection was established by Reconnect or a DTUPool if later. It waits
+// for a request in progress.
+func (mb *dtuTransporter) LastActivity() time.Time {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.lastActivity
+}
+
+// State returns the state of the connection. It waits for a request in
+// progress.
+func (mb *dtuTransporter) State() ConnState {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return connState(mb.conn != nil, mb.lastActivity, mb.timeout())
+}
+
+// Conn returns the current connection, e.g. to set socket options, or nil
+// if it is closed. It waits for a request in progress. The connection must
+// not be read or written. Options of connections established later by
+// Reconnect are best set in Reconnect.
+func (mb *dtuTransporter) Conn() net.Conn {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.conn
+}
+
+// close closes current connection. Caller must hold the mutex.
+func (mb *dtuTransporter) close() (err error) {
+	if mb.conn != nil {
+		err = mb.conn.Close()
+		mb.conn = nil
+	}
+	return
+}
+
+// connectTimeout returns ConnectTimeout, or Timeout if not set.
+func (mb *dtuTransporter) connectTimeout() time.Duration {
+	if mb.ConnectTimeout > 0 {
+		return mb.ConnectTimeout
+	}
+	return mb.timeout()
+}
+
+// reconnectWait returns the time left before the next reconnect is allowed.
+// Caller must hold the mutex.
+func (mb *dtuTransporter) reconnectWait() time.Duration {
+	if mb.ReconnectBackoff <= 0 {
+		return 0
+	}
+	return time.Until(mb.nextReconnect)
+}
+
+// reconnected counts a reconnect with its error and schedules the next one.
+// Caller must hold the mutex.
+func (mb *dtuTransporter) reconnected(err error) {
+	mb.reconnects++
+	if mb.ReconnectBackoff > 0 {
+		max := mb.MaxReconnectBackoff
+		if max <= 0 {
+			max = dtuMaxReconnectBackoff
+		}
+		backoff := mb.ReconnectBackoff
+		for i := 1; i < mb.reconnects && backoff < max; i++ {
+			backoff *= 2
+		}
+		if backoff > max {
+			backoff = max
+		}
+		mb.nextReconnect = time.Now().Add(backoff)
+	}
+	if mb.OnReconnect != nil {
+		mb.OnReconnect(mb.reconnects, err)
+	}
+}
+
+func (mb *dtuTransporter) maxReconnects() int {
+	if mb.MaxReconnects > 0 {
+		return mb.MaxReconnects
+	}
+	return 1
+}
+
+// send writes the request and reads a response of up to size bytes. Caller
+// must hold the mutex.
+func (mb *dtuTransporter) send(aduRequest []byte, size int) (aduResponse []byte, err error) {
 	// Send the request
-	mb.logf("modbus: sending % x\n", aduRequest)
-	if _, err = mb.conn.Write(aduRequest); err != nil {
+	mb.tracef("modbus: sending % x\n", aduRequest)
+	if err = writeFull(mb.conn, aduRequest); err != nil {
 		return
 	}
 	function := aduRequest[1]
-	functionFail := aduRequest[1] & 0x80
+	functionFail := aduRequest[1] | 0x80
 	bytesToRead := calculateResponseLength(aduRequest)
 	//time.Sleep(mb.calculateDelay(len(aduRequest) + bytesToRead))
 
 	var n int
 	var n1 int
-	var data [dtuMaxSize]byte
+	data := getReadBuffer(size)
+	defer putReadBuffer(data)
 	//We first read the minimum length and then read either the full package
 	//or the error package, depending on the error status (byte 2 of the response)
-	n, err = io.ReadAtLeast(mb.conn, data[:], dtuMinSize)
+	n, err = mb.readAtLeast(data[:], dtuMinSize)
 	if err != nil {
 		return
 	}
 	//if the function is correct
 	if data[1] == function {
 		//we read the rest of the bytes
-		if n < bytesToRead {
-			if bytesToRead > dtuMinSize && bytesToRead <= dtuMaxSize {
+		if bytesToRead <= dtuMinSize {
+			// Without silent intervals the frame must tell its length
+			n, err = mb.readFrame(data[:], n)
+		} else if bytesToRead > len(data) {
+			err = fmt.Errorf("modbus: response length '%v' must not be bigger than '%v'", bytesToRead, len(data))
+		} else if n < bytesToRead {
+			if bytesToRead > dtuMinSize && bytesToRead <= len(data) {
 				if bytesToRead > n {
 					n1, err = io.ReadFull(mb.conn, data[n:bytesToRead])
 					n += n1
@@ -182,11 +784,101 @@ func (mb *dtuTransporter) Send(aduRequest []byte) (aduResponse []byte, err error
 		_ = mb.flush()
 		return
 	}
-	aduResponse = data[:n]
-	mb.logf("modbus: received % x\n", aduResponse)
+	aduResponse = append([]byte(nil), data[:n]...)
+	mb.tracef("modbus: received % x\n", aduResponse)
+	return
+}
+
+// readFrame reads the rest of a variable length response frame, given the
+// first n bytes in buf, and returns the frame length.
+func (mb *dtuTransporter) readFrame(buf []byte, n int) (length int, err error) {
+	var n1 int
+	for {
+		length = calculateFrameLength(buf[:n])
+		if length < 0 {
+			// Unknown length, assume the frame has been received in one piece
+			length = n
+			return
+		}
+		if length > len(buf) {
+			err = fmt.Errorf("modbus: response length '%v' must not be bigger than '%v'", length, len(buf))
+			return
+		}
+		if length > 0 && n >= length {
+			return
+		}
+		min := 1
+		if length > 0 {
+			min = length - n
+		}
+		n1, err = io.ReadAtLeast(mb.conn, buf[n:], min)
+		n += n1
+		if err != nil {
+			return
+		}
+	}
+}
+
+// register reads the registration packet of a new connection if there is a
+// RegistrationHandler. Caller must hold the mutex.
+func (mb *dtuTransporter) register() (err error) {
+	if mb.RegistrationHandler == nil || mb.registered == mb.conn {
+		return
+	}
+	var data [dtuMaxSize]byte
+	var n int
+	for {
+		if n, err = mb.conn.Read(data[:]); err != nil {
+			return
+		}
+		if !mb.isHeartbeat(data[:n]) {
+			break
+		}
+	}
+	mb.registered = mb.conn
+	mb.logf("modbus: received registration % x\n", data[:n])
+	mb.RegistrationHandler(data[:n])
 	return
 }
 
+// readAtLeast reads at least min bytes of the response into buf, skipping
+// heartbeats in front of it.
+func (mb *dtuTransporter) readAtLeast(buf []byte, min int) (n int, err error) {
+	marker := mb.HeartbeatMarker
+	var n1 int
+	for {
+		if len(marker) > 0 && n > 0 {
+			if mb.isHeartbeat(buf[:n]) {
+				mb.tracef("modbus: skipping heartbeat % x\n", marker)
+				n = copy(buf, buf[len(marker):n])
+				continue
+			}
+			// The beginning of a heartbeat, wait for the rest of it
+			if n < len(marker) && bytes.Equal(buf[:n], marker[:n]) {
+				n1, err = io.ReadAtLeast(mb.conn, buf[n:], len(marker)-n)
+				n += n1
+				if err != nil {
+					return
+				}
+				continue
+			}
+		}
+		if n >= min {
+			return
+		}
+		n1, err = io.ReadAtLeast(mb.conn, buf[n:], min-n)
+		n += n1
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isHeartbeat reports whether data starts with the heartbeat marker.
+func (mb *dtuTransporter) isHeartbeat(data []byte) bool {
+	return len(mb.HeartbeatMarker) > 0 && bytes.HasPrefix(data, mb.HeartbeatMarker)
+}
+
 // calculateDelay roughly calculates time needed for the next frame.
 // See MODBUS over Serial Line - Specification and Implementation Guide (page 13).
 func (mb *dtuTransporter) calculateDelay(chars int) time.Duration {
@@ -202,25 +894,87 @@ func (mb *dtuTransporter) calculateDelay(chars int) time.Duration {
 	return time.Duration(characterDelay*chars+frameDelay) * time.Microsecond
 }
 
+// discardStale drains the connection before a request and restores the read
+// deadline. Caller must hold the mutex.
+func (mb *dtuTransporter) discardStale(ctx context.Context, deadline time.Time) error {
+	n, err := drain(mb.conn)
+	if n > 0 {
+		mb.logf("modbus: discarded %v stale bytes", n)
+	}
+	if err != nil {
+		return err
+	}
+	if err = mb.conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	// The deadline set when ctx is done may have been overwritten
+	return contextErr(ctx)
+}
+
+// Reset discards the data received on the connection and not read yet, e.g.
+// after a framing error or a device restart, without closing it. It waits
+// for a request in progress.
+func (mb *dtuTransporter) Reset() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.conn == nil {
+		return nil
+	}
+	n, err := drain(mb.conn)
+	if n > 0 {
+		mb.logf("modbus: discarded %v stale bytes", n)
+	}
+	return err
+}
+
 // flush flushes pending data in the connection,
 // returns io.EOF if connection is closed.
 func (mb *dtuTransporter) flush() (err error) {
-	if err = mb.conn.SetReadDeadline(time.Now()); err != nil {
-		return
-	}
 	// Timeout setting will be reset when reading
-	b := make([]byte, 1000)
-	if _, err = mb.conn.Read(b); err != nil {
-		// Ignore timeout error
-		if netError, ok := err.(net.Error); ok && netError.Timeout() {
-			err = nil
-		}
-	}
+	_, err = drain(mb.conn)
 	return
 }
 
 func (mb *dtuTransporter) logf(format string, v ...interface{}) {
-	if mb.Logger != nil {
-		mb.Logger.Printf(format, v...)
+	if logger := mb.logger(); logger != nil {
+		logger.Printf(format, v...)
+	}
+}
+
+func (mb *dtuTransporter) metrics() Metrics {
+	return mb.Metrics
+}
+
+func (mb *dtuTransporter) hooks() (onRequest func(adu []byte), onResponse func(adu []byte, err error)) {
+	return mb.OnRequest, mb.OnResponse
+}
+
+func (mb *dtuTransporter) responseValidator() func(aduRequest, aduResponse []byte) error {
+	return mb.ResponseValidator
+}
+
+func (mb *dtuTransporter) circuitBreaker() *CircuitBreaker {
+	return mb.CircuitBreaker
+}
+
+func (mb *dtuTransporter) requestTracer() func(format string, v ...interface{}) {
+	if !mb.TraceRequests {
+		return nil
+	}
+	return mb.logf
+}
+
+func (mb *dtuTransporter) ping() PingFunc {
+	return mb.Ping
+}
+
+// tracef logs the frame if TraceFrames is set, it is not formatted otherwise.
+func (mb *dtuTransporter) tracef(format string, frame []byte) {
+	if !mb.TraceFrames {
+		return
+	}
+	if logger := mb.logger(); logger != nil {
+		logger.Printf(format, frame)
 	}
 }
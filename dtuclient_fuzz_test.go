@@ -0,0 +1,71 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+//go:build go1.18
+// +build go1.18
+
+package modbus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDTUPackagerRoundTrip(f *testing.F) {
+	f.Add(byte(1), byte(FuncCodeReadHoldingRegisters), []byte{0, 0, 0, 2})
+	f.Add(byte(0), byte(FuncCodeReadExceptionStatus), []byte{})
+	f.Add(byte(247), byte(FuncCodeReadHoldingRegisters), make([]byte, dtuMaxSize-4))
+	f.Add(byte(1), byte(FuncCodeWriteMultipleRegisters), make([]byte, dtuMaxSize-3))
+	f.Add(byte(1), byte(FuncCodeReadCoils|0x80), []byte{2})
+	f.Fuzz(func(t *testing.T, slaveId, functionCode byte, data []byte) {
+		packager := dtuPackager{}
+		request := ProtocolDataUnit{FunctionCode: functionCode, Data: data}
+		adu, err := packager.EncodeSlave(slaveId, &request)
+		if len(data) > dtuMaxSize-4 {
+			if err == nil {
+				t.Fatalf("data size %v: expected error", len(data))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(adu) != len(data)+4 || adu[0] != slaveId {
+			t.Fatalf("unexpected frame % x", adu)
+		}
+		// Matching response, an exception of the function if the bit is set
+		aduRequest := append([]byte(nil), adu...)
+		aduRequest[1] &= 0x7F
+		if err = packager.Verify(aduRequest, adu); err != nil {
+			t.Fatalf("verify % x: %v", adu, err)
+		}
+		pdu, err := packager.Decode(adu)
+		if functionCode&0x80 != 0 {
+			// Exception responses decode to an error
+			if err == nil {
+				t.Fatalf("decode % x: expected error", adu)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("decode % x: %v", adu, err)
+		}
+		if pdu.FunctionCode != functionCode || !bytes.Equal(pdu.Data, data) {
+			t.Fatalf("decode % x: expected %v % x, actual %v % x", adu, functionCode, data, pdu.FunctionCode, pdu.Data)
+		}
+	})
+}
+
+func FuzzDTUPackagerDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 3})
+	f.Add([]byte{1, 3, 0})
+	f.Add([]byte{1, 0x83, 2, 0xC0, 0xF1})
+	f.Fuzz(func(t *testing.T, adu []byte) {
+		packager := dtuPackager{}
+		if _, err := packager.Decode(adu); err == nil && len(adu) < dtuMinSize {
+			t.Fatalf("decode % x: expected error", adu)
+		}
+	})
+}
@@ -0,0 +1,1055 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+func TestDTUTransporterCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+
+	received := make(chan []byte)
+	go func() {
+		b := make([]byte, 16)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), b[:n]...)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		// Send a partial response then stall
+		server.Write(rsp[:2])
+		cancel()
+	}()
+	start := time.Now()
+	_, err := handler.SendContext(ctx, req)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("cancel took too long: %v", time.Since(start))
+	}
+
+	go func() {
+		<-received
+		server.Write(rsp)
+	}()
+	aduResponse, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("response: expected % x, actual % x", rsp, aduResponse)
+	}
+}
+
+func TestDTUClientContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	_, err := NewClient(handler).ReadHoldingRegistersContext(ctx, 0, 1)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDTUTransporterReconnect(t *testing.T) {
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+
+	broken, peer := net.Pipe()
+	peer.Close()
+
+	reconnects := 0
+	handler := NewDTUClientHandler(broken)
+	handler.Reconnect = func() (net.Conn, error) {
+		reconnects++
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			b := make([]byte, 16)
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}()
+		return client, nil
+	}
+	aduResponse, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("response: expected % x, actual % x", rsp, aduResponse)
+	}
+	if reconnects != 1 {
+		t.Fatalf("reconnects: expected %v, actual %v", 1, reconnects)
+	}
+
+	// The served connection is closed after one response and every new one fails
+	handler.Reconnect = func() (net.Conn, error) {
+		reconnects++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	handler.MaxReconnects = 3
+	reconnects = 0
+	if _, err = handler.Send(req); err == nil {
+		t.Fatal("expected error")
+	}
+	if reconnects != 3 {
+		t.Fatalf("reconnects: expected %v, actual %v", 3, reconnects)
+	}
+}
+
+func TestDTUTransporterRegistrationHeartbeat(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	heartbeat := []byte{0xFE, 0xFE}
+
+	go func() {
+		server.Write([]byte("DTU0001"))
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			// Heartbeats in front of the response, the second one split
+			server.Write(heartbeat)
+			server.Write(heartbeat[:1])
+			server.Write(append(heartbeat[1:], rsp[:3]...))
+			server.Write(rsp[3:])
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	var registrations []string
+	handler.RegistrationHandler = func(packet []byte) {
+		registrations = append(registrations, string(packet))
+	}
+	handler.HeartbeatMarker = heartbeat
+	for i := 0; i < 2; i++ {
+		aduResponse, err := handler.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rsp, aduResponse) {
+			t.Fatalf("response: expected % x, actual % x", rsp, aduResponse)
+		}
+	}
+	if len(registrations) != 1 || registrations[0] != "DTU0001" {
+		t.Fatalf("registrations: unexpected %q", registrations)
+	}
+}
+
+func TestDTUTransporterTraceFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}
+	}()
+
+	var lines []string
+	handler := NewDTUClientHandler(client)
+	handler.Logger = LoggerFunc(func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Fatalf("frames must not be logged: %q", lines)
+	}
+	handler.TraceFrames = true
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"modbus: sending 01 03 00 00 00 01 84 0a\n",
+		"modbus: received 01 03 02 00 2a 39 9b\n",
+	}
+	if len(lines) != len(expected) || lines[0] != expected[0] || lines[1] != expected[1] {
+		t.Fatalf("log: expected %q, actual %q", expected, lines)
+	}
+}
+
+func TestDTUClientException(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 16)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		// The exception response arrives in pieces
+		rsp := []byte{0x01, 0x83, 0x02, 0xC0, 0xF1}
+		server.Write(rsp[:4])
+		server.Write(rsp[4:])
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	_, err := NewClient(handler).ReadHoldingRegisters(0, 1)
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mbError.FunctionCode != 0x83 || mbError.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Fatalf("unexpected exception: %+v", mbError)
+	}
+	if CategorizeError(err) != ErrorCategoryException || IsRetryable(err) {
+		t.Fatalf("exception must not be a frame error: %v", err)
+	}
+}
+
+func TestDTUTransporterIdleTimeout(t *testing.T) {
+	for _, idleTimeout := range []time.Duration{0, 50 * time.Millisecond} {
+		client, server := net.Pipe()
+		go func() {
+			b := make([]byte, 16)
+			for {
+				if _, err := server.Read(b); err != nil {
+					return
+				}
+				server.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+			}
+		}()
+		handler := NewDTUClientHandler(client)
+		handler.IdleTimeout = idleTimeout
+		if _, err := handler.Send([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		handler.mu.Lock()
+		closed := handler.conn == nil
+		handler.mu.Unlock()
+		if closed != (idleTimeout > 0) {
+			t.Fatalf("idle timeout %v: connection closed %v", idleTimeout, closed)
+		}
+		handler.Close()
+		server.Close()
+	}
+}
+
+func TestDTUTransporterFlushBeforeSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stale := []byte{0x01, 0x03, 0x02, 0x00, 0x01, 0x79, 0x84}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		// Late response of an aborted request
+		if _, err := server.Write(stale); err != nil {
+			return
+		}
+		b := make([]byte, 16)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		server.Write(rsp)
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.FlushBeforeSend = true
+	defer handler.Close()
+	aduResponse, err := handler.Send([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("unexpected response: % x", aduResponse)
+	}
+}
+
+func TestDTUClientBroadcast(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 16)
+		n, err := server.Read(b)
+		if err != nil {
+			return
+		}
+		// No slave replies to a broadcast
+		received <- b[:n]
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = 50 * time.Millisecond
+	defer handler.Close()
+	mb := NewClient(handler)
+	results, err := mb.WriteSingleRegister(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{0, 3}, results) {
+		t.Fatalf("unexpected results % x", results)
+	}
+	if aduRequest := <-received; aduRequest[0] != 0 || aduRequest[1] != FuncCodeWriteSingleRegister {
+		t.Fatalf("unexpected request % x", aduRequest)
+	}
+	if _, err = mb.WriteMultipleRegistersContext(WithSlaveId(context.Background(), 1), 1, 1, []byte{0, 3}); err == nil {
+		t.Fatal("expected timeout of unicast request")
+	}
+	if _, err = mb.ReadHoldingRegisters(1, 1); err == nil {
+		t.Fatal("expected error for broadcast read")
+	}
+}
+
+func TestDTUTransporterFlushStale(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		b := make([]byte, 16)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		// Server id longer than a frame
+		tooLong := make([]byte, 3+255+2)
+		tooLong[0], tooLong[1], tooLong[2] = 0x01, FuncCodeReportServerID, 255
+		if _, err := server.Write(tooLong); err != nil {
+			return
+		}
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		server.Write(rsp)
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = time.Second
+	defer handler.Close()
+	if _, err := handler.Send([]byte{0x01, 0x11, 0xC0, 0x2C}); err == nil {
+		t.Fatal("expected error for response length")
+	}
+	// The rest of the frame has been discarded
+	aduResponse, err := handler.Send([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("unexpected response: % x", aduResponse)
+	}
+}
+
+func TestDTUTransporterReset(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	written := make(chan struct{})
+	go func() {
+		// Garbage sent by a restarting device
+		if _, err := server.Write([]byte{0x00, 0xFF, 0xFE}); err != nil {
+			return
+		}
+		close(written)
+		b := make([]byte, 16)
+		if _, err := server.Read(b); err != nil {
+			return
+		}
+		server.Write(rsp)
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = time.Second
+	defer handler.Close()
+	if err := handler.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	<-written
+	aduResponse, err := handler.Send([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("unexpected response: % x", aduResponse)
+	}
+	handler.Close()
+	if err = handler.Reset(); err != nil {
+		t.Fatalf("reset without connection: %v", err)
+	}
+}
+
+func TestDTUTransporterMaxADULength(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	defer handler.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	handler.MaxADULength = dtuExceptionSize - 1
+	if _, err := handler.Send(req); err == nil {
+		t.Fatal("expected error for max ADU length")
+	}
+	handler.MaxADULength = dtuExceptionSize
+	if _, err := handler.Send(req); err == nil {
+		t.Fatal("expected error for response length")
+	}
+	handler.MaxADULength = 7
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// shortWriteConn writes at most one byte per call.
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestDTUTransporterShortWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	received := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, len(req))
+		if _, err := io.ReadFull(server, b); err != nil {
+			return
+		}
+		received <- b
+		server.Write(rsp)
+	}()
+	handler := NewDTUClientHandler(shortWriteConn{client})
+	handler.Timeout = time.Second
+	defer handler.Close()
+	aduResponse, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("unexpected response: % x", aduResponse)
+	}
+	if b := <-received; !bytes.Equal(req, b) {
+		t.Fatalf("unexpected request: % x", b)
+	}
+}
+
+type zeroWriter struct{}
+
+func (zeroWriter) Write(b []byte) (int, error) { return 0, nil }
+
+func TestWriteFullShortWrite(t *testing.T) {
+	if err := writeFull(zeroWriter{}, []byte{1}); err != io.ErrShortWrite {
+		t.Fatalf("expected %v, actual %v", io.ErrShortWrite, err)
+	}
+	if err := writeFull(zeroWriter{}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDTUTransporterKeepAlive(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	probes := make(chan []byte, 16)
+	server.RegisterFunctionHandler(FuncCodeDiagnostics, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		probes <- request.Data
+		return request, nil
+	})
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	handler.KeepAliveInterval = 50 * time.Millisecond
+	client := NewClient(handler)
+
+	// Requests reset the keep-alive timer
+	for i := 0; i < 10; i++ {
+		if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(probes) != 0 {
+		t.Fatalf("unexpected %v keep-alive probes", len(probes))
+	}
+	select {
+	case data := <-probes:
+		if !bytes.Equal([]byte{0x00, 0x00, 0xA5, 0x37}, data) {
+			t.Fatalf("unexpected probe % x", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no keep-alive probe")
+	}
+
+	handler.Close()
+
+	handler = newServerClient(t, server)
+	handler.SlaveId = 1
+	handler.KeepAliveInterval = 50 * time.Millisecond
+	probed := make(chan struct{}, 16)
+	handler.KeepAlive = func(client Client) error {
+		probed <- struct{}{}
+		_, err := client.ReadHoldingRegisters(0, 1)
+		return err
+	}
+	if err := handler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-probed:
+	case <-time.After(time.Second):
+		t.Fatal("keep-alive not called")
+	}
+	handler.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := len(probed); n > 1 {
+		t.Fatalf("unexpected %v keep-alive probes after close", n)
+	}
+}
+
+func TestDTUTransporterState(t *testing.T) {
+	handler := NewDTUClientHandler(nil)
+	if state := handler.State(); state != StateClosed {
+		t.Fatalf("state: expected %v, actual %v", StateClosed, state)
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+		}
+	}()
+	handler = NewDTUClientHandler(client)
+	handler.Timeout = 50 * time.Millisecond
+	defer handler.Close()
+	start := time.Now()
+	if _, err := handler.Send([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}); err != nil {
+		t.Fatal(err)
+	}
+	if last := handler.LastActivity(); last.Before(start) || last.After(time.Now()) {
+		t.Fatalf("unexpected last activity %v", last)
+	}
+	if state := handler.State(); state != StateConnected {
+		t.Fatalf("state: expected %v, actual %v", StateConnected, state)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if state := handler.State(); state != StateIdle || state.String() != "idle" {
+		t.Fatalf("state: expected %v, actual %v", StateIdle, state)
+	}
+}
+
+func TestDTUTransporterFunctionTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			// Slow device
+			time.Sleep(100 * time.Millisecond)
+			server.Write(rsp)
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = 30 * time.Millisecond
+	defer handler.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+
+	handler.SetTimeout(FuncCodeReadHoldingRegisters, time.Second)
+	aduResponse, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rsp, aduResponse) {
+		t.Fatalf("unexpected response: % x", aduResponse)
+	}
+
+	handler.SetTimeout(FuncCodeReadHoldingRegisters, 0)
+	var netErr net.Error
+	if _, err = handler.Send(req); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, actual %v", err)
+	}
+}
+
+func TestDTUTransporterErrTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		// Device not responding
+		io.Copy(io.Discard, server)
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = 20 * time.Millisecond
+	defer handler.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+
+	_, err := handler.Send(req)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+	}
+	// The network error is kept
+	var netErr net.Error
+	if !errors.As(errors.Unwrap(err), &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected net.Error, actual %#v", errors.Unwrap(err))
+	}
+	// Errors of the context are not wrapped
+	handler.Timeout = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = handler.SendContext(ctx, req); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, actual %v", context.DeadlineExceeded, err)
+	}
+	if err = wrapTimeout(serial.ErrTimeout); !errors.Is(err, ErrTimeout) || !errors.Is(err, serial.ErrTimeout) {
+		t.Fatalf("serial timeout: unexpected %v", err)
+	}
+}
+
+func TestDTUTransporterConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	handler := NewDTUClientHandler(client)
+	if conn := handler.Conn(); conn != client {
+		t.Fatalf("conn: expected %v, actual %v", client, conn)
+	}
+	handler.Close()
+	if conn := handler.Conn(); conn != nil {
+		t.Fatalf("conn: expected nil, actual %v", conn)
+	}
+}
+
+func TestDTUClientHandlerContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 16)
+				for {
+					if _, err := conn.Read(b); err != nil {
+						return
+					}
+					conn.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+				}
+			}()
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = NewDTUClientHandlerContext(ctx, ln.Addr().String(), nil); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+	handler, err := NewDTUClientHandlerContext(context.Background(), ln.Addr().String(), &net.Dialer{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	handler.SlaveId = 1
+	client := NewClient(handler)
+	if _, err = client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Reconnects with the dialer
+	handler.Close()
+	if err = handler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reconnects with the connect timeout without dialer
+	handler, err = NewDTUClientHandlerContext(context.Background(), ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	handler.SlaveId = 1
+	handler.ConnectTimeout = time.Second
+	if d := handler.connectTimeout(); d != time.Second {
+		t.Fatalf("connect timeout: expected %v, actual %v", time.Second, d)
+	}
+	handler.Close()
+	if err = handler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewClient(handler).ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDTUTransporterInterRequestDelay(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	received := make(chan time.Time, 3)
+	go func() {
+		b := make([]byte, 16)
+		for {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			received <- time.Now()
+			server.Write([]byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B})
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.InterRequestDelay = 50 * time.Millisecond
+	defer handler.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now()
+	<-received
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	if d := (<-received).Sub(end); d < handler.InterRequestDelay {
+		t.Fatalf("request sent %v after the previous one", d)
+	}
+	// The delay is aborted with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := handler.SendContext(ctx, req); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDTUClientFunctionCodeMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	responses := [][]byte{
+		// Read input registers response to a read holding registers request
+		{0x01, 0x04, 0x02, 0x00, 0x2A, 0x38, 0xEF},
+		// Exception of the request
+		{0x01, 0x83, 0x02, 0xC0, 0xF1},
+	}
+	go func() {
+		b := make([]byte, 16)
+		for _, rsp := range responses {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	defer handler.Close()
+	mb := NewClient(handler)
+	_, err := mb.ReadHoldingRegisters(0, 1)
+	if CategorizeError(err) != ErrorCategoryFraming {
+		t.Fatalf("expected framing error, actual %v", err)
+	}
+	_, err = mb.ReadHoldingRegisters(0, 1)
+	if CategorizeError(err) != ErrorCategoryException {
+		t.Fatalf("expected exception, actual %v", err)
+	}
+}
+
+func TestDTUTransporterBlockingRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	push := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		// Device pushing data later than the timeout
+		time.Sleep(100 * time.Millisecond)
+		server.Write(push)
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.Timeout = 30 * time.Millisecond
+	defer handler.Close()
+
+	var netErr net.Error
+	if _, err := handler.Receive(context.Background()); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, actual %v", err)
+	}
+	handler.BlockingRead = true
+	aduResponse, err := handler.Receive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(push, aduResponse) {
+		t.Fatalf("unexpected frame: % x", aduResponse)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = handler.Receive(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, actual %v", context.DeadlineExceeded, err)
+	}
+}
+
+func BenchmarkDTUTransporterSend(b *testing.B) {
+	client, server := net.Pipe()
+	defer server.Close()
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	defer handler.Close()
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := handler.Send(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDTUTransporterResponseValidator(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	responses := [][]byte{
+		// CRC bytes in the wrong order
+		{0x01, 0x03, 0x02, 0x00, 0x2A, 0x9B, 0x39},
+		// Rejected by the validator
+		{0x01, 0x03, 0x02, 0x00, 0x2B, 0xF8, 0x5B},
+	}
+	go func() {
+		b := make([]byte, 16)
+		for _, rsp := range responses {
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}
+	}()
+	handler := NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	defer handler.Close()
+	var requests int
+	handler.ResponseValidator = func(aduRequest, aduResponse []byte) error {
+		requests++
+		if aduRequest[1] != FuncCodeReadHoldingRegisters {
+			t.Errorf("unexpected request % x", aduRequest)
+		}
+		if aduResponse[4] != 0x2A {
+			return fmt.Errorf("unexpected value %v", aduResponse[4])
+		}
+		n := len(aduResponse)
+		aduResponse[n-2], aduResponse[n-1] = aduResponse[n-1], aduResponse[n-2]
+		return nil
+	}
+	mb := NewClient(handler)
+	results, err := mb.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(results, []byte{0x00, 0x2A}) {
+		t.Fatalf("results: expected 00 2a, actual % x", results)
+	}
+	_, err = mb.ReadHoldingRegisters(0, 1)
+	if CategorizeError(err) != ErrorCategoryFraming {
+		t.Fatalf("expected framing error, actual %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("validator calls: expected 2, actual %v", requests)
+	}
+}
+
+func TestDTUClientHandlerSetters(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 1)
+	server.AddSlave(2).SetHoldingRegister(0, 2)
+	handler := newServerClient(t, server)
+	handler.SetSlaveId(1)
+	client := NewClient(handler)
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			results, err := client.ReadHoldingRegisters(0, 1)
+			if err != nil {
+				done <- err
+				return
+			}
+			if results[1] != 1 && results[1] != 2 {
+				done <- fmt.Errorf("unexpected results % x", results)
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 50; i++ {
+		handler.SetSlaveId(byte(1 + i%2))
+		handler.SetRequestTimeout(time.Second + time.Duration(i)*time.Millisecond)
+		handler.SetLogger(LoggerFunc(func(string, ...interface{}) {}))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	handler.SetSlaveId(2)
+	results, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1] != 2 {
+		t.Fatalf("slave 2: unexpected results % x", results)
+	}
+}
+
+func TestDTUTransporterReconnectBackoff(t *testing.T) {
+	req := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A}
+	rsp := []byte{0x01, 0x03, 0x02, 0x00, 0x2A, 0x39, 0x9B}
+
+	// Every new connection is closed by the device
+	handler := NewDTUClientHandler(nil)
+	handler.Reconnect = func() (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	handler.ReconnectBackoff = 20 * time.Millisecond
+	handler.MaxReconnectBackoff = 30 * time.Millisecond
+	var reconnects []int
+	handler.OnReconnect = func(n int, err error) {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		reconnects = append(reconnects, n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := handler.Send(req); err == nil {
+			t.Fatal("expected error")
+		}
+		// Backing off
+		if _, err := handler.Send(req); err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+			t.Fatalf("expected backoff error, actual %v", err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	if len(reconnects) != 3 || reconnects[2] != 3 {
+		t.Fatalf("reconnects: unexpected %v", reconnects)
+	}
+
+	handler.Reconnect = func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			b := make([]byte, 16)
+			if _, err := server.Read(b); err != nil {
+				return
+			}
+			server.Write(rsp)
+		}()
+		return client, nil
+	}
+	if _, err := handler.Send(req); err != nil {
+		t.Fatal(err)
+	}
+	if handler.reconnects != 0 || handler.reconnectWait() > 0 {
+		t.Fatalf("reconnects: expected reset, actual %v", handler.reconnects)
+	}
+}
+
+func TestDTUTransporterClose(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	started := make(chan struct{})
+	server.RegisterFunctionHandler(FuncCodeReadHoldingRegisters, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{2, 0, 42}}, nil
+	})
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.ReadHoldingRegisters(0, 1)
+		done <- err
+	}()
+	<-started
+	// Waits for the request in flight
+	if err := handler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadHoldingRegisters(0, 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, actual %v", ErrClosed, err)
+	}
+	if _, err := client.WriteSingleRegister(0, 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, actual %v", ErrClosed, err)
+	}
+	if err := handler.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+}
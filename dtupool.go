@@ -0,0 +1,385 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DTUPool accepts connections dialed in by DTU devices and routes requests to
+// the device by its id, which is read from the registration packet sent
+// after connecting. The handler of a device is kept when it reconnects, only
+// its connection is replaced.
+type DTUPool struct {
+	// Identify reads the registration packet of a new connection and returns
+	// the device id. The whole first packet, without surrounding white
+	// space, is used as id if not set.
+	Identify func(conn net.Conn) (deviceID string, err error)
+	// OnConnect and OnDisconnect, if set, are called when a device
+	// connects or its connection is closed. The client of a connected
+	// device is returned by Client.
+	OnConnect    func(deviceID string)
+	OnDisconnect func(deviceID string)
+	// Configure, if set, is called with the handler of a device when it
+	// first connects, to set it up beyond the settings of the pool, e.g.
+	// the slave id or a heartbeat marker.
+	Configure func(deviceID string, handler *DTUClientHandler)
+	// Timeout of registration and requests
+	Timeout time.Duration
+	// Idle timeout to close the connection of a device, 0 disables it
+	IdleTimeout time.Duration
+	// Inactivity after which a keep-alive probe is sent to a device, 0
+	// disables it. See DTUClientHandler.KeepAliveInterval.
+	KeepAliveInterval time.Duration
+	// Transmission logger
+	Logger Logger
+	// TLSConfig, if set, secures the connections accepted by Serve with
+	// TLS. The handshake is bounded by Timeout.
+	TLSConfig *tls.Config
+	// MaxConnections, if set, is the maximum number of connections open at
+	// once, including those not identified yet, e.g. to keep a gateway
+	// from running out of file descriptors. Connections beyond it are
+	// closed by Add. A device reconnecting while the pool is full is
+	// rejected until its previous connection is closed, e.g. by IdleTimeout.
+	MaxConnections int
+	// OnConnectionLimit, if set, is called with the remote address of each
+	// connection rejected because MaxConnections are open.
+	OnConnectionLimit func(remoteAddr net.Addr)
+
+	mu        sync.Mutex
+	handlers  map[string]*DTUClientHandler
+	conns     map[string]*dtuPoolConn
+	listeners map[net.Listener]struct{}
+	closed    bool
+	// Connections open, see Connections
+	open int
+}
+
+// NewDTUPool allocates a DTUPool without any device.
+func NewDTUPool() *DTUPool {
+	return &DTUPool{
+		Timeout:     tcpTimeout,
+		IdleTimeout: dtuIdleTimeout,
+		handlers:    make(map[string]*DTUClientHandler),
+		conns:       make(map[string]*dtuPoolConn),
+		listeners:   make(map[net.Listener]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves the connections as
+// Serve.
+func (p *DTUPool) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return p.Serve(l)
+}
+
+// Serve accepts connections on the listener, with TLS if TLSConfig is set,
+// and adds each of them in a new goroutine. It returns when the listener
+// fails or the pool is closed.
+func (p *DTUPool) Serve(l net.Listener) error {
+	if p.TLSConfig != nil {
+		l = tls.NewListener(l, p.TLSConfig)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPoolClosed
+	}
+	p.listeners[l] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, l)
+		p.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.isClosed() {
+				return errPoolClosed
+			}
+			return err
+		}
+		go func() {
+			if _, err := p.Add(conn); err != nil {
+				p.logf("modbus: dtu pool rejected %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Add identifies the device of the connection and makes it its current
+// connection. The connection is closed if MaxConnections are open, if it
+// can not be identified, or if the device reconnects during the
+// ReconnectBackoff of its handler.
+func (p *DTUPool) Add(conn net.Conn) (deviceID string, err error) {
+	if !p.acquire() {
+		conn.Close()
+		if p.OnConnectionLimit != nil {
+			p.OnConnectionLimit(conn.RemoteAddr())
+		}
+		return "", errPoolFull
+	}
+	defer func() {
+		// The connection of the device releases it once closed otherwise
+		if err != nil {
+			p.release()
+		}
+	}()
+	if deviceID, err = p.identify(conn); err != nil {
+		conn.Close()
+		return
+	}
+	if handler := p.Handler(deviceID); handler != nil {
+		handler.mu.Lock()
+		wait := handler.reconnectWait()
+		handler.mu.Unlock()
+		if wait > 0 {
+			conn.Close()
+			return "", fmt.Errorf("modbus: device '%v' reconnected %v before the end of its backoff", deviceID, wait)
+		}
+	}
+	c := &dtuPoolConn{Conn: conn, pool: p, deviceID: deviceID}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return "", errPoolClosed
+	}
+	handler, ok := p.handlers[deviceID]
+	if !ok {
+		handler = NewDTUClientHandler(nil)
+		handler.Timeout = p.Timeout
+		handler.IdleTimeout = p.IdleTimeout
+		handler.KeepAliveInterval = p.KeepAliveInterval
+		handler.Logger = p.Logger
+		if p.Configure != nil {
+			p.Configure(deviceID, handler)
+		}
+		p.handlers[deviceID] = handler
+	}
+	old := p.conns[deviceID]
+	p.conns[deviceID] = c
+	p.mu.Unlock()
+
+	// Abort a pending request on the old connection, then swap it
+	if old != nil {
+		old.Close()
+	}
+	handler.mu.Lock()
+	if ok {
+		handler.reconnected(nil)
+	}
+	handler.setConn(c)
+	handler.mu.Unlock()
+	p.logf("modbus: dtu pool device '%v' connected from %v", deviceID, conn.RemoteAddr())
+	if p.OnConnect != nil {
+		p.OnConnect(deviceID)
+	}
+	return
+}
+
+// Handler returns the handler of the device or nil if it has never connected.
+// The handler remains valid when the device reconnects.
+func (p *DTUPool) Handler(deviceID string) *DTUClientHandler {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.handlers[deviceID]
+}
+
+// Client returns a client of the device or nil if it has never connected.
+func (p *DTUPool) Client(deviceID string) Client {
+	handler := p.Handler(deviceID)
+	if handler == nil {
+		return nil
+	}
+	return NewClient(handler)
+}
+
+// Devices returns the ids of the connected devices.
+func (p *DTUPool) Devices() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deviceIDs := make([]string, 0, len(p.conns))
+	for deviceID := range p.conns {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs
+}
+
+// Connections returns the number of connections open, those of the devices
+// and those being identified.
+func (p *DTUPool) Connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// Close closes all listeners and connections.
+func (p *DTUPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	conns := make([]*dtuPoolConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Shutdown closes all listeners, then closes the connection of each device
+// once its request in flight, if any, is done. If ctx is done first, the
+// remaining connections are closed as by Close and ctx.Err() is returned.
+func (p *DTUPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	handlers := make([]*DTUClientHandler, 0, len(p.conns))
+	conns := make([]*dtuPoolConn, 0, len(p.conns))
+	for deviceID, c := range p.conns {
+		handlers = append(handlers, p.handlers[deviceID])
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, handler := range handlers {
+			// Requests hold the lock of the handler until they are done
+			handler.mu.Lock()
+			handler.close()
+			handler.mu.Unlock()
+		}
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, c := range conns {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// identify reads the device id from the registration packet.
+func (p *DTUPool) identify(conn net.Conn) (deviceID string, err error) {
+	if p.Timeout > 0 {
+		if err = conn.SetReadDeadline(time.Now().Add(p.Timeout)); err != nil {
+			return
+		}
+	}
+	if p.Identify != nil {
+		deviceID, err = p.Identify(conn)
+	} else {
+		var data [dtuMaxSize]byte
+		var n int
+		n, err = conn.Read(data[:])
+		deviceID = string(bytes.TrimSpace(data[:n]))
+	}
+	if err != nil {
+		return
+	}
+	if deviceID == "" {
+		err = fmt.Errorf("modbus: empty device id")
+		return
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	return
+}
+
+// disconnect removes the connection of the device if it is still the current one.
+func (p *DTUPool) disconnect(c *dtuPoolConn) {
+	p.mu.Lock()
+	current := p.conns[c.deviceID] == c
+	if current {
+		delete(p.conns, c.deviceID)
+	}
+	p.mu.Unlock()
+
+	if current {
+		p.logf("modbus: dtu pool device '%v' disconnected", c.deviceID)
+		if p.OnDisconnect != nil {
+			p.OnDisconnect(c.deviceID)
+		}
+	}
+}
+
+// acquire counts a new connection, or returns false if MaxConnections are
+// open.
+func (p *DTUPool) acquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MaxConnections > 0 && p.open >= p.MaxConnections {
+		return false
+	}
+	p.open++
+	return true
+}
+
+// release uncounts a connection closed.
+func (p *DTUPool) release() {
+	p.mu.Lock()
+	p.open--
+	p.mu.Unlock()
+}
+
+func (p *DTUPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *DTUPool) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+	}
+}
+
+var (
+	errPoolClosed = errors.New("modbus: dtu pool closed")
+	errPoolFull   = errors.New("modbus: dtu pool has too many connections")
+)
+
+// dtuPoolConn notifies the pool when the connection is closed.
+type dtuPoolConn struct {
+	net.Conn
+	pool     *DTUPool
+	deviceID string
+	once     sync.Once
+}
+
+func (c *dtuPoolConn) Close() (err error) {
+	err = c.Conn.Close()
+	c.once.Do(func() {
+		c.pool.disconnect(c)
+		c.pool.release()
+	})
+	return
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialDevice connects a device answering with the server to the pool.
+func dialDevice(t *testing.T, pool *DTUPool, deviceID string, server *Server) net.Conn {
+	conn, device := net.Pipe()
+	go func() {
+		if _, err := device.Write([]byte(deviceID + "\r\n")); err != nil {
+			return
+		}
+		server.ServeConn(device)
+	}()
+	id, err := pool.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != deviceID {
+		t.Fatalf("device id: expected %q, actual %q", deviceID, id)
+	}
+	return device
+}
+
+func TestDTUPool(t *testing.T) {
+	pool := NewDTUPool()
+	defer pool.Close()
+	events := make(chan string, 10)
+	pool.OnConnect = func(deviceID string) { events <- "+" + deviceID }
+	pool.OnDisconnect = func(deviceID string) { events <- "-" + deviceID }
+
+	if pool.Client("SN001") != nil {
+		t.Fatal("client of unknown device must be nil")
+	}
+	device1 := NewServer()
+	device1.AddSlave(1).SetHoldingRegister(0, 1)
+	device2 := NewServer()
+	device2.AddSlave(1).SetHoldingRegister(0, 2)
+
+	dialDevice(t, pool, "SN001", device1)
+	handler := pool.Handler("SN001")
+	handler.SlaveId = 1
+	client := NewClient(handler)
+	results, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1] != 1 {
+		t.Fatalf("device 1: unexpected % x", results)
+	}
+
+	// The handler uses the new connection after reconnecting
+	conn := dialDevice(t, pool, "SN001", device2)
+	results, err = client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1] != 2 {
+		t.Fatalf("device 2: unexpected % x", results)
+	}
+	if devices := pool.Devices(); len(devices) != 1 || devices[0] != "SN001" {
+		t.Fatalf("devices: unexpected %v", devices)
+	}
+
+	conn.Close()
+	if _, err = client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected error on closed connection")
+	}
+	if devices := pool.Devices(); len(devices) != 0 {
+		t.Fatalf("devices: unexpected %v", devices)
+	}
+	close(events)
+	var actual []string
+	for event := range events {
+		actual = append(actual, event)
+	}
+	if len(actual) != 3 || actual[0] != "+SN001" || actual[1] != "+SN001" || actual[2] != "-SN001" {
+		t.Fatalf("events: unexpected %v", actual)
+	}
+}
+
+func TestDTUPoolIdentify(t *testing.T) {
+	pool := NewDTUPool()
+	defer pool.Close()
+	conn, device := net.Pipe()
+	defer device.Close()
+	go device.Write([]byte(" \r\n"))
+	if _, err := pool.Add(conn); err == nil {
+		t.Fatal("expected error for empty device id")
+	}
+}
+
+func TestDTUPoolShutdown(t *testing.T) {
+	pool := NewDTUPool()
+	pool.Configure = func(deviceID string, handler *DTUClientHandler) {
+		handler.SlaveId = 7
+	}
+	device := NewServer()
+	device.AddSlave(7)
+	started := make(chan struct{})
+	// Slow request in flight during shutdown
+	device.RegisterFunctionHandler(0x41, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{1}}, nil
+	})
+	dialDevice(t, pool, "SN001", device)
+	client := pool.Client("SN001")
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.SendPDU(&ProtocolDataUnit{FunctionCode: 0x41})
+		result <- err
+	}()
+	<-started
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("request in flight must be done: %v", err)
+	}
+	if devices := pool.Devices(); len(devices) != 0 {
+		t.Fatalf("devices: unexpected %v", devices)
+	}
+	if _, err := client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected error after shutdown")
+	}
+}
+
+func TestDTUPoolTLS(t *testing.T) {
+	certificate, roots := newTestCertificate(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewDTUPool()
+	pool.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	connected := make(chan string, 1)
+	pool.OnConnect = func(deviceID string) { connected <- deviceID }
+	go pool.Serve(ln)
+	defer pool.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("SN001\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if deviceID := <-connected; deviceID != "SN001" {
+		t.Fatalf("device id: expected %q, actual %q", "SN001", deviceID)
+	}
+}
+
+func TestDTUPoolReconnectBackoff(t *testing.T) {
+	pool := NewDTUPool()
+	defer pool.Close()
+	var reconnects []int
+	pool.Configure = func(deviceID string, handler *DTUClientHandler) {
+		handler.SlaveId = 1
+		handler.ReconnectBackoff = 50 * time.Millisecond
+		handler.OnReconnect = func(n int, err error) { reconnects = append(reconnects, n) }
+	}
+	server := NewServer()
+	server.AddSlave(1)
+
+	dialDevice(t, pool, "SN001", server)
+	dialDevice(t, pool, "SN001", server)
+	// Rejected during the backoff
+	conn, device := net.Pipe()
+	defer device.Close()
+	go device.Write([]byte("SN001"))
+	if _, err := pool.Add(conn); err == nil {
+		t.Fatal("expected error for reconnect during backoff")
+	}
+	time.Sleep(60 * time.Millisecond)
+	dialDevice(t, pool, "SN001", server)
+	if len(reconnects) != 2 || reconnects[1] != 2 {
+		t.Fatalf("reconnects: unexpected %v", reconnects)
+	}
+	// Reset by a successful request
+	if _, err := pool.Client("SN001").ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	dialDevice(t, pool, "SN001", server)
+	if len(reconnects) != 3 || reconnects[2] != 1 {
+		t.Fatalf("reconnects: unexpected %v", reconnects)
+	}
+}
+
+func TestDTUPoolMaxConnections(t *testing.T) {
+	pool := NewDTUPool()
+	defer pool.Close()
+	pool.MaxConnections = 1
+	rejected := make(chan net.Addr, 1)
+	pool.OnConnectionLimit = func(remoteAddr net.Addr) { rejected <- remoteAddr }
+
+	conn := dialDevice(t, pool, "SN001", NewServer())
+	if n := pool.Connections(); n != 1 {
+		t.Fatalf("connections: expected 1, actual %v", n)
+	}
+	extra, device := net.Pipe()
+	defer device.Close()
+	if _, err := pool.Add(extra); err != errPoolFull {
+		t.Fatalf("expected %v, actual %v", errPoolFull, err)
+	}
+	select {
+	case <-rejected:
+	case <-time.After(time.Second):
+		t.Fatal("expected OnConnectionLimit")
+	}
+	// Closed without reading its registration
+	if _, err := device.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected rejected connection to be closed")
+	}
+
+	// Room again once the device disconnects
+	conn.Close()
+	if err := pool.Handler("SN001").Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Connections(); n != 0 {
+		t.Fatalf("connections: expected 0, actual %v", n)
+	}
+	dialDevice(t, pool, "SN002", NewServer())
+	if n := pool.Connections(); n != 1 {
+		t.Fatalf("connections: expected 1, actual %v", n)
+	}
+}
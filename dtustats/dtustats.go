@@ -0,0 +1,193 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+// Package dtustats collects the statistics of the devices of a
+// modbus.DTUPool and publishes them with expvar or in the Prometheus text
+// exposition format, without depending on a metrics library.
+package dtustats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daijingjing/modbus"
+)
+
+// DeviceStats are the statistics of a device.
+type DeviceStats struct {
+	// Whether the device is connected to the pool
+	Connected bool
+	// Time of the last connection or response of the device, exceptions
+	// included
+	LastSeen time.Time
+	// Requests sent to the device and those failed, exceptions included
+	Requests uint64
+	Errors   uint64
+	// Round-trip time of the last response
+	RTT time.Duration
+}
+
+// Collector collects the statistics of the devices of the pools it is
+// attached to, keyed by device id. It is an expvar.Var publishing them as
+// JSON, e.g. expvar.Publish("dtu_devices", collector), and an http.Handler
+// serving them to Prometheus, labeled by device_id.
+type Collector struct {
+	mu      sync.Mutex
+	devices map[string]*DeviceStats
+}
+
+// New creates a Collector without any device.
+func New() *Collector {
+	return &Collector{devices: make(map[string]*DeviceStats)}
+}
+
+// Attach collects the statistics of the devices of pool. It chains the
+// Configure, OnConnect and OnDisconnect functions and the Metrics of the
+// handlers already set, so it must be called after setting them and before
+// the pool serves any device.
+func (c *Collector) Attach(pool *modbus.DTUPool) {
+	configure, onConnect, onDisconnect := pool.Configure, pool.OnConnect, pool.OnDisconnect
+	pool.Configure = func(deviceID string, handler *modbus.DTUClientHandler) {
+		if configure != nil {
+			configure(deviceID, handler)
+		}
+		metrics := handler.Metrics
+		handler.Metrics = modbus.MetricsFunc(func(slaveId, functionCode byte, duration time.Duration, err error) {
+			c.observe(deviceID, duration, err)
+			if metrics != nil {
+				metrics.ObserveRequest(slaveId, functionCode, duration, err)
+			}
+		})
+	}
+	pool.OnConnect = func(deviceID string) {
+		c.update(deviceID, func(stats *DeviceStats) {
+			stats.Connected = true
+			stats.LastSeen = time.Now()
+		})
+		if onConnect != nil {
+			onConnect(deviceID)
+		}
+	}
+	pool.OnDisconnect = func(deviceID string) {
+		c.update(deviceID, func(stats *DeviceStats) {
+			stats.Connected = false
+		})
+		if onDisconnect != nil {
+			onDisconnect(deviceID)
+		}
+	}
+}
+
+// Device returns the statistics of the device, false if it has never
+// connected.
+func (c *Collector) Device(deviceID string) (stats DeviceStats, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, found := c.devices[deviceID]; found {
+		return *s, true
+	}
+	return
+}
+
+// Snapshot returns the statistics of all devices by device id.
+func (c *Collector) Snapshot() map[string]DeviceStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]DeviceStats, len(c.devices))
+	for deviceID, stats := range c.devices {
+		snapshot[deviceID] = *stats
+	}
+	return snapshot
+}
+
+// String returns the statistics of all devices as JSON, for expvar.
+func (c *Collector) String() string {
+	b, err := json.Marshal(c.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ServeHTTP writes the statistics of all devices in the Prometheus text
+// exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snapshot := c.Snapshot()
+	deviceIDs := make([]string, 0, len(snapshot))
+	for deviceID := range snapshot {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", metric.name, metric.help, metric.name, metric.typ)
+		for _, deviceID := range deviceIDs {
+			stats := snapshot[deviceID]
+			fmt.Fprintf(w, "%v{device_id=\"%v\"} %v\n", metric.name, labelEscaper.Replace(deviceID), metric.value(&stats))
+		}
+	}
+}
+
+func (c *Collector) observe(deviceID string, duration time.Duration, err error) {
+	c.update(deviceID, func(stats *DeviceStats) {
+		stats.Requests++
+		category := modbus.CategorizeError(err)
+		if category != modbus.ErrorCategoryNone {
+			stats.Errors++
+		}
+		// The device has answered
+		if category == modbus.ErrorCategoryNone || category == modbus.ErrorCategoryException {
+			stats.LastSeen = time.Now()
+			stats.RTT = duration
+		}
+	})
+}
+
+func (c *Collector) update(deviceID string, f func(stats *DeviceStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.devices[deviceID]
+	if !ok {
+		stats = &DeviceStats{}
+		c.devices[deviceID] = stats
+	}
+	f(stats)
+}
+
+// labelEscaper escapes the label values of the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics are the metrics served to Prometheus.
+var metrics = []struct {
+	name, help, typ string
+	value           func(stats *DeviceStats) interface{}
+}{
+	{"modbus_dtu_device_connected", "Whether the device is connected.", "gauge", func(stats *DeviceStats) interface{} {
+		if stats.Connected {
+			return 1
+		}
+		return 0
+	}},
+	{"modbus_dtu_device_last_seen_timestamp_seconds", "Time of the last connection or response of the device.", "gauge", func(stats *DeviceStats) interface{} {
+		if stats.LastSeen.IsZero() {
+			return 0
+		}
+		return float64(stats.LastSeen.UnixNano()) / 1e9
+	}},
+	{"modbus_dtu_device_requests_total", "Requests sent to the device.", "counter", func(stats *DeviceStats) interface{} {
+		return stats.Requests
+	}},
+	{"modbus_dtu_device_errors_total", "Requests to the device failed, exceptions included.", "counter", func(stats *DeviceStats) interface{} {
+		return stats.Errors
+	}},
+	{"modbus_dtu_device_rtt_seconds", "Round-trip time of the last response of the device.", "gauge", func(stats *DeviceStats) interface{} {
+		return stats.RTT.Seconds()
+	}},
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package dtustats
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daijingjing/modbus"
+)
+
+func TestCollector(t *testing.T) {
+	pool := modbus.NewDTUPool()
+	defer pool.Close()
+	observed := 0
+	pool.Configure = func(deviceID string, handler *modbus.DTUClientHandler) {
+		handler.SlaveId = 1
+		handler.Metrics = modbus.MetricsFunc(func(slaveId, functionCode byte, d time.Duration, err error) {
+			observed++
+		})
+	}
+	collector := New()
+	collector.Attach(pool)
+
+	server := modbus.NewServer()
+	server.AddSlave(1)
+	conn, device := net.Pipe()
+	go func() {
+		if _, err := device.Write([]byte("SN\"1\r\n")); err != nil {
+			return
+		}
+		server.ServeConn(device)
+	}()
+	if _, err := pool.Add(conn); err != nil {
+		t.Fatal(err)
+	}
+	client := pool.Client(`SN"1`)
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadHoldingRegisters(0xFFFF, 2); err == nil {
+		t.Fatal("expected exception")
+	}
+	if observed != 2 {
+		t.Fatalf("metrics of the handler: expected 2 requests, actual %v", observed)
+	}
+	stats, ok := collector.Device(`SN"1`)
+	if !ok {
+		t.Fatal("expected device stats")
+	}
+	if !stats.Connected || stats.Requests != 2 || stats.Errors != 1 || stats.LastSeen.IsZero() || stats.RTT <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	var snapshot map[string]DeviceStats
+	if err := json.Unmarshal([]byte(collector.String()), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot[`SN"1`].Requests != 2 {
+		t.Fatalf("unexpected expvar %v", collector.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	collector.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE modbus_dtu_device_requests_total counter\n",
+		"modbus_dtu_device_connected{device_id=\"SN\\\"1\"} 1\n",
+		"modbus_dtu_device_requests_total{device_id=\"SN\\\"1\"} 2\n",
+		"modbus_dtu_device_errors_total{device_id=\"SN\\\"1\"} 1\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in:\n%v", expected, body)
+		}
+	}
+
+	pool.Handler(`SN"1`).Close()
+	if stats, _ = collector.Device(`SN"1`); stats.Connected {
+		t.Fatal("expected device disconnected")
+	}
+}
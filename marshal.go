@@ -0,0 +1,404 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Maximum number of registers in one write
+	maxWriteRegisters = 123
+)
+
+// registerTag is a parsed modbus struct tag:
+//  modbus:"addr=100,type=float32,order=cdab,len=4"
+// Values are optional except the address, the type is checked against the
+// type of the field.
+type registerTag struct {
+	address int
+	typ     string
+	order   WordOrder
+	length  int
+}
+
+func parseRegisterTag(name, tag string) (t registerTag, err error) {
+	t.address = -1
+	for _, option := range strings.Split(tag, ",") {
+		key, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "addr":
+			var address uint64
+			if address, err = strconv.ParseUint(value, 0, 16); err != nil {
+				err = fmt.Errorf("modbus: field '%v' address '%v' is invalid", name, value)
+				return
+			}
+			t.address = int(address)
+		case "type":
+			t.typ = value
+		case "order":
+			if t.order, err = parseWordOrder(value); err != nil {
+				err = fmt.Errorf("modbus: field '%v' word order '%v' is invalid", name, value)
+				return
+			}
+		case "len":
+			if t.length, err = strconv.Atoi(value); err != nil || t.length < 1 {
+				err = fmt.Errorf("modbus: field '%v' length '%v' is invalid", name, value)
+				return
+			}
+		default:
+			err = fmt.Errorf("modbus: field '%v' tag option '%v' is unknown", name, key)
+			return
+		}
+	}
+	if t.address < 0 {
+		err = fmt.Errorf("modbus: field '%v' tag '%v' has no address", name, tag)
+	}
+	return
+}
+
+// parseWordOrder parses the byte layout returned by WordOrder.String, case
+// insensitively.
+func parseWordOrder(s string) (WordOrder, error) {
+	for o := BigEndian; o <= LittleEndianSwap; o++ {
+		if strings.EqualFold(o.String(), s) {
+			return o, nil
+		}
+	}
+	return BigEndian, fmt.Errorf("modbus: word order '%v' is unknown", s)
+}
+
+// kindRegisters returns the number of registers holding a value of kind.
+func kindRegisters(kind reflect.Kind) int {
+	switch kind {
+	case reflect.Uint16, reflect.Int16:
+		return 1
+	case reflect.Uint32, reflect.Int32, reflect.Float32:
+		return 2
+	}
+	return 0
+}
+
+// registerField is a tagged field of a struct mapped to registers.
+type registerField struct {
+	index   []int
+	address int
+	kind    reflect.Kind
+	order   WordOrder
+	// Number of elements of arrays and slices, 0 for a single value
+	count int
+}
+
+// registers returns the number of registers of the field.
+func (f *registerField) registers() int {
+	if f.count > 0 {
+		return f.count * kindRegisters(f.kind)
+	}
+	return kindRegisters(f.kind)
+}
+
+// structFields returns the tagged fields of struct type t, including those of
+// nested structs. Addresses of a tagged nested struct are relative to its own.
+func structFields(t reflect.Type, base int, index []int, fields []registerField) ([]registerField, error) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		tag, tagged := field.Tag.Lookup("modbus")
+		if tag == "-" {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), i)
+		if field.Type.Kind() == reflect.Struct {
+			nestedBase := base
+			if tagged {
+				opts, err := parseRegisterTag(field.Name, tag)
+				if err != nil {
+					return nil, err
+				}
+				nestedBase += opts.address
+			}
+			var err error
+			if fields, err = structFields(field.Type, nestedBase, fieldIndex, fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !tagged {
+			continue
+		}
+		opts, err := parseRegisterTag(field.Name, tag)
+		if err != nil {
+			return nil, err
+		}
+		f := registerField{index: fieldIndex, address: base + opts.address, order: opts.order}
+		elem := field.Type
+		switch elem.Kind() {
+		case reflect.Array:
+			if elem.Len() == 0 {
+				return nil, fmt.Errorf("modbus: array field '%v' has no element", field.Name)
+			}
+			f.count = elem.Len()
+			elem = elem.Elem()
+		case reflect.Slice:
+			if opts.length == 0 {
+				return nil, fmt.Errorf("modbus: slice field '%v' has no length", field.Name)
+			}
+			f.count = opts.length
+			elem = elem.Elem()
+		}
+		f.kind = elem.Kind()
+		if kindRegisters(f.kind) == 0 {
+			return nil, fmt.Errorf("modbus: field '%v' of type '%v' is not supported", field.Name, field.Type)
+		}
+		if opts.typ != "" && opts.typ != f.kind.String() {
+			return nil, fmt.Errorf("modbus: field '%v' type '%v' does not match '%v'", field.Name, opts.typ, f.kind)
+		}
+		if f.address+f.registers() > 0x10000 {
+			return nil, fmt.Errorf("modbus: field '%v' address '%v' is out of range", field.Name, f.address)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// structLayout returns the tagged fields of the struct v and the register
+// range they span.
+func structLayout(v reflect.Value) (fields []registerField, start, end int, err error) {
+	if v.Kind() != reflect.Struct {
+		err = fmt.Errorf("modbus: '%v' is not a struct", v.Type())
+		return
+	}
+	if fields, err = structFields(v.Type(), 0, nil, nil); err != nil {
+		return
+	}
+	if len(fields) == 0 {
+		err = fmt.Errorf("modbus: '%v' has no modbus fields", v.Type())
+		return
+	}
+	start, end = fields[0].address, 0
+	for _, f := range fields {
+		if f.address < start {
+			start = f.address
+		}
+		if e := f.address + f.registers(); e > end {
+			end = e
+		}
+	}
+	return
+}
+
+// structValue returns the struct v, or the struct it points to.
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("modbus: '%T' is not a struct or a non-nil pointer to one", v)
+	}
+	return rv, nil
+}
+
+// structPointer returns the struct pointed to by v.
+func structPointer(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return reflect.Value{}, fmt.Errorf("modbus: '%T' is not a non-nil pointer", v)
+	}
+	return rv.Elem(), nil
+}
+
+// Unmarshal decodes the registers in data into the struct pointed to by v.
+// Fields are mapped by their modbus tag, e.g.:
+//  type Meter struct {
+//  	FlowRate float32   `modbus:"addr=100,order=cdab"`
+//  	Status   uint16    `modbus:"addr=102,type=uint16"`
+//  	History  []int16   `modbus:"addr=103,len=4"`
+//  	Phases   [3]uint32 `modbus:"addr=110"`
+//  	Limits   Limits    `modbus:"addr=120"`
+//  }
+// Supported types are uint16, int16, uint32, int32 and float32 as well as
+// arrays, slices (given their len) and nested structs of them. Addresses of
+// the fields of a tagged nested struct are relative to its address. Unexported
+// fields and untagged ones other than structs are skipped. data holds the
+// registers starting at the lowest address of the fields.
+func Unmarshal(data []byte, v interface{}) error {
+	rv, err := structPointer(v)
+	if err != nil {
+		return err
+	}
+	fields, start, end, err := structLayout(rv)
+	if err != nil {
+		return err
+	}
+	if len(data) < (end-start)*2 {
+		return fmt.Errorf("modbus: data size '%v' is less than expected '%v'", len(data), (end-start)*2)
+	}
+	for _, f := range fields {
+		fv := rv.FieldByIndex(f.index)
+		b := data[(f.address-start)*2:]
+		if f.count == 0 {
+			decodeRegisterValue(fv, f.kind, f.order, b)
+			continue
+		}
+		if fv.Kind() == reflect.Slice {
+			fv.Set(reflect.MakeSlice(fv.Type(), f.count, f.count))
+		}
+		size := kindRegisters(f.kind) * 2
+		for i := 0; i < f.count; i++ {
+			decodeRegisterValue(fv.Index(i), f.kind, f.order, b[i*size:])
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the struct v, or the struct it points to, in registers
+// starting at the lowest address of its fields, see Unmarshal. Registers
+// between the fields are zero.
+func Marshal(v interface{}) (data []byte, err error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return
+	}
+	fields, start, end, err := structLayout(rv)
+	if err != nil {
+		return
+	}
+	data, err = marshalFields(rv, fields, start, end)
+	return
+}
+
+func marshalFields(rv reflect.Value, fields []registerField, start, end int) (data []byte, err error) {
+	data = make([]byte, (end-start)*2)
+	for _, f := range fields {
+		fv := rv.FieldByIndex(f.index)
+		b := data[(f.address-start)*2:]
+		if f.count == 0 {
+			encodeRegisterValue(fv, f.kind, f.order, b)
+			continue
+		}
+		if fv.Len() != f.count {
+			err = fmt.Errorf("modbus: field length '%v' does not match '%v'", fv.Len(), f.count)
+			return nil, err
+		}
+		size := kindRegisters(f.kind) * 2
+		for i := 0; i < f.count; i++ {
+			encodeRegisterValue(fv.Index(i), f.kind, f.order, b[i*size:])
+		}
+	}
+	return
+}
+
+// ReadInto reads the holding registers spanned by the fields of the struct
+// pointed to by v and decodes them into it, see Unmarshal. Registers are read
+// in requests of up to 125 registers, including those between the fields.
+func ReadInto(client Client, v interface{}) error {
+	rv, err := structPointer(v)
+	if err != nil {
+		return err
+	}
+	_, start, end, err := structLayout(rv)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, (end-start)*2)
+	for address := start; address < end; address += maxReadRegisters {
+		quantity := end - address
+		if quantity > maxReadRegisters {
+			quantity = maxReadRegisters
+		}
+		results, err := client.ReadHoldingRegisters(uint16(address), uint16(quantity))
+		if err != nil {
+			return err
+		}
+		if len(results) != quantity*2 {
+			return fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(results), quantity*2)
+		}
+		data = append(data, results...)
+	}
+	return Unmarshal(data, v)
+}
+
+// WriteFrom encodes the struct v, or the struct it points to, and writes the
+// holding registers of its fields, see Marshal. Registers between the fields
+// are not written.
+func WriteFrom(client Client, v interface{}) error {
+	rv, err := structValue(v)
+	if err != nil {
+		return err
+	}
+	fields, start, end, err := structLayout(rv)
+	if err != nil {
+		return err
+	}
+	data, err := marshalFields(rv, fields, start, end)
+	if err != nil {
+		return err
+	}
+	// Write the runs of adjacent fields
+	written := make([]bool, end-start)
+	for _, f := range fields {
+		for i := 0; i < f.registers(); i++ {
+			written[f.address-start+i] = true
+		}
+	}
+	for i := 0; i < len(written); {
+		if !written[i] {
+			i++
+			continue
+		}
+		n := 1
+		for i+n < len(written) && written[i+n] && n < maxWriteRegisters {
+			n++
+		}
+		if _, err = client.WriteMultipleRegisters(uint16(start+i), uint16(n), data[i*2:(i+n)*2]); err != nil {
+			return err
+		}
+		i += n
+	}
+	return nil
+}
+
+func decodeRegisterValue(v reflect.Value, kind reflect.Kind, order WordOrder, b []byte) {
+	switch kind {
+	case reflect.Uint16:
+		v.SetUint(uint64(binary.BigEndian.Uint16(b)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(binary.BigEndian.Uint16(b))))
+	case reflect.Uint32:
+		v.SetUint(uint64(order.Uint32(b)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(order.Uint32(b))))
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(order.Uint32(b))))
+	}
+}
+
+func encodeRegisterValue(v reflect.Value, kind reflect.Kind, order WordOrder, b []byte) {
+	switch kind {
+	case reflect.Uint16:
+		binary.BigEndian.PutUint16(b, uint16(v.Uint()))
+	case reflect.Int16:
+		binary.BigEndian.PutUint16(b, uint16(v.Int()))
+	case reflect.Uint32:
+		order.PutUint32(b, uint32(v.Uint()))
+	case reflect.Int32:
+		order.PutUint32(b, uint32(v.Int()))
+	case reflect.Float32:
+		order.PutUint32(b, math.Float32bits(float32(v.Float())))
+	}
+}
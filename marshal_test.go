@@ -0,0 +1,145 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type limits struct {
+	Low  int16 `modbus:"addr=0"`
+	High int16 `modbus:"addr=1"`
+}
+
+type meterRegisters struct {
+	FlowRate float32   `modbus:"addr=100,order=cdab"`
+	Status   uint16    `modbus:"addr=102,type=uint16"`
+	History  []int16   `modbus:"addr=103,len=2"`
+	Phases   [2]uint32 `modbus:"addr=106"`
+	Limits   limits    `modbus:"addr=110"`
+	Offset   int32     `modbus:"addr=112"`
+	Name     string
+	internal uint16 `modbus:"addr=0"`
+}
+
+var meterData = []byte{
+	0x00, 0x00, 0x42, 0x28, // 100: 42.0 CDAB
+	0x00, 0x07, // 102
+	0xFF, 0xFF, 0x00, 0x02, // 103: -1, 2
+	0x00, 0x00, // 105: gap
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // 106: 65536, 3
+	0xFF, 0xF6, 0x00, 0x0A, // 110: -10, 10
+	0xFF, 0xFF, 0xFF, 0xFE, // 112: -2
+}
+
+func TestUnmarshal(t *testing.T) {
+	var m meterRegisters
+	if err := Unmarshal(meterData, &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := meterRegisters{
+		FlowRate: 42,
+		Status:   7,
+		History:  []int16{-1, 2},
+		Phases:   [2]uint32{65536, 3},
+		Limits:   limits{-10, 10},
+		Offset:   -2,
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(m) {
+		t.Fatalf("expected %+v, actual %+v", expected, m)
+	}
+	data, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(meterData, data) {
+		t.Fatalf("marshal: expected % x, actual % x", meterData, data)
+	}
+	if err = Unmarshal(meterData[:len(meterData)-1], &m); err == nil {
+		t.Fatal("expected error for short data")
+	}
+	m.History = m.History[:1]
+	if _, err = Marshal(&m); err == nil {
+		t.Fatal("expected error for slice length")
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	invalid := []interface{}{
+		meterRegisters{},
+		&struct{ A uint16 }{},
+		&struct {
+			A uint16 `modbus:"type=uint16"`
+		}{},
+		&struct {
+			A uint16 `modbus:"addr=1,type=int16"`
+		}{},
+		&struct {
+			A []uint16 `modbus:"addr=1"`
+		}{},
+		&struct {
+			A uint64 `modbus:"addr=1"`
+		}{},
+		&struct {
+			A uint16 `modbus:"addr=1,size=2"`
+		}{},
+		&struct {
+			A uint32 `modbus:"addr=65535"`
+		}{},
+		&struct {
+			A [0]uint16 `modbus:"addr=1"`
+		}{},
+	}
+	for _, v := range invalid {
+		if err := Unmarshal(make([]byte, 10), v); err == nil {
+			t.Errorf("%#v: expected error", v)
+		}
+	}
+	for _, v := range []interface{}{nil, (*meterRegisters)(nil), 1} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("marshal %#v: expected error", v)
+		}
+		if err := WriteFrom(&registerClient{registers: make([]byte, 10)}, v); err == nil {
+			t.Errorf("write from %#v: expected error", v)
+		}
+	}
+}
+
+// writeCountingClient records the writes of a registerClient.
+type writeCountingClient struct {
+	registerClient
+
+	writes []string
+}
+
+func (c *writeCountingClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	c.writes = append(c.writes, fmt.Sprintf("%v+%v", address, quantity))
+	return c.registerClient.WriteMultipleRegisters(address, quantity, value)
+}
+
+func TestReadIntoWriteFrom(t *testing.T) {
+	c := &writeCountingClient{registerClient: registerClient{registers: make([]byte, 2*200)}}
+	copy(c.registers[200:], meterData)
+	var m meterRegisters
+	if err := ReadInto(c, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.FlowRate != 42 || m.Offset != -2 {
+		t.Fatalf("unexpected %+v", m)
+	}
+	m.Status = 8
+	if err := WriteFrom(c, &m); err != nil {
+		t.Fatal(err)
+	}
+	// The gap at 105 is not written
+	if fmt.Sprint(c.writes) != "[100+5 106+8]" {
+		t.Fatalf("writes: unexpected %v", c.writes)
+	}
+	if c.registers[205] != 8 {
+		t.Fatalf("status: unexpected % x", c.registers[204:206])
+	}
+}
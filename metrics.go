@@ -0,0 +1,104 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Metrics observes the requests of a client. It is set in the Metrics field
+// of a handler and called after each request with its duration and error.
+type Metrics interface {
+	ObserveRequest(slaveId, functionCode byte, duration time.Duration, err error)
+}
+
+// MetricsFunc is an adapter to use an ordinary function as Metrics.
+type MetricsFunc func(slaveId, functionCode byte, duration time.Duration, err error)
+
+// ObserveRequest calls f(slaveId, functionCode, duration, err).
+func (f MetricsFunc) ObserveRequest(slaveId, functionCode byte, duration time.Duration, err error) {
+	f(slaveId, functionCode, duration, err)
+}
+
+// ErrorCategory classifies request errors for metrics.
+type ErrorCategory int
+
+const (
+	ErrorCategoryNone ErrorCategory = iota
+	ErrorCategoryTimeout
+	ErrorCategoryFraming
+	ErrorCategoryException
+	ErrorCategoryOther
+)
+
+// String returns the category name used as metric label.
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorCategoryNone:
+		return "none"
+	case ErrorCategoryTimeout:
+		return "timeout"
+	case ErrorCategoryFraming:
+		return "framing"
+	case ErrorCategoryException:
+		return "exception"
+	default:
+		return "other"
+	}
+}
+
+// CategorizeError returns the category of a request error: a timeout, a
+// malformed response frame, a modbus exception or any other error.
+func CategorizeError(err error) ErrorCategory {
+	if err == nil {
+		return ErrorCategoryNone
+	}
+	if errors.Is(err, ErrTimeout) {
+		return ErrorCategoryTimeout
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return ErrorCategoryTimeout
+	}
+	var fe *frameError
+	if errors.As(err, &fe) {
+		return ErrorCategoryFraming
+	}
+	var mbError *ModbusError
+	if errors.As(err, &mbError) {
+		return ErrorCategoryException
+	}
+	return ErrorCategoryOther
+}
+
+// metricsTransporter is implemented by the transporters having a Metrics field.
+type metricsTransporter interface {
+	metrics() Metrics
+}
+
+// hookTransporter is implemented by the transporters having OnRequest and
+// OnResponse fields.
+type hookTransporter interface {
+	hooks() (onRequest func(adu []byte), onResponse func(adu []byte, err error))
+}
+
+// validatorTransporter is implemented by the transporters having a
+// ResponseValidator field.
+type validatorTransporter interface {
+	responseValidator() func(aduRequest, aduResponse []byte) error
+}
+
+// breakerTransporter is implemented by the transporters having a
+// CircuitBreaker field.
+type breakerTransporter interface {
+	circuitBreaker() *CircuitBreaker
+}
+
+// defaultSlavePackager is implemented by the packagers having a SlaveId field.
+type defaultSlavePackager interface {
+	defaultSlaveId() byte
+}
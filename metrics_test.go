@@ -0,0 +1,73 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errorCategoryTests = []struct {
+	err      error
+	category ErrorCategory
+}{
+	{nil, ErrorCategoryNone},
+	{netTimeoutError{}, ErrorCategoryTimeout},
+	{context.DeadlineExceeded, ErrorCategoryTimeout},
+	{&frameError{errors.New("modbus: response crc '1' does not match expected '2'")}, ErrorCategoryFraming},
+	{fmt.Errorf("read: %w", &ModbusError{ExceptionCode: ExceptionCodeServerDeviceBusy}), ErrorCategoryException},
+	{context.Canceled, ErrorCategoryOther},
+}
+
+func TestCategorizeError(t *testing.T) {
+	for _, input := range errorCategoryTests {
+		if category := CategorizeError(input.err); category != input.category {
+			t.Errorf("%v: expected %v, actual %v", input.err, input.category, category)
+		}
+	}
+}
+
+type observation struct {
+	slaveId, functionCode byte
+	category              ErrorCategory
+}
+
+func TestClientMetrics(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	var observations []observation
+	handler.Metrics = MetricsFunc(func(slaveId, functionCode byte, duration time.Duration, err error) {
+		if duration <= 0 {
+			t.Errorf("duration must be positive: %v", duration)
+		}
+		observations = append(observations, observation{slaveId, functionCode, CategorizeError(err)})
+	})
+	client := NewClient(handler)
+
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFIFOQueue(0); err == nil {
+		t.Fatal("expected exception")
+	}
+	ctx, cancel := context.WithTimeout(WithSlaveId(context.Background(), 9), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.ReadInputRegistersContext(ctx, 0, 1); err == nil {
+		t.Fatal("expected timeout")
+	}
+	expected := []observation{
+		{1, FuncCodeReadHoldingRegisters, ErrorCategoryNone},
+		{1, FuncCodeReadFIFOQueue, ErrorCategoryException},
+		{9, FuncCodeReadInputRegisters, ErrorCategoryTimeout},
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(observations) {
+		t.Fatalf("observations: expected %v, actual %v", expected, observations)
+	}
+}
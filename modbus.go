@@ -8,6 +8,8 @@ Package modbus provides a client for MODBUS TCP and RTU/ASCII.
 package modbus
 
 import (
+	"context"
+	"errors"
 	"fmt"
 )
 
@@ -26,6 +28,63 @@ const (
 	FuncCodeReadWriteMultipleRegisters = 23
 	FuncCodeMaskWriteRegister          = 22
 	FuncCodeReadFIFOQueue              = 24
+
+	// File record access
+	FuncCodeReadFileRecord  = 20
+	FuncCodeWriteFileRecord = 21
+
+	// Diagnostics (serial line only)
+	FuncCodeReadExceptionStatus = 7
+	FuncCodeDiagnostics         = 8
+	FuncCodeGetCommEventCounter = 11
+	FuncCodeGetCommEventLog     = 12
+	FuncCodeReportServerID      = 17
+
+	// Encapsulated interface transport
+	FuncCodeEncapsulatedInterfaceTransport = 43
+)
+
+// MEI types of FuncCodeEncapsulatedInterfaceTransport
+const (
+	MEITypeReadDeviceIdentification = 0x0E
+)
+
+// Read device id codes of MEITypeReadDeviceIdentification
+const (
+	ReadDeviceIDCodeBasic    = 0x01
+	ReadDeviceIDCodeRegular  = 0x02
+	ReadDeviceIDCodeExtended = 0x03
+	ReadDeviceIDCodeSpecific = 0x04
+)
+
+// Object ids of the basic and regular device identification categories
+const (
+	ObjectIDVendorName          = 0x00
+	ObjectIDProductCode         = 0x01
+	ObjectIDMajorMinorRevision  = 0x02
+	ObjectIDVendorURL           = 0x03
+	ObjectIDProductName         = 0x04
+	ObjectIDModelName           = 0x05
+	ObjectIDUserApplicationName = 0x06
+)
+
+// Sub-function codes of FuncCodeDiagnostics
+const (
+	DiagnosticsReturnQueryData                = 0x00
+	DiagnosticsRestartComm                    = 0x01
+	DiagnosticsReturnDiagnosticRegister       = 0x02
+	DiagnosticsChangeASCIIInputDelimiter      = 0x03
+	DiagnosticsForceListenOnlyMode            = 0x04
+	DiagnosticsClearCounters                  = 0x0A
+	DiagnosticsReturnBusMessageCount          = 0x0B
+	DiagnosticsReturnBusCommErrorCount        = 0x0C
+	DiagnosticsReturnBusExceptionErrorCount   = 0x0D
+	DiagnosticsReturnServerMessageCount       = 0x0E
+	DiagnosticsReturnServerNoResponseCount    = 0x0F
+	DiagnosticsReturnServerNAKCount           = 0x10
+	DiagnosticsReturnServerBusyCount          = 0x11
+	DiagnosticsReturnBusCharacterOverrunCount = 0x12
+	DiagnosticsClearOverrunCounterAndFlag     = 0x14
 )
 
 const (
@@ -74,12 +133,132 @@ func (e *ModbusError) Error() string {
 	return fmt.Sprintf("modbus: exception '%v' (%s), function '%v'", e.ExceptionCode, name, e.FunctionCode)
 }
 
+// Is reports whether target is ErrNotSupported for an illegal function
+// exception.
+func (e *ModbusError) Is(target error) bool {
+	return target == ErrNotSupported && e.ExceptionCode == ExceptionCodeIllegalFunction
+}
+
+// ErrNotSupported is matched by errors.Is for the exception responses of the
+// devices not implementing the function requested, i.e. with exception code
+// ExceptionCodeIllegalFunction.
+var ErrNotSupported = errors.New("modbus: function not supported")
+
+// ErrClosed is returned by the requests of a transporter closed by Close,
+// until it is connected again with Connect, and by an AsyncClient closed.
+var ErrClosed = errors.New("modbus: transporter is closed")
+
+// ErrCancelled is returned by SendWithCancel when its done channel is closed
+// before the response.
+var ErrCancelled = errors.New("modbus: request cancelled")
+
+// ErrTimeout is matched by errors.Is for the errors of the requests and
+// connections timing out, e.g. after Timeout. The underlying error, such as
+// a net.Error, is returned by errors.Unwrap. Errors of a context reaching
+// its deadline are returned as is.
+var ErrTimeout = errors.New("modbus: timeout")
+
+// timeoutError wraps a timeout error so that it matches ErrTimeout.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Timeout and Temporary implement net.Error like the wrapped errors.
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// EchoError is returned by the write functions when the response does not
+// echo a field of the request, e.g. a value clamped or silently rejected by
+// the device.
+type EchoError struct {
+	FunctionCode byte
+	// Echoed field: address, value, quantity, AND-mask or OR-mask
+	Field    string
+	Request  uint16
+	Response uint16
+}
+
+// Error returns the mismatching field and values.
+func (e *EchoError) Error() string {
+	return fmt.Sprintf("modbus: response %v '%v' does not match request '%v'", e.Field, e.Response, e.Request)
+}
+
+// CoilMismatchError is returned by WriteMultipleCoilsBoolVerified when the
+// coils read back do not hold the values written, e.g. writes silently
+// dropped by a relay board.
+type CoilMismatchError struct {
+	// Address of the first coil written
+	Address uint16
+	// Offsets from Address of the mismatching coils, in increasing order
+	Indices []int
+}
+
+// Error returns the mismatching coils, the first 16 of them.
+func (e *CoilMismatchError) Error() string {
+	if len(e.Indices) > 16 {
+		return fmt.Sprintf("modbus: coils at offsets '%v' and '%v' more from address '%v' do not match the values written",
+			e.Indices[:16], len(e.Indices)-16, e.Address)
+	}
+	return fmt.Sprintf("modbus: coils at offsets '%v' from address '%v' do not match the values written", e.Indices, e.Address)
+}
+
+// ErrInvalidQuantity is matched by errors.Is for the errors of the requests
+// not sent because of a quantity out of the range of their function.
+var ErrInvalidQuantity = errors.New("modbus: invalid quantity")
+
+// QuantityError is returned without sending the request when a quantity is
+// out of the range of the function, e.g. 1 to 125 registers to read. It
+// matches ErrInvalidQuantity.
+type QuantityError struct {
+	FunctionCode byte
+	// Field is the quantity, e.g. "quantity to read"
+	Field    string
+	Quantity int
+	Min, Max int
+}
+
+// Error returns the quantity and its range.
+func (e *QuantityError) Error() string {
+	return fmt.Sprintf("modbus: %v '%v' must be between '%v' and '%v'", e.Field, e.Quantity, e.Min, e.Max)
+}
+
+// Is reports whether target is ErrInvalidQuantity.
+func (e *QuantityError) Is(target error) bool {
+	return target == ErrInvalidQuantity
+}
+
 // ProtocolDataUnit (PDU) is independent of underlying communication layers.
 type ProtocolDataUnit struct {
 	FunctionCode byte
 	Data         []byte
 }
 
+// Logger is the transmission logger of the handlers. It is implemented by
+// *log.Logger, LoggerFunc adapts other logging libraries.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LoggerFunc is an adapter to use an ordinary function as Logger.
+type LoggerFunc func(format string, v ...interface{})
+
+// Printf calls f(format, v...).
+func (f LoggerFunc) Printf(format string, v ...interface{}) {
+	f(format, v...)
+}
+
 // Packager specifies the communication layer.
 type Packager interface {
 	Encode(pdu *ProtocolDataUnit) (adu []byte, err error)
@@ -87,7 +266,34 @@ type Packager interface {
 	Verify(aduRequest []byte, aduResponse []byte) (err error)
 }
 
-// Transporter specifies the transport layer.
+// SlavePackager is implemented by packagers which can address another slave
+// than their default one for a single request, see WithSlaveId.
+type SlavePackager interface {
+	EncodeSlave(slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error)
+}
+
+// Transporter specifies the transport layer. The response returned by Send
+// is owned by the caller, transporters reading into reused buffers return a
+// copy.
 type Transporter interface {
 	Send(aduRequest []byte) (aduResponse []byte, err error)
 }
+
+// ContextTransporter is implemented by transporters which can abort a request
+// when the given context is done.
+type ContextTransporter interface {
+	SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error)
+}
+
+// BroadcastTransporter is implemented by transporters of serial line frames,
+// where slave id 0 addresses all slaves and none of them replies.
+type BroadcastTransporter interface {
+	SendBroadcast(ctx context.Context, aduRequest []byte) (err error)
+}
+
+// NoResponseTransporter is implemented by transporters which can send the
+// request of a function without response, e.g. a vendor specific one, without
+// waiting for a response.
+type NoResponseTransporter interface {
+	SendNoResponse(ctx context.Context, aduRequest []byte) (err error)
+}
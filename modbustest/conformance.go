@@ -0,0 +1,149 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+// Package modbustest provides utilities for testing Modbus clients and
+// transporters.
+package modbustest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/daijingjing/modbus"
+)
+
+// ConformanceTest is a test of one function of a client. It returns an error
+// if the response is not as expected.
+type ConformanceTest struct {
+	Name string
+	Test func(client modbus.Client) error
+}
+
+// ConformanceTests are the tests run by ConformanceSuite. They write coils
+// and holding registers at address 0 to 19.
+var ConformanceTests = []ConformanceTest{
+	{"ReadCoils", func(client modbus.Client) error {
+		results, err := client.ReadCoils(0, 10)
+		return expectLength(results, err, 2)
+	}},
+	{"ReadDiscreteInputs", func(client modbus.Client) error {
+		results, err := client.ReadDiscreteInputs(0, 10)
+		return expectLength(results, err, 2)
+	}},
+	{"ReadHoldingRegisters", func(client modbus.Client) error {
+		results, err := client.ReadHoldingRegisters(0, 3)
+		return expectLength(results, err, 6)
+	}},
+	{"ReadInputRegisters", func(client modbus.Client) error {
+		results, err := client.ReadInputRegisters(0, 1)
+		return expectLength(results, err, 2)
+	}},
+	{"WriteSingleCoil", func(client modbus.Client) error {
+		results, err := client.WriteSingleCoil(1, 0xFF00)
+		return expectResults(results, err, []byte{0xFF, 0x00})
+	}},
+	{"WriteSingleRegister", func(client modbus.Client) error {
+		results, err := client.WriteSingleRegister(1, 0x0003)
+		return expectResults(results, err, []byte{0x00, 0x03})
+	}},
+	{"WriteMultipleCoils", func(client modbus.Client) error {
+		results, err := client.WriteMultipleCoils(2, 10, []byte{0xCD, 0x01})
+		return expectResults(results, err, []byte{0x00, 0x0A})
+	}},
+	{"WriteMultipleRegisters", func(client modbus.Client) error {
+		results, err := client.WriteMultipleRegisters(2, 2, []byte{0x00, 0x0A, 0x01, 0x02})
+		return expectResults(results, err, []byte{0x00, 0x02})
+	}},
+	{"MaskWriteRegister", func(client modbus.Client) error {
+		results, err := client.MaskWriteRegister(4, 0x00F2, 0x0025)
+		return expectResults(results, err, []byte{0x00, 0xF2, 0x00, 0x25})
+	}},
+	{"ReadWriteMultipleRegisters", func(client modbus.Client) error {
+		results, err := client.ReadWriteMultipleRegisters(0, 6, 10, 3, []byte{0x00, 0xFF, 0x00, 0xFF, 0x00, 0xFF})
+		return expectLength(results, err, 12)
+	}},
+	{"ReadFIFOQueue", func(client modbus.Client) error {
+		_, err := client.ReadFIFOQueue(0)
+		return err
+	}},
+	{"ReadFileRecord", func(client modbus.Client) error {
+		_, err := client.ReadFileRecord([]modbus.FileRecord{{FileNumber: 1, RecordLength: 1}})
+		return err
+	}},
+	{"ReadExceptionStatus", func(client modbus.Client) error {
+		_, err := client.ReadExceptionStatus()
+		return err
+	}},
+	{"Diagnostics", func(client modbus.Client) error {
+		results, err := client.Diagnostics(modbus.DiagnosticsReturnQueryData, 0xA537)
+		return expectResults(results, err, []byte{0xA5, 0x37})
+	}},
+	{"GetCommEventCounter", func(client modbus.Client) error {
+		_, _, err := client.GetCommEventCounter()
+		return err
+	}},
+	{"GetCommEventLog", func(client modbus.Client) error {
+		_, err := client.GetCommEventLog()
+		return err
+	}},
+	{"ReportServerID", func(client modbus.Client) error {
+		_, _, err := client.ReportServerID()
+		return err
+	}},
+	{"ReadDeviceIdentification", func(client modbus.Client) error {
+		_, err := client.ReadDeviceIdentification(modbus.ReadDeviceIDCodeBasic, 0)
+		return err
+	}},
+}
+
+// ConformanceSuite runs each of ConformanceTests against client in a subtest.
+// Tests of the functions the device does not support, i.e. responding with
+// an illegal function or illegal data address exception, are skipped.
+func ConformanceSuite(t *testing.T, client modbus.Client) {
+	for _, test := range ConformanceTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Test(client)
+			if IsUnsupported(err) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// IsUnsupported reports whether err is an exception response of a device not
+// supporting the function or the addresses requested.
+func IsUnsupported(err error) bool {
+	var mbError *modbus.ModbusError
+	if !errors.As(err, &mbError) {
+		return false
+	}
+	return mbError.ExceptionCode == modbus.ExceptionCodeIllegalFunction ||
+		mbError.ExceptionCode == modbus.ExceptionCodeIllegalDataAddress
+}
+
+func expectLength(results []byte, err error, length int) error {
+	if err != nil {
+		return err
+	}
+	if len(results) != length {
+		return fmt.Errorf("response data size '%v' does not match expected '%v'", len(results), length)
+	}
+	return nil
+}
+
+func expectResults(results []byte, err error, expected []byte) error {
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(results, expected) {
+		return fmt.Errorf("response data '% x' does not match expected '% x'", results, expected)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbustest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/daijingjing/modbus"
+)
+
+func TestConformanceSuite(t *testing.T) {
+	server := modbus.NewServer()
+	server.AddSlave(1)
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	handler := modbus.NewDTUClientHandler(client)
+	handler.SlaveId = 1
+	defer handler.Close()
+
+	ConformanceSuite(t, modbus.NewClient(handler))
+}
+
+func TestIsUnsupported(t *testing.T) {
+	tests := []struct {
+		err         error
+		unsupported bool
+	}{
+		{nil, false},
+		{errors.New("modbus: response data size '1' does not match count '2'"), false},
+		{&modbus.ModbusError{FunctionCode: 0x98, ExceptionCode: modbus.ExceptionCodeIllegalFunction}, true},
+		{fmt.Errorf("read: %w", &modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeIllegalDataAddress}), true},
+		{&modbus.ModbusError{FunctionCode: 0x83, ExceptionCode: modbus.ExceptionCodeServerDeviceFailure}, false},
+	}
+	for _, test := range tests {
+		if unsupported := IsUnsupported(test.err); unsupported != test.unsupported {
+			t.Errorf("%v: expected %v, actual %v", test.err, test.unsupported, unsupported)
+		}
+	}
+}
+
+func TestExpectResults(t *testing.T) {
+	if err := expectResults([]byte{0x00, 0x03}, nil, []byte{0x00, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectResults([]byte{0x00, 0x04}, nil, []byte{0x00, 0x03}); err == nil {
+		t.Fatal("expected error for unexpected echo")
+	}
+	if err := expectLength([]byte{0x00}, nil, 2); err == nil {
+		t.Fatal("expected error for unexpected length")
+	}
+}
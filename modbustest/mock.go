@@ -0,0 +1,177 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbustest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/daijingjing/modbus"
+)
+
+// ErrTimeout is a timeout error to inject in a MockClient. It is categorized
+// as a timeout and retryable like those of the network transporters, and
+// matches modbus.ErrTimeout.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string        { return "modbus: i/o timeout" }
+func (timeoutError) Timeout() bool        { return true }
+func (timeoutError) Temporary() bool      { return true }
+func (timeoutError) Is(target error) bool { return target == modbus.ErrTimeout }
+
+// MockClient is an in-memory client for unit testing code using a Client.
+// Requests are handled by Server as by a device, coils and registers of the
+// default slave are held in Store.
+type MockClient struct {
+	modbus.ClientContext
+	Server *modbus.Server
+	Store  *modbus.DataStore
+
+	mu     sync.Mutex
+	calls  map[byte]int
+	errors map[injection]error
+}
+
+// injection identifies a call of a function, call 0 being every call.
+type injection struct {
+	functionCode byte
+	call         int
+}
+
+// MockSlaveId is the slave id of the Store of a MockClient.
+const MockSlaveId = 1
+
+// NewMockClient creates a MockClient with an empty Store.
+func NewMockClient() *MockClient {
+	mb := &MockClient{
+		Server: modbus.NewServer(),
+		calls:  make(map[byte]int),
+		errors: make(map[injection]error),
+	}
+	mb.Store = mb.Server.AddSlave(MockSlaveId)
+	mb.ClientContext = modbus.NewClient2(mockPackager{}, mockTransporter{mb})
+	return mb
+}
+
+// InjectError makes the given call of the function, counted from 1 since the
+// client was created, fail with err. Call 0 makes every call fail.
+func (mb *MockClient) InjectError(functionCode byte, call int, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.errors[injection{functionCode, call}] = err
+}
+
+// ClearErrors removes all injected errors.
+func (mb *MockClient) ClearErrors() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.errors = make(map[injection]error)
+}
+
+// Calls returns the number of calls of the function.
+func (mb *MockClient) Calls(functionCode byte) int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.calls[functionCode]
+}
+
+// SetHoldingFloat32 sets the 2 holding registers at address to value.
+func (mb *MockClient) SetHoldingFloat32(address uint16, value float32, order modbus.WordOrder) {
+	hi, lo := float32Registers(value, order)
+	mb.Store.SetHoldingRegister(address, hi)
+	mb.Store.SetHoldingRegister(address+1, lo)
+}
+
+// SetInputFloat32 sets the 2 input registers at address to value.
+func (mb *MockClient) SetInputFloat32(address uint16, value float32, order modbus.WordOrder) {
+	hi, lo := float32Registers(value, order)
+	mb.Store.SetInputRegister(address, hi)
+	mb.Store.SetInputRegister(address+1, lo)
+}
+
+func float32Registers(value float32, order modbus.WordOrder) (hi, lo uint16) {
+	var b [4]byte
+	order.PutUint32(b[:], math.Float32bits(value))
+	return uint16(b[0])<<8 | uint16(b[1]), uint16(b[2])<<8 | uint16(b[3])
+}
+
+// mockTransporter passes the requests of a MockClient to its server.
+type mockTransporter struct {
+	*MockClient
+}
+
+// Send counts the request, fails it if an error is injected or passes it to
+// the server.
+func (mb mockTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	slaveId := aduRequest[0]
+	response, err := mb.handle(aduRequest)
+	if err != nil {
+		return
+	}
+	if response == nil {
+		err = ErrTimeout
+		return
+	}
+	aduResponse = append([]byte{slaveId, response.FunctionCode}, response.Data...)
+	return
+}
+
+// SendNoResponse is like Send but drops the response.
+func (mb mockTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	_, err = mb.handle(aduRequest)
+	return
+}
+
+// handle counts the request, fails it if an error is injected or passes it
+// to the server.
+func (mb mockTransporter) handle(aduRequest []byte) (response *modbus.ProtocolDataUnit, err error) {
+	slaveId, functionCode := aduRequest[0], aduRequest[1]
+	mb.mu.Lock()
+	mb.calls[functionCode]++
+	call := mb.calls[functionCode]
+	err, ok := mb.errors[injection{functionCode, call}]
+	if !ok {
+		err = mb.errors[injection{functionCode, 0}]
+	}
+	mb.mu.Unlock()
+	if err != nil {
+		return
+	}
+	response = mb.Server.HandleRequest(slaveId, &modbus.ProtocolDataUnit{
+		FunctionCode: functionCode,
+		Data:         aduRequest[2:],
+	})
+	return
+}
+
+// mockPackager frames PDUs as the slave id followed by the PDU.
+type mockPackager struct{}
+
+func (mockPackager) Encode(pdu *modbus.ProtocolDataUnit) (adu []byte, err error) {
+	return mockPackager{}.EncodeSlave(MockSlaveId, pdu)
+}
+
+func (mockPackager) EncodeSlave(slaveId byte, pdu *modbus.ProtocolDataUnit) (adu []byte, err error) {
+	adu = append([]byte{slaveId, pdu.FunctionCode}, pdu.Data...)
+	return
+}
+
+func (mockPackager) Verify(aduRequest []byte, aduResponse []byte) (err error) {
+	if aduResponse[0] != aduRequest[0] {
+		err = fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", aduResponse[0], aduRequest[0])
+	} else if aduResponse[1]&0x7F != aduRequest[1] {
+		err = fmt.Errorf("modbus: response function code '%v' does not match request '%v'", aduResponse[1], aduRequest[1])
+	}
+	return
+}
+
+func (mockPackager) Decode(adu []byte) (pdu *modbus.ProtocolDataUnit, err error) {
+	pdu = &modbus.ProtocolDataUnit{FunctionCode: adu[1], Data: adu[2:]}
+	return
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbustest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/daijingjing/modbus"
+)
+
+func TestMockClient(t *testing.T) {
+	mb := NewMockClient()
+	mb.Store.SetHoldingRegister(1, 0x1234)
+	mb.Store.SetCoil(3, true)
+
+	results, err := mb.ReadHoldingRegisters(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{0x00, 0x00, 0x12, 0x34}, results) {
+		t.Fatalf("unexpected registers % x", results)
+	}
+	if results, err = mb.ReadCoils(0, 4); err != nil || results[0] != 0x08 {
+		t.Fatalf("unexpected coils % x: %v", results, err)
+	}
+	if _, err = mb.WriteSingleRegister(2, 0x0005); err != nil {
+		t.Fatal(err)
+	}
+	if v := mb.Store.HoldingRegister(2); v != 0x0005 {
+		t.Fatalf("unexpected register %v", v)
+	}
+	// Unknown slave
+	ctx := modbus.WithSlaveId(context.Background(), 2)
+	if _, err = mb.ReadHoldingRegistersContext(ctx, 0, 1); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(err, modbus.ErrTimeout) {
+		t.Fatalf("%v must match modbus.ErrTimeout", err)
+	}
+}
+
+func TestMockClientInjectError(t *testing.T) {
+	mb := NewMockClient()
+	mb.InjectError(modbus.FuncCodeReadHoldingRegisters, 3, ErrTimeout)
+	for i := 1; i <= 4; i++ {
+		_, err := mb.ReadHoldingRegisters(0, 1)
+		if (err != nil) != (i == 3) {
+			t.Fatalf("call %v: unexpected error %v", i, err)
+		}
+		if i == 3 && (modbus.CategorizeError(err) != modbus.ErrorCategoryTimeout || !modbus.IsRetryable(err)) {
+			t.Fatalf("injected error must be a timeout: %v", err)
+		}
+	}
+	if calls := mb.Calls(modbus.FuncCodeReadHoldingRegisters); calls != 4 {
+		t.Fatalf("calls: expected %v, actual %v", 4, calls)
+	}
+	busy := &modbus.ModbusError{FunctionCode: 0x86, ExceptionCode: modbus.ExceptionCodeServerDeviceBusy}
+	mb.InjectError(modbus.FuncCodeWriteSingleRegister, 0, busy)
+	for i := 0; i < 2; i++ {
+		if _, err := mb.WriteSingleRegister(0, 1); !errors.Is(err, busy) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mb.ClearErrors()
+	if _, err := mb.WriteSingleRegister(0, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMockClientFloat32(t *testing.T) {
+	mb := NewMockClient()
+	mb.SetHoldingFloat32(10, 3.5, modbus.BigEndian)
+	mb.SetInputFloat32(20, -1.25, modbus.LittleEndianSwap)
+	client := modbus.NewTypedClient(mb)
+	if v, err := client.ReadFloat32(10); err != nil || v != 3.5 {
+		t.Fatalf("unexpected value %v: %v", v, err)
+	}
+	results, err := mb.ReadInputRegisters(20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := math.Float32frombits(modbus.LittleEndianSwap.Uint32(results)); v != -1.25 {
+		t.Fatalf("unexpected value %v", v)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+)
+
+const (
+	// Data echoed back by the loopback request of PingDiagnostics
+	pingData = 0xA537
+)
+
+// PingFunc sends a cheap request to the device through client and returns
+// nil if it responds correctly.
+type PingFunc func(ctx context.Context, client ClientContext) error
+
+// PingDiagnostics sends a Diagnostics return query data request, which the
+// device must echo back. It is the default PingFunc.
+func PingDiagnostics(ctx context.Context, client ClientContext) error {
+	_, err := client.DiagnosticsContext(ctx, DiagnosticsReturnQueryData, pingData)
+	return err
+}
+
+// PingHoldingRegister returns a PingFunc reading the holding register at
+// address, for devices not supporting diagnostics.
+func PingHoldingRegister(address uint16) PingFunc {
+	return func(ctx context.Context, client ClientContext) error {
+		_, err := client.ReadHoldingRegistersContext(ctx, address, 1)
+		return err
+	}
+}
+
+// pingTransporter is implemented by the transporters having a Ping field.
+type pingTransporter interface {
+	ping() PingFunc
+}
+
+func (mb *client) Ping() (err error) {
+	return mb.PingContext(context.Background())
+}
+
+func (mb *client) PingContext(ctx context.Context) (err error) {
+	ping := PingDiagnostics
+	if transporter, ok := mb.transporter.(pingTransporter); ok && transporter.ping() != nil {
+		ping = transporter.ping()
+	}
+	return ping(ctx, mb)
+}
@@ -0,0 +1,45 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// Diagnostics not supported
+	server.RegisterFunctionHandler(FuncCodeDiagnostics, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return nil, &ModbusError{ExceptionCode: ExceptionCodeIllegalFunction}
+	})
+	var mbError *ModbusError
+	if err := client.Ping(); !errors.As(err, &mbError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler.Ping = PingHoldingRegister(5)
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	// No response of the device within Timeout
+	handler.SlaveId = 2
+	handler.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if err := client.Ping(); CategorizeError(err) != ErrorCategoryTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("ping took too long: %v", time.Since(start))
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ContextDialer establishes connections, e.g. through a proxy. It is
+// implemented by net.Dialer, HTTPProxy and the SOCKS5 dialers of
+// golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// HTTPProxy connects through an HTTP proxy with the CONNECT method.
+type HTTPProxy struct {
+	// Address of the proxy, host:port
+	Address string
+	// Header, if set, is sent with the CONNECT requests, e.g. with the
+	// Proxy-Authorization of the proxy
+	Header http.Header
+	// Forward, if set, establishes the connections to the proxy in place of
+	// a net.Dialer
+	Forward ContextDialer
+}
+
+// DialContext connects to the proxy and asks it to connect to address. The
+// deadline of ctx applies to the whole exchange.
+func (p *HTTPProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	forward := p.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, network, p.Address)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = p.connect(ctx, conn, address); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT request on conn and reads the response. conn is
+// closed on error.
+func (p *HTTPProxy) connect(ctx context.Context, conn net.Conn, address string) (_ net.Conn, err error) {
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return
+	}
+	stop := watchContext(ctx, conn)
+	defer func() {
+		if stop() {
+			err = ctx.Err()
+		}
+	}()
+	header := p.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: header,
+	}
+	if err = request.Write(conn); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("modbus: proxy '%v' refused to connect to '%v': %v", p.Address, address, response.Status)
+		return
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+	if reader.Buffered() > 0 {
+		// Data of the device sent right after the response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the data buffered while reading the response of the
+// proxy before that of the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
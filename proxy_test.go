@@ -0,0 +1,168 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHTTPProxy serves CONNECT requests with the authorization, sending the
+// host of each request to hosts.
+func serveHTTPProxy(ln net.Listener, authorization string, hosts chan<- string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			request, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			hosts <- request.Host
+			if request.Method != http.MethodConnect || request.Header.Get("Proxy-Authorization") != authorization {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			target, err := net.Dial("tcp", request.Host)
+			if err != nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer target.Close()
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+// listenEcho listens on ln and echoes the data of each connection.
+func listenEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	device, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	go listenEcho(device)
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	hosts := make(chan string, 2)
+	go serveHTTPProxy(proxy, "Basic bW9kYnVz", hosts)
+
+	handler := NewTCPClientHandler(device.Addr().String())
+	handler.Timeout = time.Second
+	handler.Proxy = &HTTPProxy{
+		Address: proxy.Addr().String(),
+		Header:  http.Header{"Proxy-Authorization": {"Basic bW9kYnVz"}},
+	}
+	defer handler.Close()
+	req := []byte{0, 1, 0, 0, 0, 2, 1, 2}
+	rsp, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: % x", rsp)
+	}
+	if host := <-hosts; host != device.Addr().String() {
+		t.Fatalf("host: expected %v, actual %v", device.Addr(), host)
+	}
+
+	handler.Close()
+	handler.Proxy = &HTTPProxy{Address: proxy.Addr().String()}
+	err = handler.Connect()
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected refusal, actual %v", err)
+	}
+}
+
+func TestHTTPProxyTLS(t *testing.T) {
+	certificate, roots := newTestCertificate(t)
+	device, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	go listenEcho(device)
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go serveHTTPProxy(proxy, "", make(chan string, 1))
+
+	// The host of the address is verified
+	handler := NewTLSClientHandler(device.Addr().String(), &tls.Config{RootCAs: roots})
+	handler.Timeout = time.Second
+	handler.Proxy = &HTTPProxy{Address: proxy.Addr().String()}
+	defer handler.Close()
+	req := []byte{0, 1, 0, 0, 0, 2, 1, 2}
+	rsp, err := handler.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: % x", rsp)
+	}
+	if _, ok := handler.conn.(*tls.Conn); !ok {
+		t.Fatalf("connection is not secured: %T", handler.conn)
+	}
+}
+
+func TestHTTPProxyConnectTimeout(t *testing.T) {
+	// Accept connections but never answer the CONNECT requests
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	handler := NewTCPClientHandler("127.0.0.1:502")
+	handler.ConnectTimeout = 50 * time.Millisecond
+	handler.Proxy = &HTTPProxy{Address: proxy.Addr().String()}
+	start := time.Now()
+	if err = handler.Connect(); !errors.Is(err, ErrTimeout) {
+		handler.Close()
+		t.Fatalf("expected %v, actual %v", ErrTimeout, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("connect took too long: %v", time.Since(start))
+	}
+}
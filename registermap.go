@@ -0,0 +1,402 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+const (
+	// Maximum number of registers in one read
+	maxReadRegisters = 125
+)
+
+// PointType is the type of the value held by a point of a RegisterMap.
+type PointType int
+
+const (
+	PointUint16 PointType = iota
+	PointUint32
+	PointInt32
+	PointFloat32
+)
+
+// String returns the Go type name of the point type.
+func (t PointType) String() string {
+	switch t {
+	case PointUint16:
+		return "uint16"
+	case PointUint32:
+		return "uint32"
+	case PointInt32:
+		return "int32"
+	case PointFloat32:
+		return "float32"
+	}
+	return fmt.Sprintf("PointType(%d)", int(t))
+}
+
+// registers returns the number of registers holding a value of the type.
+func (t PointType) registers() uint16 {
+	if t == PointUint16 {
+		return 1
+	}
+	return 2
+}
+
+// Point is a named value held in holding registers starting at Address.
+type Point struct {
+	Name    string
+	Address uint16
+	Type    PointType
+	// Layout of 32-bit values, BigEndian by default
+	Order WordOrder
+}
+
+// RegisterMap reads and writes the holding registers of a client by point
+// name. Reading several points coalesces adjacent ones in a single request.
+type RegisterMap struct {
+	client Client
+	points map[string]Point
+}
+
+// NewRegisterMap creates a RegisterMap of the given points.
+func NewRegisterMap(client Client, points ...Point) (*RegisterMap, error) {
+	rm := &RegisterMap{
+		client: client,
+		points: make(map[string]Point),
+	}
+	for _, point := range points {
+		if err := rm.Add(point); err != nil {
+			return nil, err
+		}
+	}
+	return rm, nil
+}
+
+// Add adds a point, its name must be unique.
+func (rm *RegisterMap) Add(point Point) error {
+	if point.Name == "" {
+		return fmt.Errorf("modbus: point name must not be empty")
+	}
+	if _, ok := rm.points[point.Name]; ok {
+		return fmt.Errorf("modbus: point '%v' is already defined", point.Name)
+	}
+	if point.Type < PointUint16 || point.Type > PointFloat32 {
+		return fmt.Errorf("modbus: point '%v' has unknown type '%v'", point.Name, point.Type)
+	}
+	if int(point.Address)+int(point.Type.registers()) > 0x10000 {
+		return fmt.Errorf("modbus: point '%v' address '%v' is out of range", point.Name, point.Address)
+	}
+	rm.points[point.Name] = point
+	return nil
+}
+
+// AddStruct adds a point for each field of the struct pointed to by v having
+// a modbus tag, see Unmarshal. The point is named after the field and typed
+// after it:
+//  type Meter struct {
+//  	FlowRate float32 `modbus:"addr=100,order=cdab"`
+//  	Status   uint16  `modbus:"addr=110"`
+//  }
+func (rm *RegisterMap) AddStruct(v interface{}) error {
+	typ := reflect.TypeOf(v)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return fmt.Errorf("modbus: '%T' is not a struct", v)
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag, ok := field.Tag.Lookup("modbus")
+		if !ok || tag == "-" {
+			continue
+		}
+		point, err := parsePointTag(field.Name, field.Type.Kind(), tag)
+		if err != nil {
+			return err
+		}
+		if err = rm.Add(point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePointTag parses the modbus tag of a struct field.
+func parsePointTag(name string, kind reflect.Kind, tag string) (point Point, err error) {
+	point.Name = name
+	switch kind {
+	case reflect.Uint16:
+		point.Type = PointUint16
+	case reflect.Uint32:
+		point.Type = PointUint32
+	case reflect.Int32:
+		point.Type = PointInt32
+	case reflect.Float32:
+		point.Type = PointFloat32
+	default:
+		err = fmt.Errorf("modbus: field '%v' of kind '%v' is not supported", name, kind)
+		return
+	}
+	opts, err := parseRegisterTag(name, tag)
+	if err != nil {
+		return
+	}
+	if opts.typ != "" && opts.typ != point.Type.String() {
+		err = fmt.Errorf("modbus: field '%v' type '%v' does not match '%v'", name, opts.typ, point.Type)
+		return
+	}
+	if opts.length != 0 {
+		err = fmt.Errorf("modbus: field '%v' must not have a length", name)
+		return
+	}
+	point.Address = uint16(opts.address)
+	point.Order = opts.order
+	return
+}
+
+// Point returns the point of the given name.
+func (rm *RegisterMap) Point(name string) (point Point, ok bool) {
+	point, ok = rm.points[name]
+	return
+}
+
+// ReadUint16 reads the uint16 point of the given name.
+func (rm *RegisterMap) ReadUint16(name string) (value uint16, err error) {
+	v, err := rm.readOne(name, PointUint16)
+	if err != nil {
+		return
+	}
+	value = v.(uint16)
+	return
+}
+
+// ReadUint32 reads the uint32 point of the given name.
+func (rm *RegisterMap) ReadUint32(name string) (value uint32, err error) {
+	v, err := rm.readOne(name, PointUint32)
+	if err != nil {
+		return
+	}
+	value = v.(uint32)
+	return
+}
+
+// ReadInt32 reads the int32 point of the given name.
+func (rm *RegisterMap) ReadInt32(name string) (value int32, err error) {
+	v, err := rm.readOne(name, PointInt32)
+	if err != nil {
+		return
+	}
+	value = v.(int32)
+	return
+}
+
+// ReadFloat32 reads the float32 point of the given name.
+func (rm *RegisterMap) ReadFloat32(name string) (value float32, err error) {
+	v, err := rm.readOne(name, PointFloat32)
+	if err != nil {
+		return
+	}
+	value = v.(float32)
+	return
+}
+
+// Read reads the points of the given names, all points if none is given.
+// Values are of the Go type of their point, e.g. float32 for PointFloat32.
+// Adjacent points are read in one request of up to 125 registers.
+func (rm *RegisterMap) Read(names ...string) (values map[string]interface{}, err error) {
+	points := make([]Point, 0, len(rm.points))
+	if len(names) == 0 {
+		for _, point := range rm.points {
+			points = append(points, point)
+		}
+	} else {
+		for _, name := range names {
+			point, ok := rm.points[name]
+			if !ok {
+				err = fmt.Errorf("modbus: point '%v' is not defined", name)
+				return
+			}
+			points = append(points, point)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Address < points[j].Address
+	})
+	values = make(map[string]interface{}, len(points))
+	for len(points) > 0 {
+		// Extend the read while the next point is adjacent or overlapping
+		start := int(points[0].Address)
+		end := start + int(points[0].Type.registers())
+		n := 1
+		for ; n < len(points); n++ {
+			next := int(points[n].Address)
+			nextEnd := next + int(points[n].Type.registers())
+			if next > end || maxInt(end, nextEnd)-start > maxReadRegisters {
+				break
+			}
+			end = maxInt(end, nextEnd)
+		}
+		var data []byte
+		data, err = rm.client.ReadHoldingRegisters(uint16(start), uint16(end-start))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != (end-start)*2 {
+			err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), (end-start)*2)
+			return nil, err
+		}
+		for _, point := range points[:n] {
+			offset := (int(point.Address) - start) * 2
+			values[point.Name] = point.decode(data[offset:])
+		}
+		points = points[n:]
+	}
+	return
+}
+
+// WriteUint16 writes the uint16 point of the given name.
+func (rm *RegisterMap) WriteUint16(name string, value uint16) error {
+	return rm.write(name, PointUint16, uint32(value))
+}
+
+// WriteUint32 writes the uint32 point of the given name.
+func (rm *RegisterMap) WriteUint32(name string, value uint32) error {
+	return rm.write(name, PointUint32, value)
+}
+
+// WriteInt32 writes the int32 point of the given name.
+func (rm *RegisterMap) WriteInt32(name string, value int32) error {
+	return rm.write(name, PointInt32, uint32(value))
+}
+
+// WriteFloat32 writes the float32 point of the given name.
+func (rm *RegisterMap) WriteFloat32(name string, value float32) error {
+	return rm.write(name, PointFloat32, math.Float32bits(value))
+}
+
+// lookup returns the point of the given name and ensures its type.
+func (rm *RegisterMap) lookup(name string, typ PointType) (point Point, err error) {
+	point, ok := rm.points[name]
+	if !ok {
+		err = fmt.Errorf("modbus: point '%v' is not defined", name)
+		return
+	}
+	if point.Type != typ {
+		err = fmt.Errorf("modbus: point '%v' type '%v' does not match '%v'", name, point.Type, typ)
+		return
+	}
+	return
+}
+
+func (rm *RegisterMap) readOne(name string, typ PointType) (value interface{}, err error) {
+	if _, err = rm.lookup(name, typ); err != nil {
+		return
+	}
+	values, err := rm.Read(name)
+	if err != nil {
+		return
+	}
+	value = values[name]
+	return
+}
+
+func (rm *RegisterMap) write(name string, typ PointType, value uint32) (err error) {
+	point, err := rm.lookup(name, typ)
+	if err != nil {
+		return
+	}
+	var data [4]byte
+	if typ == PointUint16 {
+		binary.BigEndian.PutUint16(data[:], uint16(value))
+	} else {
+		point.Order.PutUint32(data[:], value)
+	}
+	quantity := typ.registers()
+	_, err = rm.client.WriteMultipleRegisters(point.Address, quantity, data[:quantity*2])
+	return
+}
+
+// DecodePoints decodes the points from data, the registers of a single read,
+// e.g. a value and its capture time which must not be read apart. The
+// Address of each point is its offset in registers from the start of data:
+//  values, err := DecodePoints(data,
+//  	Point{Name: "energy", Address: 0, Type: PointFloat32},
+//  	Point{Name: "timestamp", Address: 2, Type: PointUint32})
+// Values are of the Go type of their point, as those of RegisterMap.Read.
+func DecodePoints(data []byte, points ...Point) (values map[string]interface{}, err error) {
+	values = make(map[string]interface{}, len(points))
+	for _, point := range points {
+		if point.Name == "" {
+			return nil, fmt.Errorf("modbus: point name must not be empty")
+		}
+		if _, ok := values[point.Name]; ok {
+			return nil, fmt.Errorf("modbus: point '%v' is already defined", point.Name)
+		}
+		if point.Type < PointUint16 || point.Type > PointFloat32 {
+			return nil, fmt.Errorf("modbus: point '%v' has unknown type '%v'", point.Name, point.Type)
+		}
+		offset := int(point.Address) * 2
+		if offset+int(point.Type.registers())*2 > len(data) {
+			return nil, fmt.Errorf("modbus: point '%v' at offset '%v' exceeds the data size '%v'", point.Name, point.Address, len(data))
+		}
+		values[point.Name] = point.decode(data[offset:])
+	}
+	return
+}
+
+// ReadPoints reads the holding registers from address spanned by the points
+// in a single request, so that their values are consistent, and decodes them
+// as DecodePoints. The Address of each point is its offset from address.
+func ReadPoints(client Client, address uint16, points ...Point) (values map[string]interface{}, err error) {
+	quantity := 0
+	for _, point := range points {
+		quantity = maxInt(quantity, int(point.Address)+int(point.Type.registers()))
+	}
+	if quantity < 1 || quantity > maxReadRegisters {
+		err = &QuantityError{FunctionCode: FuncCodeReadHoldingRegisters, Field: "quantity", Quantity: quantity, Min: 1, Max: maxReadRegisters}
+		return
+	}
+	if int(address)+quantity > 0x10000 {
+		err = fmt.Errorf("modbus: address '%v' plus quantity '%v' is out of range", address, quantity)
+		return
+	}
+	data, err := client.ReadHoldingRegisters(address, uint16(quantity))
+	if err != nil {
+		return
+	}
+	if len(data) != quantity*2 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), quantity*2)
+		return
+	}
+	return DecodePoints(data, points...)
+}
+
+// decode decodes the value of the point from its registers.
+func (point Point) decode(b []byte) interface{} {
+	switch point.Type {
+	case PointUint16:
+		return binary.BigEndian.Uint16(b)
+	case PointUint32:
+		return point.Order.Uint32(b)
+	case PointInt32:
+		return int32(point.Order.Uint32(b))
+	default:
+		return math.Float32frombits(point.Order.Uint32(b))
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
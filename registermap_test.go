@@ -0,0 +1,176 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// countingClient counts the reads of a registerClient.
+type countingClient struct {
+	registerClient
+
+	reads []string
+}
+
+func (c *countingClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	c.reads = append(c.reads, fmt.Sprintf("%v+%v", address, quantity))
+	return c.registerClient.ReadHoldingRegisters(address, quantity)
+}
+
+type meter struct {
+	FlowRate float32 `modbus:"addr=0,order=CDAB"`
+	Total    uint32  `modbus:"addr=2"`
+	Status   uint16  `modbus:"addr=4,type=uint16"`
+	Offset   int32   `modbus:"addr=200"`
+	Unused   uint16
+}
+
+func TestRegisterMap(t *testing.T) {
+	c := &countingClient{registerClient: registerClient{registers: make([]byte, 2*300)}}
+	rm, err := NewRegisterMap(c, Point{Name: "last", Address: 124})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.AddStruct(&meter{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.WriteFloat32("FlowRate", 42); err != nil {
+		t.Fatal(err)
+	}
+	if c.registers[0] != 0x00 || c.registers[2] != 0x42 || c.registers[3] != 0x28 {
+		t.Fatalf("flow rate: unexpected registers % x", c.registers[:4])
+	}
+	if err = rm.WriteUint32("Total", 70000); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.WriteUint16("Status", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.WriteInt32("Offset", -2); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.WriteUint16("Offset", 1); err == nil {
+		t.Fatal("expected error for type mismatch")
+	}
+	f, err := rm.ReadFloat32("FlowRate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 42 {
+		t.Fatalf("flow rate: expected %v, actual %v", 42, f)
+	}
+
+	c.reads = nil
+	values, err := rm.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"FlowRate": float32(42),
+		"Total":    uint32(70000),
+		"Status":   uint16(7),
+		"Offset":   int32(-2),
+		"last":     uint16(0),
+	}
+	if fmt.Sprint(expected) != fmt.Sprint(values) {
+		t.Fatalf("values: expected %v, actual %v", expected, values)
+	}
+	// Points 0 to 4 are adjacent, 124 is not
+	if fmt.Sprint(c.reads) != "[0+5 124+1 200+2]" {
+		t.Fatalf("reads: unexpected %v", c.reads)
+	}
+	if _, err = rm.Read("missing"); err == nil {
+		t.Fatal("expected error for undefined point")
+	}
+}
+
+func TestRegisterMapReadLimit(t *testing.T) {
+	c := &countingClient{registerClient: registerClient{registers: make([]byte, 2*300)}}
+	rm, err := NewRegisterMap(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 70; i++ {
+		if err = rm.Add(Point{Name: fmt.Sprint(i), Address: uint16(i * 2), Type: PointInt32}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = rm.Read(); err != nil {
+		t.Fatal(err)
+	}
+	// 62 values fit in 124 registers
+	if fmt.Sprint(c.reads) != "[0+124 124+16]" {
+		t.Fatalf("reads: unexpected %v", c.reads)
+	}
+}
+
+func TestRegisterMapDefinition(t *testing.T) {
+	invalid := []interface{}{
+		&struct {
+			Duplicate uint16 `modbus:"addr=1"`
+		}{},
+		&struct {
+			V float64 `modbus:"addr=1"`
+		}{},
+		&struct {
+			V float32 `modbus:"addr=1,order=ABC"`
+		}{},
+		&struct {
+			V float32 `modbus:"addr=x"`
+		}{},
+		&struct {
+			V float32 `modbus:"addr=65535"`
+		}{},
+		42,
+	}
+	for _, v := range invalid {
+		rm, err := NewRegisterMap(nil, Point{Name: "Duplicate"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rm.AddStruct(v); err == nil {
+			t.Errorf("%#v: expected error", v)
+		}
+	}
+	if _, err := NewRegisterMap(nil, Point{Name: "a", Type: PointFloat32 + 1}); err == nil {
+		t.Fatal("expected error for unknown type")
+	}
+	if _, err := NewRegisterMap(nil, Point{}); err == nil {
+		t.Fatal("expected error for empty name")
+	}
+}
+
+func TestReadPoints(t *testing.T) {
+	c := &countingClient{registerClient: registerClient{registers: make([]byte, 2*20)}}
+	// Energy 1.5 in CDAB order and its timestamp at 10
+	copy(c.registers[20:], []byte{0x00, 0x00, 0x3F, 0xC0, 0x65, 0x4A, 0x1B, 0x00})
+	points := []Point{
+		{Name: "energy", Address: 0, Type: PointFloat32, Order: LittleEndianSwap},
+		{Name: "timestamp", Address: 2, Type: PointUint32},
+	}
+	values, err := ReadPoints(c, 10, points...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reads) != 1 || c.reads[0] != "10+4" {
+		t.Fatalf("reads: expected [10+4], actual %v", c.reads)
+	}
+	if values["energy"] != float32(1.5) || values["timestamp"] != uint32(0x654A1B00) {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	if _, err = DecodePoints(c.registers[20:26], points...); err == nil {
+		t.Fatal("expected error for point beyond the data")
+	}
+	if _, err = DecodePoints(c.registers, points[0], points[0]); err == nil {
+		t.Fatal("expected error for duplicate point")
+	}
+	if _, err = ReadPoints(c, 0, Point{Name: "far", Address: 124, Type: PointUint32}); !errors.Is(err, ErrInvalidQuantity) {
+		t.Fatalf("expected %v, actual %v", ErrInvalidQuantity, err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// RetryClient retries requests of the wrapped Client which fail with a
+// retryable error, see IsRetryable. Requests changing the device state are
+// not retried unless RetryWrites is set, as they may have been executed.
+type RetryClient struct {
+	Client
+	// Maximum number of retries after the first attempt
+	MaxRetries int
+	// Backoff returns the time to wait before the given retry (starting at 1)
+	Backoff func(retry int) time.Duration
+	// RetryWrites allows retrying write requests which are idempotent
+	RetryWrites bool
+}
+
+// NewRetryClient creates a RetryClient waiting for a constant backoff between retries.
+func NewRetryClient(inner Client, maxRetries int, backoff time.Duration) *RetryClient {
+	return &RetryClient{
+		Client:     inner,
+		MaxRetries: maxRetries,
+		Backoff: func(int) time.Duration {
+			return backoff
+		},
+	}
+}
+
+// IsRetryable reports whether a request failed with a transient error, namely
+// a timeout or a malformed response frame (e.g. a crc mismatch). Modbus
+// exceptions and invalid requests are not retryable.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	// Timeouts of transporters not wrapping them
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return true
+	}
+	var fe *frameError
+	return errors.As(err, &fe)
+}
+
+func (mb *RetryClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return mb.retry(true, func() ([]byte, error) {
+		return mb.Client.ReadCoils(address, quantity)
+	})
+}
+
+func (mb *RetryClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return mb.retry(true, func() ([]byte, error) {
+		return mb.Client.ReadDiscreteInputs(address, quantity)
+	})
+}
+
+func (mb *RetryClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.WriteSingleCoil(address, value)
+	})
+}
+
+func (mb *RetryClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.WriteMultipleCoils(address, quantity, value)
+	})
+}
+
+func (mb *RetryClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return mb.retry(true, func() ([]byte, error) {
+		return mb.Client.ReadInputRegisters(address, quantity)
+	})
+}
+
+func (mb *RetryClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return mb.retry(true, func() ([]byte, error) {
+		return mb.Client.ReadHoldingRegisters(address, quantity)
+	})
+}
+
+func (mb *RetryClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.WriteSingleRegister(address, value)
+	})
+}
+
+func (mb *RetryClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.WriteMultipleRegisters(address, quantity, value)
+	})
+}
+
+func (mb *RetryClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity, value)
+	})
+}
+
+func (mb *RetryClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.MaskWriteRegister(address, andMask, orMask)
+	})
+}
+
+// ReadFIFOQueue is treated as a write since reading removes values from the queue.
+func (mb *RetryClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return mb.retry(false, func() ([]byte, error) {
+		return mb.Client.ReadFIFOQueue(address)
+	})
+}
+
+func (mb *RetryClient) ReadFileRecord(requests []FileRecord) (records []FileRecord, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		records, err = mb.Client.ReadFileRecord(requests)
+		return
+	})
+	return
+}
+
+func (mb *RetryClient) WriteFileRecord(records []FileRecord) (err error) {
+	_, err = mb.retry(false, func() ([]byte, error) {
+		return nil, mb.Client.WriteFileRecord(records)
+	})
+	return
+}
+
+func (mb *RetryClient) ReadExceptionStatus() (status byte, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		status, err = mb.Client.ReadExceptionStatus()
+		return
+	})
+	return
+}
+
+// Diagnostics is only retried for DiagnosticsReturnQueryData, other
+// sub-functions may restart the device or clear its counters.
+func (mb *RetryClient) Diagnostics(subFunction, data uint16) ([]byte, error) {
+	return mb.retry(subFunction == DiagnosticsReturnQueryData, func() ([]byte, error) {
+		return mb.Client.Diagnostics(subFunction, data)
+	})
+}
+
+func (mb *RetryClient) GetCommEventCounter() (status, eventCount uint16, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		status, eventCount, err = mb.Client.GetCommEventCounter()
+		return
+	})
+	return
+}
+
+func (mb *RetryClient) GetCommEventLog() (log *CommEventLog, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		log, err = mb.Client.GetCommEventLog()
+		return
+	})
+	return
+}
+
+func (mb *RetryClient) ReportServerID() (id []byte, status byte, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		id, status, err = mb.Client.ReportServerID()
+		return
+	})
+	return
+}
+
+func (mb *RetryClient) ReadDeviceIdentification(readDeviceIDCode, objectID byte) (objects map[byte][]byte, err error) {
+	_, err = mb.retry(true, func() (results []byte, err error) {
+		objects, err = mb.Client.ReadDeviceIdentification(readDeviceIDCode, objectID)
+		return
+	})
+	return
+}
+
+// retry calls fn until it succeeds, fails with a non-retryable error or
+// MaxRetries is reached.
+func (mb *RetryClient) retry(idempotent bool, fn func() ([]byte, error)) (results []byte, err error) {
+	for retry := 0; ; retry++ {
+		results, err = fn()
+		if err == nil || retry >= mb.MaxRetries || !(idempotent || mb.RetryWrites) || !IsRetryable(err) {
+			return
+		}
+		if mb.Backoff != nil {
+			time.Sleep(mb.Backoff(retry + 1))
+		}
+	}
+}
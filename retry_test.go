@@ -0,0 +1,110 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type netTimeoutError struct{}
+
+func (netTimeoutError) Error() string   { return "i/o timeout" }
+func (netTimeoutError) Timeout() bool   { return true }
+func (netTimeoutError) Temporary() bool { return true }
+
+// failingClient fails the first requests with the given error.
+type failingClient struct {
+	Client
+
+	err      error
+	failures int
+	calls    int
+}
+
+func (c *failingClient) result() ([]byte, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return []byte{0, 1}, nil
+}
+
+func (c *failingClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.result()
+}
+
+func (c *failingClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return c.result()
+}
+
+var retryableTests = []struct {
+	err       error
+	retryable bool
+}{
+	{netTimeoutError{}, true},
+	{fmt.Errorf("read: %w", netTimeoutError{}), true},
+	{&frameError{errors.New("modbus: response crc '1' does not match expected '2'")}, true},
+	{&ModbusError{FunctionCode: 0x83, ExceptionCode: ExceptionCodeIllegalDataAddress}, false},
+	{errors.New("modbus: quantity '0' must be between '1' and '125',"), false},
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, input := range retryableTests {
+		if IsRetryable(input.err) != input.retryable {
+			t.Errorf("%v: expected retryable %v", input.err, input.retryable)
+		}
+	}
+}
+
+func TestRetryClient(t *testing.T) {
+	inner := &failingClient{err: netTimeoutError{}, failures: 2}
+	client := NewRetryClient(inner, 3, time.Millisecond)
+	if _, err := client.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 3 {
+		t.Fatalf("calls: expected %v, actual %v", 3, inner.calls)
+	}
+
+	inner = &failingClient{err: netTimeoutError{}, failures: 5}
+	client = NewRetryClient(inner, 3, 0)
+	var retries []int
+	client.Backoff = func(retry int) time.Duration {
+		retries = append(retries, retry)
+		return 0
+	}
+	if _, err := client.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if inner.calls != 4 || len(retries) != 3 || retries[2] != 3 {
+		t.Fatalf("calls: expected %v, actual %v, retries %v", 4, inner.calls, retries)
+	}
+}
+
+func TestRetryClientNotRetryable(t *testing.T) {
+	inner := &failingClient{err: &ModbusError{ExceptionCode: ExceptionCodeIllegalDataAddress}, failures: 1}
+	if _, err := NewRetryClient(inner, 3, 0).ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if inner.calls != 1 {
+		t.Fatalf("calls: expected %v, actual %v", 1, inner.calls)
+	}
+
+	inner = &failingClient{err: netTimeoutError{}, failures: 1}
+	client := NewRetryClient(inner, 3, 0)
+	if _, err := client.WriteSingleRegister(0, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if inner.calls != 1 {
+		t.Fatalf("calls: expected %v, actual %v", 1, inner.calls)
+	}
+	client.RetryWrites = true
+	if _, err := client.WriteSingleRegister(0, 1); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@
 package modbus
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -42,6 +43,16 @@ func RTUClient(address string) Client {
 // rtuPackager implements Packager interface.
 type rtuPackager struct {
 	SlaveId byte
+	// SkipCRCCheck disables the verification of the CRC of responses, e.g.
+	// for gateways mangling it. The 2 CRC bytes must still be present.
+	SkipCRCCheck bool
+	// CRC, if set, computes the CRC of the frames in place of the standard
+	// Modbus CRC
+	CRC func(data []byte) uint16
+}
+
+func (mb *rtuPackager) defaultSlaveId() byte {
+	return mb.SlaveId
 }
 
 // Encode encodes PDU in a RTU frame:
@@ -50,6 +61,11 @@ type rtuPackager struct {
 //  Data            : 0 up to 252 bytes
 //  CRC             : 2 byte
 func (mb *rtuPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
+	return mb.EncodeSlave(mb.SlaveId, pdu)
+}
+
+// EncodeSlave encodes PDU in a RTU frame addressed to the given slave.
+func (mb *rtuPackager) EncodeSlave(slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error) {
 	length := len(pdu.Data) + 4
 	if length > rtuMaxSize {
 		err = fmt.Errorf("modbus: length of data '%v' must not be bigger than '%v'", length, rtuMaxSize)
@@ -57,21 +73,19 @@ func (mb *rtuPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	}
 	adu = make([]byte, length)
 
-	adu[0] = mb.SlaveId
+	adu[0] = slaveId
 	adu[1] = pdu.FunctionCode
 	copy(adu[2:], pdu.Data)
 
 	// Append crc
-	var crc crc
-	crc.reset().pushBytes(adu[0 : length-2])
-	checksum := crc.value()
+	checksum := mb.checksum(adu[0 : length-2])
 
 	adu[length-1] = byte(checksum >> 8)
 	adu[length-2] = byte(checksum)
 	return
 }
 
-// Verify verifies response length and slave id.
+// Verify verifies response length, slave id and function code.
 func (mb *rtuPackager) Verify(aduRequest []byte, aduResponse []byte) (err error) {
 	length := len(aduResponse)
 	// Minimum size (including address, function and CRC)
@@ -84,6 +98,7 @@ func (mb *rtuPackager) Verify(aduRequest []byte, aduResponse []byte) (err error)
 		err = fmt.Errorf("modbus: response slave id '%v' does not match request '%v'", aduResponse[0], aduRequest[0])
 		return
 	}
+	err = verifyFunctionCode(aduRequest[1], aduResponse[1])
 	return
 }
 
@@ -91,26 +106,54 @@ func (mb *rtuPackager) Verify(aduRequest []byte, aduResponse []byte) (err error)
 func (mb *rtuPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
 	length := len(adu)
 	// Calculate checksum
-	var crc crc
-	crc.reset().pushBytes(adu[0 : length-2])
-	checksum := uint16(adu[length-1])<<8 | uint16(adu[length-2])
-	if checksum != crc.value() {
-		err = fmt.Errorf("modbus: response crc '%v' does not match expected '%v'", checksum, crc.value())
-		return
+	if !mb.SkipCRCCheck {
+		checksum := uint16(adu[length-1])<<8 | uint16(adu[length-2])
+		if expected := mb.checksum(adu[0 : length-2]); checksum != expected {
+			err = fmt.Errorf("modbus: response crc '%v' does not match expected '%v'", checksum, expected)
+			return
+		}
 	}
 	// Function code & data
 	pdu = &ProtocolDataUnit{}
 	pdu.FunctionCode = adu[1]
 	pdu.Data = adu[2 : length-2]
+	// Exception response has the error bit set and the exception code only
+	if pdu.FunctionCode&0x80 != 0 {
+		if len(pdu.Data) != 1 {
+			err = fmt.Errorf("modbus: exception response data size '%v' does not match expected '%v'", len(pdu.Data), 1)
+			return
+		}
+		err = responseError(pdu)
+	}
 	return
 }
 
+// checksum returns the CRC of data, computed by CRC if set.
+func (mb *rtuPackager) checksum(data []byte) uint16 {
+	if mb.CRC != nil {
+		return mb.CRC(data)
+	}
+	var crc crc
+	return crc.reset().pushBytes(data).value()
+}
+
 // rtuSerialTransporter implements Transporter interface.
 type rtuSerialTransporter struct {
 	serialPort
+
+	// End of the last frame on the line
+	lastFrame time.Time
 }
 
 func (mb *rtuSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.serialPort.mu.Lock()
+	defer mb.serialPort.mu.Unlock()
+
+	if err = waitInterRequestDelay(context.Background(), mb.serialPort.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.serialPort.requestEnd = time.Now() }()
 	// Make sure port is connected
 	if err = mb.serialPort.connect(); err != nil {
 		return
@@ -119,19 +162,22 @@ func (mb *rtuSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, err
 	mb.serialPort.lastActivity = time.Now()
 	mb.serialPort.startCloseTimer()
 
-	// Send the request
-	mb.serialPort.logf("modbus: sending % x\n", aduRequest)
-	if _, err = mb.port.Write(aduRequest); err != nil {
+	// Send the request after the silent interval
+	mb.waitSilentInterval()
+	defer mb.endFrame()
+	mb.serialPort.tracef("modbus: sending % x\n", aduRequest)
+	if err = writeFull(mb.port, aduRequest); err != nil {
 		return
 	}
 	function := aduRequest[1]
-	functionFail := aduRequest[1] & 0x80
+	functionFail := aduRequest[1] | 0x80
 	bytesToRead := calculateResponseLength(aduRequest)
 	time.Sleep(mb.calculateDelay(len(aduRequest) + bytesToRead))
 
 	var n int
 	var n1 int
-	var data [rtuMaxSize]byte
+	data := getReadBuffer(rtuMaxSize)
+	defer putReadBuffer(data)
 	//We first read the minimum length and then read either the full package
 	//or the error package, depending on the error status (byte 2 of the response)
 	n, err = io.ReadAtLeast(mb.port, data[:], rtuMinSize)
@@ -160,24 +206,148 @@ func (mb *rtuSerialTransporter) Send(aduRequest []byte) (aduResponse []byte, err
 	if err != nil {
 		return
 	}
-	aduResponse = data[:n]
-	mb.serialPort.logf("modbus: received % x\n", aduResponse)
+	aduResponse = append([]byte(nil), data[:n]...)
+	mb.serialPort.tracef("modbus: received % x\n", aduResponse)
+	return
+}
+
+// SendBroadcast writes the request and waits for the silent interval, there
+// is no response.
+func (mb *rtuSerialTransporter) SendBroadcast(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "broadcasting")
+}
+
+// SendNoResponse writes the request of a function without response and waits
+// for the silent interval.
+func (mb *rtuSerialTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	return mb.write(ctx, aduRequest, "sending")
+}
+
+// write writes the request without reading a response, tracing it as action.
+func (mb *rtuSerialTransporter) write(ctx context.Context, aduRequest []byte, action string) (err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.serialPort.mu.Lock()
+	defer mb.serialPort.mu.Unlock()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = waitInterRequestDelay(ctx, mb.serialPort.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.serialPort.requestEnd = time.Now() }()
+	if err = mb.serialPort.connect(); err != nil {
+		return
+	}
+	mb.serialPort.lastActivity = time.Now()
+	mb.serialPort.startCloseTimer()
+
+	mb.waitSilentInterval()
+	defer mb.endFrame()
+	mb.serialPort.tracef("modbus: "+action+" % x\n", aduRequest)
+	if err = writeFull(mb.port, aduRequest); err != nil {
+		return
+	}
+	time.Sleep(mb.calculateDelay(len(aduRequest)))
 	return
 }
 
-// calculateDelay roughly calculates time needed for the next frame.
+// characterBits returns the bits per character: a start bit, the data bits,
+// the parity bit if any and the stop bits, and the baud rate. The defaults
+// of the serial port are 19200 bps, 8 data bits, even parity and 1 stop bit.
+func (mb *rtuSerialTransporter) characterBits() (bits, baudRate int) {
+	baudRate, dataBits, stopBits := mb.BaudRate, mb.DataBits, mb.StopBits
+	if baudRate <= 0 {
+		baudRate = 19200
+	}
+	if dataBits <= 0 {
+		dataBits = 8
+	}
+	if stopBits <= 0 {
+		stopBits = 1
+	}
+	bits = 1 + dataBits + stopBits
+	if mb.Parity != "N" {
+		bits++
+	}
+	return
+}
+
+// characterTime returns the transmission time of a character.
+func (mb *rtuSerialTransporter) characterTime() time.Duration {
+	bits, baudRate := mb.characterBits()
+	return time.Duration(bits) * time.Second / time.Duration(baudRate)
+}
+
+// frameDelay returns the silent interval between frames of 3.5 characters,
+// fixed to 1750us above 19200 bps.
 // See MODBUS over Serial Line - Specification and Implementation Guide (page 13).
+func (mb *rtuSerialTransporter) frameDelay() time.Duration {
+	if mb.BaudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	bits, baudRate := mb.characterBits()
+	return time.Duration(7*bits) * time.Second / time.Duration(2*baudRate)
+}
+
+// calculateDelay roughly calculates time needed to transmit chars characters
+// followed by the silent interval.
 func (mb *rtuSerialTransporter) calculateDelay(chars int) time.Duration {
-	var characterDelay, frameDelay int // us
+	return time.Duration(chars)*mb.characterTime() + mb.frameDelay()
+}
+
+// waitSilentInterval waits for the silent interval since the end of the last
+// frame. Caller must hold the mutex.
+func (mb *rtuSerialTransporter) waitSilentInterval() {
+	if wait := mb.frameDelay() - time.Since(mb.lastFrame); wait > 0 {
+		time.Sleep(wait)
+	}
+}
 
-	if mb.BaudRate <= 0 || mb.BaudRate > 19200 {
-		characterDelay = 750
-		frameDelay = 1750
-	} else {
-		characterDelay = 15000000 / mb.BaudRate
-		frameDelay = 35000000 / mb.BaudRate
+// endFrame records the end of a frame. Caller must hold the mutex.
+func (mb *rtuSerialTransporter) endFrame() {
+	mb.lastFrame = time.Now()
+}
+
+// calculateFrameLength returns the length of a variable length response frame
+// from its first bytes in adu, 0 if more bytes are needed to know or -1 if the
+// function does not tell the length.
+func calculateFrameLength(adu []byte) int {
+	if len(adu) < 2 {
+		return 0
+	}
+	switch adu[1] {
+	case FuncCodeGetCommEventLog,
+		FuncCodeReportServerID,
+		FuncCodeReadFileRecord,
+		FuncCodeWriteFileRecord:
+		// Byte count
+		if len(adu) < 3 {
+			return 0
+		}
+		return 3 + int(adu[2]) + 2
+	case FuncCodeReadFIFOQueue:
+		// Byte count (2 bytes)
+		if len(adu) < 4 {
+			return 0
+		}
+		return 4 + int(binary.BigEndian.Uint16(adu[2:])) + 2
+	case FuncCodeEncapsulatedInterfaceTransport:
+		// MEI type, read device id code, conformity level, more follows,
+		// next object id and number of objects, then id and length of each object
+		if len(adu) < 8 {
+			return 0
+		}
+		length := 8
+		for i := 0; i < int(adu[7]); i++ {
+			if len(adu) < length+2 {
+				return 0
+			}
+			length += 2 + int(adu[length+1])
+		}
+		return length + 2
 	}
-	return time.Duration(characterDelay*chars+frameDelay) * time.Microsecond
+	return -1
 }
 
 func calculateResponseLength(adu []byte) int {
@@ -198,11 +368,28 @@ func calculateResponseLength(adu []byte) int {
 	case FuncCodeWriteSingleCoil,
 		FuncCodeWriteMultipleCoils,
 		FuncCodeWriteSingleRegister,
-		FuncCodeWriteMultipleRegisters:
+		FuncCodeWriteMultipleRegisters,
+		FuncCodeDiagnostics,
+		FuncCodeGetCommEventCounter:
 		length += 4
 	case FuncCodeMaskWriteRegister:
 		length += 6
-	case FuncCodeReadFIFOQueue:
+	case FuncCodeReadExceptionStatus:
+		length++
+	case FuncCodeReadFileRecord:
+		// Byte count, then length, reference type and registers of each
+		// sub-request
+		length++
+		for i := 3; i+7 <= len(adu)-2; i += 7 {
+			length += 2 + 2*int(binary.BigEndian.Uint16(adu[i+5:]))
+		}
+	case FuncCodeWriteFileRecord:
+		// Echo of the request
+		length = len(adu)
+	case FuncCodeReadFIFOQueue,
+		FuncCodeGetCommEventLog,
+		FuncCodeReportServerID,
+		FuncCodeEncapsulatedInterfaceTransport:
 		// undetermined
 	default:
 	}
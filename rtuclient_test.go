@@ -6,7 +6,9 @@ package modbus
 
 import (
 	"bytes"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestRTUEncoding(t *testing.T) {
@@ -45,6 +47,59 @@ func TestRTUDecoding(t *testing.T) {
 	}
 }
 
+func TestRTUDecodingException(t *testing.T) {
+	decoder := rtuPackager{}
+	_, err := decoder.Decode([]byte{0x01, 0x83, 0x02, 0xC0, 0xF1})
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.FunctionCode != 0x83 || mbError.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Exception response with trailing data
+	_, err = decoder.Decode([]byte{0x01, 0x83, 0x02, 0x03, 0xB1, 0x51})
+	if err == nil || errors.As(err, &mbError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRTUDecodingCRC(t *testing.T) {
+	// Response with a zeroed CRC
+	adu := []byte{0x01, 0x10, 0x8A, 0x00, 0x00, 0x03, 0x00, 0x00}
+	decoder := rtuPackager{}
+	if _, err := decoder.Decode(adu); err == nil {
+		t.Fatal("expected crc error")
+	}
+	decoder.SkipCRCCheck = true
+	pdu, err := decoder.Decode(adu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x8A, 0x00, 0x00, 0x03}
+	if !bytes.Equal(expected, pdu.Data) {
+		t.Fatalf("Data: expected %v, actual %v", expected, pdu.Data)
+	}
+}
+
+func TestRTUCustomCRC(t *testing.T) {
+	packager := rtuPackager{SlaveId: 0x01}
+	packager.CRC = func(data []byte) uint16 {
+		return 0x1234
+	}
+	adu, err := packager.Encode(&ProtocolDataUnit{FunctionCode: 0x03, Data: []byte{0x50, 0x00, 0x00, 0x18}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x01, 0x03, 0x50, 0x00, 0x00, 0x18, 0x34, 0x12}
+	if !bytes.Equal(expected, adu) {
+		t.Fatalf("adu: expected %v, actual %v", expected, adu)
+	}
+	if _, err = packager.Decode([]byte{0x01, 0x10, 0x8A, 0x00, 0x00, 0x03, 0x34, 0x12}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = packager.Decode([]byte{0x01, 0x10, 0x8A, 0x00, 0x00, 0x03, 0xAA, 0x10}); err == nil {
+		t.Fatal("expected crc error")
+	}
+}
+
 var responseLengthTests = []struct {
 	adu    []byte
 	length int
@@ -56,6 +111,10 @@ var responseLengthTests = []struct {
 	{[]byte{0x11, 6, 0, 1, 0, 3, 0x9A, 0x9B}, 8},
 	{[]byte{0x11, 0xF, 0, 0x13, 0, 0xA, 2, 0xCD, 1, 0xBF, 0xB}, 8},
 	{[]byte{0x11, 0x10, 0, 1, 0, 2, 4, 0, 0xA, 1, 2, 0xC6, 0xF0}, 8},
+	{[]byte{0x11, 7, 0x4C, 0x22}, 5},
+	{[]byte{0x11, 8, 0, 0, 0xA5, 0x37, 0xD8, 0x1D}, 8},
+	{[]byte{0x11, 0x14, 0xE, 6, 0, 4, 0, 1, 0, 2, 6, 0, 3, 0, 9, 0, 2, 0xE9, 0x5B}, 17},
+	{[]byte{0x11, 0x15, 9, 6, 0, 4, 0, 7, 0, 1, 0x6, 0xAF, 0x3B, 0x99}, 14},
 }
 
 func TestCalculateResponseLength(t *testing.T) {
@@ -96,3 +155,64 @@ func BenchmarkRTUDecoder(b *testing.B) {
 		}
 	}
 }
+
+func TestRTUSerialBroadcast(t *testing.T) {
+	buf := &bytes.Buffer{}
+	transporter := &rtuSerialTransporter{}
+	transporter.port = &nopCloser{ReadWriter: buf}
+	client := NewClient2(&rtuPackager{}, transporter)
+	if _, err := client.WriteMultipleCoils(1, 3, []byte{0x05}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x00, 0x0F, 0x00, 0x01, 0x00, 0x03, 0x01, 0x05, 0xB3, 0x58}
+	if !bytes.Equal(expected, buf.Bytes()) {
+		t.Fatalf("expected % x, actual % x", expected, buf.Bytes())
+	}
+}
+
+func TestRTUFrameDelay(t *testing.T) {
+	tests := []struct {
+		baudRate, dataBits, stopBits int
+		parity                       string
+		character, frame             time.Duration
+	}{
+		// Defaults: 19200 bps, 8 data bits, even parity, 1 stop bit
+		{0, 0, 0, "", 572916 * time.Nanosecond, 2005208 * time.Nanosecond},
+		{9600, 8, 1, "E", 1145833 * time.Nanosecond, 4010416 * time.Nanosecond},
+		{1200, 8, 2, "N", 9166666 * time.Nanosecond, 32083333 * time.Nanosecond},
+		{300, 7, 1, "O", 33333333 * time.Nanosecond, 116666666 * time.Nanosecond},
+		{115200, 8, 1, "N", 86805 * time.Nanosecond, 1750 * time.Microsecond},
+	}
+	for _, test := range tests {
+		transporter := &rtuSerialTransporter{}
+		transporter.BaudRate = test.baudRate
+		transporter.DataBits = test.dataBits
+		transporter.StopBits = test.stopBits
+		transporter.Parity = test.parity
+		if character := transporter.characterTime(); character != test.character {
+			t.Errorf("%+v: character time: expected %v, actual %v", test, test.character, character)
+		}
+		if frame := transporter.frameDelay(); frame != test.frame {
+			t.Errorf("%+v: frame delay: expected %v, actual %v", test, test.frame, frame)
+		}
+	}
+}
+
+func TestRTUSilentInterval(t *testing.T) {
+	transporter := &rtuSerialTransporter{}
+	transporter.BaudRate = 1200
+	transporter.port = &nopCloser{ReadWriter: &bytes.Buffer{}}
+	start := time.Now()
+	transporter.endFrame()
+	transporter.waitSilentInterval()
+	if elapsed := time.Since(start); elapsed < transporter.frameDelay() {
+		t.Fatalf("silent interval: expected at least %v, actual %v", transporter.frameDelay(), elapsed)
+	}
+	// No wait once the line has been silent long enough
+	transporter.lastFrame = time.Now().Add(-time.Second)
+	start = time.Now()
+	transporter.waitSilentInterval()
+	if elapsed := time.Since(start); elapsed > transporter.frameDelay() {
+		t.Fatalf("unexpected wait %v", elapsed)
+	}
+}
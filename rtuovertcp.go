@@ -0,0 +1,33 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"net"
+)
+
+// RTUOverTCPClientHandler implements Packager and Transporter interface for
+// RTU frames sent over a TCP connection, as done by serial to ethernet
+// converters. There is no silent interval between frames, the length of a
+// response is told by its function code or content.
+type RTUOverTCPClientHandler struct {
+	rtuPackager
+	dtuTransporter
+}
+
+// NewRTUOverTCPClientHandler allocates and initializes a RTUOverTCPClientHandler.
+func NewRTUOverTCPClientHandler(conn net.Conn) *RTUOverTCPClientHandler {
+	handler := &RTUOverTCPClientHandler{}
+	handler.conn = conn
+	handler.Timeout = tcpTimeout
+	handler.keepAliveClient = NewClient(handler)
+	return handler
+}
+
+// RTUOverTCPClient creates RTU over TCP client with default handler and given connection.
+func RTUOverTCPClient(conn net.Conn) Client {
+	handler := NewRTUOverTCPClientHandler(conn)
+	return NewClient(handler)
+}
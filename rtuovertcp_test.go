@@ -0,0 +1,70 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+var frameLengthTests = []struct {
+	adu    []byte
+	length int
+}{
+	{[]byte{0x01}, 0},
+	{[]byte{0x01, 0x11}, 0},
+	{[]byte{0x01, 0x11, 0x03}, 8},
+	{[]byte{0x01, 0x18, 0x00}, 0},
+	{[]byte{0x01, 0x18, 0x00, 0x06}, 12},
+	{[]byte{0x01, 0x2B, 0x0E, 0x01, 0x01, 0x00, 0x00, 0x02}, 0},
+	{[]byte{0x01, 0x2B, 0x0E, 0x01, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 'A', 0x01}, 0},
+	{[]byte{0x01, 0x2B, 0x0E, 0x01, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01, 'A', 0x01, 0x02}, 17},
+	{[]byte{0x01, 0x14, 0x0C}, 17},
+	{[]byte{0x01, 0x03, 0x02, 0x00}, -1},
+}
+
+func TestCalculateFrameLength(t *testing.T) {
+	for _, input := range frameLengthTests {
+		if length := calculateFrameLength(input.adu); length != input.length {
+			t.Errorf("% x: expected %v, actual %v", input.adu, input.length, length)
+		}
+	}
+}
+
+func TestRTUOverTCPClient(t *testing.T) {
+	conn, device := net.Pipe()
+	defer device.Close()
+	handler := NewRTUOverTCPClientHandler(conn)
+	handler.SlaveId = 1
+	defer handler.Close()
+
+	response, err := handler.Encode(&ProtocolDataUnit{
+		FunctionCode: FuncCodeReportServerID,
+		Data:         []byte{0x03, 'A', 'B', 0xFF},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		request := make([]byte, 16)
+		if _, err := device.Read(request); err != nil {
+			return
+		}
+		// No silent interval tells where the frame ends
+		for i := range response {
+			if _, err := device.Write(response[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+	id, status, err := NewClient(handler).ReportServerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, []byte("AB")) || status != 0xFF {
+		t.Fatalf("unexpected id % x, status %x", id, status)
+	}
+}
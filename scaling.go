@@ -0,0 +1,78 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"fmt"
+)
+
+// ClampMode specifies how Scaling handles raw values outside of its raw range.
+type ClampMode int
+
+const (
+	// ClampNone extrapolates the values outside of the range
+	ClampNone ClampMode = iota
+	// ClampLimit limits the values to the engineering range
+	ClampLimit
+	// ClampError returns an error for the values outside of the range
+	ClampError
+)
+
+// Scaling maps the raw value of a register linearly to engineering units,
+// RawMin to EngMin and RawMax to EngMax, e.g. the counts 0 to 4095 of a
+// 4-20mA input to 0 to 100%.
+type Scaling struct {
+	RawMin, RawMax float64
+	EngMin, EngMax float64
+	// Signed reads the register as int16, uint16 otherwise
+	Signed bool
+	// Clamp handles the raw values outside of RawMin and RawMax
+	Clamp ClampMode
+}
+
+// Scale returns the engineering value of the register value raw.
+func (s Scaling) Scale(raw uint16) (value float64, err error) {
+	if s.RawMin == s.RawMax {
+		err = fmt.Errorf("modbus: raw range '%v' to '%v' must not be empty", s.RawMin, s.RawMax)
+		return
+	}
+	r := float64(raw)
+	if s.Signed {
+		r = float64(int16(raw))
+	}
+	low, high := s.RawMin, s.RawMax
+	if low > high {
+		low, high = high, low
+	}
+	if r < low || r > high {
+		switch s.Clamp {
+		case ClampLimit:
+			if r < low {
+				r = low
+			} else {
+				r = high
+			}
+		case ClampError:
+			err = fmt.Errorf("modbus: raw value '%v' is out of range '%v' to '%v'", r, s.RawMin, s.RawMax)
+			return
+		}
+	}
+	value = s.EngMin + (r-s.RawMin)*(s.EngMax-s.EngMin)/(s.RawMax-s.RawMin)
+	return
+}
+
+// ReadScaled reads the input register at address and returns its value
+// scaled to engineering units.
+func (mb *TypedClient) ReadScaled(address uint16, scale Scaling) (value float64, err error) {
+	data, err := mb.ReadInputRegisters(address, 1)
+	if err != nil {
+		return
+	}
+	if len(data) != 2 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), 2)
+		return
+	}
+	return scale.Scale(uint16(data[0])<<8 | uint16(data[1]))
+}
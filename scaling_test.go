@@ -0,0 +1,64 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"testing"
+)
+
+func TestScaling(t *testing.T) {
+	percent := Scaling{RawMin: 0, RawMax: 4000, EngMin: 0, EngMax: 100}
+	signed := Scaling{RawMin: -1000, RawMax: 1000, EngMin: -50, EngMax: 50, Signed: true}
+	limited := percent
+	limited.Clamp = ClampLimit
+	strict := percent
+	strict.Clamp = ClampError
+	tests := []struct {
+		scale Scaling
+		raw   uint16
+		value float64
+		err   bool
+	}{
+		{percent, 0, 0, false},
+		{percent, 1000, 25, false},
+		{percent, 4000, 100, false},
+		{percent, 4400, 110, false},
+		{signed, 0xFF9C, -5, false}, // -100
+		{signed, 1000, 50, false},
+		{limited, 4400, 100, false},
+		{strict, 4000, 100, false},
+		{strict, 4001, 0, true},
+		{Scaling{RawMin: 10, RawMax: 10}, 10, 0, true},
+	}
+	for _, test := range tests {
+		value, err := test.scale.Scale(test.raw)
+		if test.err {
+			if err == nil {
+				t.Errorf("%+v %v: expected error", test.scale, test.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v %v: %v", test.scale, test.raw, err)
+		} else if value != test.value {
+			t.Errorf("%+v %v: expected %v, actual %v", test.scale, test.raw, test.value, value)
+		}
+	}
+}
+
+func TestTypedClientReadScaled(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetInputRegister(3, 2000)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewTypedClient(NewClient(handler))
+	value, err := client.ReadScaled(3, Scaling{RawMin: 0, RawMax: 4000, EngMin: 4, EngMax: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 12 {
+		t.Fatalf("value: expected 12, actual %v", value)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Consecutive errors after which a slave is skipped
+	schedulerMaxErrors = 3
+	// Number of intervals a failing slave is skipped
+	schedulerBackoffIntervals = 10
+)
+
+// PollJob is a request polled by a Scheduler.
+type PollJob struct {
+	SlaveId byte
+	Request *ProtocolDataUnit
+}
+
+// PollResult is the outcome of a PollJob in one polling cycle.
+type PollResult struct {
+	Job      PollJob
+	Response *ProtocolDataUnit
+	Err      error
+}
+
+// SlaveStats are the polling statistics of a slave.
+type SlaveStats struct {
+	Successes int
+	Errors    int
+	// Errors since the last success
+	ConsecutiveErrors int
+	LastError         error
+	// End of the backoff of a failing slave, zero if it is polled
+	SkippedUntil time.Time
+}
+
+// Scheduler polls jobs of several slaves through one client, e.g. the
+// devices behind a DTU connection. Each cycle sends the requests of the jobs
+// in order, one at a time. A slave failing MaxErrors times in a row is
+// skipped for Backoff, then polled again.
+type Scheduler struct {
+	Client   ClientContext
+	Jobs     []PollJob
+	Interval time.Duration
+	// Consecutive errors after which a slave is skipped, 3 if not set
+	MaxErrors int
+	// Time a failing slave is skipped, 10 intervals if not set
+	Backoff time.Duration
+	// OnResult, if set, is called with the result of each request
+	OnResult func(result PollResult)
+	// Jitter, if set, is the maximum random delay before each request, so
+	// that the requests of several pollers on a shared bus do not collide
+	// in lock-step
+	Jitter time.Duration
+	// Rand is the source of the jitter, e.g. rand.New(rand.NewSource(seed))
+	// for reproducible delays, seeded from the time if not set
+	Rand *rand.Rand
+
+	mu    sync.Mutex
+	stats map[byte]*SlaveStats
+}
+
+// NewScheduler creates a Scheduler polling the jobs every interval.
+func NewScheduler(client ClientContext, interval time.Duration, jobs ...PollJob) *Scheduler {
+	return &Scheduler{
+		Client:   client,
+		Jobs:     jobs,
+		Interval: interval,
+		stats:    make(map[byte]*SlaveStats),
+	}
+}
+
+// Run polls the jobs, starting a cycle every interval or when the previous
+// cycle ends if later. It returns ctx.Err() when ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if s.Interval <= 0 {
+		return fmt.Errorf("modbus: polling interval '%v' must be positive", s.Interval)
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stats returns the statistics of the polled slaves by slave id.
+func (s *Scheduler) Stats() map[byte]SlaveStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[byte]SlaveStats, len(s.stats))
+	for slaveId, st := range s.stats {
+		stats[slaveId] = *st
+	}
+	return stats
+}
+
+// poll runs one cycle of the jobs.
+func (s *Scheduler) poll(ctx context.Context) {
+	for _, job := range s.Jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.skipped(job.SlaveId, time.Now()) {
+			continue
+		}
+		if sleepContext(ctx, s.jitter()) != nil {
+			return
+		}
+		response, err := s.Client.SendPDUContext(WithSlaveId(ctx, job.SlaveId), job.Request)
+		if err != nil && ctx.Err() != nil {
+			// Aborted, not a failure of the slave
+			return
+		}
+		s.record(job.SlaveId, err)
+		if s.OnResult != nil {
+			s.OnResult(PollResult{Job: job, Response: response, Err: err})
+		}
+	}
+}
+
+// skipped reports whether the slave is in backoff at now.
+func (s *Scheduler) skipped(slaveId byte, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[slaveId]
+	return ok && now.Before(st.SkippedUntil)
+}
+
+// record updates the statistics of the slave with the error of a request.
+func (s *Scheduler) record(slaveId byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[byte]*SlaveStats)
+	}
+	st, ok := s.stats[slaveId]
+	if !ok {
+		st = &SlaveStats{}
+		s.stats[slaveId] = st
+	}
+	if err == nil {
+		st.Successes++
+		st.ConsecutiveErrors = 0
+		st.SkippedUntil = time.Time{}
+		return
+	}
+	st.Errors++
+	st.ConsecutiveErrors++
+	st.LastError = err
+	if st.ConsecutiveErrors >= s.maxErrors() {
+		st.SkippedUntil = time.Now().Add(s.backoff())
+	}
+}
+
+// jitter returns a random delay from 0 to Jitter.
+func (s *Scheduler) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	if s.Rand == nil {
+		s.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(s.Rand.Int63n(int64(s.Jitter) + 1))
+}
+
+func (s *Scheduler) maxErrors() int {
+	if s.MaxErrors > 0 {
+		return s.MaxErrors
+	}
+	return schedulerMaxErrors
+}
+
+func (s *Scheduler) backoff() time.Duration {
+	if s.Backoff > 0 {
+		return s.Backoff
+	}
+	return schedulerBackoffIntervals * s.Interval
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 42)
+	handler := newServerClient(t, server)
+	handler.Timeout = 20 * time.Millisecond
+	read := &ProtocolDataUnit{FunctionCode: FuncCodeReadHoldingRegisters, Data: dataBlock(0, 1)}
+	// Slave 9 does not respond
+	scheduler := NewScheduler(NewClient(handler), 10*time.Millisecond,
+		PollJob{SlaveId: 1, Request: read}, PollJob{SlaveId: 9, Request: read})
+	scheduler.MaxErrors = 2
+	scheduler.Backoff = time.Hour
+	results := make(map[byte]int)
+	scheduler.OnResult = func(result PollResult) {
+		if result.Job.SlaveId == 1 && (result.Err != nil || result.Response.Data[2] != 42) {
+			t.Errorf("unexpected result: %+v", result)
+		}
+		results[result.Job.SlaveId]++
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := scheduler.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats := scheduler.Stats()
+	if st := stats[1]; st.Successes < 3 || st.Errors != 0 || results[1] != st.Successes {
+		t.Fatalf("slave 1: unexpected stats %+v, %v results", st, results[1])
+	}
+	// Skipped after 2 errors
+	if st := stats[9]; st.Errors != 2 || st.ConsecutiveErrors != 2 || st.SkippedUntil.IsZero() || results[9] != 2 {
+		t.Fatalf("slave 9: unexpected stats %+v, %v results", st, results[9])
+	}
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	if err := NewScheduler(nil, 0).Run(context.Background()); err == nil {
+		t.Fatal("expected error for interval")
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	scheduler := NewScheduler(nil, time.Second)
+	if jitter := scheduler.jitter(); jitter != 0 {
+		t.Fatalf("jitter: expected 0, actual %v", jitter)
+	}
+	scheduler.Jitter = 10 * time.Millisecond
+	scheduler.Rand = rand.New(rand.NewSource(1))
+	// Same delays with the same seed
+	other := NewScheduler(nil, time.Second)
+	other.Jitter = scheduler.Jitter
+	other.Rand = rand.New(rand.NewSource(1))
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		jitter := scheduler.jitter()
+		if jitter < 0 || jitter > scheduler.Jitter {
+			t.Fatalf("jitter: %v out of range", jitter)
+		}
+		if otherJitter := other.jitter(); otherJitter != jitter {
+			t.Fatalf("jitter with the same seed: expected %v, actual %v", jitter, otherJitter)
+		}
+		delays[jitter] = true
+	}
+	if len(delays) < 2 {
+		t.Fatalf("jitter: expected random delays, actual %v", delays)
+	}
+}
@@ -6,7 +6,6 @@ package modbus
 
 import (
 	"io"
-	"log"
 	"sync"
 	"time"
 
@@ -24,14 +23,41 @@ type serialPort struct {
 	// Serial port configuration.
 	serial.Config
 
-	Logger      *log.Logger
+	Logger      Logger
 	IdleTimeout time.Duration
+	// TraceFrames enables logging of the sent and received frames
+	TraceFrames bool
+	// TraceRequests enables logging of each request decoded, with its
+	// function, fields and response values, e.g. during integration
+	TraceRequests bool
+	// Metrics, if set, observes each request
+	Metrics Metrics
+	// OnRequest, if set, is called with each request frame before it is sent
+	OnRequest func(adu []byte)
+	// OnResponse, if set, is called with the response frame of each request,
+	// nil if none, and the error of the request
+	OnResponse func(adu []byte, err error)
+	// ResponseValidator, if set, is called with each request and its response
+	// frame once read, before the client verifies and decodes the frame with
+	// the Verify and Decode of the packager. It may correct the frame in
+	// place or reject it, the error is returned as a framing error.
+	ResponseValidator func(aduRequest, aduResponse []byte) error
+	// CircuitBreaker, if set, fails the requests to the slaves failing
+	// repeatedly fast, see CircuitBreaker
+	CircuitBreaker *CircuitBreaker
+	// Ping, if set, sends the request of Client.Ping
+	Ping PingFunc
+	// InterRequestDelay, if set, is the minimum time from the end of a
+	// request to the start of the next one, e.g. for slow devices
+	InterRequestDelay time.Duration
 
 	mu sync.Mutex
 	// port is platform-dependent data structure for serial port.
 	port         io.ReadWriteCloser
 	lastActivity time.Time
 	closeTimer   *time.Timer
+	// End of the previous request
+	requestEnd time.Time
 }
 
 func (mb *serialPort) Connect() (err error) {
@@ -69,12 +95,62 @@ func (mb *serialPort) close() (err error) {
 	return
 }
 
+// LastActivity returns the start time of the last request, zero if there
+// has been none. It waits for a request in progress.
+func (mb *serialPort) LastActivity() time.Time {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.lastActivity
+}
+
+// State returns the state of the connection. It waits for a request in
+// progress.
+func (mb *serialPort) State() ConnState {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return connState(mb.port != nil, mb.lastActivity, mb.Config.Timeout)
+}
+
 func (mb *serialPort) logf(format string, v ...interface{}) {
 	if mb.Logger != nil {
 		mb.Logger.Printf(format, v...)
 	}
 }
 
+func (mb *serialPort) metrics() Metrics {
+	return mb.Metrics
+}
+
+func (mb *serialPort) hooks() (onRequest func(adu []byte), onResponse func(adu []byte, err error)) {
+	return mb.OnRequest, mb.OnResponse
+}
+
+func (mb *serialPort) responseValidator() func(aduRequest, aduResponse []byte) error {
+	return mb.ResponseValidator
+}
+
+func (mb *serialPort) circuitBreaker() *CircuitBreaker {
+	return mb.CircuitBreaker
+}
+
+func (mb *serialPort) requestTracer() func(format string, v ...interface{}) {
+	if !mb.TraceRequests {
+		return nil
+	}
+	return mb.logf
+}
+
+func (mb *serialPort) ping() PingFunc {
+	return mb.Ping
+}
+
+// tracef logs the frame if TraceFrames is set, it is not formatted otherwise.
+func (mb *serialPort) tracef(format string, frame []byte) {
+	if mb.TraceFrames && mb.Logger != nil {
+		mb.Logger.Printf(format, frame)
+	}
+}
+
 func (mb *serialPort) startCloseTimer() {
 	if mb.IdleTimeout <= 0 {
 		return
@@ -0,0 +1,613 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// Number of addresses in each data table
+	dataStoreSize = 65536
+)
+
+// FunctionHandler handles a request PDU and returns the response PDU.
+// Returning a *ModbusError makes the server reply with that exception, any
+// other error is reported as a server device failure.
+type FunctionHandler func(request *ProtocolDataUnit) (response *ProtocolDataUnit, err error)
+
+// DataStore holds the coils, discrete inputs, holding and input registers of
+// a slave. It is safe for concurrent use.
+type DataStore struct {
+	mu               sync.RWMutex
+	coils            []bool
+	discreteInputs   []bool
+	holdingRegisters []uint16
+	inputRegisters   []uint16
+	exceptionStatus  byte
+}
+
+// NewDataStore allocates a DataStore with all 65536 addresses of each table set to zero.
+func NewDataStore() *DataStore {
+	return &DataStore{
+		coils:            make([]bool, dataStoreSize),
+		discreteInputs:   make([]bool, dataStoreSize),
+		holdingRegisters: make([]uint16, dataStoreSize),
+		inputRegisters:   make([]uint16, dataStoreSize),
+	}
+}
+
+// Coil returns the state of the coil at address.
+func (s *DataStore) Coil(address uint16) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.coils[address]
+}
+
+// SetCoil sets the state of the coil at address.
+func (s *DataStore) SetCoil(address uint16, value bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coils[address] = value
+}
+
+// DiscreteInput returns the state of the discrete input at address.
+func (s *DataStore) DiscreteInput(address uint16) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.discreteInputs[address]
+}
+
+// SetDiscreteInput sets the state of the discrete input at address.
+func (s *DataStore) SetDiscreteInput(address uint16, value bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discreteInputs[address] = value
+}
+
+// HoldingRegister returns the value of the holding register at address.
+func (s *DataStore) HoldingRegister(address uint16) uint16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.holdingRegisters[address]
+}
+
+// SetHoldingRegister sets the value of the holding register at address.
+func (s *DataStore) SetHoldingRegister(address, value uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holdingRegisters[address] = value
+}
+
+// InputRegister returns the value of the input register at address.
+func (s *DataStore) InputRegister(address uint16) uint16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inputRegisters[address]
+}
+
+// SetInputRegister sets the value of the input register at address.
+func (s *DataStore) SetInputRegister(address, value uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputRegisters[address] = value
+}
+
+// ExceptionStatus returns the eight exception status outputs.
+func (s *DataStore) ExceptionStatus() byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.exceptionStatus
+}
+
+// SetExceptionStatus sets the eight exception status outputs.
+func (s *DataStore) SetExceptionStatus(status byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exceptionStatus = status
+}
+
+// Server is a Modbus server answering RTU frames over stream connections, as
+// sent by DTU devices. Each slave id has its own DataStore. Requests for
+// unknown slave ids are not answered.
+type Server struct {
+	// Transmission logger
+	Logger Logger
+
+	mu        sync.RWMutex
+	slaves    map[byte]*DataStore
+	handlers  map[byte]FunctionHandler
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer allocates a Server without any slave.
+func NewServer() *Server {
+	return &Server{
+		slaves:    make(map[byte]*DataStore),
+		handlers:  make(map[byte]FunctionHandler),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// AddSlave adds a slave with an empty DataStore and returns the store.
+// It returns the existing store if the slave has already been added.
+func (s *Server) AddSlave(slaveId byte) *DataStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	store, ok := s.slaves[slaveId]
+	if !ok {
+		store = NewDataStore()
+		s.slaves[slaveId] = store
+	}
+	return store
+}
+
+// Slave returns the DataStore of the slave or nil if it has not been added.
+func (s *Server) Slave(slaveId byte) *DataStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.slaves[slaveId]
+}
+
+// RegisterFunctionHandler overrides the handling of the function code for all
+// slaves. A nil handler restores the default behavior.
+func (s *Server) RegisterFunctionHandler(code byte, fn FunctionHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fn == nil {
+		delete(s.handlers, code)
+	} else {
+		s.handlers[code] = fn
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them in a new
+// goroutine. It returns when the listener fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return errServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests on the connection until it is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	reader := rtuFrameReader{r: conn}
+	for {
+		aduRequest, err := reader.next()
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				s.logf("modbus: server read error: %v", err)
+			}
+			return
+		}
+		s.logf("modbus: server received % x", aduRequest)
+		aduResponse := s.handleFrame(aduRequest)
+		if aduResponse == nil {
+			continue
+		}
+		s.logf("modbus: server sending % x", aduResponse)
+		if err = writeFull(conn, aduResponse); err != nil {
+			s.logf("modbus: server write error: %v", err)
+			return
+		}
+	}
+}
+
+// Close closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// HandleRequest processes the request PDU addressed to the slave and returns
+// the response PDU, or nil if no response must be sent.
+// Slave id 0 is a broadcast handled by all slaves without response.
+func (s *Server) HandleRequest(slaveId byte, request *ProtocolDataUnit) *ProtocolDataUnit {
+	s.mu.RLock()
+	fn := s.handlers[request.FunctionCode]
+	var stores []*DataStore
+	if slaveId == 0 {
+		for _, store := range s.slaves {
+			stores = append(stores, store)
+		}
+	} else if store, ok := s.slaves[slaveId]; ok {
+		stores = append(stores, store)
+	}
+	s.mu.RUnlock()
+
+	if len(stores) == 0 {
+		return nil
+	}
+	var response *ProtocolDataUnit
+	if fn != nil {
+		response = s.handle(fn, nil, request)
+	} else {
+		for _, store := range stores {
+			response = s.handle(nil, store, request)
+		}
+	}
+	if slaveId == 0 {
+		return nil
+	}
+	return response
+}
+
+// handle runs the registered or the default handler and turns errors into exceptions.
+func (s *Server) handle(fn FunctionHandler, store *DataStore, request *ProtocolDataUnit) *ProtocolDataUnit {
+	var response *ProtocolDataUnit
+	var err error
+	if fn != nil {
+		response, err = fn(request)
+	} else if def, ok := defaultFunctionHandlers[request.FunctionCode]; ok {
+		response, err = def(store, request)
+	} else {
+		err = &ModbusError{FunctionCode: request.FunctionCode, ExceptionCode: ExceptionCodeIllegalFunction}
+	}
+	if err != nil {
+		var mbError *ModbusError
+		if !errors.As(err, &mbError) {
+			s.logf("modbus: server handler error: %v", err)
+			mbError = &ModbusError{ExceptionCode: ExceptionCodeServerDeviceFailure}
+		}
+		return &ProtocolDataUnit{
+			FunctionCode: request.FunctionCode | 0x80,
+			Data:         []byte{mbError.ExceptionCode},
+		}
+	}
+	return response
+}
+
+// handleFrame decodes a RTU frame and encodes the response.
+func (s *Server) handleFrame(aduRequest []byte) []byte {
+	packager := dtuPackager{SlaveId: aduRequest[0]}
+	request, err := packager.Decode(aduRequest)
+	if err != nil {
+		s.logf("modbus: server dropped frame: %v", err)
+		return nil
+	}
+	response := s.HandleRequest(aduRequest[0], request)
+	if response == nil {
+		return nil
+	}
+	aduResponse, err := packager.Encode(response)
+	if err != nil {
+		s.logf("modbus: server encode error: %v", err)
+		return nil
+	}
+	return aduResponse
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+var errServerClosed = errors.New("modbus: server closed")
+
+// rtuFrameReader splits a byte stream into RTU request frames.
+type rtuFrameReader struct {
+	r   io.Reader
+	buf [rtuMaxSize]byte
+	n   int
+}
+
+// next returns the next request frame.
+func (f *rtuFrameReader) next() (adu []byte, err error) {
+	for {
+		if f.n >= 2 {
+			length := calculateRequestLength(f.buf[:f.n])
+			if length < 0 || f.n >= len(f.buf) {
+				// Unknown frame, assume it has been received in one piece
+				length = f.n
+			}
+			if length > 0 && f.n >= length {
+				adu = make([]byte, length)
+				copy(adu, f.buf[:length])
+				f.n = copy(f.buf[:], f.buf[length:f.n])
+				return
+			}
+		}
+		var n int
+		if n, err = f.r.Read(f.buf[f.n:]); err != nil {
+			return
+		}
+		f.n += n
+	}
+}
+
+// calculateRequestLength returns the length of the RTU request frame in adu,
+// 0 if more bytes are needed to know or -1 for an unknown function code.
+func calculateRequestLength(adu []byte) int {
+	switch adu[1] {
+	case FuncCodeReadDiscreteInputs,
+		FuncCodeReadCoils,
+		FuncCodeReadInputRegisters,
+		FuncCodeReadHoldingRegisters,
+		FuncCodeWriteSingleCoil,
+		FuncCodeWriteSingleRegister,
+		FuncCodeDiagnostics:
+		return 8
+	case FuncCodeMaskWriteRegister:
+		return 10
+	case FuncCodeReadFIFOQueue:
+		return 6
+	case FuncCodeEncapsulatedInterfaceTransport:
+		return 7
+	case FuncCodeReadExceptionStatus,
+		FuncCodeGetCommEventCounter,
+		FuncCodeGetCommEventLog,
+		FuncCodeReportServerID:
+		return 4
+	case FuncCodeWriteMultipleCoils,
+		FuncCodeWriteMultipleRegisters:
+		if len(adu) < 7 {
+			return 0
+		}
+		return 7 + int(adu[6]) + 2
+	case FuncCodeReadFileRecord,
+		FuncCodeWriteFileRecord:
+		if len(adu) < 3 {
+			return 0
+		}
+		return 3 + int(adu[2]) + 2
+	case FuncCodeReadWriteMultipleRegisters:
+		if len(adu) < 11 {
+			return 0
+		}
+		return 11 + int(adu[10]) + 2
+	}
+	return -1
+}
+
+var defaultFunctionHandlers = map[byte]func(*DataStore, *ProtocolDataUnit) (*ProtocolDataUnit, error){
+	FuncCodeReadCoils:                  serverReadCoils,
+	FuncCodeReadDiscreteInputs:         serverReadDiscreteInputs,
+	FuncCodeReadHoldingRegisters:       serverReadHoldingRegisters,
+	FuncCodeReadInputRegisters:         serverReadInputRegisters,
+	FuncCodeWriteSingleCoil:            serverWriteSingleCoil,
+	FuncCodeWriteSingleRegister:        serverWriteSingleRegister,
+	FuncCodeWriteMultipleCoils:         serverWriteMultipleCoils,
+	FuncCodeWriteMultipleRegisters:     serverWriteMultipleRegisters,
+	FuncCodeMaskWriteRegister:          serverMaskWriteRegister,
+	FuncCodeReadWriteMultipleRegisters: serverReadWriteMultipleRegisters,
+	FuncCodeReadExceptionStatus:        serverReadExceptionStatus,
+	FuncCodeDiagnostics:                serverDiagnostics,
+}
+
+// serverRange validates the request data length and the address range.
+func serverRange(request *ProtocolDataUnit, dataLength int, max uint16) (address, quantity uint16, err error) {
+	if len(request.Data) < dataLength {
+		err = exception(request, ExceptionCodeIllegalDataValue)
+		return
+	}
+	address = binary.BigEndian.Uint16(request.Data)
+	quantity = binary.BigEndian.Uint16(request.Data[2:])
+	if quantity < 1 || quantity > max {
+		err = exception(request, ExceptionCodeIllegalDataValue)
+		return
+	}
+	if int(address)+int(quantity) > dataStoreSize {
+		err = exception(request, ExceptionCodeIllegalDataAddress)
+		return
+	}
+	return
+}
+
+func exception(request *ProtocolDataUnit, code byte) error {
+	return &ModbusError{FunctionCode: request.FunctionCode, ExceptionCode: code}
+}
+
+func serverReadBits(request *ProtocolDataUnit, bits []bool, mu *sync.RWMutex) (*ProtocolDataUnit, error) {
+	address, quantity, err := serverRange(request, 4, 2000)
+	if err != nil {
+		return nil, err
+	}
+	count := (int(quantity) + 7) / 8
+	data := make([]byte, 1+count)
+	data[0] = byte(count)
+	mu.RLock()
+	for i := 0; i < int(quantity); i++ {
+		if bits[int(address)+i] {
+			data[1+i/8] |= 1 << uint(i%8)
+		}
+	}
+	mu.RUnlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}, nil
+}
+
+func serverReadRegisters(request *ProtocolDataUnit, registers []uint16, mu *sync.RWMutex) (*ProtocolDataUnit, error) {
+	address, quantity, err := serverRange(request, 4, 125)
+	if err != nil {
+		return nil, err
+	}
+	mu.RLock()
+	data := dataBlock(registers[address : int(address)+int(quantity)]...)
+	mu.RUnlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{byte(len(data))}, data...)}, nil
+}
+
+func serverReadCoils(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	return serverReadBits(request, s.coils, &s.mu)
+}
+
+func serverReadDiscreteInputs(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	return serverReadBits(request, s.discreteInputs, &s.mu)
+}
+
+func serverReadHoldingRegisters(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	return serverReadRegisters(request, s.holdingRegisters, &s.mu)
+}
+
+func serverReadInputRegisters(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	return serverReadRegisters(request, s.inputRegisters, &s.mu)
+}
+
+func serverWriteSingleCoil(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	if len(request.Data) != 4 {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	address := binary.BigEndian.Uint16(request.Data)
+	value := binary.BigEndian.Uint16(request.Data[2:])
+	if value != CoilOn && value != CoilOff {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	s.SetCoil(address, value == CoilOn)
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data}, nil
+}
+
+func serverWriteSingleRegister(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	if len(request.Data) != 4 {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	s.SetHoldingRegister(binary.BigEndian.Uint16(request.Data), binary.BigEndian.Uint16(request.Data[2:]))
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data}, nil
+}
+
+func serverWriteMultipleCoils(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	address, quantity, err := serverRange(request, 5, 1968)
+	if err != nil {
+		return nil, err
+	}
+	count := int(request.Data[4])
+	if count != (int(quantity)+7)/8 || len(request.Data) != 5+count {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	s.mu.Lock()
+	for i := 0; i < int(quantity); i++ {
+		s.coils[int(address)+i] = request.Data[5+i/8]&(1<<uint(i%8)) != 0
+	}
+	s.mu.Unlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data[:4]}, nil
+}
+
+func serverWriteMultipleRegisters(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	address, quantity, err := serverRange(request, 5, 123)
+	if err != nil {
+		return nil, err
+	}
+	count := int(request.Data[4])
+	if count != int(quantity)*2 || len(request.Data) != 5+count {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	s.mu.Lock()
+	for i := 0; i < int(quantity); i++ {
+		s.holdingRegisters[int(address)+i] = binary.BigEndian.Uint16(request.Data[5+i*2:])
+	}
+	s.mu.Unlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data[:4]}, nil
+}
+
+func serverMaskWriteRegister(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	if len(request.Data) != 6 {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	address := binary.BigEndian.Uint16(request.Data)
+	andMask := binary.BigEndian.Uint16(request.Data[2:])
+	orMask := binary.BigEndian.Uint16(request.Data[4:])
+	s.mu.Lock()
+	s.holdingRegisters[address] = (s.holdingRegisters[address] & andMask) | (orMask &^ andMask)
+	s.mu.Unlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data}, nil
+}
+
+func serverReadWriteMultipleRegisters(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	readAddress, readQuantity, err := serverRange(request, 9, 125)
+	if err != nil {
+		return nil, err
+	}
+	write := &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data[4:]}
+	writeAddress, writeQuantity, err := serverRange(write, 5, 121)
+	if err != nil {
+		return nil, err
+	}
+	count := int(write.Data[4])
+	if count != int(writeQuantity)*2 || len(write.Data) != 5+count {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	// Write operation is performed before read
+	s.mu.Lock()
+	for i := 0; i < int(writeQuantity); i++ {
+		s.holdingRegisters[int(writeAddress)+i] = binary.BigEndian.Uint16(write.Data[5+i*2:])
+	}
+	data := dataBlock(s.holdingRegisters[readAddress : int(readAddress)+int(readQuantity)]...)
+	s.mu.Unlock()
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: append([]byte{byte(len(data))}, data...)}, nil
+}
+
+func serverReadExceptionStatus(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{s.ExceptionStatus()}}, nil
+}
+
+// serverDiagnostics only supports the loopback sub-function as the server
+// does not keep communication counters.
+func serverDiagnostics(s *DataStore, request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+	if len(request.Data) != 4 {
+		return nil, exception(request, ExceptionCodeIllegalDataValue)
+	}
+	if binary.BigEndian.Uint16(request.Data) != DiagnosticsReturnQueryData {
+		return nil, exception(request, ExceptionCodeIllegalFunction)
+	}
+	return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: request.Data}, nil
+}
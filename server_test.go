@@ -0,0 +1,415 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newServerClient returns a DTU handler connected to the server through a pipe.
+func newServerClient(t *testing.T, server *Server) *DTUClientHandler {
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	t.Cleanup(func() { client.Close() })
+	return NewDTUClientHandler(client)
+}
+
+func TestServerRegisters(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	store.SetInputRegister(8, 0x1234)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	if _, err := client.WriteMultipleRegisters(1, 2, []byte{0, 3, 0, 4}); err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.ReadHoldingRegisters(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 0, 0, 3, 0, 4}; !bytes.Equal(expected, results) {
+		t.Fatalf("registers: expected % x, actual % x", expected, results)
+	}
+	if _, err = client.MaskWriteRegister(1, 0x00F2, 0x0025); err != nil {
+		t.Fatal(err)
+	}
+	if v := store.HoldingRegister(1); v != 0x0007 {
+		t.Fatalf("mask write: expected %v, actual %v", 0x0007, v)
+	}
+	results, err = client.ReadInputRegisters(8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x12, 0x34}; !bytes.Equal(expected, results) {
+		t.Fatalf("input registers: expected % x, actual % x", expected, results)
+	}
+	results, err = client.ReadWriteMultipleRegisters(1, 2, 2, 1, []byte{0, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 7, 0, 9}; !bytes.Equal(expected, results) {
+		t.Fatalf("read write registers: expected % x, actual % x", expected, results)
+	}
+}
+
+func TestReadWriteMultipleRegisters(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	if _, err := client.ReadWriteMultipleRegisters(0, 126, 0, 1, []byte{0, 1}); err == nil {
+		t.Fatal("expected error for quantity to read")
+	}
+	if _, err := client.ReadWriteMultipleRegisters(0, 1, 0, 122, make([]byte, 244)); err == nil {
+		t.Fatal("expected error for quantity to write")
+	}
+	if _, err := client.ReadWriteMultipleRegisters(0, 1, 0, 2, []byte{0, 1}); err == nil {
+		t.Fatal("expected error for value size")
+	}
+	results, err := client.ReadWriteMultipleRegisters(0, 2, 0, 1, []byte{0x12, 0x34})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x12, 0x34, 0, 0}; !bytes.Equal(expected, results) {
+		t.Fatalf("expected % x, actual % x", expected, results)
+	}
+}
+
+func TestServerCoils(t *testing.T) {
+	server := NewServer()
+	store := server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	if _, err := client.WriteMultipleCoils(5, 10, []byte{0x04, 0x03}); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Coil(7) || !store.Coil(13) || !store.Coil(14) || store.Coil(5) {
+		t.Fatal("coils are not written")
+	}
+	if _, err := client.WriteSingleCoil(5, 0xFF00); err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.ReadCoils(5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0x05, 0x03}; !bytes.Equal(expected, results) {
+		t.Fatalf("coils: expected % x, actual % x", expected, results)
+	}
+}
+
+func TestServerSlaves(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 1)
+	server.AddSlave(2).SetHoldingRegister(0, 2)
+	handler := newServerClient(t, server)
+	client := NewClient(handler)
+
+	for _, slaveId := range []byte{1, 2} {
+		handler.SlaveId = slaveId
+		results, err := client.ReadHoldingRegisters(0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[1] != slaveId {
+			t.Fatalf("slave %v: unexpected % x", slaveId, results)
+		}
+	}
+}
+
+func TestServerSlaveIdContext(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 1)
+	server.AddSlave(2).SetHoldingRegister(0, 2)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		for _, slaveId := range []byte{1, 2} {
+			wg.Add(1)
+			go func(slaveId byte) {
+				defer wg.Done()
+				results, err := client.ReadHoldingRegistersContext(WithSlaveId(context.Background(), slaveId), 0, 1)
+				if err == nil && results[1] != slaveId {
+					err = fmt.Errorf("slave %v: unexpected % x", slaveId, results)
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(slaveId)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if handler.SlaveId != 1 {
+		t.Fatalf("slave id: expected %v, actual %v", 1, handler.SlaveId)
+	}
+}
+
+func TestServerException(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	_, err := client.ReadFIFOQueue(0)
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalFunction {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = client.ReadHoldingRegisters(0xFFFF, 2)
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalDataAddress {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServerFunctionHandler(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	server.RegisterFunctionHandler(FuncCodeReadHoldingRegisters, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return nil, &ModbusError{ExceptionCode: ExceptionCodeServerDeviceBusy}
+	})
+	_, err := client.ReadHoldingRegisters(0, 1)
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeServerDeviceBusy {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServerExceptionStatus(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetExceptionStatus(0x6D)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	status, err := client.ReadExceptionStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0x6D {
+		t.Fatalf("exception status: expected %v, actual %v", 0x6D, status)
+	}
+	server.RegisterFunctionHandler(FuncCodeReadExceptionStatus, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return nil, &ModbusError{ExceptionCode: ExceptionCodeServerDeviceFailure}
+	})
+	_, err = client.ReadExceptionStatus()
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeServerDeviceFailure {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServerDiagnostics(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	results, err := client.Diagnostics(DiagnosticsReturnQueryData, 0xA537)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0xA5, 0x37}; !bytes.Equal(expected, results) {
+		t.Fatalf("query data: expected % x, actual % x", expected, results)
+	}
+	_, err = client.Diagnostics(DiagnosticsReturnBusMessageCount, 0)
+	var mbError *ModbusError
+	if !errors.As(err, &mbError) || mbError.ExceptionCode != ExceptionCodeIllegalFunction {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server.RegisterFunctionHandler(FuncCodeDiagnostics, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		data := append([]byte(nil), request.Data...)
+		data[3] ^= 1
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}, nil
+	})
+	if _, err = client.Diagnostics(DiagnosticsReturnQueryData, 0xA537); err == nil {
+		t.Fatal("expected error for modified query data")
+	}
+	results, err = client.Diagnostics(DiagnosticsReturnBusMessageCount, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 1}; !bytes.Equal(expected, results) {
+		t.Fatalf("bus message count: expected % x, actual % x", expected, results)
+	}
+}
+
+func TestServerCommEvents(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	server.RegisterFunctionHandler(FuncCodeGetCommEventCounter, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{0xFF, 0xFF, 0x01, 0x08}}, nil
+	})
+	status, eventCount, err := client.GetCommEventCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0xFFFF || eventCount != 0x0108 {
+		t.Fatalf("event counter: unexpected status %x, count %v", status, eventCount)
+	}
+
+	var response []byte
+	server.RegisterFunctionHandler(FuncCodeGetCommEventLog, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: response}, nil
+	})
+	response = []byte{0x08, 0x00, 0x00, 0x01, 0x08, 0x01, 0x21, 0x20, 0x00}
+	log, err := client.GetCommEventLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Status != 0 || log.EventCount != 0x0108 || log.MessageCount != 0x0121 || !bytes.Equal([]byte{0x20, 0x00}, log.Events) {
+		t.Fatalf("event log: unexpected %+v", log)
+	}
+	for _, response = range [][]byte{{0x00}, {0x05, 0x00, 0x00, 0x01, 0x08, 0x01}} {
+		if _, err = client.GetCommEventLog(); err == nil {
+			t.Fatalf("expected error for % x", response)
+		}
+	}
+}
+
+func TestServerReportServerID(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	var response []byte
+	server.RegisterFunctionHandler(FuncCodeReportServerID, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: response}, nil
+	})
+	response = []byte{4, 'A', 'B', 'C', 0xFF}
+	id, status, err := client.ReportServerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte("ABC"), id) || status != 0xFF {
+		t.Fatalf("server id: unexpected % x, status %v", id, status)
+	}
+	// Empty server id
+	response = []byte{1, 0x00}
+	id, status, err = client.ReportServerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 0 || status != 0x00 {
+		t.Fatalf("server id: unexpected % x, status %v", id, status)
+	}
+	// A truncated server id times out
+	handler.Timeout = 50 * time.Millisecond
+	for _, response = range [][]byte{{0}, {5, 'A', 'B', 0xFF}} {
+		if _, _, err = client.ReportServerID(); err == nil {
+			t.Fatalf("expected error for % x", response)
+		}
+	}
+}
+
+func TestServerReadDeviceIdentification(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1)
+	handler := newServerClient(t, server)
+	handler.SlaveId = 1
+	client := NewClient(handler)
+
+	var requests [][]byte
+	server.RegisterFunctionHandler(FuncCodeEncapsulatedInterfaceTransport, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		requests = append(requests, request.Data)
+		data := []byte{MEITypeReadDeviceIdentification, request.Data[1], 0x81}
+		if request.Data[2] < ObjectIDMajorMinorRevision {
+			data = append(data, 0xFF, ObjectIDMajorMinorRevision, 2, 0, 3, 'A', 'C', 'M', 1, 2, 'M', '1')
+		} else {
+			data = append(data, 0x00, 0x00, 1, 2, 3, 'V', '1', '0')
+		}
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: data}, nil
+	})
+	objects, err := client.ReadDeviceIdentification(ReadDeviceIDCodeBasic, ObjectIDVendorName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[byte]string{
+		ObjectIDVendorName:         "ACM",
+		ObjectIDProductCode:        "M1",
+		ObjectIDMajorMinorRevision: "V10",
+	}
+	if len(objects) != len(expected) {
+		t.Fatalf("objects: expected %v, actual %q", expected, objects)
+	}
+	for id, value := range expected {
+		if string(objects[id]) != value {
+			t.Fatalf("object %v: expected %q, actual %q", id, value, objects[id])
+		}
+	}
+	if len(requests) != 2 || requests[1][2] != ObjectIDMajorMinorRevision {
+		t.Fatalf("requests: unexpected % x", requests)
+	}
+
+	server.RegisterFunctionHandler(FuncCodeEncapsulatedInterfaceTransport, func(request *ProtocolDataUnit) (*ProtocolDataUnit, error) {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{0x0D, 1, 0x81, 0, 0, 0}}, nil
+	})
+	if _, err = client.ReadDeviceIdentification(ReadDeviceIDCodeBasic, 0); err == nil {
+		t.Fatal("expected error for MEI type")
+	}
+}
+
+func TestParseDeviceIdentification(t *testing.T) {
+	objects := make(map[byte][]byte)
+	if _, _, err := parseDeviceIdentification([]byte{0x0E, 1, 0x81, 0, 0, 1, 0, 5, 'A'}, 1, objects); err == nil {
+		t.Fatal("expected error for truncated object")
+	}
+	if _, _, err := parseDeviceIdentification([]byte{0x0E, 1, 0x81, 0, 0, 0, 0}, 1, objects); err == nil {
+		t.Fatal("expected error for trailing bytes")
+	}
+	if _, _, err := parseDeviceIdentification([]byte{0x0E, 2, 0x81, 0, 0, 0}, 1, objects); err == nil {
+		t.Fatal("expected error for read device id code")
+	}
+}
+
+func TestRTUFrameReader(t *testing.T) {
+	frames := [][]byte{
+		{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0A},
+		{0x11, 0x10, 0, 1, 0, 2, 4, 0, 0xA, 1, 2, 0xC6, 0xF0},
+	}
+	reader := rtuFrameReader{r: bytes.NewReader(bytes.Join(frames, nil))}
+	for _, expected := range frames {
+		adu, err := reader.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, adu) {
+			t.Fatalf("frame: expected % x, actual % x", expected, adu)
+		}
+	}
+}
@@ -5,19 +5,20 @@
 package modbus
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const (
-	tcpProtocolIdentifier uint16 = 0x0000
-
 	// Modbus Application Protocol
 	tcpHeaderSize = 7
 	tcpMaxLength  = 260
@@ -41,6 +42,34 @@ func NewTCPClientHandler(address string) *TCPClientHandler {
 	return h
 }
 
+// NewTCPClientHandlerContext allocates a new TCPClientHandler connected with
+// dialer, which establishes the later connections too. The connection is
+// aborted if ctx is done first.
+func NewTCPClientHandlerContext(ctx context.Context, address string, dialer *net.Dialer) (*TCPClientHandler, error) {
+	h := NewTCPClientHandler(address)
+	h.Dialer = dialer
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.connect(ctx); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// NewTLSClientHandler allocates a new TCPClientHandler connecting with TLS,
+// as specified by Modbus/TCP Security. Its port is 802 by default.
+func NewTLSClientHandler(address string, tlsConfig *tls.Config) *TCPClientHandler {
+	h := NewTCPClientHandler(address)
+	h.TLSConfig = tlsConfig
+	return h
+}
+
+// TLSClient creates TCP client connecting with TLS with default handler and given connect string.
+func TLSClient(address string, tlsConfig *tls.Config) Client {
+	handler := NewTLSClientHandler(address, tlsConfig)
+	return NewClient(handler)
+}
+
 // TCPClient creates TCP client with default handler and given connect string.
 func TCPClient(address string) Client {
 	handler := NewTCPClientHandler(address)
@@ -49,10 +78,59 @@ func TCPClient(address string) Client {
 
 // tcpPackager implements Packager interface.
 type tcpPackager struct {
-	// For synchronization between messages of server & client
+	// For synchronization between messages of server & client. The last
+	// id used, masked to 16 bits so that it wraps from 65535 to 0. Every
+	// request, including a retry, gets a new id so that a late response
+	// to a previous attempt fails Verify instead of being taken for the
+	// response. Requests to unit id 0 are not broadcast over TCP, they get
+	// a response and an id like any other request.
 	transactionId uint32
-	// Broadcast address is 0
+	// Broadcast address is 0. Unlike SetSlaveId, setting it is not safe
+	// while requests are made from other goroutines.
 	SlaveId byte
+	// NextTransactionId, if set, returns the transaction id of each request
+	// instead of the internal counter. Ids must be unique among the
+	// requests in flight to a unit id when Pipelined.
+	NextTransactionId func() uint16
+	// PerUnitTransactionIds, if set, numbers the requests of each unit id
+	// with its own counter instead of a single one, e.g. for gateways
+	// reusing transaction ids per unit. Responses are matched by unit and
+	// transaction id.
+	PerUnitTransactionIds bool
+	// ProtocolIdentifier of the requests, 0 for Modbus by default. Some
+	// tunneling schemes set another one to tell Modbus apart from other
+	// payloads on the same connection. Verify checks that the responses
+	// carry the same one.
+	ProtocolIdentifier uint16
+
+	// Last ids used per unit id if PerUnitTransactionIds
+	unitTransactionIds [256]uint32
+	// Guards SlaveId set by SetSlaveId
+	config sync.RWMutex
+}
+
+// SetTransactionId sets the transaction id of the next request, e.g. to
+// continue the sequence of a previous connection, of every unit id if
+// PerUnitTransactionIds. It is not used when NextTransactionId is set.
+func (mb *tcpPackager) SetTransactionId(id uint16) {
+	atomic.StoreUint32(&mb.transactionId, uint32(id-1)&0xFFFF)
+	for i := range mb.unitTransactionIds {
+		atomic.StoreUint32(&mb.unitTransactionIds[i], uint32(id-1)&0xFFFF)
+	}
+}
+
+// SetSlaveId sets SlaveId, the unit id of the requests encoded from then on.
+// It is safe while requests are made from other goroutines.
+func (mb *tcpPackager) SetSlaveId(slaveId byte) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.SlaveId = slaveId
+}
+
+func (mb *tcpPackager) defaultSlaveId() byte {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.SlaveId
 }
 
 // Encode adds modbus application protocol header:
@@ -63,18 +141,22 @@ type tcpPackager struct {
 //  Function code: 1 byte
 //  Data: n bytes
 func (mb *tcpPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
+	return mb.EncodeSlave(mb.defaultSlaveId(), pdu)
+}
+
+// EncodeSlave adds modbus application protocol header with the given unit identifier.
+func (mb *tcpPackager) EncodeSlave(slaveId byte, pdu *ProtocolDataUnit) (adu []byte, err error) {
 	adu = make([]byte, tcpHeaderSize+1+len(pdu.Data))
 
 	// Transaction identifier
-	transactionId := atomic.AddUint32(&mb.transactionId, 1)
-	binary.BigEndian.PutUint16(adu, uint16(transactionId))
+	binary.BigEndian.PutUint16(adu, mb.nextTransactionId(slaveId))
 	// Protocol identifier
-	binary.BigEndian.PutUint16(adu[2:], tcpProtocolIdentifier)
+	binary.BigEndian.PutUint16(adu[2:], mb.ProtocolIdentifier)
 	// Length = sizeof(SlaveId) + sizeof(FunctionCode) + Data
 	length := uint16(1 + 1 + len(pdu.Data))
 	binary.BigEndian.PutUint16(adu[4:], length)
 	// Unit identifier
-	adu[6] = mb.SlaveId
+	adu[6] = slaveId
 
 	// PDU
 	adu[tcpHeaderSize] = pdu.FunctionCode
@@ -82,8 +164,34 @@ func (mb *tcpPackager) Encode(pdu *ProtocolDataUnit) (adu []byte, err error) {
 	return
 }
 
-// Verify confirms transaction, protocol and unit id.
+// nextTransactionId returns the transaction id of a new request to the unit.
+func (mb *tcpPackager) nextTransactionId(unitId byte) uint16 {
+	if mb.NextTransactionId != nil {
+		return mb.NextTransactionId()
+	}
+	counter := &mb.transactionId
+	if mb.PerUnitTransactionIds {
+		counter = &mb.unitTransactionIds[unitId]
+	}
+	for {
+		last := atomic.LoadUint32(counter)
+		next := (last + 1) & 0xFFFF
+		if atomic.CompareAndSwapUint32(counter, last, next) {
+			return uint16(next)
+		}
+	}
+}
+
+func (mb *tcpPackager) frameTransactionId(adu []byte) uint16 {
+	return binary.BigEndian.Uint16(adu)
+}
+
+// Verify confirms transaction, protocol and unit id, and function code.
 func (mb *tcpPackager) Verify(aduRequest []byte, aduResponse []byte) (err error) {
+	if len(aduResponse) < tcpHeaderSize+1 {
+		err = fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", len(aduResponse), tcpHeaderSize+1)
+		return
+	}
 	// Transaction id
 	responseVal := binary.BigEndian.Uint16(aduResponse)
 	requestVal := binary.BigEndian.Uint16(aduRequest)
@@ -103,6 +211,7 @@ func (mb *tcpPackager) Verify(aduRequest []byte, aduResponse []byte) (err error)
 		err = fmt.Errorf("modbus: response unit id '%v' does not match request '%v'", aduResponse[6], aduRequest[6])
 		return
 	}
+	err = verifyFunctionCode(aduRequest[tcpHeaderSize], aduResponse[tcpHeaderSize])
 	return
 }
 
@@ -112,11 +221,16 @@ func (mb *tcpPackager) Verify(aduRequest []byte, aduResponse []byte) (err error)
 //  Length: 2 bytes
 //  Unit identifier: 1 byte
 func (mb *tcpPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
-	// Read length value in the header
-	length := binary.BigEndian.Uint16(adu[4:])
+	// Header and function code at least
+	if len(adu) < tcpHeaderSize+1 {
+		err = fmt.Errorf("modbus: response length '%v' does not meet minimum '%v'", len(adu), tcpHeaderSize+1)
+		return
+	}
+	// Read length value in the header, which counts the unit id
+	length := int(binary.BigEndian.Uint16(adu[4:])) - 1
 	pduLength := len(adu) - tcpHeaderSize
-	if pduLength <= 0 || pduLength != int(length-1) {
-		err = fmt.Errorf("modbus: length in response '%v' does not match pdu data length '%v'", length-1, pduLength)
+	if pduLength != length {
+		err = fmt.Errorf("modbus: length in response '%v' does not match pdu data length '%v'", length, pduLength)
 		return
 	}
 	pdu = &ProtocolDataUnit{}
@@ -128,92 +242,454 @@ func (mb *tcpPackager) Decode(adu []byte) (pdu *ProtocolDataUnit, err error) {
 
 // tcpTransporter implements Transporter interface.
 type tcpTransporter struct {
-	// Connect string
+	// Connect string, host:port with IPv6 literals in brackets, e.g.
+	// "[::1]:502"
 	Address string
-	// Connect & Read timeout
+	// Request timeout, and connect timeout if ConnectTimeout is not set
 	Timeout time.Duration
+	// AdaptiveTimeout, if set, replaces Timeout as the timeout of the
+	// requests, estimated from the latency of the previous ones. Timeout
+	// still applies until a latency is observed if its Max is not set, and
+	// the timeouts set by SetTimeout still apply.
+	AdaptiveTimeout *AdaptiveTimeout
+	// ConnectTimeout, if set, is the timeout of establishing a connection,
+	// including the TLS handshake, in place of Timeout
+	ConnectTimeout time.Duration
 	// Idle timeout to close the connection
 	IdleTimeout time.Duration
+	// Dialer, if set, establishes the connections in place of a dialer with
+	// the connect timeout, e.g. to bind a local address
+	Dialer *net.Dialer
+	// Resolver, if set, resolves the host name of Address in place of the
+	// resolver of Dialer, e.g. for split-horizon DNS. Proxy, if set, gets
+	// Address as is.
+	Resolver *net.Resolver
+	// Proxy, if set, establishes the connections to Address in place of
+	// Dialer, which is not used then, e.g. an HTTPProxy or a SOCKS5 dialer of
+	// golang.org/x/net/proxy. The connections to the proxy itself are those
+	// of its own dialer. The connect timeout still applies, as well as TLS
+	// over the proxied connection.
+	Proxy ContextDialer
 	// Transmission logger
-	Logger *log.Logger
+	Logger Logger
+	// TraceFrames enables logging of the sent and received frames
+	TraceFrames bool
+	// TraceRequests enables logging of each request decoded, with its
+	// function, fields and response values, e.g. during integration
+	TraceRequests bool
+	// Metrics, if set, observes each request
+	Metrics Metrics
+	// OnRequest, if set, is called with each request frame before it is sent
+	OnRequest func(adu []byte)
+	// OnResponse, if set, is called with the response frame of each request,
+	// nil if none, and the error of the request
+	OnResponse func(adu []byte, err error)
+	// ResponseValidator, if set, is called with each request and its response
+	// frame once read, before the client verifies and decodes the frame with
+	// the Verify and Decode of the packager. It may correct the frame in
+	// place or reject it, the error is returned as a framing error.
+	ResponseValidator func(aduRequest, aduResponse []byte) error
+	// CircuitBreaker, if set, fails the requests to the slaves failing
+	// repeatedly fast, see CircuitBreaker
+	CircuitBreaker *CircuitBreaker
+	// Ping, if set, sends the request of Client.Ping
+	Ping PingFunc
+	// InterRequestDelay, if set, is the minimum time from the end of a
+	// request to the start of the next one, e.g. for slow devices. It does
+	// not apply to pipelined requests.
+	InterRequestDelay time.Duration
+	// Pipelined allows multiple requests in flight on the connection, the
+	// responses are matched to the requests by unit and transaction id.
+	Pipelined bool
+	// FlushBeforeSend discards stale data of previous requests received on
+	// the connection before sending a new request. Not used when Pipelined.
+	FlushBeforeSend bool
+	// MaxADULength is the maximum length of a response frame, 260 if not set
+	MaxADULength int
+	// Resync, if set, recovers from a desynchronized stream, e.g. after a
+	// response has been lost on an unreliable link: if the header read does
+	// not match the request, the stream is scanned byte by byte, up to
+	// MaxADULength bytes, for the header of the response. Not used when
+	// Pipelined.
+	Resync bool
+	// LengthExcludesUnitId reads the length field of the response headers as
+	// the length of the PDU, for the gateways not counting the unit id in it
+	// as specified. The field of the responses is corrected to the specified
+	// length before they are verified and decoded.
+	LengthExcludesUnitId bool
+	// TLSConfig, if set, secures the connection with TLS (Modbus/TCP Security)
+	TLSConfig *tls.Config
+	// MaxConnectRetries is the number of retries of a failed connection
+	// attempt, none if not set
+	MaxConnectRetries int
+	// ConnectBackoff is the time to wait before the first retry to connect,
+	// doubled for each further retry
+	ConnectBackoff time.Duration
 
 	// TCP connection
 	mu           sync.Mutex
 	conn         net.Conn
 	closeTimer   *time.Timer
 	lastActivity time.Time
+	pipeline     *tcpPipeline
+	// End of the previous request
+	requestEnd time.Time
+	// Timeout overrides per function code
+	timeouts map[byte]time.Duration
+	// Set by Close until Connect
+	closed bool
+	// Guards Timeout and Logger set by SetRequestTimeout and SetLogger
+	config sync.RWMutex
 }
 
 // Send sends data to server and ensures response length is greater than header length.
 func (mb *tcpTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return mb.SendContext(context.Background(), aduRequest)
+}
+
+// SendWithCancel is like Send but aborts the request once done is closed,
+// e.g. on shutdown, returning ErrCancelled. The connection is closed then and
+// established again by the next request.
+func (mb *tcpTransporter) SendWithCancel(aduRequest []byte, done <-chan struct{}) (aduResponse []byte, err error) {
+	return sendWithCancel(done, func(ctx context.Context) ([]byte, error) {
+		return mb.SendContext(ctx, aduRequest)
+	}, func() {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+		mb.close()
+	})
+}
+
+// SendContext is like Send but aborts connecting or waiting for the response
+// when ctx is done. Any partial response is flushed.
+func (mb *tcpTransporter) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
+	size, err := maxADULength(mb.MaxADULength, tcpMaxLength, tcpHeaderSize+2)
+	if err != nil {
+		return
+	}
+	if mb.Pipelined {
+		return mb.sendPipelined(ctx, aduRequest, size)
+	}
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
+	if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.requestEnd = time.Now() }()
 	// Establish a new connection if not connected
-	if err = mb.connect(); err != nil {
+	if err = mb.connect(ctx); err != nil {
 		return
 	}
 	// Set timer to close when idle
 	mb.lastActivity = time.Now()
 	mb.startCloseTimer()
-	// Set write and read timeout
-	var timeout time.Time
-	if mb.Timeout > 0 {
-		timeout = mb.lastActivity.Add(mb.Timeout)
+	if mb.FlushBeforeSend {
+		if err = mb.discardStale(); err != nil {
+			return
+		}
 	}
-	if err = mb.conn.SetDeadline(timeout); err != nil {
+	// Set write and read timeout, whichever of ctx and Timeout expires first
+	timeout := functionTimeout(mb.timeouts, aduRequest[tcpHeaderSize], mb.AdaptiveTimeout.timeout(mb.timeout()))
+	if err = mb.conn.SetDeadline(requestDeadline(ctx, mb.lastActivity, timeout)); err != nil {
 		return
 	}
+	stop := watchContext(ctx, mb.conn)
+	start := time.Now()
+	aduResponse, err = mb.send(aduRequest, size)
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		aduResponse, err = nil, contextErr(ctx)
+		mb.flush()
+	}
+	mb.AdaptiveTimeout.observe(start, err)
+	return
+}
+
+// SendNoResponse writes the request of a function without response, with the
+// write timeout of SendContext.
+func (mb *tcpTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if !mb.Pipelined {
+		if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+			return
+		}
+		defer func() { mb.requestEnd = time.Now() }()
+	}
+	if err = mb.connect(ctx); err != nil {
+		return
+	}
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	timeout := functionTimeout(mb.timeouts, aduRequest[tcpHeaderSize], mb.timeout())
+	if err = mb.conn.SetWriteDeadline(requestDeadline(ctx, mb.lastActivity, timeout)); err != nil {
+		return
+	}
+	// Interrupting the connection would fail the reads of the pipeline
+	stop := func() bool { return false }
+	if !mb.Pipelined {
+		stop = watchContext(ctx, mb.conn)
+	}
+	mb.tracef("modbus: sending % x\n", aduRequest)
+	err = writeFull(mb.conn, aduRequest)
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		err = contextErr(ctx)
+	}
+	if err != nil {
+		// A partial request corrupts the stream
+		mb.close()
+	}
+	return
+}
+
+// send writes the request and reads a response of up to size bytes. Caller
+// must hold the mutex.
+func (mb *tcpTransporter) send(aduRequest []byte, size int) (aduResponse []byte, err error) {
 	// Send data
-	mb.logf("modbus: sending % x", aduRequest)
-	if _, err = mb.conn.Write(aduRequest); err != nil {
+	mb.tracef("modbus: sending % x\n", aduRequest)
+	if err = writeFull(mb.conn, aduRequest); err != nil {
 		return
 	}
 	// Read header first
-	var data [tcpMaxLength]byte
+	data := getReadBuffer(size)
+	defer putReadBuffer(data)
 	if _, err = io.ReadFull(mb.conn, data[:tcpHeaderSize]); err != nil {
 		return
 	}
+	if mb.Resync {
+		if err = mb.resync(aduRequest, data[:tcpHeaderSize], size); err != nil {
+			return
+		}
+	}
 	// Read length, ignore transaction & protocol id (4 bytes)
-	length := int(binary.BigEndian.Uint16(data[4:]))
+	length := tcpResponseLength(data[:tcpHeaderSize], mb.LengthExcludesUnitId)
 	if length <= 0 {
-		mb.flush(data[:])
+		mb.flush()
 		err = fmt.Errorf("modbus: length in response header '%v' must not be zero", length)
 		return
 	}
-	if length > (tcpMaxLength - (tcpHeaderSize - 1)) {
-		mb.flush(data[:])
-		err = fmt.Errorf("modbus: length in response header '%v' must not greater than '%v'", length, tcpMaxLength-tcpHeaderSize+1)
+	if length > (size - (tcpHeaderSize - 1)) {
+		mb.flush()
+		err = fmt.Errorf("modbus: length in response header '%v' must not greater than '%v'", length, size-tcpHeaderSize+1)
 		return
 	}
+	binary.BigEndian.PutUint16(data[4:], uint16(length))
 	// Skip unit id
 	length += tcpHeaderSize - 1
 	if _, err = io.ReadFull(mb.conn, data[tcpHeaderSize:length]); err != nil {
 		return
 	}
-	aduResponse = data[:length]
-	mb.logf("modbus: received % x\n", aduResponse)
+	aduResponse = append([]byte(nil), data[:length]...)
+	mb.tracef("modbus: received % x\n", aduResponse)
+	return
+}
+
+// resync scans the stream byte by byte for the header of the response to
+// aduRequest, shifting it into header, until at most size bytes are read.
+// Caller must hold the mutex.
+func (mb *tcpTransporter) resync(aduRequest, header []byte, size int) (err error) {
+	skipped := 0
+	for !matchTCPHeader(aduRequest, header, size, mb.LengthExcludesUnitId) {
+		if skipped+tcpHeaderSize >= size {
+			err = fmt.Errorf("modbus: no response header found in '%v' bytes", size)
+			return
+		}
+		copy(header, header[1:])
+		if _, err = io.ReadFull(mb.conn, header[tcpHeaderSize-1:]); err != nil {
+			return
+		}
+		skipped++
+	}
+	if skipped > 0 {
+		mb.logf("modbus: skipped %v bytes to resynchronize", skipped)
+	}
 	return
 }
 
-// Connect establishes a new connection to the address in Address.
+// matchTCPHeader reports whether header is a plausible header of the
+// response to aduRequest: same transaction and protocol id, and a length
+// of a frame of up to size bytes.
+func matchTCPHeader(aduRequest, header []byte, size int, excludesUnitId bool) bool {
+	length := tcpResponseLength(header, excludesUnitId)
+	return header[0] == aduRequest[0] && header[1] == aduRequest[1] &&
+		header[2] == aduRequest[2] && header[3] == aduRequest[3] &&
+		length >= 2 && length <= size-(tcpHeaderSize-1)
+}
+
+// tcpResponseLength returns the length of the unit id and the PDU following
+// the response header, from its length field counting the unit id unless
+// excludesUnitId.
+func tcpResponseLength(header []byte, excludesUnitId bool) int {
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if excludesUnitId {
+		length++
+	}
+	return length
+}
+
+// SetRequestTimeout sets Timeout, the timeout of the requests sent from then
+// on. Unlike setting Timeout and Logger, SetRequestTimeout and SetLogger are
+// safe while requests are in flight, each request uses the values set when
+// it starts.
+func (mb *tcpTransporter) SetRequestTimeout(timeout time.Duration) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.Timeout = timeout
+}
+
+// SetLogger sets Logger, the transmission logger.
+func (mb *tcpTransporter) SetLogger(logger Logger) {
+	mb.config.Lock()
+	defer mb.config.Unlock()
+	mb.Logger = logger
+}
+
+func (mb *tcpTransporter) timeout() time.Duration {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.Timeout
+}
+
+func (mb *tcpTransporter) logger() Logger {
+	mb.config.RLock()
+	defer mb.config.RUnlock()
+	return mb.Logger
+}
+
+// SetTimeout sets the timeout of the requests of the function code, in place
+// of Timeout. A timeout of 0 removes the override.
+func (mb *tcpTransporter) SetTimeout(functionCode byte, timeout time.Duration) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.timeouts = setFunctionTimeout(mb.timeouts, functionCode, timeout)
+}
+
+// Connect establishes a new connection to the address in Address. It reopens
+// a transporter closed by Close.
 // Connect and Close are exported so that multiple requests can be done with one session
 func (mb *tcpTransporter) Connect() error {
+	return mb.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect but gives up connecting, including waiting
+// to retry, when ctx is done.
+func (mb *tcpTransporter) ConnectContext(ctx context.Context) error {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
-	return mb.connect()
+	mb.closed = false
+	return wrapTimeout(mb.connect(ctx))
 }
 
-func (mb *tcpTransporter) connect() error {
-	if mb.conn == nil {
-		dialer := net.Dialer{Timeout: mb.Timeout}
-		conn, err := dialer.Dial("tcp", mb.Address)
+// connect establishes a new connection if not connected, retrying up to
+// MaxConnectRetries times. It returns the error of the last attempt, or
+// ctx.Err() if ctx is done while waiting to retry, or ErrClosed if closed by
+// Close. Caller must hold the mutex.
+func (mb *tcpTransporter) connect(ctx context.Context) (err error) {
+	if mb.closed {
+		return ErrClosed
+	}
+	if mb.conn != nil {
+		return
+	}
+	backoff := mb.ConnectBackoff
+	for retry := 0; ; retry++ {
+		if err = mb.dial(ctx); err == nil || retry >= mb.MaxConnectRetries || ctx.Err() != nil {
+			return
+		}
+		mb.logf("modbus: retrying to connect in %v after error: %v", backoff, err)
+		if err = sleepContext(ctx, backoff); err != nil {
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// connectTimeout returns ConnectTimeout, or Timeout if not set.
+func (mb *tcpTransporter) connectTimeout() time.Duration {
+	if mb.ConnectTimeout > 0 {
+		return mb.ConnectTimeout
+	}
+	return mb.timeout()
+}
+
+// dial establishes a new connection. Its errors name Address. Caller must
+// hold the mutex.
+func (mb *tcpTransporter) dial(ctx context.Context) (err error) {
+	if _, _, err = net.SplitHostPort(mb.Address); err != nil {
+		return fmt.Errorf("modbus: invalid address '%v', expected host:port or [IPv6]:port: %w", mb.Address, err)
+	}
+	defer func() {
 		if err != nil {
+			err = fmt.Errorf("modbus: failed to connect to '%v': %w", mb.Address, err)
+		}
+	}()
+	if mb.Proxy != nil {
+		return mb.dialProxy(ctx)
+	}
+	dialer := mb.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: mb.connectTimeout()}
+	}
+	if mb.Resolver != nil {
+		withResolver := *dialer
+		withResolver.Resolver = mb.Resolver
+		dialer = &withResolver
+	}
+	var conn net.Conn
+	if mb.TLSConfig != nil {
+		// Timeout of the dialer includes the handshake
+		tlsDialer := tls.Dialer{NetDialer: dialer, Config: mb.TLSConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", mb.Address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", mb.Address)
+	}
+	if err != nil {
+		return err
+	}
+	mb.conn = conn
+	return nil
+}
+
+// dialProxy establishes a new connection through Proxy within the connect
+// timeout. Caller must hold the mutex.
+func (mb *tcpTransporter) dialProxy(parent context.Context) (err error) {
+	ctx := parent
+	if timeout := mb.connectTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, timeout)
+		defer cancel()
+	}
+	defer func() {
+		// The connect timeout expiring is a timeout as that of a net.Dialer
+		if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			err = os.ErrDeadlineExceeded
+		}
+	}()
+	conn, err := mb.Proxy.DialContext(ctx, "tcp", mb.Address)
+	if err != nil {
+		return err
+	}
+	if mb.TLSConfig != nil {
+		config := mb.TLSConfig
+		if config.ServerName == "" {
+			// As tls.Dialer, verify the host of the address
+			config = config.Clone()
+			if config.ServerName, _, err = net.SplitHostPort(mb.Address); err != nil {
+				config.ServerName = mb.Address
+			}
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
 			return err
 		}
-		mb.conn = conn
+		conn = tlsConn
 	}
+	mb.conn = conn
 	return nil
 }
 
@@ -228,33 +704,114 @@ func (mb *tcpTransporter) startCloseTimer() {
 	}
 }
 
-// Close closes current connection.
+// Close closes current connection and stops the idle timer once the request
+// in progress, if any, is done. Pipelined requests waiting for their response
+// fail with ErrClosed. Further requests fail with ErrClosed instead of
+// reconnecting, until Connect. Closing a closed transporter does nothing.
 func (mb *tcpTransporter) Close() error {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
+	mb.closed = true
+	if mb.closeTimer != nil {
+		mb.closeTimer.Stop()
+	}
+	if mb.pipeline != nil && mb.pipeline.conn == mb.conn {
+		mb.pipeline.fail(ErrClosed)
+	}
 	return mb.close()
 }
 
+// Reset discards the data received on the connection and not read yet, e.g.
+// after a framing error, without closing it. It waits for a request in
+// progress. The stream of a Pipelined connection is read by the pipeline, it
+// can not be reset.
+func (mb *tcpTransporter) Reset() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.Pipelined {
+		return fmt.Errorf("modbus: pipelined connection can not be reset")
+	}
+	if mb.conn == nil {
+		return nil
+	}
+	return mb.discardStale()
+}
+
 // flush flushes pending data in the connection,
 // returns io.EOF if connection is closed.
-func (mb *tcpTransporter) flush(b []byte) (err error) {
-	if err = mb.conn.SetReadDeadline(time.Now()); err != nil {
-		return
-	}
+func (mb *tcpTransporter) flush() (err error) {
 	// Timeout setting will be reset when reading
-	if _, err = mb.conn.Read(b); err != nil {
-		// Ignore timeout error
-		if netError, ok := err.(net.Error); ok && netError.Timeout() {
-			err = nil
-		}
-	}
+	_, err = drain(mb.conn)
 	return
 }
 
+// discardStale drains the connection before a request. Caller must hold the mutex.
+func (mb *tcpTransporter) discardStale() error {
+	n, err := drain(mb.conn)
+	if n > 0 {
+		mb.logf("modbus: discarded %v stale bytes", n)
+	}
+	return err
+}
+
+// LastActivity returns the start time of the last request, zero if there
+// has been none. It waits for a request in progress.
+func (mb *tcpTransporter) LastActivity() time.Time {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.lastActivity
+}
+
+// State returns the state of the connection. It waits for a request in
+// progress.
+func (mb *tcpTransporter) State() ConnState {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return connState(mb.conn != nil, mb.lastActivity, mb.timeout())
+}
+
 func (mb *tcpTransporter) logf(format string, v ...interface{}) {
-	if mb.Logger != nil {
-		mb.Logger.Printf(format, v...)
+	if logger := mb.logger(); logger != nil {
+		logger.Printf(format, v...)
+	}
+}
+
+func (mb *tcpTransporter) metrics() Metrics {
+	return mb.Metrics
+}
+
+func (mb *tcpTransporter) hooks() (onRequest func(adu []byte), onResponse func(adu []byte, err error)) {
+	return mb.OnRequest, mb.OnResponse
+}
+
+func (mb *tcpTransporter) responseValidator() func(aduRequest, aduResponse []byte) error {
+	return mb.ResponseValidator
+}
+
+func (mb *tcpTransporter) circuitBreaker() *CircuitBreaker {
+	return mb.CircuitBreaker
+}
+
+func (mb *tcpTransporter) requestTracer() func(format string, v ...interface{}) {
+	if !mb.TraceRequests {
+		return nil
+	}
+	return mb.logf
+}
+
+func (mb *tcpTransporter) ping() PingFunc {
+	return mb.Ping
+}
+
+// tracef logs the frame if TraceFrames is set, it is not formatted otherwise.
+func (mb *tcpTransporter) tracef(format string, frame []byte) {
+	if !mb.TraceFrames {
+		return
+	}
+	if logger := mb.logger(); logger != nil {
+		logger.Printf(format, frame)
 	}
 }
 
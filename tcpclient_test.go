@@ -6,8 +6,15 @@ package modbus
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -27,6 +34,148 @@ func TestTCPEncoding(t *testing.T) {
 	if !bytes.Equal(expected, adu) {
 		t.Fatalf("Expected %v, actual %v", expected, adu)
 	}
+
+	adu, err = packager.EncodeSlave(5, &pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{0, 2, 0, 0, 0, 6, 5, 3, 0, 4, 0, 3}
+	if !bytes.Equal(expected, adu) {
+		t.Fatalf("Expected %v, actual %v", expected, adu)
+	}
+}
+
+func TestTCPTransactionId(t *testing.T) {
+	packager := tcpPackager{}
+	pdu := ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 4, 0, 3}}
+
+	packager.SetTransactionId(1000)
+	for _, expected := range []uint16{1000, 1001} {
+		adu, err := packager.Encode(&pdu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := binary.BigEndian.Uint16(adu); id != expected {
+			t.Fatalf("transaction id: expected %v, actual %v", expected, id)
+		}
+	}
+	ids := []uint16{7, 3}
+	packager.NextTransactionId = func() uint16 {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	for _, expected := range []uint16{7, 3} {
+		adu, err := packager.Encode(&pdu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := binary.BigEndian.Uint16(adu); id != expected {
+			t.Fatalf("transaction id: expected %v, actual %v", expected, id)
+		}
+		// The response must echo the generated id
+		response := append([]byte(nil), adu...)
+		if err = packager.Verify(adu, response); err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(response, expected+1)
+		if err = packager.Verify(adu, response); err == nil {
+			t.Fatal("expected error for transaction id")
+		}
+	}
+}
+
+func TestTCPTransactionIdWrap(t *testing.T) {
+	packager := tcpPackager{}
+	packager.SetTransactionId(65534)
+	pdu := ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 4, 0, 3}}
+	for _, expected := range []uint16{65534, 65535, 0, 1} {
+		adu, err := packager.Encode(&pdu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := binary.BigEndian.Uint16(adu); id != expected {
+			t.Fatalf("transaction id: expected %v, actual %v", expected, id)
+		}
+		if err = packager.Verify(adu, adu); err != nil {
+			t.Fatal(err)
+		}
+		if packager.transactionId > 0xFFFF {
+			t.Fatalf("transaction id counter is not masked: %v", packager.transactionId)
+		}
+	}
+	// Setting id 0 wraps the last id to 65535
+	packager.SetTransactionId(0)
+	if packager.transactionId != 0xFFFF {
+		t.Fatalf("unexpected last transaction id %v", packager.transactionId)
+	}
+}
+
+func TestTCPPerUnitTransactionIds(t *testing.T) {
+	pdu := ProtocolDataUnit{FunctionCode: 3, Data: []byte{0, 4, 0, 3}}
+	for _, perUnit := range []bool{false, true} {
+		packager := tcpPackager{PerUnitTransactionIds: perUnit}
+		packager.SetTransactionId(10)
+		expected := []uint16{10, 11, 12, 13}
+		if perUnit {
+			expected = []uint16{10, 10, 11, 11}
+		}
+		for i, unitId := range []byte{1, 2, 1, 2} {
+			adu, err := packager.EncodeSlave(unitId, &pdu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := binary.BigEndian.Uint16(adu); id != expected[i] {
+				t.Fatalf("per unit %v, request %v: expected transaction id %v, actual %v", perUnit, i, expected[i], id)
+			}
+		}
+	}
+}
+
+func TestTCPTransporterPipelinedUnits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Answer the requests of both units in reverse order
+		requests := make([]byte, 16)
+		if _, err = io.ReadFull(conn, requests); err != nil {
+			return
+		}
+		conn.Write(append(requests[8:], requests[:8]...))
+	}()
+	client := &tcpTransporter{
+		Address:   ln.Addr().String(),
+		Timeout:   1 * time.Second,
+		Pipelined: true,
+	}
+	defer client.Close()
+	var wg sync.WaitGroup
+	for unitId := byte(1); unitId <= 2; unitId++ {
+		wg.Add(1)
+		go func(unitId byte) {
+			defer wg.Done()
+			// Same transaction id for both units
+			req := []byte{0, 5, 0, 0, 0, 2, unitId, 3}
+			rsp, err := client.Send(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(req, rsp) {
+				t.Errorf("unexpected response to % x: % x", req, rsp)
+			}
+		}(unitId)
+	}
+	wg.Wait()
 }
 
 func TestTCPDecoding(t *testing.T) {
@@ -49,6 +198,103 @@ func TestTCPDecoding(t *testing.T) {
 	}
 }
 
+func TestTCPVerify(t *testing.T) {
+	packager := tcpPackager{}
+	request := []byte{0, 1, 0, 0, 0, 6, 17, 3, 0, 120, 0, 3}
+	if err := packager.Verify(request, []byte{0, 1, 0, 0, 0, 5, 17, 3, 2, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := packager.Verify(request, []byte{0, 1, 0, 0, 0, 3, 17, 0x83, 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, response := range [][]byte{
+		{0, 1, 0, 0, 0, 5, 17, 4, 2, 0, 1},
+		{0, 1, 0, 0, 0, 3, 17, 0x84, 2},
+		{0, 1, 0, 0, 0, 1, 17},
+	} {
+		if err := packager.Verify(request, response); err == nil {
+			t.Errorf("% x: expected error", response)
+		}
+	}
+}
+
+func TestTCPProtocolIdentifier(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 64)
+		for _, protocolId := range []uint16{0x1234, 0} {
+			if _, err = io.ReadFull(conn, b[:12]); err != nil {
+				return
+			}
+			// Register value 42, with the given protocol id
+			rsp := []byte{b[0], b[1], 0, 0, 0, 5, b[6], 3, 2, 0, 42}
+			binary.BigEndian.PutUint16(rsp[2:], protocolId)
+			if _, err = conn.Write(rsp); err != nil {
+				return
+			}
+		}
+	}()
+	handler := NewTCPClientHandler(ln.Addr().String())
+	handler.Timeout = time.Second
+	handler.Resync = true
+	handler.ProtocolIdentifier = 0x1234
+	defer handler.Close()
+
+	adu, err := handler.Encode(&ProtocolDataUnit{FunctionCode: FuncCodeReadHoldingRegisters, Data: []byte{0, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint16(adu[2:]); id != 0x1234 {
+		t.Fatalf("protocol id: expected %#x, actual %#x", 0x1234, id)
+	}
+	client := NewClient(handler)
+	results, err := client.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []byte{0, 42}; !bytes.Equal(expected, results) {
+		t.Fatalf("results: expected % x, actual % x", expected, results)
+	}
+	// A Modbus response without the protocol id of the tunnel
+	handler.Resync = false
+	if _, err = client.ReadHoldingRegisters(0, 1); err == nil || !strings.Contains(err.Error(), "protocol id") {
+		t.Fatalf("expected protocol id mismatch, actual %v", err)
+	}
+}
+
+func TestTCPDecodingShort(t *testing.T) {
+	packager := tcpPackager{}
+	// Function code only
+	pdu, err := packager.Decode([]byte{0, 1, 0, 0, 0, 2, 17, 0x41})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pdu.FunctionCode != 0x41 || len(pdu.Data) != 0 {
+		t.Fatalf("unexpected pdu: %v % x", pdu.FunctionCode, pdu.Data)
+	}
+	for _, adu := range [][]byte{
+		nil,
+		{0, 1, 0, 0, 0},
+		{0, 1, 0, 0, 0, 1, 17},
+		{0, 1, 0, 0, 0, 0, 17, 3},
+		{0, 1, 0, 0, 0, 1, 17, 3},
+		{0, 1, 0, 0, 0, 3, 17, 3},
+	} {
+		if _, err = packager.Decode(adu); err == nil {
+			t.Errorf("% x: expected error", adu)
+		}
+	}
+}
+
 func TestTCPTransporter(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -82,10 +328,315 @@ func TestTCPTransporter(t *testing.T) {
 	if !bytes.Equal(req, rsp) {
 		t.Fatalf("unexpected response: %x", rsp)
 	}
+	if state := client.State(); state != StateConnected {
+		t.Fatalf("state: expected %v, actual %v", StateConnected, state)
+	}
 	time.Sleep(150 * time.Millisecond)
 	if client.conn != nil {
 		t.Fatalf("connection is not closed: %+v", client.conn)
 	}
+	if state := client.State(); state != StateClosed {
+		t.Fatalf("state: expected %v, actual %v", StateClosed, state)
+	}
+}
+
+func TestTCPTransporterFlushBeforeSend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Late response of an aborted request
+		if _, err = conn.Write([]byte{0, 9, 0, 0, 0, 2, 1, 2}); err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	client := &tcpTransporter{
+		Address:         ln.Addr().String(),
+		Timeout:         1 * time.Second,
+		FlushBeforeSend: true,
+	}
+	defer client.Close()
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	req := []byte{0, 1, 0, 2, 0, 2, 1, 2}
+	rsp, err := client.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: %x", rsp)
+	}
+}
+
+func TestTCPTransporterReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Late response of an aborted request
+		if _, err = conn.Write([]byte{0, 9, 0, 0, 0, 2, 1, 2}); err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	client := &tcpTransporter{
+		Address: ln.Addr().String(),
+		Timeout: 1 * time.Second,
+	}
+	defer client.Close()
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{0, 1, 0, 2, 0, 2, 1, 2}
+	rsp, err := client.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: %x", rsp)
+	}
+	client.Pipelined = true
+	if err = client.Reset(); err == nil {
+		t.Fatal("expected error for pipelined connection")
+	}
+}
+
+func TestTCPTransporterResync(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 64)
+		// Garbage and a stale response before the response
+		n, err := conn.Read(b)
+		if err != nil {
+			return
+		}
+		stale := []byte{0xFF, 0, 9, 0, 0, 0, 2, 1, 2}
+		if _, err = conn.Write(append(stale, b[:n]...)); err != nil {
+			return
+		}
+		// Garbage only
+		if _, err = conn.Read(b); err != nil {
+			return
+		}
+		conn.Write(bytes.Repeat([]byte{0xFF}, 32))
+	}()
+	client := &tcpTransporter{
+		Address:      ln.Addr().String(),
+		Timeout:      1 * time.Second,
+		Resync:       true,
+		MaxADULength: 16,
+	}
+	defer client.Close()
+	req := []byte{0, 1, 0, 0, 0, 2, 1, 2}
+	rsp, err := client.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: %x", rsp)
+	}
+	if _, err = client.Send(req); err == nil || !strings.Contains(err.Error(), "no response header") {
+		t.Fatalf("expected resync error, actual %v", err)
+	}
+}
+
+func TestTCPTransporterLengthExcludesUnitId(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req := make([]byte, 12)
+				for {
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					// Length of the PDU only
+					rsp := append(append([]byte(nil), req[:4]...), 0, 4, req[6], 3, 2, 0, 42)
+					if _, err = conn.Write(rsp); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	for _, pipelined := range []bool{false, true} {
+		handler := NewTCPClientHandler(ln.Addr().String())
+		handler.Timeout = time.Second
+		handler.Pipelined = pipelined
+		handler.LengthExcludesUnitId = true
+		results, err := NewClient(handler).ReadHoldingRegisters(0, 1)
+		handler.Close()
+		if err != nil {
+			t.Fatalf("pipelined %v: %v", pipelined, err)
+		}
+		if expected := []byte{0, 42}; !bytes.Equal(expected, results) {
+			t.Fatalf("pipelined %v: expected % x, actual % x", pipelined, expected, results)
+		}
+	}
+	// Strict by default
+	handler := NewTCPClientHandler(ln.Addr().String())
+	handler.Timeout = time.Second
+	defer handler.Close()
+	if _, err = NewClient(handler).ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected error for length")
+	}
+}
+
+func TestTCPTransporterMaxADULength(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// Aggregated frame longer than the standard 260 bytes
+	req := make([]byte, 300)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(req)-tcpHeaderSize+1))
+	client := &tcpTransporter{
+		Address: ln.Addr().String(),
+		Timeout: 1 * time.Second,
+	}
+	defer client.Close()
+	if _, err = client.Send(req); err == nil {
+		t.Fatal("expected error for response length")
+	}
+	client.Close()
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	client.MaxADULength = 400
+	rsp, err := client.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req, rsp) {
+		t.Fatalf("unexpected response: %x", rsp)
+	}
+	client.MaxADULength = tcpHeaderSize + 1
+	if _, err = client.Send(req); err == nil {
+		t.Fatal("expected error for max ADU length")
+	}
+}
+
+func TestTCPTransporterPipelined(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const requests = 5
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		var frames [][]byte
+		for i := 0; i < requests; i++ {
+			frame := make([]byte, 8)
+			if _, err = io.ReadFull(conn, frame); err != nil {
+				t.Error(err)
+				return
+			}
+			frames = append(frames, frame)
+		}
+		// Unknown transaction id, then responses in reverse order with a duplicate
+		conn.Write([]byte{0xFF, 0xFF, 0, 0, 0, 2, 1, 2})
+		for i := len(frames) - 1; i >= 0; i-- {
+			conn.Write(frames[i])
+		}
+		conn.Write(frames[0])
+		io.Copy(io.Discard, conn)
+	}()
+	client := &tcpTransporter{
+		Address:   ln.Addr().String(),
+		Timeout:   1 * time.Second,
+		Pipelined: true,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := []byte{0, byte(i), 0, 0, 0, 2, 1, byte(i)}
+			rsp, err := client.Send(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(req, rsp) {
+				t.Errorf("unexpected response to % x: % x", req, rsp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// No response matches
+	client.Timeout = 50 * time.Millisecond
+	_, err = client.Send([]byte{0, 9, 0, 0, 0, 2, 1, 9})
+	if !IsRetryable(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = client.pipeline.add(tcpTransaction{1, 8}); err != nil {
+		t.Fatalf("pipeline must still be usable: %v", err)
+	}
 }
 
 func BenchmarkTCPEncoder(b *testing.B) {
@@ -116,3 +667,271 @@ func BenchmarkTCPDecoder(b *testing.B) {
 		}
 	}
 }
+
+func TestTCPClientHandlerContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = NewTCPClientHandlerContext(ctx, ln.Addr().String(), dialer); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+	handler, err := NewTCPClientHandlerContext(context.Background(), ln.Addr().String(), dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	conn.Close()
+	// Connect uses the dialer again
+	handler.Close()
+	dialer.LocalAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	if err = handler.Connect(); err != nil {
+		t.Skip(err)
+	}
+	defer handler.Close()
+	conn = <-accepted
+	defer conn.Close()
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("remote address: expected 127.0.0.2, actual %v", ip)
+	}
+}
+
+func TestTCPTransporterConnectRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	// Device coming up at the third attempt
+	attempts := 0
+	dialer := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	client := &tcpTransporter{
+		Address:        ln.Addr().String(),
+		Dialer:         dialer,
+		ConnectBackoff: 10 * time.Millisecond,
+	}
+	defer client.Close()
+	if err = client.Connect(); err == nil {
+		t.Fatal("expected error without retries")
+	}
+	attempts = 0
+	client.MaxConnectRetries = 1
+	if err = client.Connect(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected last error, actual %v", err)
+	}
+	attempts = 0
+	client.MaxConnectRetries = 5
+	start := time.Now()
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts: expected %v, actual %v", 3, attempts)
+	}
+	// Backoff of 10 and 20ms
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("expected backoff, connected after %v", d)
+	}
+	client.Close()
+
+	attempts = 0
+	client.ConnectBackoff = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = client.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, actual %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestTCPTransporterClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never responds
+		io.Copy(io.Discard, conn)
+	}()
+	client := &tcpTransporter{
+		Address:   ln.Addr().String(),
+		Timeout:   time.Second,
+		Pipelined: true,
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Send([]byte{0, 1, 0, 0, 0, 2, 1, 3})
+		done <- err
+	}()
+	for client.State() != StateConnected {
+		time.Sleep(time.Millisecond)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Fails the pipelined request waiting for its response
+	if err = <-done; !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, actual %v", ErrClosed, err)
+	}
+	if _, err = client.Send([]byte{0, 2, 0, 0, 0, 2, 1, 3}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, actual %v", ErrClosed, err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+	// Reopened by Connect
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestTCPTransporterSendWithCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	client := &tcpTransporter{Address: ln.Addr().String(), Timeout: 10 * time.Second}
+	defer client.Close()
+	done := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+	start := time.Now()
+	// Never answered
+	if _, err = client.SendWithCancel([]byte{0, 1, 0, 0, 0, 2, 1, 2}, done); err != ErrCancelled {
+		t.Fatalf("expected %v, actual %v", ErrCancelled, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the request to be cancelled, returned after %v", d)
+	}
+	if state := client.State(); state != StateClosed {
+		t.Fatalf("state: expected %v, actual %v", StateClosed, state)
+	}
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("expected the connection to be closed, actual %v", err)
+	}
+
+	// The next request connects again
+	go func() {
+		conn := <-accepted
+		defer conn.Close()
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(conn, b); err == nil {
+			conn.Write(b)
+		}
+	}()
+	if _, err = client.SendWithCancel([]byte{0, 2, 0, 0, 0, 2, 1, 2}, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPTransporterConnectTimeout(t *testing.T) {
+	handler := NewTCPClientHandler("localhost:502")
+	if d := handler.connectTimeout(); d != tcpTimeout {
+		t.Fatalf("connect timeout: expected %v, actual %v", tcpTimeout, d)
+	}
+	handler.ConnectTimeout = time.Second
+	handler.Timeout = time.Minute
+	if d := handler.connectTimeout(); d != time.Second {
+		t.Fatalf("connect timeout: expected %v, actual %v", time.Second, d)
+	}
+}
+
+func TestTCPTransporterIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	client := &tcpTransporter{Address: "[::1]:" + port, Timeout: time.Second}
+	if err = client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// Unbracketed literal
+	client = &tcpTransporter{Address: "::1:" + port, Timeout: time.Second}
+	if err = client.Connect(); err == nil || !strings.Contains(err.Error(), "invalid address '::1:"+port+"'") {
+		t.Fatalf("expected invalid address, actual %v", err)
+	}
+}
+
+func TestTCPTransporterResolver(t *testing.T) {
+	// Queried concurrently for A and AAAA records
+	var queries int32
+	client := &tcpTransporter{
+		Address: "plc.example.test:502",
+		Timeout: time.Second,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				atomic.AddInt32(&queries, 1)
+				return nil, errors.New("split-horizon DNS unreachable")
+			},
+		},
+	}
+	err := client.Connect()
+	if err == nil || !strings.Contains(err.Error(), "failed to connect to 'plc.example.test:502'") {
+		t.Fatalf("expected error naming the address, actual %v", err)
+	}
+	if atomic.LoadInt32(&queries) == 0 {
+		t.Fatal("expected the resolver to be used")
+	}
+}
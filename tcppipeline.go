@@ -0,0 +1,223 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tcpResult is the response to a pipelined request.
+type tcpResult struct {
+	aduResponse []byte
+	err         error
+}
+
+// tcpTransaction identifies a request in flight by unit and transaction id.
+type tcpTransaction struct {
+	unitId        byte
+	transactionId uint16
+}
+
+// transactionOf returns the unit and transaction id of a frame.
+func transactionOf(adu []byte) tcpTransaction {
+	return tcpTransaction{adu[6], binary.BigEndian.Uint16(adu)}
+}
+
+// tcpPipeline reads the responses from a connection and dispatches them to
+// the pending requests by unit and transaction id.
+type tcpPipeline struct {
+	conn net.Conn
+	// Maximum length of a response frame
+	size int
+	// Length field of the responses not counting the unit id
+	excludesUnitId bool
+	logf           func(format string, v ...interface{})
+	tracef         func(format string, frame []byte)
+
+	mu      sync.Mutex
+	pending map[tcpTransaction]chan tcpResult
+	err     error
+}
+
+func newTCPPipeline(conn net.Conn, size int, excludesUnitId bool, logf func(format string, v ...interface{}), tracef func(format string, frame []byte)) *tcpPipeline {
+	return &tcpPipeline{
+		conn:           conn,
+		size:           size,
+		excludesUnitId: excludesUnitId,
+		logf:           logf,
+		tracef:         tracef,
+		pending:        make(map[tcpTransaction]chan tcpResult),
+	}
+}
+
+// add registers a pending request. Transaction ids must be unique among the
+// requests in flight to the unit.
+func (p *tcpPipeline) add(transaction tcpTransaction) (<-chan tcpResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	if _, ok := p.pending[transaction]; ok {
+		return nil, fmt.Errorf("modbus: transaction id '%v' of unit id '%v' is already in flight", transaction.transactionId, transaction.unitId)
+	}
+	// Buffered so that dispatching never blocks on an abandoned request
+	ch := make(chan tcpResult, 1)
+	p.pending[transaction] = ch
+	return ch, nil
+}
+
+// remove abandons a pending request, a late response is dropped.
+func (p *tcpPipeline) remove(transaction tcpTransaction) {
+	p.mu.Lock()
+	delete(p.pending, transaction)
+	p.mu.Unlock()
+}
+
+// dispatch delivers the response to its request.
+func (p *tcpPipeline) dispatch(aduResponse []byte) {
+	transaction := transactionOf(aduResponse)
+	p.mu.Lock()
+	ch, ok := p.pending[transaction]
+	delete(p.pending, transaction)
+	p.mu.Unlock()
+
+	if !ok {
+		p.logf("modbus: dropping response of unknown transaction id '%v' of unit id '%v': % x",
+			transaction.transactionId, transaction.unitId, aduResponse)
+		return
+	}
+	ch <- tcpResult{aduResponse: aduResponse}
+}
+
+// fail completes all pending requests with err, as well as any further one.
+func (p *tcpPipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+	for transaction, ch := range p.pending {
+		ch <- tcpResult{err: err}
+		delete(p.pending, transaction)
+	}
+}
+
+// run reads responses until the connection fails.
+func (p *tcpPipeline) run() {
+	for {
+		aduResponse, err := p.read()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.tracef("modbus: received % x\n", aduResponse)
+		p.dispatch(aduResponse)
+	}
+}
+
+// read reads the next response frame.
+func (p *tcpPipeline) read() (aduResponse []byte, err error) {
+	var header [tcpHeaderSize]byte
+	if _, err = io.ReadFull(p.conn, header[:]); err != nil {
+		return
+	}
+	length := tcpResponseLength(header[:], p.excludesUnitId)
+	// The stream can not be resynchronized after a malformed header
+	if length <= 0 || length > (p.size-(tcpHeaderSize-1)) {
+		err = fmt.Errorf("modbus: length in response header '%v' must be between '%v' and '%v'", length, 1, p.size-tcpHeaderSize+1)
+		return
+	}
+	aduResponse = make([]byte, tcpHeaderSize-1+length)
+	copy(aduResponse, header[:])
+	binary.BigEndian.PutUint16(aduResponse[4:], uint16(length))
+	_, err = io.ReadFull(p.conn, aduResponse[tcpHeaderSize:])
+	return
+}
+
+// sendPipelined writes the request and waits for the response matching its
+// unit and transaction id, while other requests may be in flight.
+func (mb *tcpTransporter) sendPipelined(ctx context.Context, aduRequest []byte, size int) (aduResponse []byte, err error) {
+	mb.mu.Lock()
+	if err = mb.connect(ctx); err != nil {
+		mb.mu.Unlock()
+		return
+	}
+	mb.lastActivity = time.Now()
+	mb.startCloseTimer()
+	if mb.pipeline == nil || mb.pipeline.conn != mb.conn {
+		mb.pipeline = newTCPPipeline(mb.conn, size, mb.LengthExcludesUnitId, mb.logf, mb.tracef)
+		go mb.runPipeline(mb.pipeline)
+	}
+	p := mb.pipeline
+	requestTimeout := functionTimeout(mb.timeouts, aduRequest[tcpHeaderSize], mb.AdaptiveTimeout.timeout(mb.timeout()))
+	deadline := requestDeadline(ctx, mb.lastActivity, requestTimeout)
+	transaction := transactionOf(aduRequest)
+	ch, err := p.add(transaction)
+	if err == nil {
+		// Writes are serialized by the mutex
+		mb.tracef("modbus: sending % x\n", aduRequest)
+		if err = mb.conn.SetWriteDeadline(deadline); err == nil {
+			err = writeFull(mb.conn, aduRequest)
+		}
+		if err != nil {
+			p.remove(transaction)
+			// A partial request corrupts the stream
+			mb.close()
+		}
+	}
+	mb.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	start := time.Now()
+	select {
+	case result := <-ch:
+		mb.AdaptiveTimeout.observe(start, result.err)
+		return result.aduResponse, result.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		if err = contextErr(ctx); err == nil {
+			err = os.ErrDeadlineExceeded
+			mb.AdaptiveTimeout.observe(start, err)
+		}
+	}
+	p.remove(transaction)
+	// The response may have been dispatched in the meantime
+	select {
+	case result := <-ch:
+		return result.aduResponse, result.err
+	default:
+	}
+	return
+}
+
+// runPipeline reads responses of the connection and drops it once it fails.
+func (mb *tcpTransporter) runPipeline(p *tcpPipeline) {
+	p.run()
+	mb.mu.Lock()
+	if mb.conn == p.conn {
+		mb.logf("modbus: closing pipelined connection: %v", p.err)
+		mb.close()
+	}
+	mb.mu.Unlock()
+}
@@ -5,8 +5,6 @@
 package test
 
 import (
-	"encoding/binary"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -17,57 +15,17 @@ import (
 )
 
 func TestMain(t *testing.M) {
-	listener, _ := net.Listen("tcp4", ":1000")
-	done := make(chan interface{})
-	go func() {
-		for {
-
-			select {
-			case <-done:
-				return
-
-			default:
-				conn, err := listener.Accept()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-
-				go func() {
-					defer conn.Close()
-					handler := modbus.NewDTUClientHandler(conn)
-
-					data := make([]byte, 1024)
-
-					for {
-						select {
-						case <-done:
-							return
-						default:
-							n, _ := io.ReadAtLeast(conn, data, 4)
-
-							handler.SlaveId = data[0]
-							pdu, _ := handler.Decode(data[:n])
-							length := int(binary.BigEndian.Uint16(pdu.Data[2:]))
-
-							resp := make([]byte, length*2+1)
-							resp[0] = byte(length * 2)
-							adu, _ := handler.Encode(&modbus.ProtocolDataUnit{
-								FunctionCode: pdu.FunctionCode,
-								Data:         resp,
-							})
-
-							n, _ = conn.Write(adu)
-						}
-					}
-
-				}()
-			}
-		}
-	}()
+	listener, err := net.Listen("tcp4", ":1000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := modbus.NewServer()
+	server.AddSlave(1)
+	server.AddSlave(2)
+	go server.Serve(listener)
 
 	r := t.Run()
-	done <- true
+	server.Close()
 
 	os.Exit(r)
 }
@@ -98,7 +56,9 @@ func TestClientTestReadHoldingRegisters(t *testing.T) {
 
 func TestDtuClient(t *testing.T) {
 	conn, _ := net.Dial("tcp4", "localhost:1000")
-	client := modbus.DTUClient(conn)
+	handler := modbus.NewDTUClientHandler(conn)
+	handler.SlaveId = 1
+	client := modbus.NewClient(handler)
 	ClientTestAll(t, client)
 }
 
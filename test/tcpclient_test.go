@@ -40,7 +40,12 @@ func TestLocal(t *testing.T) {
 		binary.BigEndian.PutUint32(bb, math.Float32bits(v))
 
 		_, err = client.WriteSingleRegister(10, v2)
-		t.Logf("Write Slave %d uint16 value: %d", handler.SlaveId, v2)
+		if err == nil {
+			t.Logf("Write Slave %d uint16 value: %d", handler.SlaveId, v2)
+		} else {
+			// Including a value not echoed by the device
+			t.Fatalf("write uint16 value error: %v", err)
+		}
 
 		_, err = client.WriteMultipleRegisters(0, 2, bb)
 		if err == nil {
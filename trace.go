@@ -0,0 +1,154 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// functionNames are the names of the functions in the traces of requests.
+var functionNames = map[byte]string{
+	FuncCodeReadCoils:                      "ReadCoils",
+	FuncCodeReadDiscreteInputs:             "ReadDiscreteInputs",
+	FuncCodeReadHoldingRegisters:           "ReadHoldingRegisters",
+	FuncCodeReadInputRegisters:             "ReadInputRegisters",
+	FuncCodeWriteSingleCoil:                "WriteSingleCoil",
+	FuncCodeWriteSingleRegister:            "WriteSingleRegister",
+	FuncCodeReadExceptionStatus:            "ReadExceptionStatus",
+	FuncCodeDiagnostics:                    "Diagnostics",
+	FuncCodeGetCommEventCounter:            "GetCommEventCounter",
+	FuncCodeGetCommEventLog:                "GetCommEventLog",
+	FuncCodeWriteMultipleCoils:             "WriteMultipleCoils",
+	FuncCodeWriteMultipleRegisters:         "WriteMultipleRegisters",
+	FuncCodeReportServerID:                 "ReportServerID",
+	FuncCodeReadFileRecord:                 "ReadFileRecord",
+	FuncCodeWriteFileRecord:                "WriteFileRecord",
+	FuncCodeMaskWriteRegister:              "MaskWriteRegister",
+	FuncCodeReadWriteMultipleRegisters:     "ReadWriteMultipleRegisters",
+	FuncCodeReadFIFOQueue:                  "ReadFIFOQueue",
+	FuncCodeEncapsulatedInterfaceTransport: "EncapsulatedInterfaceTransport",
+}
+
+// tracerTransporter is implemented by the transporters having a
+// TraceRequests field.
+type tracerTransporter interface {
+	// requestTracer returns the function logging the requests, nil if they
+	// are not traced
+	requestTracer() func(format string, v ...interface{})
+}
+
+// transactionPackager is implemented by the packagers of frames with a
+// transaction id.
+type transactionPackager interface {
+	frameTransactionId(adu []byte) uint16
+}
+
+// traceRequest logs the decoded request and its response or error, e.g.
+//  modbus: unit 1 transaction 7: ReadHoldingRegisters address=0 quantity=2 -> [3 4] in 1.2ms
+func (mb *client) traceRequest(tracef func(format string, v ...interface{}), slaveId byte, aduRequest []byte,
+	request, response *ProtocolDataUnit, err error, duration time.Duration) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "modbus: unit %v", slaveId)
+	if packager, ok := mb.packager.(transactionPackager); ok {
+		fmt.Fprintf(&b, " transaction %v", packager.frameTransactionId(aduRequest))
+	}
+	fmt.Fprintf(&b, ": %v -> ", describeRequest(request))
+	if err != nil {
+		fmt.Fprintf(&b, "error: %v", err)
+	} else {
+		b.WriteString(describeResponse(request, response))
+	}
+	tracef("%v in %v", b.String(), duration)
+}
+
+// describeRequest returns the function name and the fields of the request.
+func describeRequest(request *ProtocolDataUnit) string {
+	name, ok := functionNames[request.FunctionCode]
+	if !ok {
+		name = fmt.Sprintf("Function%v", request.FunctionCode)
+	}
+	data := request.Data
+	field := func(i int) uint16 { return binary.BigEndian.Uint16(data[2*i:]) }
+	switch request.FunctionCode {
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs, FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters:
+		if len(data) == 4 {
+			return fmt.Sprintf("%v address=%v quantity=%v", name, field(0), field(1))
+		}
+	case FuncCodeWriteSingleCoil:
+		if len(data) == 4 {
+			return fmt.Sprintf("%v address=%v value=%v", name, field(0), field(1) == CoilOn)
+		}
+	case FuncCodeWriteSingleRegister:
+		if len(data) == 4 {
+			return fmt.Sprintf("%v address=%v value=%v", name, field(0), field(1))
+		}
+	case FuncCodeWriteMultipleCoils:
+		if len(data) >= 5 {
+			return fmt.Sprintf("%v address=%v quantity=%v values=%v", name, field(0), field(1),
+				describeBits(data[5:], int(field(1))))
+		}
+	case FuncCodeWriteMultipleRegisters:
+		if len(data) >= 5 {
+			return fmt.Sprintf("%v address=%v quantity=%v values=%v", name, field(0), field(1), describeRegisters(data[5:]))
+		}
+	case FuncCodeMaskWriteRegister:
+		if len(data) == 6 {
+			return fmt.Sprintf("%v address=%v and=%#04x or=%#04x", name, field(0), field(1), field(2))
+		}
+	case FuncCodeReadWriteMultipleRegisters:
+		if len(data) >= 9 {
+			return fmt.Sprintf("%v read address=%v quantity=%v write address=%v quantity=%v values=%v",
+				name, field(0), field(1), field(2), field(3), describeRegisters(data[9:]))
+		}
+	case FuncCodeReadFIFOQueue:
+		if len(data) == 2 {
+			return fmt.Sprintf("%v address=%v", name, field(0))
+		}
+	}
+	if len(data) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%v data=[% x]", name, data)
+}
+
+// describeResponse returns the values of the response to the request.
+func describeResponse(request, response *ProtocolDataUnit) string {
+	data := response.Data
+	switch request.FunctionCode {
+	case FuncCodeReadCoils, FuncCodeReadDiscreteInputs:
+		if len(data) >= 1 && len(request.Data) == 4 {
+			return describeBits(data[1:], int(binary.BigEndian.Uint16(request.Data[2:])))
+		}
+	case FuncCodeReadHoldingRegisters, FuncCodeReadInputRegisters, FuncCodeReadWriteMultipleRegisters:
+		if len(data) >= 1 {
+			return describeRegisters(data[1:])
+		}
+	case FuncCodeReadFIFOQueue:
+		if len(data) >= 4 {
+			return describeRegisters(data[4:])
+		}
+	case FuncCodeWriteSingleCoil, FuncCodeWriteSingleRegister, FuncCodeWriteMultipleCoils,
+		FuncCodeWriteMultipleRegisters, FuncCodeMaskWriteRegister:
+		return "ok"
+	}
+	return fmt.Sprintf("[% x]", data)
+}
+
+// describeRegisters returns the values of the registers in data.
+func describeRegisters(data []byte) string {
+	values := make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return fmt.Sprint(values)
+}
+
+// describeBits returns the states of the first quantity coils in data.
+func describeBits(data []byte, quantity int) string {
+	return fmt.Sprint(UnpackCoils(data, quantity))
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceRequests(t *testing.T) {
+	server := NewServer()
+	server.AddSlave(1).SetHoldingRegister(0, 42)
+	handler := newServerClient(t, server)
+	var mu sync.Mutex
+	var lines []string
+	handler.Logger = LoggerFunc(func(format string, v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	client := NewClient(handler)
+	ctx := WithSlaveId(context.Background(), 1)
+	if _, err := client.ReadHoldingRegistersContext(ctx, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(lines) != 0 {
+		t.Fatalf("requests must not be logged: %q", lines)
+	}
+	mu.Unlock()
+
+	handler.TraceRequests = true
+	if _, err := client.ReadHoldingRegistersContext(ctx, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadHoldingRegistersContext(ctx, 0xFFFF, 2); err == nil {
+		t.Fatal("expected exception")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 2 {
+		t.Fatalf("log: expected 2 lines, actual %q", lines)
+	}
+	if expected := "modbus: unit 1: ReadHoldingRegisters address=0 quantity=1 -> [42] in "; !strings.HasPrefix(lines[0], expected) {
+		t.Fatalf("log: expected %q, actual %q", expected, lines[0])
+	}
+	if expected := "modbus: unit 1: ReadHoldingRegisters address=65535 quantity=2 -> error: "; !strings.HasPrefix(lines[1], expected) {
+		t.Fatalf("log: expected %q, actual %q", expected, lines[1])
+	}
+}
+
+func TestTraceRequestTransaction(t *testing.T) {
+	mb := &client{packager: &tcpPackager{}}
+	var line string
+	tracef := func(format string, v ...interface{}) { line = fmt.Sprintf(format, v...) }
+	request := &ProtocolDataUnit{FunctionCode: FuncCodeWriteMultipleCoils, Data: []byte{0, 1, 0, 3, 1, 5}}
+	response := &ProtocolDataUnit{FunctionCode: FuncCodeWriteMultipleCoils, Data: []byte{0, 1, 0, 3}}
+	aduRequest := []byte{0, 7, 0, 0, 0, 8, 2, 15, 0, 1, 0, 3, 1, 5}
+	mb.traceRequest(tracef, 2, aduRequest, request, response, nil, time.Millisecond)
+	if expected := "modbus: unit 2 transaction 7: WriteMultipleCoils address=1 quantity=3 values=[true false true] -> ok in 1ms"; line != expected {
+		t.Fatalf("log: expected %q, actual %q", expected, line)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	// Maximum number of 32-bit values in one read (125 registers).
+	maxReadValues32 = 125 / 2
+)
+
+// WordOrder specifies how the bytes of a multi-register value are laid out.
+// For a 32-bit value 0xAABBCCDD the registers hold:
+//  BigEndian        : AA BB, CC DD (ABCD)
+//  LittleEndian     : DD CC, BB AA (DCBA)
+//  BigEndianSwap    : BB AA, DD CC (BADC)
+//  LittleEndianSwap : CC DD, AA BB (CDAB)
+// 64-bit values are laid out likewise in 4 registers, e.g. 0x1122334455667788
+// is held as 77 88, 55 66, 33 44, 11 22 in LittleEndianSwap order.
+type WordOrder int
+
+const (
+	BigEndian WordOrder = iota
+	LittleEndian
+	BigEndianSwap
+	LittleEndianSwap
+)
+
+// String returns the byte layout of a 32-bit value, e.g. "CDAB".
+func (o WordOrder) String() string {
+	switch o {
+	case BigEndian:
+		return "ABCD"
+	case LittleEndian:
+		return "DCBA"
+	case BigEndianSwap:
+		return "BADC"
+	case LittleEndianSwap:
+		return "CDAB"
+	}
+	return fmt.Sprintf("WordOrder(%d)", int(o))
+}
+
+// Uint32 decodes a 32-bit value from 2 registers.
+func (o WordOrder) Uint32(b []byte) uint32 {
+	var v [4]byte
+	copy(v[:], b[:4])
+	o.reorder(v[:])
+	return binary.BigEndian.Uint32(v[:])
+}
+
+// PutUint32 encodes a 32-bit value into 2 registers.
+func (o WordOrder) PutUint32(b []byte, value uint32) {
+	binary.BigEndian.PutUint32(b, value)
+	o.reorder(b[:4])
+}
+
+// Uint64 decodes a 64-bit value from 4 registers.
+func (o WordOrder) Uint64(b []byte) uint64 {
+	var v [8]byte
+	copy(v[:], b[:8])
+	o.reorder(v[:])
+	return binary.BigEndian.Uint64(v[:])
+}
+
+// PutUint64 encodes a 64-bit value into 4 registers.
+func (o WordOrder) PutUint64(b []byte, value uint64) {
+	binary.BigEndian.PutUint64(b, value)
+	o.reorder(b[:8])
+}
+
+// reorder converts b between big-endian and the word order. It is its own
+// inverse so it is used for both encoding and decoding.
+func (o WordOrder) reorder(b []byte) {
+	if o == LittleEndian || o == BigEndianSwap {
+		// Swap bytes in each register
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+	}
+	if o == LittleEndian || o == LittleEndianSwap {
+		// Reverse order of registers
+		for i, j := 0, len(b)-2; i < j; i, j = i+2, j-2 {
+			b[i], b[i+1], b[j], b[j+1] = b[j], b[j+1], b[i], b[i+1]
+		}
+	}
+}
+
+// TypedClient wraps a Client with helpers reading and writing multi-register
+// values held in holding registers, and coil states as bool. A 32-bit value
+// spans 2 registers, a 64-bit value 4 registers.
+type TypedClient struct {
+	Client
+	// Layout of multi-register values, BigEndian by default
+	Order WordOrder
+}
+
+// NewTypedClient creates a TypedClient using the given client.
+func NewTypedClient(client Client) *TypedClient {
+	return &TypedClient{Client: client}
+}
+
+// WithOrder returns a copy of the client using the given word order, so it can
+// be overridden for a single call:
+//  client.WithOrder(modbus.LittleEndianSwap).ReadFloat32(100)
+func (mb *TypedClient) WithOrder(order WordOrder) *TypedClient {
+	c := *mb
+	c.Order = order
+	return &c
+}
+
+// ReadUint32 reads an unsigned 32-bit integer from 2 registers at address.
+func (mb *TypedClient) ReadUint32(address uint16) (value uint32, err error) {
+	data, err := mb.readValues32(address, 1)
+	if err != nil {
+		return
+	}
+	value = mb.Order.Uint32(data)
+	return
+}
+
+// ReadInt32 reads a signed 32-bit integer from 2 registers at address.
+func (mb *TypedClient) ReadInt32(address uint16) (value int32, err error) {
+	v, err := mb.ReadUint32(address)
+	value = int32(v)
+	return
+}
+
+// ReadFloat32 reads an IEEE 754 single precision float from 2 registers at address.
+func (mb *TypedClient) ReadFloat32(address uint16) (value float32, err error) {
+	v, err := mb.ReadUint32(address)
+	value = math.Float32frombits(v)
+	return
+}
+
+// ReadFloat32s reads count consecutive floats (2*count registers) starting at address.
+func (mb *TypedClient) ReadFloat32s(address uint16, count int) (values []float32, err error) {
+	data, err := mb.readValues32(address, count)
+	if err != nil {
+		return
+	}
+	values = make([]float32, count)
+	for i := range values {
+		values[i] = math.Float32frombits(mb.Order.Uint32(data[i*4:]))
+	}
+	return
+}
+
+// WriteUint32 writes an unsigned 32-bit integer to 2 registers at address.
+func (mb *TypedClient) WriteUint32(address uint16, value uint32) (err error) {
+	var data [4]byte
+	mb.Order.PutUint32(data[:], value)
+	_, err = mb.WriteMultipleRegisters(address, 2, data[:])
+	return
+}
+
+// WriteInt32 writes a signed 32-bit integer to 2 registers at address.
+func (mb *TypedClient) WriteInt32(address uint16, value int32) error {
+	return mb.WriteUint32(address, uint32(value))
+}
+
+// WriteFloat32 writes an IEEE 754 single precision float to 2 registers at address.
+func (mb *TypedClient) WriteFloat32(address uint16, value float32) error {
+	return mb.WriteUint32(address, math.Float32bits(value))
+}
+
+// ReadUint64 reads an unsigned 64-bit integer from 4 registers at address.
+func (mb *TypedClient) ReadUint64(address uint16) (value uint64, err error) {
+	data, err := mb.ReadHoldingRegisters(address, 4)
+	if err != nil {
+		return
+	}
+	if len(data) != 8 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), 8)
+		return
+	}
+	value = mb.Order.Uint64(data)
+	return
+}
+
+// ReadInt64 reads a signed 64-bit integer from 4 registers at address.
+func (mb *TypedClient) ReadInt64(address uint16) (value int64, err error) {
+	v, err := mb.ReadUint64(address)
+	value = int64(v)
+	return
+}
+
+// ReadFloat64 reads an IEEE 754 double precision float from 4 registers at address.
+func (mb *TypedClient) ReadFloat64(address uint16) (value float64, err error) {
+	v, err := mb.ReadUint64(address)
+	value = math.Float64frombits(v)
+	return
+}
+
+// WriteUint64 writes an unsigned 64-bit integer to 4 registers at address.
+func (mb *TypedClient) WriteUint64(address uint16, value uint64) (err error) {
+	var data [8]byte
+	mb.Order.PutUint64(data[:], value)
+	_, err = mb.WriteMultipleRegisters(address, 4, data[:])
+	return
+}
+
+// WriteInt64 writes a signed 64-bit integer to 4 registers at address.
+func (mb *TypedClient) WriteInt64(address uint16, value int64) error {
+	return mb.WriteUint64(address, uint64(value))
+}
+
+// WriteFloat64 writes an IEEE 754 double precision float to 4 registers at address.
+func (mb *TypedClient) WriteFloat64(address uint16, value float64) error {
+	return mb.WriteUint64(address, math.Float64bits(value))
+}
+
+// ReadHoldingRegistersAsUint16 reads quantity holding registers starting at
+// address.
+func (mb *TypedClient) ReadHoldingRegistersAsUint16(address, quantity uint16) (values []uint16, err error) {
+	data, err := mb.ReadHoldingRegisters(address, quantity)
+	if err != nil {
+		return
+	}
+	if len(data) != int(quantity)*2 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), int(quantity)*2)
+		return
+	}
+	values = make([]uint16, quantity)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return
+}
+
+// ReadHoldingRegistersAsInt16 reads quantity holding registers starting at
+// address as signed 16-bit integers.
+func (mb *TypedClient) ReadHoldingRegistersAsInt16(address, quantity uint16) (values []int16, err error) {
+	registers, err := mb.ReadHoldingRegistersAsUint16(address, quantity)
+	if err != nil {
+		return
+	}
+	values = make([]int16, len(registers))
+	for i, register := range registers {
+		values[i] = int16(register)
+	}
+	return
+}
+
+// WriteSingleRegisterInt16 writes a signed 16-bit integer to the holding
+// register at address.
+func (mb *TypedClient) WriteSingleRegisterInt16(address uint16, value int16) (err error) {
+	_, err = mb.WriteSingleRegister(address, uint16(value))
+	return
+}
+
+// WriteMultipleRegistersFromUint16 writes values to consecutive holding
+// registers starting at address, up to 123 registers.
+func (mb *TypedClient) WriteMultipleRegistersFromUint16(address uint16, values []uint16) (err error) {
+	if len(values) < 1 || len(values) > maxWriteRegisters {
+		err = &QuantityError{FunctionCode: FuncCodeWriteMultipleRegisters, Field: "quantity", Quantity: len(values), Min: 1, Max: maxWriteRegisters}
+		return
+	}
+	data := make([]byte, len(values)*2)
+	for i, value := range values {
+		binary.BigEndian.PutUint16(data[i*2:], value)
+	}
+	_, err = mb.WriteMultipleRegisters(address, uint16(len(values)), data)
+	return
+}
+
+// ReadFIFOQueueUint16 reads the registers of the FIFO queue at address.
+func (mb *TypedClient) ReadFIFOQueueUint16(address uint16) (values []uint16, err error) {
+	data, err := mb.ReadFIFOQueue(address)
+	if err != nil {
+		return
+	}
+	values = make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return
+}
+
+// IsRunning reads the run indicator status of ReportServerID, true if on
+// (0xFF), false if off (0x00). The error of a device not implementing the
+// function matches ErrNotSupported.
+func (mb *TypedClient) IsRunning() (running bool, err error) {
+	_, status, err := mb.ReportServerID()
+	if err != nil {
+		return
+	}
+	switch status {
+	case 0xFF:
+		running = true
+	case 0x00:
+	default:
+		err = fmt.Errorf("modbus: run indicator status '%v' is neither on '%v' nor off '%v'", status, 0xFF, 0x00)
+	}
+	return
+}
+
+// readValues32 reads count 32-bit values and ensures all bytes are returned.
+func (mb *TypedClient) readValues32(address uint16, count int) (data []byte, err error) {
+	if count < 1 || count > maxReadValues32 {
+		err = &QuantityError{FunctionCode: FuncCodeReadHoldingRegisters, Field: "count", Quantity: count, Min: 1, Max: maxReadValues32}
+		return
+	}
+	data, err = mb.ReadHoldingRegisters(address, uint16(count*2))
+	if err != nil {
+		return
+	}
+	if len(data) != count*4 {
+		err = fmt.Errorf("modbus: response data size '%v' does not match expected '%v'", len(data), count*4)
+		return
+	}
+	return
+}
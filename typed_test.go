@@ -0,0 +1,300 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// registerClient serves holding registers from memory.
+type registerClient struct {
+	Client
+
+	registers []byte
+	short     bool
+}
+
+func (c *registerClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	data := c.registers[address*2 : (address+quantity)*2]
+	if c.short {
+		data = data[:len(data)-1]
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (c *registerClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	copy(c.registers[address*2:(address+quantity)*2], value)
+	return dataBlock(address, quantity), nil
+}
+
+func (c *registerClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	c.registers[address*2], c.registers[address*2+1] = byte(value>>8), byte(value)
+	return dataBlock(value), nil
+}
+
+func TestTypedClientRead(t *testing.T) {
+	c := &registerClient{registers: []byte{
+		0x42, 0x28, 0x00, 0x00, // 42.0
+		0xFF, 0xFF, 0xFF, 0xFE, // -2
+		0xC1, 0x20, 0x00, 0x00, // -10.0
+	}}
+	client := NewTypedClient(c)
+
+	f, err := client.ReadFloat32(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 42 {
+		t.Fatalf("float32: expected %v, actual %v", 42, f)
+	}
+	i, err := client.ReadInt32(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != -2 {
+		t.Fatalf("int32: expected %v, actual %v", -2, i)
+	}
+	u, err := client.ReadUint32(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != 0xFFFFFFFE {
+		t.Fatalf("uint32: expected %v, actual %v", uint32(0xFFFFFFFE), u)
+	}
+	values, err := client.ReadFloat32s(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[1] != -10 {
+		t.Fatalf("float32s: unexpected %v", values)
+	}
+}
+
+func TestTypedClientReadShort(t *testing.T) {
+	c := &registerClient{registers: make([]byte, 8), short: true}
+	if _, err := NewTypedClient(c).ReadFloat32(0); err == nil {
+		t.Fatal("expected error for short response")
+	}
+	if _, err := NewTypedClient(c).ReadFloat32s(0, 0); err == nil {
+		t.Fatal("expected error for zero count")
+	}
+}
+
+func TestTypedClientWrite(t *testing.T) {
+	c := &registerClient{registers: make([]byte, 8)}
+	client := NewTypedClient(c)
+	if err := client.WriteFloat32(1, 42); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0x42, 0x28, 0, 0, 0, 0}
+	if !bytes.Equal(expected, c.registers) {
+		t.Fatalf("registers: expected % x, actual % x", expected, c.registers)
+	}
+}
+
+func TestTypedClientUint16(t *testing.T) {
+	c := &registerClient{registers: make([]byte, 8)}
+	client := NewTypedClient(c)
+	if err := client.WriteMultipleRegistersFromUint16(1, []uint16{3, 0xABCD}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 3, 0xAB, 0xCD, 0, 0}
+	if !bytes.Equal(expected, c.registers) {
+		t.Fatalf("registers: expected % x, actual % x", expected, c.registers)
+	}
+	values, err := client.ReadHoldingRegistersAsUint16(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != 0 || values[1] != 3 || values[2] != 0xABCD {
+		t.Fatalf("uint16s: unexpected %v", values)
+	}
+	if err = client.WriteMultipleRegistersFromUint16(0, make([]uint16, 124)); err == nil {
+		t.Fatal("expected error for quantity")
+	}
+	if err = client.WriteMultipleRegistersFromUint16(0, nil); err == nil {
+		t.Fatal("expected error for zero quantity")
+	}
+	c.short = true
+	if _, err = client.ReadHoldingRegistersAsUint16(0, 2); err == nil {
+		t.Fatal("expected error for short response")
+	}
+}
+
+func TestTypedClientInt16(t *testing.T) {
+	c := &registerClient{registers: []byte{0x80, 0x00, 0x7F, 0xFF, 0, 0, 0, 0}}
+	client := NewTypedClient(c)
+	if err := client.WriteSingleRegisterInt16(2, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteSingleRegisterInt16(3, -32767); err != nil {
+		t.Fatal(err)
+	}
+	values, err := client.ReadHoldingRegistersAsInt16(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int16{-32768, 32767, -1, -32767}
+	if len(values) != len(expected) {
+		t.Fatalf("int16s: expected %v, actual %v", expected, values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Fatalf("int16s: expected %v, actual %v", expected, values)
+		}
+	}
+}
+
+var wordOrderTests = []struct {
+	order WordOrder
+	data  []byte
+}{
+	{BigEndian, []byte{0xAA, 0xBB, 0xCC, 0xDD}},
+	{LittleEndian, []byte{0xDD, 0xCC, 0xBB, 0xAA}},
+	{BigEndianSwap, []byte{0xBB, 0xAA, 0xDD, 0xCC}},
+	{LittleEndianSwap, []byte{0xCC, 0xDD, 0xAA, 0xBB}},
+}
+
+func TestWordOrder(t *testing.T) {
+	for _, input := range wordOrderTests {
+		if v := input.order.Uint32(input.data); v != 0xAABBCCDD {
+			t.Errorf("%v: expected %x, actual %x", input.order, 0xAABBCCDD, v)
+		}
+		data := make([]byte, 4)
+		input.order.PutUint32(data, 0xAABBCCDD)
+		if !bytes.Equal(input.data, data) {
+			t.Errorf("%v: expected % x, actual % x", input.order, input.data, data)
+		}
+	}
+}
+
+var wordOrder64Tests = []struct {
+	order WordOrder
+	data  []byte
+}{
+	{BigEndian, []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}},
+	{LittleEndian, []byte{0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}},
+	{BigEndianSwap, []byte{0x22, 0x11, 0x44, 0x33, 0x66, 0x55, 0x88, 0x77}},
+	{LittleEndianSwap, []byte{0x77, 0x88, 0x55, 0x66, 0x33, 0x44, 0x11, 0x22}},
+}
+
+func TestWordOrder64(t *testing.T) {
+	for _, input := range wordOrder64Tests {
+		if v := input.order.Uint64(input.data); v != 0x1122334455667788 {
+			t.Errorf("%v: expected %x, actual %x", input.order, uint64(0x1122334455667788), v)
+		}
+		data := make([]byte, 8)
+		input.order.PutUint64(data, 0x1122334455667788)
+		if !bytes.Equal(input.data, data) {
+			t.Errorf("%v: expected % x, actual % x", input.order, input.data, data)
+		}
+	}
+}
+
+func TestTypedClient64(t *testing.T) {
+	c := &registerClient{registers: make([]byte, 16)}
+	client := NewTypedClient(c)
+	client.Order = LittleEndianSwap
+	if err := client.WriteFloat64(0, -1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteInt64(4, -2); err != nil {
+		t.Fatal(err)
+	}
+	// -1.5 is 0xBFF8000000000000
+	expected := []byte{0, 0, 0, 0, 0, 0, 0xBF, 0xF8, 0xFF, 0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	if !bytes.Equal(expected, c.registers) {
+		t.Fatalf("registers: expected % x, actual % x", expected, c.registers)
+	}
+	f, err := client.ReadFloat64(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != -1.5 {
+		t.Fatalf("float64: expected %v, actual %v", -1.5, f)
+	}
+	i, err := client.ReadInt64(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != -2 {
+		t.Fatalf("int64: expected %v, actual %v", -2, i)
+	}
+	if err = client.WriteUint64(0, 0x1122334455667788); err != nil {
+		t.Fatal(err)
+	}
+	u, err := client.WithOrder(BigEndian).ReadUint64(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != 0x7788556633441122 {
+		t.Fatalf("uint64: expected %x, actual %x", uint64(0x7788556633441122), u)
+	}
+	c.short = true
+	if _, err = client.ReadUint64(0); err == nil {
+		t.Fatal("expected error for short response")
+	}
+}
+
+func TestTypedClientWordOrder(t *testing.T) {
+	c := &registerClient{registers: []byte{0x00, 0x00, 0x42, 0x28}}
+	client := NewTypedClient(c)
+	client.Order = LittleEndianSwap
+
+	f, err := client.ReadFloat32(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 42 {
+		t.Fatalf("float32: expected %v, actual %v", 42, f)
+	}
+	if f, _ = client.WithOrder(BigEndian).ReadFloat32(0); f == 42 {
+		t.Fatalf("float32: order override ignored")
+	}
+	if err = client.WriteUint32(0, 0xAABBCCDD); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xCC, 0xDD, 0xAA, 0xBB}
+	if !bytes.Equal(expected, c.registers) {
+		t.Fatalf("registers: expected % x, actual % x", expected, c.registers)
+	}
+}
+
+func TestTypedClientIsRunning(t *testing.T) {
+	var status byte
+	client := NewTypedClient(newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode, Data: []byte{2, 'A', status}}
+	}))
+	for _, input := range []struct {
+		status  byte
+		running bool
+	}{{0xFF, true}, {0x00, false}} {
+		status = input.status
+		running, err := client.IsRunning()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running != input.running {
+			t.Fatalf("status %v: expected %v, actual %v", input.status, input.running, running)
+		}
+	}
+	status = 0x01
+	if _, err := client.IsRunning(); err == nil {
+		t.Fatal("expected error for run indicator status")
+	}
+
+	// Device not implementing the function
+	client = NewTypedClient(newPDUClient(func(request *ProtocolDataUnit) *ProtocolDataUnit {
+		return &ProtocolDataUnit{FunctionCode: request.FunctionCode | 0x80, Data: []byte{ExceptionCodeIllegalFunction}}
+	}))
+	if _, err := client.IsRunning(); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, actual %v", err)
+	}
+	if errors.Is(&ModbusError{ExceptionCode: ExceptionCodeIllegalDataAddress}, ErrNotSupported) {
+		t.Fatal("illegal data address must not match ErrNotSupported")
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDPClientHandler implements Packager and Transporter interface.
+type UDPClientHandler struct {
+	tcpPackager
+	udpTransporter
+}
+
+// NewUDPClientHandler allocates a new UDPClientHandler.
+func NewUDPClientHandler(address string) *UDPClientHandler {
+	h := &UDPClientHandler{}
+	h.Address = address
+	h.Timeout = tcpTimeout
+	return h
+}
+
+// UDPClient creates UDP client with default handler and given connect string.
+func UDPClient(address string) Client {
+	handler := NewUDPClientHandler(address)
+	return NewClient(handler)
+}
+
+// udpTransporter implements Transporter interface. Each request and response
+// is a single datagram with the modbus application protocol header.
+type udpTransporter struct {
+	// Connect string
+	Address string
+	// Read timeout
+	Timeout time.Duration
+	// Transmission logger
+	Logger Logger
+	// TraceFrames enables logging of the sent and received frames
+	TraceFrames bool
+	// TraceRequests enables logging of each request decoded, with its
+	// function, fields and response values, e.g. during integration
+	TraceRequests bool
+	// Metrics, if set, observes each request
+	Metrics Metrics
+	// OnRequest, if set, is called with each request frame before it is sent
+	OnRequest func(adu []byte)
+	// OnResponse, if set, is called with the response frame of each request,
+	// nil if none, and the error of the request
+	OnResponse func(adu []byte, err error)
+	// ResponseValidator, if set, is called with each request and its response
+	// frame once read, before the client verifies and decodes the frame with
+	// the Verify and Decode of the packager. It may correct the frame in
+	// place or reject it, the error is returned as a framing error.
+	ResponseValidator func(aduRequest, aduResponse []byte) error
+	// CircuitBreaker, if set, fails the requests to the slaves failing
+	// repeatedly fast, see CircuitBreaker
+	CircuitBreaker *CircuitBreaker
+	// Ping, if set, sends the request of Client.Ping
+	Ping PingFunc
+	// InterRequestDelay, if set, is the minimum time from the end of a
+	// request to the start of the next one, e.g. for slow devices
+	InterRequestDelay time.Duration
+	// MaxADULength is the maximum length of a response datagram, 260 if not set
+	MaxADULength int
+
+	// UDP connection
+	mu   sync.Mutex
+	conn net.Conn
+	// Timeout overrides per function code
+	timeouts map[byte]time.Duration
+	// End of the previous request
+	requestEnd time.Time
+}
+
+// SetTimeout sets the timeout of the requests of the function code, in place
+// of Timeout. A timeout of 0 removes the override.
+func (mb *udpTransporter) SetTimeout(functionCode byte, timeout time.Duration) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.timeouts = setFunctionTimeout(mb.timeouts, functionCode, timeout)
+}
+
+// Send sends data to server and waits for the response datagram.
+func (mb *udpTransporter) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	return mb.SendContext(context.Background(), aduRequest)
+}
+
+// SendWithCancel is like Send but aborts the request once done is closed,
+// e.g. on shutdown, returning ErrCancelled. The socket is closed then and
+// opened again by the next request.
+func (mb *udpTransporter) SendWithCancel(aduRequest []byte, done <-chan struct{}) (aduResponse []byte, err error) {
+	return sendWithCancel(done, func(ctx context.Context) ([]byte, error) {
+		return mb.SendContext(ctx, aduRequest)
+	}, func() {
+		mb.Close()
+	})
+}
+
+// SendContext is like Send but aborts waiting for the response when ctx is done.
+func (mb *udpTransporter) SendContext(ctx context.Context, aduRequest []byte) (aduResponse []byte, err error) {
+	defer func() { err = wrapTimeout(err) }()
+	size, err := maxADULength(mb.MaxADULength, tcpMaxLength, tcpHeaderSize+2)
+	if err != nil {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.requestEnd = time.Now() }()
+	if err = mb.connect(ctx); err != nil {
+		return
+	}
+	timeout := functionTimeout(mb.timeouts, aduRequest[tcpHeaderSize], mb.Timeout)
+	if err = mb.conn.SetDeadline(requestDeadline(ctx, time.Now(), timeout)); err != nil {
+		return
+	}
+	stop := watchContext(ctx, mb.conn)
+	aduResponse, err = mb.send(aduRequest, size)
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		aduResponse, err = nil, contextErr(ctx)
+	}
+	return
+}
+
+// SendNoResponse writes the request datagram of a function without response,
+// with the write timeout of SendContext.
+func (mb *udpTransporter) SendNoResponse(ctx context.Context, aduRequest []byte) (err error) {
+	defer func() { err = wrapTimeout(err) }()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err = waitInterRequestDelay(ctx, mb.requestEnd, mb.InterRequestDelay); err != nil {
+		return
+	}
+	defer func() { mb.requestEnd = time.Now() }()
+	if err = mb.connect(ctx); err != nil {
+		return
+	}
+	timeout := functionTimeout(mb.timeouts, aduRequest[tcpHeaderSize], mb.Timeout)
+	if err = mb.conn.SetWriteDeadline(requestDeadline(ctx, time.Now(), timeout)); err != nil {
+		return
+	}
+	stop := watchContext(ctx, mb.conn)
+	mb.tracef("modbus: sending % x\n", aduRequest)
+	n, err := mb.conn.Write(aduRequest)
+	if err == nil && n != len(aduRequest) {
+		err = io.ErrShortWrite
+	}
+	if stop() || (err != nil && contextErr(ctx) != nil) {
+		err = contextErr(ctx)
+	}
+	return
+}
+
+// send writes the request datagram and reads datagrams of up to size bytes
+// until the response to the request. Caller must hold the mutex.
+func (mb *udpTransporter) send(aduRequest []byte, size int) (aduResponse []byte, err error) {
+	mb.tracef("modbus: sending % x\n", aduRequest)
+	// A datagram can not be continued by another write
+	n, err := mb.conn.Write(aduRequest)
+	if err != nil {
+		return
+	}
+	if n != len(aduRequest) {
+		err = io.ErrShortWrite
+		return
+	}
+	transactionId := binary.BigEndian.Uint16(aduRequest)
+	data := getReadBuffer(size)
+	defer putReadBuffer(data)
+	for {
+		var n int
+		if n, err = mb.conn.Read(data[:]); err != nil {
+			return
+		}
+		// Datagrams can be duplicated or reordered, drop those of other requests
+		if n < tcpHeaderSize {
+			mb.logf("modbus: dropping short datagram: % x", data[:n])
+			continue
+		}
+		if responseId := binary.BigEndian.Uint16(data[:]); responseId != transactionId {
+			mb.logf("modbus: dropping response of unexpected transaction id '%v': % x", responseId, data[:n])
+			continue
+		}
+		aduResponse = make([]byte, n)
+		copy(aduResponse, data[:n])
+		mb.tracef("modbus: received % x\n", aduResponse)
+		return
+	}
+}
+
+// Connect sets the remote address of the UDP socket.
+func (mb *udpTransporter) Connect() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	return mb.connect(context.Background())
+}
+
+func (mb *udpTransporter) connect(ctx context.Context) error {
+	if mb.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", mb.Address)
+		if err != nil {
+			return err
+		}
+		mb.conn = conn
+	}
+	return nil
+}
+
+// Close closes the UDP socket.
+func (mb *udpTransporter) Close() (err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.conn != nil {
+		err = mb.conn.Close()
+		mb.conn = nil
+	}
+	return
+}
+
+func (mb *udpTransporter) logf(format string, v ...interface{}) {
+	if mb.Logger != nil {
+		mb.Logger.Printf(format, v...)
+	}
+}
+
+func (mb *udpTransporter) metrics() Metrics {
+	return mb.Metrics
+}
+
+func (mb *udpTransporter) hooks() (onRequest func(adu []byte), onResponse func(adu []byte, err error)) {
+	return mb.OnRequest, mb.OnResponse
+}
+
+func (mb *udpTransporter) responseValidator() func(aduRequest, aduResponse []byte) error {
+	return mb.ResponseValidator
+}
+
+func (mb *udpTransporter) circuitBreaker() *CircuitBreaker {
+	return mb.CircuitBreaker
+}
+
+func (mb *udpTransporter) requestTracer() func(format string, v ...interface{}) {
+	if !mb.TraceRequests {
+		return nil
+	}
+	return mb.logf
+}
+
+func (mb *udpTransporter) ping() PingFunc {
+	return mb.Ping
+}
+
+// tracef logs the frame if TraceFrames is set, it is not formatted otherwise.
+func (mb *udpTransporter) tracef(format string, frame []byte) {
+	if mb.TraceFrames && mb.Logger != nil {
+		mb.Logger.Printf(format, frame)
+	}
+}
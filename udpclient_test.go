@@ -0,0 +1,60 @@
+// Copyright 2014 Quoc-Viet Nguyen. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the BSD license. See the LICENSE file for details.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTransporter(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var b [tcpMaxLength]byte
+		for {
+			n, addr, err := ln.ReadFrom(b[:])
+			if err != nil {
+				return
+			}
+			request := b[:n]
+			if len(request) < tcpHeaderSize+1 || request[tcpHeaderSize] != FuncCodeReadHoldingRegisters {
+				// Stall
+				continue
+			}
+			stale := []byte{request[0], request[1] + 1, 0, 0, 0, 5, request[6], 3, 2, 0, 1}
+			response := []byte{request[0], request[1], 0, 0, 0, 5, request[6], 3, 2, 0, 42}
+			ln.WriteTo(stale, addr)
+			ln.WriteTo([]byte{0}, addr)
+			ln.WriteTo(response, addr)
+		}
+	}()
+
+	handler := NewUDPClientHandler(ln.LocalAddr().String())
+	handler.SlaveId = 1
+	defer handler.Close()
+	client := NewClient(handler)
+	for i := 0; i < 2; i++ {
+		results, err := client.ReadHoldingRegisters(0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(results, []byte{0, 42}) {
+			t.Fatalf("unexpected results % x", results)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = client.ReadInputRegistersContext(ctx, 0, 1); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}